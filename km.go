@@ -1,6 +1,7 @@
 package main
 
 import (
+	"bufio"
 	"flag"
 	"fmt"
 	"io/ioutil"
@@ -8,9 +9,12 @@ import (
 	"net"
 	"net/http"
 	"os"
+	"strings"
 	"syscall"
+	"time"
 
 	"github.com/FreekKalter/km/lib"
+	"golang.org/x/crypto/ssh/terminal"
 	"launchpad.net/goyaml"
 )
 
@@ -41,17 +45,28 @@ func main() {
 	if config.Log != "" {
 		logFile, err = os.OpenFile(config.Log, syscall.O_WRONLY|syscall.O_APPEND|syscall.O_CREAT, 0666)
 		if err != nil {
-			log.Fatal("could not open logfile: %s", err.Error())
+			log.Fatalf("could not open logfile: %s", err.Error())
 		}
 		log.SetOutput(logFile)
 		log.SetPrefix("km-app:\t")
 	}
 
+	if flag.NArg() > 0 {
+		if err = runCommand(config, flag.Args()); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+
 	s, err := km.NewServer("km", config)
 	if err != nil {
 		log.Fatal(err)
 	}
-	defer s.Dbmap.Db.Close()
+	defer s.Store.Close()
+	go s.PurgeEvery(time.Hour)
+	if config.BackupDir != "" {
+		go s.BackupEvery(config.BackupInterval())
+	}
 
 	http.Handle("/", s)
 	listener, err := net.Listen("tcp", fmt.Sprintf(":%d", config.Port))
@@ -62,6 +77,517 @@ func main() {
 	http.Serve(listener, nil)
 }
 
+// runCommand runs a command given on the commandline instead of starting the server
+func runCommand(config km.Config, args []string) error {
+	switch args[0] {
+	case "migrate":
+		return migrate(config, args[1:])
+	case "repair":
+		return repair(config)
+	case "purge":
+		return purge(config)
+	case "audit":
+		return audit(config, args[1:])
+	case "verify":
+		return verify(config)
+	case "seal":
+		return seal(config)
+	case "export":
+		return export(config, args[1:])
+	case "import":
+		return importDays(config, args[1:])
+	case "backup":
+		return backup(config, args[1:])
+	case "restore":
+		return restore(config, args[1:])
+	case "users":
+		return users(config, args[1:])
+	}
+	return fmt.Errorf("unknown command: %s", args[0])
+}
+
+// migrate runs "km migrate up|down|status"
+func migrate(config km.Config, args []string) error {
+	if len(args) != 1 {
+		return fmt.Errorf("usage: km migrate up|down|status")
+	}
+	store, err := km.OpenStore("km", config)
+	if err != nil {
+		return err
+	}
+	defer store.Close()
+	migrator, ok := store.(km.Migrator)
+	if !ok {
+		return fmt.Errorf("store %q has no migrations", config.Store)
+	}
+
+	switch args[0] {
+	case "up":
+		err = migrator.MigrateUp()
+	case "down":
+		err = migrator.MigrateDown()
+	case "status":
+	default:
+		return fmt.Errorf("usage: km migrate up|down|status")
+	}
+	if err != nil {
+		return err
+	}
+	version, migrations, err := migrator.MigrationStatus()
+	if err != nil {
+		return err
+	}
+	fmt.Printf("schema version: %d\n", version)
+	for _, m := range migrations {
+		state := "pending"
+		if m.Version <= version {
+			state = "applied"
+		}
+		fmt.Printf("%4d  %-8s %s\n", m.Version, state, m.Name)
+	}
+	return nil
+}
+
+// repair runs "km repair", merging days saved more than once
+func repair(config km.Config) error {
+	store, err := km.OpenStore("km", config)
+	if err != nil {
+		return err
+	}
+	defer store.Close()
+	repairer, ok := store.(km.Repairer)
+	if !ok {
+		return fmt.Errorf("store %q can not contain duplicate days", config.Store)
+	}
+	dates, err := repairer.Repair()
+	if err != nil {
+		return err
+	}
+	for _, date := range dates {
+		fmt.Printf("merged %s\n", date.Format("2006-01-02"))
+	}
+	fmt.Printf("%d days repaired\n", len(dates))
+	return nil
+}
+
+// purge runs "km purge", deleting the days that are in the trash for longer than the retention
+func purge(config km.Config) error {
+	store, err := openMigratedStore(config)
+	if err != nil {
+		return err
+	}
+	defer store.Close()
+	purged, err := km.PurgeTrash(store, config.Retention())
+	if err != nil {
+		return err
+	}
+	fmt.Printf("%d rows purged\n", purged)
+	return nil
+}
+
+// openMigratedStore opens the store from the config file with all migrations applied, like the
+// server does, so commands never work on an older schema
+func openMigratedStore(config km.Config) (km.Store, error) {
+	store, err := km.OpenStore("km", config)
+	if err != nil {
+		return nil, err
+	}
+	if migrator, ok := store.(km.Migrator); ok {
+		if err = migrator.MigrateUp(); err != nil {
+			store.Close()
+			return nil, fmt.Errorf("migrating database: %s (days saved more than once can be merged with: km repair)", err)
+		}
+	}
+	return store, nil
+}
+
+// userFlag adds the -user flag to flags, selecting the user a command works on
+func userFlag(flags *flag.FlagSet) *string {
+	return flags.String("user", "", "the user to work on, the days saved before there were users when left out")
+}
+
+// openUserStore opens the store from the config file scoped to the user with name, or to the
+// days saved before there were users when name is empty
+func openUserStore(config km.Config, name string) (km.Store, error) {
+	store, err := openMigratedStore(config)
+	if err != nil || name == "" {
+		return store, err
+	}
+	user, err := km.GetUserByName(store, name)
+	if err != nil {
+		store.Close()
+		return nil, err
+	}
+	return store.ForUser(user.ID), nil
+}
+
+// audit runs "km audit [-user name]", printing the whole audit log of a user, oldest change first
+func audit(config km.Config, args []string) error {
+	flags := flag.NewFlagSet("audit", flag.ContinueOnError)
+	user := userFlag(flags)
+	if err := flags.Parse(args); err != nil || flags.NArg() != 0 {
+		return fmt.Errorf("usage: km audit [-user name]")
+	}
+	store, err := openUserStore(config, *user)
+	if err != nil {
+		return err
+	}
+	defer store.Close()
+	entries, err := store.AuditLog()
+	if err != nil {
+		return err
+	}
+	for _, e := range entries {
+		before, _ := e.Before.MarshalJSON()
+		after, _ := e.After.MarshalJSON()
+		fmt.Printf("%s %s %-7s %-10s user=%q addr=%s request=%s\n\tbefore: %s\n\tafter:  %s\n",
+			e.At.Format(time.RFC3339), e.Date.Format("2006-01-02"), e.Action, e.Kind, e.User, e.RemoteAddr, e.RequestID, before, after)
+	}
+	return nil
+}
+
+// verify runs "km verify", reporting every row that does not match the hash chain of its user
+func verify(config km.Config) error {
+	store, err := openMigratedStore(config)
+	if err != nil {
+		return err
+	}
+	defer store.Close()
+	found := 0
+	err = km.ForEachOwner(store, func(owner km.User, store km.Store) error {
+		problems, err := km.Verify(store)
+		for _, problem := range problems {
+			if owner.ID != 0 {
+				fmt.Printf("%s: ", owner.Name)
+			}
+			fmt.Println(problem)
+		}
+		found += len(problems)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	if found > 0 {
+		return fmt.Errorf("%d problems found", found)
+	}
+	fmt.Println("ok, everything matches the chain")
+	return nil
+}
+
+// seal runs "km seal", adding the rows saved before the hash chain existed to the chain of their user
+func seal(config km.Config) error {
+	store, err := openMigratedStore(config)
+	if err != nil {
+		return err
+	}
+	defer store.Close()
+	sealed := 0
+	err = km.ForEachOwner(store, func(owner km.User, store km.Store) error {
+		n, err := km.Seal(store, km.Origin{User: "km seal"})
+		sealed += n
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	fmt.Printf("%d rows sealed\n", sealed)
+	return nil
+}
+
+// export runs "km export [-user name] 2014|2014-01 [file]", writing the days of a year or month
+// to an xlsx workbook
+func export(config km.Config, args []string) error {
+	flags := flag.NewFlagSet("export", flag.ContinueOnError)
+	user := userFlag(flags)
+	if err := flags.Parse(args); err != nil || flags.NArg() < 1 || flags.NArg() > 2 {
+		return fmt.Errorf("usage: km export [-user name] 2014|2014-01 [file]")
+	}
+	err, from, to, name := km.ParsePeriod(flags.Arg(0))
+	if err != nil {
+		return fmt.Errorf("usage: km export [-user name] 2014|2014-01 [file]")
+	}
+	filename := name + ".xlsx"
+	if flags.NArg() == 2 {
+		filename = flags.Arg(1)
+	}
+	loc, err := config.Location()
+	if err != nil {
+		return err
+	}
+	store, err := openUserStore(config, *user)
+	if err != nil {
+		return err
+	}
+	defer store.Close()
+	days, err := km.GetExportDays(store, from, to, loc)
+	if err != nil {
+		return err
+	}
+	f, err := os.Create(filename)
+	if err != nil {
+		return err
+	}
+	if err = km.WriteXLSX(f, from, to, days); err != nil {
+		f.Close()
+		return err
+	}
+	if err = f.Close(); err != nil {
+		return err
+	}
+	fmt.Printf("%d days exported to %s\n", len(days), filename)
+	return nil
+}
+
+// importDays runs "km import [-user name] [-dry-run] [-merge] [-override] file.csv|file.json",
+// importing the days in file in one go
+func importDays(config km.Config, args []string) error {
+	flags := flag.NewFlagSet("import", flag.ContinueOnError)
+	dryRun := flags.Bool("dry-run", false, "only validate the days and report conflicts, save nothing")
+	merge := flags.Bool("merge", false, "save days that are saved already, over what is saved")
+	override := flags.Bool("override", false, "save readings without validating them")
+	user := userFlag(flags)
+	if err := flags.Parse(args); err != nil || flags.NArg() != 1 {
+		return fmt.Errorf("usage: km import [-user name] [-dry-run] [-merge] [-override] file.csv|file.json")
+	}
+	filename := flags.Arg(0)
+	f, err := os.Open(filename)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	var rows []km.ImportRow
+	if strings.HasSuffix(strings.ToLower(filename), ".csv") {
+		err, rows = km.ParseImportCSV(f)
+	} else {
+		err, rows = km.ParseImportJSON(f)
+	}
+	if err != nil {
+		return err
+	}
+
+	loc, err := config.Location()
+	if err != nil {
+		return err
+	}
+	store, err := openUserStore(config, *user)
+	if err != nil {
+		return err
+	}
+	defer store.Close()
+	opts := km.ImportOptions{DryRun: *dryRun, Merge: *merge, Override: *override, MaxDistance: config.MaxDistance}
+	result, err := km.Import(km.Audited(store, km.Origin{User: "km import"}), rows, loc, opts)
+	if err != nil {
+		return err
+	}
+	for _, date := range result.Conflicts {
+		fmt.Printf("%s is saved already\n", date)
+	}
+	for _, e := range result.Errors {
+		fmt.Printf("row %d (%s): %s\n", e.Row, e.Date, e.Reason)
+		for _, field := range e.Fields {
+			fmt.Printf("\t%s: %s\n", field.Field, field.Reason)
+		}
+	}
+	switch {
+	case result.DryRun:
+		fmt.Printf("dry run, %d of %d days can be imported\n", result.Imported, len(rows))
+	case !result.Saved:
+		return fmt.Errorf("nothing imported, %d rows rejected and %d days saved already (use -merge to save over them)", len(result.Errors), len(result.Conflicts))
+	default:
+		fmt.Printf("%d days imported\n", result.Imported)
+	}
+	return nil
+}
+
+// backup runs "km backup [file]", writing everything saved to file, or to a new archive in the
+// configured backup directory
+func backup(config km.Config, args []string) error {
+	if len(args) > 1 || (len(args) == 0 && config.BackupDir == "") {
+		return fmt.Errorf("usage: km backup file, or km backup with backupdir in the config file")
+	}
+	store, err := openMigratedStore(config)
+	if err != nil {
+		return err
+	}
+	defer store.Close()
+	if len(args) == 0 {
+		path, err := km.BackupTo(store, config.BackupDir, config.BackupsKept())
+		if err != nil {
+			return err
+		}
+		fmt.Printf("backed up to %s\n", path)
+		return nil
+	}
+	// the backup holds the password hashes, only the owner can read it
+	f, err := os.OpenFile(args[0], os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+	manifest, err := km.Backup(store, f)
+	if err != nil {
+		f.Close()
+		return err
+	}
+	if err = f.Close(); err != nil {
+		return err
+	}
+	for _, file := range manifest.Files {
+		fmt.Printf("%-16s %6d rows\n", file.Name, file.Rows)
+	}
+	fmt.Printf("backed up to %s\n", args[0])
+	return nil
+}
+
+// restore runs "km restore file", loading a backup into the store from the config file, which
+// has to be empty
+func restore(config km.Config, args []string) error {
+	if len(args) != 1 {
+		return fmt.Errorf("usage: km restore file")
+	}
+	f, err := os.Open(args[0])
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	store, err := openMigratedStore(config)
+	if err != nil {
+		return err
+	}
+	defer store.Close()
+	manifest, err := km.Restore(store, f, info.Size())
+	if err != nil {
+		return err
+	}
+	for _, file := range manifest.Files {
+		fmt.Printf("%-16s %6d rows\n", file.Name, file.Rows)
+	}
+	fmt.Printf("restored the backup of %s\n", manifest.Created.Format(time.RFC3339))
+	return nil
+}
+
+// users runs "km users list|add [-claim] name|passwd name|revoke name|disable name|enable name",
+// managing the accounts
+func users(config km.Config, args []string) error {
+	usage := fmt.Errorf("usage: km users list|add [-claim] name|passwd name|revoke name|disable name|enable name")
+	if len(args) == 0 {
+		return usage
+	}
+	store, err := openMigratedStore(config)
+	if err != nil {
+		return err
+	}
+	defer store.Close()
+
+	switch args[0] {
+	case "list":
+		if len(args) != 1 {
+			return usage
+		}
+		all, err := store.Users()
+		if err != nil {
+			return err
+		}
+		for _, u := range all {
+			state := "active"
+			if u.Disabled {
+				state = "disabled"
+			}
+			fmt.Printf("%4d  %-20s %-8s created %s\n", u.ID, u.Name, state, u.Created.Format("2006-01-02"))
+		}
+		fmt.Printf("%d users\n", len(all))
+	case "add":
+		flags := flag.NewFlagSet("add", flag.ContinueOnError)
+		claim := flags.Bool("claim", false, "give the days saved before there were users to the new user")
+		if err = flags.Parse(args[1:]); err != nil || flags.NArg() != 1 {
+			return usage
+		}
+		password, err := readPassword(flags.Arg(0))
+		if err != nil {
+			return err
+		}
+		// a user without a password can not log in, so do not add one for a password that is refused
+		if err = km.ValidatePassword(password); err != nil {
+			return err
+		}
+		user, err := km.CreateUser(store, flags.Arg(0))
+		if err != nil {
+			return err
+		}
+		if _, err = km.SetPassword(store, user.Name, password); err != nil {
+			return err
+		}
+		fmt.Printf("added user %s (%d)\n", user.Name, user.ID)
+		if *claim {
+			claimed, err := store.ClaimRows(user.ID)
+			if err != nil {
+				return err
+			}
+			fmt.Printf("%d rows saved before there were users now belong to %s\n", claimed, user.Name)
+		}
+	case "passwd":
+		if len(args) != 2 {
+			return usage
+		}
+		password, err := readPassword(args[1])
+		if err != nil {
+			return err
+		}
+		if _, err = km.SetPassword(store, args[1], password); err != nil {
+			return err
+		}
+		fmt.Printf("changed the password of %s, they are logged out everywhere\n", args[1])
+	case "revoke":
+		if len(args) != 2 {
+			return usage
+		}
+		user, err := km.GetUserByName(store, args[1])
+		if err != nil {
+			return err
+		}
+		revoked, err := store.DeleteSessions(user.ID)
+		if err != nil {
+			return err
+		}
+		fmt.Printf("ended %d sessions of %s\n", revoked, user.Name)
+	case "disable", "enable":
+		if len(args) != 2 {
+			return usage
+		}
+		user, err := km.DisableUser(store, args[1], args[0] == "disable")
+		if err != nil {
+			return err
+		}
+		fmt.Printf("%sd user %s\n", args[0], user.Name)
+	default:
+		return usage
+	}
+	return nil
+}
+
+// readPassword asks for the password of name and reads it from stdin, without echoing it when
+// stdin is a terminal
+func readPassword(name string) (string, error) {
+	fmt.Printf("password for %s: ", name)
+	if fd := int(os.Stdin.Fd()); terminal.IsTerminal(fd) {
+		password, err := terminal.ReadPassword(fd)
+		fmt.Println()
+		if err != nil {
+			return "", fmt.Errorf("reading the password: %s", err)
+		}
+		return string(password), nil
+	}
+	line, err := bufio.NewReader(os.Stdin).ReadString('\n')
+	if err != nil && line == "" {
+		return "", fmt.Errorf("reading the password: %s", err)
+	}
+	return strings.TrimRight(line, "\r\n"), nil
+}
+
 //TODO:test this function
 func parseConfig(filename string) (config km.Config, err error) {
 	configFile, err := ioutil.ReadFile(filename)
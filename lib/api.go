@@ -0,0 +1,527 @@
+package km
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// dayPart selects the part of a Day a route of the api works on
+type dayPart func(day *Day) interface{}
+
+func wholeDay(day *Day) interface{}    { return day }
+func dayReadings(day *Day) interface{} { return &day.Readings }
+func dayTimes(day *Day) interface{}    { return &day.Times }
+
+// apiPrefix is the path all routes of the versioned api start with
+const apiPrefix = "/api/v1"
+
+// apiRoutes sets up the routes of the versioned api
+// (no subrouter, a method mismatch on one of its routes would be reported as not found)
+func (s *Server) apiRoutes() {
+	s.public(s.HandleFunc(apiPrefix+"/login", s.loginHandler).Methods("POST"))
+	s.public(s.HandleFunc(apiPrefix+"/logout", s.logoutHandler).Methods("POST"))
+	s.HandleFunc(apiPrefix+"/sessions", s.revokeSessionsHandler).Methods("DELETE")
+	s.HandleFunc(apiPrefix+"/days", s.listDaysHandler).Methods("GET")
+	for _, route := range []struct {
+		path string
+		part dayPart
+	}{
+		{"/days/{date}", wholeDay},
+		{"/days/{date}/readings", dayReadings},
+		{"/days/{date}/times", dayTimes},
+	} {
+		s.HandleFunc(apiPrefix+route.path, s.getDayHandler(route.part)).Methods("GET")
+		s.HandleFunc(apiPrefix+route.path, s.putDayHandler(route.part, true)).Methods("PUT")
+		s.HandleFunc(apiPrefix+route.path, s.putDayHandler(route.part, false)).Methods("PATCH")
+	}
+	s.HandleFunc(apiPrefix+"/days/{date}", s.deleteDayHandler).Methods("DELETE")
+	s.HandleFunc(apiPrefix+"/days/{date}/history", s.historyHandler).Methods("GET")
+	s.HandleFunc(apiPrefix+"/days/{date}/trips", s.listTripsHandler).Methods("GET")
+	s.HandleFunc(apiPrefix+"/days/{date}/trips", s.postTripHandler).Methods("POST")
+	s.HandleFunc(apiPrefix+"/days/{date}/classify", s.classifyDayHandler).Methods("POST")
+	s.HandleFunc(apiPrefix+"/trips/{id}", s.getTripHandler).Methods("GET")
+	s.HandleFunc(apiPrefix+"/trips/{id}", s.putTripHandler(true)).Methods("PUT")
+	s.HandleFunc(apiPrefix+"/trips/{id}", s.putTripHandler(false)).Methods("PATCH")
+	s.HandleFunc(apiPrefix+"/trips/{id}", s.deleteTripHandler).Methods("DELETE")
+	s.HandleFunc(apiPrefix+"/reports/{year:[0-9]+}.pdf", s.reportPDFHandler).Methods("GET")
+	s.HandleFunc(apiPrefix+"/reports/{year:[0-9]+}/{month:[0-9]+}.pdf", s.reportPDFHandler).Methods("GET")
+	s.HandleFunc(apiPrefix+"/reports/{year}", s.yearReportHandler).Methods("GET")
+	s.HandleFunc(apiPrefix+"/export.csv", s.exportCSVHandler).Methods("GET")
+	s.HandleFunc(apiPrefix+"/export.xlsx", s.exportXLSXHandler).Methods("GET")
+	s.HandleFunc(apiPrefix+"/import", s.importHandler).Methods("POST")
+	s.HandleFunc(apiPrefix+"/vehicles", s.listVehiclesHandler).Methods("GET")
+	s.HandleFunc(apiPrefix+"/vehicles", s.postVehicleHandler).Methods("POST")
+	s.HandleFunc(apiPrefix+"/vehicles/{id}", s.getVehicleHandler).Methods("GET")
+	s.HandleFunc(apiPrefix+"/vehicles/{id}", s.putVehicleHandler(true)).Methods("PUT")
+	s.HandleFunc(apiPrefix+"/vehicles/{id}", s.putVehicleHandler(false)).Methods("PATCH")
+	s.HandleFunc(apiPrefix+"/vehicles/{id}/activate", s.activateVehicleHandler).Methods("POST")
+	s.HandleFunc(apiPrefix+"/trash", s.trashHandler).Methods("GET")
+	s.HandleFunc(apiPrefix+"/trash/{date}/restore", s.restoreHandler).Methods("POST")
+}
+
+// writeJSON writes v as the JSON response
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	json.NewEncoder(w).Encode(v)
+}
+
+// decodeJSON decodes the JSON in body into v, fields v does not have are rejected
+func decodeJSON(body io.Reader, v interface{}) error {
+	decoder := json.NewDecoder(body)
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(v); err != nil {
+		if strings.HasPrefix(err.Error(), "json: unknown field") {
+			return CustomResponse(UnknownField, err)
+		}
+		return CustomResponse(NotParsable, err)
+	}
+	return nil
+}
+
+// queryDates sets from and to to the dates in the from and to query parameters of r, when given
+func queryDates(r *http.Request, from, to *time.Time) error {
+	for param, date := range map[string]*time.Time{"from": from, "to": to} {
+		if value := r.URL.Query().Get(param); value != "" {
+			var err error
+			if err, *date = ParseURLDate(value); err != nil {
+				return err
+			}
+		}
+	}
+	if from.After(*to) {
+		response := InvalidURL
+		response.Extra = "from is after to"
+		return response
+	}
+	return nil
+}
+
+// listDaysHandler lists the days saved, optionally only the ones from and/or to a date
+func (s *Server) listDaysHandler(w http.ResponseWriter, r *http.Request) {
+	from, to := allDates[0], allDates[1]
+	if err := queryDates(r, &from, &to); err != nil {
+		WriteError(w, r, err)
+		return
+	}
+	err, loc := s.requestLocation(r)
+	if err != nil {
+		WriteError(w, r, err)
+		return
+	}
+	days, err := GetDays(s.store(r), from, to, loc)
+	if err != nil {
+		WriteError(w, r, err)
+		return
+	}
+	writeJSON(w, days)
+}
+
+// getDayHandler returns a handler writing part of the day saved for a date
+func (s *Server) getDayHandler(part dayPart) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		err, date := ParseURLDate(mux.Vars(r)["date"])
+		if err != nil {
+			WriteError(w, r, err)
+			return
+		}
+		err, loc := s.requestLocation(r)
+		if err != nil {
+			WriteError(w, r, err)
+			return
+		}
+		day, saved, err := GetDay(s.store(r), date, loc)
+		if err != nil {
+			WriteError(w, r, err)
+			return
+		}
+		if !saved {
+			WriteError(w, r, NoDay)
+			return
+		}
+		writeJSON(w, part(&day))
+	}
+}
+
+// putDayHandler returns a handler saving part of the day for a date, it replaces that part
+// when replace is set (PUT), otherwise only what is in the body is changed (PATCH)
+func (s *Server) putDayHandler(part dayPart, replace bool) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		err, date := ParseURLDate(mux.Vars(r)["date"])
+		if err != nil {
+			WriteError(w, r, err)
+			return
+		}
+		err, loc := s.requestLocation(r)
+		if err != nil {
+			WriteError(w, r, err)
+			return
+		}
+		body, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			WriteError(w, r, CustomResponse(NotParsable, err))
+			return
+		}
+		override, _ := strconv.ParseBool(r.URL.Query().Get("override"))
+
+		var day Day
+		err = inTx(s.auditedStore(w, r), func(tx Tx) error {
+			saved, _, err := GetDay(tx, date, loc)
+			if err != nil {
+				return err
+			}
+			changed := saved
+			if replace {
+				p := reflect.ValueOf(part(&changed)).Elem()
+				p.Set(reflect.Zero(p.Type()))
+			}
+			if err := decodeJSON(bytes.NewReader(body), part(&changed)); err != nil {
+				return err
+			}
+			if err := s.saveFields(tx, date, changedFields(saved, changed), loc, override); err != nil {
+				return err
+			}
+			day, _, err = GetDay(tx, date, loc)
+			return err
+		})
+		if err != nil {
+			WriteError(w, r, err)
+			return
+		}
+		writeJSON(w, part(&day))
+	}
+}
+
+// deleteDayHandler deletes everything saved for a date
+func (s *Server) deleteDayHandler(w http.ResponseWriter, r *http.Request) {
+	err, date := ParseURLDate(mux.Vars(r)["date"])
+	if err != nil {
+		WriteError(w, r, err)
+		return
+	}
+	if err = deleteAllForDate(s.auditedStore(w, r), date); err != nil {
+		WriteError(w, r, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// trashHandler lists the days in the trash
+func (s *Server) trashHandler(w http.ResponseWriter, r *http.Request) {
+	err, loc := s.requestLocation(r)
+	if err != nil {
+		WriteError(w, r, err)
+		return
+	}
+	days, err := GetTrash(s.store(r), loc)
+	if err != nil {
+		WriteError(w, r, err)
+		return
+	}
+	writeJSON(w, days)
+}
+
+// restoreHandler takes a day out of the trash
+func (s *Server) restoreHandler(w http.ResponseWriter, r *http.Request) {
+	err, date := ParseURLDate(mux.Vars(r)["date"])
+	if err != nil {
+		WriteError(w, r, err)
+		return
+	}
+	err, loc := s.requestLocation(r)
+	if err != nil {
+		WriteError(w, r, err)
+		return
+	}
+	var day Day
+	err = inTx(s.auditedStore(w, r), func(tx Tx) error {
+		if err := RestoreDay(tx, date); err != nil {
+			return err
+		}
+		day, _, err = GetDay(tx, date, loc)
+		return err
+	})
+	if err != nil {
+		WriteError(w, r, err)
+		return
+	}
+	writeJSON(w, day)
+}
+
+// historyHandler lists the changes made to a date, oldest first
+func (s *Server) historyHandler(w http.ResponseWriter, r *http.Request) {
+	err, date := ParseURLDate(mux.Vars(r)["date"])
+	if err != nil {
+		WriteError(w, r, err)
+		return
+	}
+	entries, err := GetHistory(s.store(r), date)
+	if err != nil {
+		WriteError(w, r, err)
+		return
+	}
+	writeJSON(w, entries)
+}
+
+// urlID parses the id of the trip or vehicle in the url of r
+func urlID(r *http.Request) (err error, id int64) {
+	id, err = strconv.ParseInt(mux.Vars(r)["id"], 10, 64)
+	if err != nil {
+		return CustomResponse(InvalidURL, err), 0
+	}
+	return nil, id
+}
+
+// listTripsHandler lists the trips of a date
+func (s *Server) listTripsHandler(w http.ResponseWriter, r *http.Request) {
+	err, date := ParseURLDate(mux.Vars(r)["date"])
+	if err != nil {
+		WriteError(w, r, err)
+		return
+	}
+	trips, err := GetTrips(s.store(r), date)
+	if err != nil {
+		WriteError(w, r, err)
+		return
+	}
+	writeJSON(w, trips)
+}
+
+// postTripHandler adds a trip to a date
+func (s *Server) postTripHandler(w http.ResponseWriter, r *http.Request) {
+	err, date := ParseURLDate(mux.Vars(r)["date"])
+	if err != nil {
+		WriteError(w, r, err)
+		return
+	}
+	var trip Trip
+	if err = decodeJSON(r.Body, &trip); err != nil {
+		WriteError(w, r, err)
+		return
+	}
+	trip.ID, trip.Date = 0, date
+	override, _ := strconv.ParseBool(r.URL.Query().Get("override"))
+	err = inTx(s.auditedStore(w, r), func(tx Tx) error {
+		return SaveTrip(tx, &trip, s.config.MaxDistance, override)
+	})
+	if err != nil {
+		WriteError(w, r, err)
+		return
+	}
+	w.Header().Set("Location", fmt.Sprintf("%s/trips/%d", apiPrefix, trip.ID))
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(trip)
+}
+
+// classifyDayHandler splits a day without trips in trips of the types posted
+func (s *Server) classifyDayHandler(w http.ResponseWriter, r *http.Request) {
+	err, date := ParseURLDate(mux.Vars(r)["date"])
+	if err != nil {
+		WriteError(w, r, err)
+		return
+	}
+	types := make(map[string]string)
+	if err = decodeJSON(r.Body, &types); err != nil {
+		WriteError(w, r, err)
+		return
+	}
+	var trips []Trip
+	err = inTx(s.auditedStore(w, r), func(tx Tx) (err error) {
+		trips, err = ClassifyDay(tx, date, types)
+		return err
+	})
+	if err != nil {
+		WriteError(w, r, err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(trips)
+}
+
+// getTripHandler returns a trip
+func (s *Server) getTripHandler(w http.ResponseWriter, r *http.Request) {
+	err, id := urlID(r)
+	if err != nil {
+		WriteError(w, r, err)
+		return
+	}
+	trip, err := GetTrip(s.store(r), id)
+	if err != nil {
+		WriteError(w, r, err)
+		return
+	}
+	writeJSON(w, trip)
+}
+
+// putTripHandler returns a handler saving a trip, it replaces the trip when replace is set (PUT),
+// otherwise only what is in the body is changed (PATCH). The date of a trip does not change.
+func (s *Server) putTripHandler(replace bool) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		err, id := urlID(r)
+		if err != nil {
+			WriteError(w, r, err)
+			return
+		}
+		override, _ := strconv.ParseBool(r.URL.Query().Get("override"))
+		var trip Trip
+		err = inTx(s.auditedStore(w, r), func(tx Tx) error {
+			saved, err := GetTrip(tx, id)
+			if err != nil {
+				return err
+			}
+			if !replace {
+				trip = saved
+			}
+			if err := decodeJSON(r.Body, &trip); err != nil {
+				return err
+			}
+			trip.ID, trip.Date = saved.ID, saved.Date
+			return SaveTrip(tx, &trip, s.config.MaxDistance, override)
+		})
+		if err != nil {
+			WriteError(w, r, err)
+			return
+		}
+		writeJSON(w, trip)
+	}
+}
+
+// deleteTripHandler deletes a trip
+func (s *Server) deleteTripHandler(w http.ResponseWriter, r *http.Request) {
+	err, id := urlID(r)
+	if err != nil {
+		WriteError(w, r, err)
+		return
+	}
+	err = inTx(s.auditedStore(w, r), func(tx Tx) error {
+		return RemoveTrip(tx, id)
+	})
+	if err != nil {
+		WriteError(w, r, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// yearReportHandler totals the km of a year per type of trip
+func (s *Server) yearReportHandler(w http.ResponseWriter, r *http.Request) {
+	year, err := strconv.Atoi(mux.Vars(r)["year"])
+	if err != nil {
+		WriteError(w, r, CustomResponse(InvalidURL, err))
+		return
+	}
+	report, err := GetYearReport(s.store(r), year)
+	if err != nil {
+		WriteError(w, r, err)
+		return
+	}
+	writeJSON(w, report)
+}
+
+// listVehiclesHandler lists the vehicles
+func (s *Server) listVehiclesHandler(w http.ResponseWriter, r *http.Request) {
+	vehicles, err := GetVehicles(s.store(r))
+	if err != nil {
+		WriteError(w, r, err)
+		return
+	}
+	writeJSON(w, vehicles)
+}
+
+// postVehicleHandler adds a vehicle
+func (s *Server) postVehicleHandler(w http.ResponseWriter, r *http.Request) {
+	var vehicle Vehicle
+	if err := decodeJSON(r.Body, &vehicle); err != nil {
+		WriteError(w, r, err)
+		return
+	}
+	vehicle.ID = 0
+	err := inTx(s.store(r), func(tx Tx) error {
+		return SaveVehicle(tx, &vehicle)
+	})
+	if err != nil {
+		WriteError(w, r, err)
+		return
+	}
+	w.Header().Set("Location", fmt.Sprintf("%s/vehicles/%d", apiPrefix, vehicle.ID))
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(vehicle)
+}
+
+// getVehicleHandler returns a vehicle
+func (s *Server) getVehicleHandler(w http.ResponseWriter, r *http.Request) {
+	err, id := urlID(r)
+	if err != nil {
+		WriteError(w, r, err)
+		return
+	}
+	vehicle, err := GetVehicle(s.store(r), id)
+	if err != nil {
+		WriteError(w, r, err)
+		return
+	}
+	writeJSON(w, vehicle)
+}
+
+// putVehicleHandler returns a handler saving a vehicle, it replaces the vehicle when replace is
+// set (PUT), otherwise only what is in the body is changed (PATCH)
+func (s *Server) putVehicleHandler(replace bool) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		err, id := urlID(r)
+		if err != nil {
+			WriteError(w, r, err)
+			return
+		}
+		var vehicle Vehicle
+		err = inTx(s.store(r), func(tx Tx) error {
+			saved, err := GetVehicle(tx, id)
+			if err != nil {
+				return err
+			}
+			if !replace {
+				vehicle = saved
+			}
+			if err := decodeJSON(r.Body, &vehicle); err != nil {
+				return err
+			}
+			vehicle.ID = saved.ID
+			return SaveVehicle(tx, &vehicle)
+		})
+		if err != nil {
+			WriteError(w, r, err)
+			return
+		}
+		writeJSON(w, vehicle)
+	}
+}
+
+// activateVehicleHandler makes a vehicle the one new days are saved for
+func (s *Server) activateVehicleHandler(w http.ResponseWriter, r *http.Request) {
+	err, id := urlID(r)
+	if err != nil {
+		WriteError(w, r, err)
+		return
+	}
+	var vehicle Vehicle
+	err = inTx(s.store(r), func(tx Tx) error {
+		vehicle, err = ActivateVehicle(tx, id)
+		return err
+	})
+	if err != nil {
+		WriteError(w, r, err)
+		return
+	}
+	writeJSON(w, vehicle)
+}
@@ -0,0 +1,320 @@
+package km
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// apiRequest serves a request to the api and decodes the JSON response into v, if given
+func apiRequest(t *testing.T, method, url, body string, v interface{}) int {
+	req, _ := http.NewRequest(method, url, strings.NewReader(body))
+	req.Header.Set("Accept", "application/json")
+	w := serve(req)
+	if v != nil && w.Code < 300 {
+		if err := json.Unmarshal(w.Body.Bytes(), v); err != nil {
+			t.Fatalf("%s %s: not a valid json response: %s", method, url, err)
+		}
+	}
+	return w.Code
+}
+
+func TestDayResource(t *testing.T) {
+	initServer(t)
+	url := "/api/v1/days/2014-01-01"
+
+	if code := apiRequest(t, "GET", url, "", nil); code != NoDay.Code {
+		t.Errorf("GET %s before saving: code = %d, want %d", url, code, NoDay.Code)
+	}
+
+	var day Day
+	body := `{"readings": {"begin": 1000, "eerste": 1010, "laatste": 1010, "terug": 1020},
+		"times": {"begin": "08:00", "eerste": "08:30", "laatste": "17:00", "terug": "17:30"}}`
+	if code := apiRequest(t, "PUT", url, body, &day); code != 200 {
+		t.Fatalf("PUT %s: code = %d, want %d", url, code, 200)
+	}
+	want := Day{Date: day.Date,
+		Readings: Readings{Begin: 1000, Eerste: 1010, Laatste: 1010, Terug: 1020},
+		Times:    Stamps{Begin: "08:00", Eerste: "08:30", Laatste: "17:00", Terug: "17:30"},
+		Hours:    8.5,
+	}
+	if day != want || day.Date.Format(DateLayout) != "2014-01-01" {
+		t.Errorf("PUT %s: got %+v, want %+v", url, day, want)
+	}
+
+	// the legacy url and format work on the same day
+	day = Day{}
+	if code := apiRequest(t, "GET", "/api/v1/days/01012014", "", &day); code != 200 || day != want {
+		t.Errorf("GET legacy date: code = %d, got %+v", code, day)
+	}
+
+	// PATCH only changes what is in the body, a time of "-" clears it
+	var times Stamps
+	if code := apiRequest(t, "PATCH", url+"/times", `{"terug": "-", "laatste": "18:00"}`, &times); code != 200 {
+		t.Fatalf("PATCH %s/times: code = %d, want %d", url, code, 200)
+	}
+	if times != (Stamps{Begin: "08:00", Eerste: "08:30", Laatste: "18:00"}) {
+		t.Errorf("PATCH %s/times: got %+v", url, times)
+	}
+
+	// PUT replaces everything it is about, the times stay when the readings are replaced
+	var readings Readings
+	if code := apiRequest(t, "PUT", url+"/readings", `{"begin": 1000, "terug": 1030}`, &readings); code != 200 {
+		t.Fatalf("PUT %s/readings: code = %d, want %d", url, code, 200)
+	}
+	if readings != (Readings{Begin: 1000, Terug: 1030}) {
+		t.Errorf("PUT %s/readings: got %+v", url, readings)
+	}
+	if apiRequest(t, "GET", url+"/times", "", &times); times.Laatste != "18:00" {
+		t.Errorf("times changed by replacing the readings: %+v", times)
+	}
+
+	for _, tc := range []struct {
+		method, url, body string
+		want              Response
+	}{
+		{"PATCH", url, `{"readings": {"terug": 900}}`, InvalidReading},
+		{"PATCH", url, `{"readings": {"back": 1100}}`, UnknownField},
+		{"PUT", url + "/times", `{"begin": "8 uur"}`, NotParsable},
+		{"PUT", url, `[`, NotParsable},
+		{"POST", url, `{}`, MethodNotAllowed},
+		{"DELETE", url + "/readings", ``, MethodNotAllowed},
+		{"GET", "/api/v1/days/today", ``, InvalidDate},
+	} {
+		if code := apiRequest(t, tc.method, tc.url, tc.body, nil); code != tc.want.Code {
+			t.Errorf("%s %s %s: code = %d, want %d", tc.method, tc.url, tc.body, code, tc.want.Code)
+		}
+	}
+	if apiRequest(t, "GET", url+"/readings", "", &readings); readings.Terug != 1030 {
+		t.Errorf("rejected readings should not be saved, got: %+v", readings)
+	}
+
+	// override saves an odometer correction
+	if code := apiRequest(t, "PATCH", url+"?override=true", `{"readings": {"terug": 900}}`, &day); code != 200 || day.Readings.Terug != 900 {
+		t.Errorf("PATCH with override: code = %d, got %+v", code, day)
+	}
+
+	if code := apiRequest(t, "DELETE", url, "", nil); code != http.StatusNoContent {
+		t.Errorf("DELETE %s: code = %d, want %d", url, code, http.StatusNoContent)
+	}
+	if code := apiRequest(t, "GET", url, "", nil); code != NoDay.Code {
+		t.Errorf("GET %s after delete: code = %d, want %d", url, code, NoDay.Code)
+	}
+}
+
+func TestListDays(t *testing.T) {
+	initServer(t)
+	for _, date := range []string{"2014-01-30", "2014-01-31", "2014-02-01"} {
+		if code := apiRequest(t, "PUT", "/api/v1/days/"+date+"/times", `{"begin": "08:00"}`, nil); code != 200 {
+			t.Fatalf("PUT %s: code = %d, want %d", date, code, 200)
+		}
+	}
+	// kilometers only
+	if code := apiRequest(t, "PUT", "/api/v1/days/2014-02-02/readings", `{"begin": 1000}`, nil); code != 200 {
+		t.Fatalf("PUT 2014-02-02: code = %d, want %d", code, 200)
+	}
+
+	for _, tc := range []struct {
+		query string
+		want  []string
+	}{
+		{"", []string{"2014-02-02", "2014-02-01", "2014-01-31", "2014-01-30"}},
+		{"?from=2014-01-31", []string{"2014-02-02", "2014-02-01", "2014-01-31"}},
+		{"?from=2014-01-31&to=01022014", []string{"2014-02-01", "2014-01-31"}},
+		{"?to=2013-12-31", []string{}},
+	} {
+		var days []Day
+		if code := apiRequest(t, "GET", "/api/v1/days"+tc.query, "", &days); code != 200 {
+			t.Fatalf("GET /api/v1/days%s: code = %d, want %d", tc.query, code, 200)
+		}
+		var dates []string
+		for _, day := range days {
+			dates = append(dates, day.Date.Format(DateLayout))
+		}
+		if strings.Join(dates, ",") != strings.Join(tc.want, ",") {
+			t.Errorf("GET /api/v1/days%s: got %v, want %v", tc.query, dates, tc.want)
+		}
+	}
+
+	for _, query := range []string{"?from=yesterday", "?from=2014-02-01&to=2014-01-01"} {
+		if code := apiRequest(t, "GET", "/api/v1/days"+query, "", nil); code != 400 {
+			t.Errorf("GET /api/v1/days%s: code = %d, want %d", query, code, 400)
+		}
+	}
+}
+
+func TestPatchKeepsInferred(t *testing.T) {
+	initServer(t)
+	apiRequest(t, "PUT", "/api/v1/days/2014-01-01/readings", `{"begin": 1000}`, nil)
+	apiRequest(t, "PATCH", "/api/v1/days/2014-01-02", `{"readings": {"begin": 1050}}`, nil)
+
+	var readings Readings
+	apiRequest(t, "PATCH", "/api/v1/days/2014-01-01", `{"times": {"begin": "08:00"}}`, nil)
+	if apiRequest(t, "GET", "/api/v1/days/2014-01-01/readings", "", &readings); readings.Terug != 1050 || !readings.Inferred {
+		t.Errorf("expected Terug to stay inferred when only the times change, got: %+v", readings)
+	}
+	apiRequest(t, "PATCH", "/api/v1/days/2014-01-01/readings", `{"terug": 1040}`, &readings)
+	if readings.Terug != 1040 || readings.Inferred {
+		t.Errorf("expected Terug to be confirmed, got: %+v", readings)
+	}
+}
+
+func TestTrash(t *testing.T) {
+	initServer(t)
+	url := "/api/v1/days/2014-01-01"
+	apiRequest(t, "PUT", url, `{"readings": {"begin": 1000}, "times": {"begin": "08:00"}}`, nil)
+	apiRequest(t, "DELETE", url, "", nil)
+
+	var trash []Day
+	if code := apiRequest(t, "GET", "/api/v1/trash", "", &trash); code != 200 {
+		t.Fatalf("GET /api/v1/trash: code = %d, want %d", code, 200)
+	}
+	if len(trash) != 1 || trash[0].Readings.Begin != 1000 || trash[0].Times.Begin != "08:00" || trash[0].DeletedAt == nil {
+		t.Errorf("expected the deleted day in the trash, got: %+v", trash)
+	}
+
+	var day Day
+	if code := apiRequest(t, "POST", "/api/v1/trash/2014-01-01/restore", "", &day); code != 200 {
+		t.Fatalf("POST restore: code = %d, want %d", code, 200)
+	}
+	if day.Readings.Begin != 1000 || day.Times.Begin != "08:00" || day.DeletedAt != nil {
+		t.Errorf("expected the restored day, got: %+v", day)
+	}
+	if code := apiRequest(t, "GET", url, "", nil); code != 200 {
+		t.Errorf("GET %s after restore: code = %d, want %d", url, code, 200)
+	}
+	if apiRequest(t, "GET", "/api/v1/trash", "", &trash); len(trash) != 0 {
+		t.Errorf("expected an empty trash after restore, got: %+v", trash)
+	}
+	if code := apiRequest(t, "POST", "/api/v1/trash/2014-01-01/restore", "", nil); code != NoDay.Code {
+		t.Errorf("POST restore of a day not in the trash: code = %d, want %d", code, NoDay.Code)
+	}
+}
+
+func TestHistory(t *testing.T) {
+	initServer(t)
+	url := "/api/v1/days/2014-01-01"
+	req, _ := http.NewRequest("PUT", url+"/readings", strings.NewReader(`{"begin": 1000}`))
+	req.Header.Set("X-Request-Id", "first")
+	if w := serve(req); w.Header().Get("X-Request-Id") != "first" {
+		t.Errorf("expected the request id to be sent back, got: %q", w.Header().Get("X-Request-Id"))
+	}
+	apiRequest(t, "PATCH", url+"/readings", `{"eerste": 1010}`, nil)
+	apiRequest(t, "DELETE", url, "", nil)
+
+	var all, history []AuditEntry
+	if code := apiRequest(t, "GET", url+"/history", "", &all); code != 200 {
+		t.Fatalf("GET %s/history: code = %d, want %d", url, code, 200)
+	}
+	for _, e := range all {
+		if e.Kind == "kilometers" {
+			history = append(history, e)
+		}
+	}
+	if len(history) != 3 {
+		t.Fatalf("expected 3 changes to the kilometers, got: %+v", history)
+	}
+	if history[0].Action != "save" || history[0].Before != "" || history[0].RequestID != "first" {
+		t.Errorf("unexpected first change: %+v", history[0])
+	}
+	if history[1].Action != "save" || !strings.Contains(string(history[1].Before), `"Eerste":0`) || !strings.Contains(string(history[1].After), `"Eerste":1010`) {
+		t.Errorf("unexpected second change: %+v", history[1])
+	}
+	if history[2].Action != "delete" || history[2].After != "" {
+		t.Errorf("unexpected third change: %+v", history[2])
+	}
+	if apiRequest(t, "GET", "/api/v1/days/2014-01-02/history", "", &history); len(history) != 0 {
+		t.Errorf("expected no history for a date without changes, got: %+v", history)
+	}
+}
+
+func TestTrips(t *testing.T) {
+	initServer(t)
+	url := "/api/v1/days/2014-01-01/trips"
+	var trips []Trip
+	if code := apiRequest(t, "GET", url, "", &trips); code != 200 || len(trips) != 0 {
+		t.Errorf("GET %s before saving: code = %d, got %+v", url, code, trips)
+	}
+
+	var trip Trip
+	body := `{"startKm": 1000, "endKm": 1030, "from": "Thuis", "to": "Kantoor", "purpose": "werk", "type": "business"}`
+	if code := apiRequest(t, "POST", url, body, &trip); code != http.StatusCreated {
+		t.Fatalf("POST %s: code = %d, want %d", url, code, http.StatusCreated)
+	}
+	if trip.ID == 0 || trip.Date.Format(DateLayout) != "2014-01-01" || trip.To != "Kantoor" {
+		t.Errorf("POST %s: got %+v", url, trip)
+	}
+	tripURL := "/api/v1/trips/" + strconv.FormatInt(trip.ID, 10)
+
+	if code := apiRequest(t, "PATCH", tripURL, `{"endKm": 1040}`, &trip); code != 200 || trip.EndKm != 1040 || trip.From != "Thuis" {
+		t.Errorf("PATCH %s: code = %d, got %+v", tripURL, code, trip)
+	}
+	if code := apiRequest(t, "PUT", tripURL, `{"startKm": 1000, "endKm": 1040, "type": "private"}`, &trip); code != 200 || trip.From != "" || trip.Type != TripPrivate {
+		t.Errorf("PUT %s: code = %d, got %+v", tripURL, code, trip)
+	}
+	var readings Readings
+	if apiRequest(t, "GET", "/api/v1/days/2014-01-01/readings", "", &readings); readings.Begin != 1000 || readings.Terug != 1040 {
+		t.Errorf("expected the readings to be derived from the trip, got: %+v", readings)
+	}
+
+	for _, tc := range []struct {
+		method, url, body string
+		want              Response
+	}{
+		{"POST", url, `{"startKm": 1020, "endKm": 1050, "type": "business"}`, InvalidTrip},
+		{"POST", url, `{"startKm": 1050, "endKm": 1060, "type": "holiday"}`, InvalidTrip},
+		{"POST", url, `{"startKm": 1050, "km": 10}`, UnknownField},
+		{"PATCH", "/api/v1/days/2014-01-01/readings", `{"begin": 1010}`, InvalidReading},
+		{"GET", "/api/v1/trips/1234", ``, NoTrip},
+		{"GET", "/api/v1/trips/first", ``, InvalidURL},
+	} {
+		if code := apiRequest(t, tc.method, tc.url, tc.body, nil); code != tc.want.Code {
+			t.Errorf("%s %s %s: code = %d, want %d", tc.method, tc.url, tc.body, code, tc.want.Code)
+		}
+	}
+
+	if code := apiRequest(t, "DELETE", tripURL, "", nil); code != http.StatusNoContent {
+		t.Errorf("DELETE %s: code = %d, want %d", tripURL, code, http.StatusNoContent)
+	}
+	if code := apiRequest(t, "GET", tripURL, "", nil); code != NoTrip.Code {
+		t.Errorf("GET %s after delete: code = %d, want %d", tripURL, code, NoTrip.Code)
+	}
+	var history []AuditEntry
+	apiRequest(t, "GET", "/api/v1/days/2014-01-01/history", "", &history)
+	if last := history[len(history)-1]; last.Kind != "trips" || last.Action != "delete" || last.After != "" {
+		t.Errorf("expected the deleted trip in the history, got: %+v", last)
+	}
+}
+
+func TestYearReportHandler(t *testing.T) {
+	initServer(t)
+	apiRequest(t, "PUT", "/api/v1/days/2014-01-02/readings", `{"begin": 1000, "eerste": 1030, "laatste": 1040, "terug": 1070}`, nil)
+	var report YearReport
+	if code := apiRequest(t, "GET", "/api/v1/reports/2014", "", &report); code != 200 {
+		t.Fatalf("GET /api/v1/reports/2014: code = %d, want %d", code, 200)
+	}
+	if report.Year != 2014 || report.Totals != (Totals{Business: 10, Commute: 60}) || report.PrivateLimit != PrivateLimit {
+		t.Errorf("unexpected report: %+v", report)
+	}
+
+	// a classified day is totalled by the types of its trips
+	url := "/api/v1/days/2014-01-02/classify"
+	var trips []Trip
+	if code := apiRequest(t, "POST", url, `{"eerste": "private"}`, &trips); code != http.StatusCreated || len(trips) != 3 {
+		t.Fatalf("POST %s: code = %d, got %+v", url, code, trips)
+	}
+	if code := apiRequest(t, "PATCH", "/api/v1/trips/"+strconv.FormatInt(trips[2].ID, 10), `{"type": "business"}`, nil); code != 200 {
+		t.Fatalf("PATCH the last trip: code = %d, want %d", code, 200)
+	}
+	if apiRequest(t, "GET", "/api/v1/reports/2014", "", &report); report.Totals != (Totals{Business: 30, Commute: 30, Private: 10}) {
+		t.Errorf("unexpected report of the classified day: %+v", report)
+	}
+	if code := apiRequest(t, "POST", url, `{}`, nil); code != DayHasTrips.Code {
+		t.Errorf("POST %s twice: code = %d, want %d", url, code, DayHasTrips.Code)
+	}
+	if code := apiRequest(t, "GET", "/api/v1/reports/this-year", "", nil); code != InvalidURL.Code {
+		t.Errorf("GET /api/v1/reports/this-year: code = %d, want %d", code, InvalidURL.Code)
+	}
+}
@@ -0,0 +1,389 @@
+package km
+
+import (
+	"crypto/rand"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// AuditEntry records one change to the kilometers, times or trips saved for a date
+type AuditEntry struct {
+	ID   int64     `db:"id" json:"id"`
+	Date time.Time `db:"date" json:"date"`
+	At   time.Time `db:"at" json:"at"`
+	// Kind is the table changed, kilometers, times or trips. All trips of a date are
+	// recorded together, ordered by their odometer readings.
+	Kind string `db:"kind" json:"kind"`
+	// Action is save, delete or restore
+	Action string `db:"action" json:"action"`
+	// Before and After are the row before and after the change, empty when there is none
+	Before     auditValue `db:"before" json:"before"`
+	After      auditValue `db:"after" json:"after"`
+	RemoteAddr string     `db:"remote_addr" json:"remoteAddr"`
+	User       string     `db:"user_name" json:"user"`
+	RequestID  string     `db:"request_id" json:"requestId"`
+	// PrevHash is the Hash of the entry before this one, Hash chains the entry to it
+	PrevHash string `db:"prev_hash" json:"prevHash"`
+	Hash     string `db:"hash" json:"hash"`
+	// UserID is the user the row changed belongs to, every user has a chain of their own
+	UserID int64 `db:"user_id" json:"-"`
+}
+
+// auditValue is a row encoded as JSON, it is written to JSON as is
+type auditValue string
+
+// MarshalJSON implements json.Marshaler
+func (v auditValue) MarshalJSON() ([]byte, error) {
+	if v == "" {
+		return []byte("null"), nil
+	}
+	return []byte(v), nil
+}
+
+// UnmarshalJSON implements json.Unmarshaler
+func (v *auditValue) UnmarshalJSON(data []byte) error {
+	if string(data) == "null" {
+		*v = ""
+	} else {
+		*v = auditValue(data)
+	}
+	return nil
+}
+
+func newAuditValue(row interface{}) auditValue {
+	if row == nil {
+		return ""
+	}
+	encoded, _ := json.Marshal(row)
+	return auditValue(encoded)
+}
+
+// Origin is where a change comes from, it is recorded with every change in the audit log
+type Origin struct {
+	RemoteAddr string
+	User       string
+	RequestID  string
+}
+
+// newRequestID returns a random id for a request that did not bring its own
+func newRequestID() string {
+	b := make([]byte, 8)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// trustedProxies are the proxies in front of the app, only the X-Forwarded-For header they
+// send is believed
+type trustedProxies []*net.IPNet
+
+// parseTrustedProxies parses the addresses and CIDR ranges of the trusted proxies
+func parseTrustedProxies(addrs []string) (trustedProxies, error) {
+	var proxies trustedProxies
+	for _, addr := range addrs {
+		if !strings.Contains(addr, "/") {
+			ip := net.ParseIP(addr)
+			if ip == nil {
+				return nil, fmt.Errorf("invalid trusted proxy: %q", addr)
+			}
+			bits := 8 * net.IPv6len
+			if ip.To4() != nil {
+				ip, bits = ip.To4(), 8*net.IPv4len
+			}
+			proxies = append(proxies, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, network, err := net.ParseCIDR(addr)
+		if err != nil {
+			return nil, fmt.Errorf("invalid trusted proxy: %q", addr)
+		}
+		proxies = append(proxies, network)
+	}
+	return proxies, nil
+}
+
+// trusts tells whether addr is one of the trusted proxies
+func (t trustedProxies) trusts(addr string) bool {
+	ip := net.ParseIP(addr)
+	if ip == nil {
+		return false
+	}
+	for _, network := range t {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// requestOrigin returns the origin of the changes made by r, the user is the one logged in.
+// Behind a trusted proxy the client is the last address in X-Forwarded-For that is not one of
+// the proxies, the header of anyone else is ignored so the address can not be made up.
+func requestOrigin(r *http.Request, proxies trustedProxies) Origin {
+	origin := Origin{RemoteAddr: r.RemoteAddr, User: userOf(r).Name, RequestID: r.Header.Get("X-Request-Id")}
+	if host, _, err := net.SplitHostPort(r.RemoteAddr); err == nil {
+		origin.RemoteAddr = host
+	}
+	if proxies.trusts(origin.RemoteAddr) {
+		addrs := strings.Split(r.Header.Get("X-Forwarded-For"), ",")
+		for i := len(addrs) - 1; i >= 0; i-- {
+			addr := strings.TrimSpace(addrs[i])
+			if addr == "" {
+				continue
+			}
+			origin.RemoteAddr = addr
+			if !proxies.trusts(addr) {
+				break
+			}
+		}
+	}
+	if origin.RequestID == "" {
+		origin.RequestID = newRequestID()
+	}
+	return origin
+}
+
+// auditStore is a Store that records every change made through it in the audit log,
+// in the same transaction as the change itself
+type auditStore struct {
+	Store
+	origin Origin
+}
+
+// Audited returns store, recording every change made through it as coming from origin
+func Audited(store Store, origin Origin) Store {
+	return auditStore{store, origin}
+}
+
+// Begin implements Store
+func (a auditStore) Begin() (Tx, error) {
+	tx, err := a.Store.Begin()
+	if err != nil {
+		return nil, err
+	}
+	return auditTx{tx, a.origin}, nil
+}
+
+// ForUser implements Store, the store scoped to the user keeps recording its changes
+func (a auditStore) ForUser(id int64) Store {
+	return auditStore{a.Store.ForUser(id), a.origin}
+}
+
+// PutKilometers implements Executor
+func (a auditStore) PutKilometers(k *Kilometers) error {
+	return inTx(a, func(tx Tx) error { return tx.PutKilometers(k) })
+}
+
+// PutTimes implements Executor
+func (a auditStore) PutTimes(t *Times) error {
+	return inTx(a, func(tx Tx) error { return tx.PutTimes(t) })
+}
+
+// DeleteDate implements Executor
+func (a auditStore) DeleteDate(date time.Time) error {
+	return inTx(a, func(tx Tx) error { return tx.DeleteDate(date) })
+}
+
+// PutTrip implements Executor
+func (a auditStore) PutTrip(t *Trip) error {
+	return inTx(a, func(tx Tx) error { return tx.PutTrip(t) })
+}
+
+// DeleteTrip implements Executor
+func (a auditStore) DeleteTrip(id int64) error {
+	return inTx(a, func(tx Tx) error { return tx.DeleteTrip(id) })
+}
+
+// RestoreDate implements Executor
+func (a auditStore) RestoreDate(date time.Time) error {
+	return inTx(a, func(tx Tx) error { return tx.RestoreDate(date) })
+}
+
+// auditTx is a transaction of an auditStore
+type auditTx struct {
+	Tx
+	origin Origin
+}
+
+// record adds an entry for a change of kind on date to the audit log, saving a row
+// without changing it is not recorded
+func (a auditTx) record(date time.Time, kind, action string, before, after interface{}) error {
+	b, f := newAuditValue(before), newAuditValue(after)
+	if b == f {
+		return nil
+	}
+	last, err := a.Tx.LastAudit()
+	if err != nil && err != sql.ErrNoRows {
+		return err
+	}
+	return a.Tx.PutAudit(chain(last, AuditEntry{
+		Date: truncateDate(date),
+		// databases keep timestamps in microseconds, the hash has to survive that
+		At:         time.Now().UTC().Truncate(time.Microsecond),
+		Kind:       kind,
+		Action:     action,
+		Before:     b,
+		After:      f,
+		RemoteAddr: a.origin.RemoteAddr,
+		User:       a.origin.User,
+		RequestID:  a.origin.RequestID,
+	}))
+}
+
+// saved returns the kilometers and times saved for date, nil when there are none
+func (a auditTx) saved(date time.Time) (k, t interface{}, err error) {
+	kilometers, err := a.Tx.GetKilometers(date)
+	switch {
+	case err == nil:
+		k = kilometers
+	case err != sql.ErrNoRows:
+		return nil, nil, err
+	}
+	times, err := a.Tx.GetTimes(date)
+	switch {
+	case err == nil:
+		t = times
+	case err != sql.ErrNoRows:
+		return nil, nil, err
+	}
+	return k, t, nil
+}
+
+// tripsOf returns the trips of date, nil when there are none
+func (a auditTx) tripsOf(date time.Time) (interface{}, error) {
+	trips, err := a.Tx.TripsForDate(date)
+	if err != nil || len(trips) == 0 {
+		return nil, err
+	}
+	return trips, nil
+}
+
+// recordTrips records how change changes the trips of dates, all trips of a date are recorded
+// as one row
+func (a auditTx) recordTrips(dates []time.Time, action string, change func() error) error {
+	before := make([]interface{}, len(dates))
+	for i, date := range dates {
+		var err error
+		if before[i], err = a.tripsOf(date); err != nil {
+			return err
+		}
+	}
+	if err := change(); err != nil {
+		return err
+	}
+	for i, date := range dates {
+		after, err := a.tripsOf(date)
+		if err != nil {
+			return err
+		}
+		if err = a.record(date, "trips", action, before[i], after); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// PutTrip implements Executor
+func (a auditTx) PutTrip(t *Trip) error {
+	dates := []time.Time{truncateDate(t.Date)}
+	if saved, err := a.Tx.GetTrip(t.ID); err == nil && !truncateDate(saved.Date).Equal(dates[0]) {
+		// the trip moves to another date
+		dates = append(dates, saved.Date)
+	}
+	return a.recordTrips(dates, "save", func() error { return a.Tx.PutTrip(t) })
+}
+
+// DeleteTrip implements Executor
+func (a auditTx) DeleteTrip(id int64) error {
+	saved, err := a.Tx.GetTrip(id)
+	if err != nil {
+		return err
+	}
+	return a.recordTrips([]time.Time{saved.Date}, "delete", func() error { return a.Tx.DeleteTrip(id) })
+}
+
+// PutKilometers implements Executor
+func (a auditTx) PutKilometers(k *Kilometers) error {
+	before, _, err := a.saved(k.Date)
+	if err != nil {
+		return err
+	}
+	if err = a.Tx.PutKilometers(k); err != nil {
+		return err
+	}
+	return a.record(k.Date, "kilometers", "save", before, *k)
+}
+
+// PutTimes implements Executor
+func (a auditTx) PutTimes(t *Times) error {
+	_, before, err := a.saved(t.Date)
+	if err != nil {
+		return err
+	}
+	if err = a.Tx.PutTimes(t); err != nil {
+		return err
+	}
+	return a.record(t.Date, "times", "save", before, *t)
+}
+
+// DeleteDate implements Executor
+func (a auditTx) DeleteDate(date time.Time) error {
+	k, t, err := a.saved(date)
+	if err != nil {
+		return err
+	}
+	return a.recordTrips([]time.Time{date}, "delete", func() error {
+		if err := a.Tx.DeleteDate(date); err != nil {
+			return err
+		}
+		if k != nil {
+			if err := a.record(date, "kilometers", "delete", k, nil); err != nil {
+				return err
+			}
+		}
+		if t != nil {
+			return a.record(date, "times", "delete", t, nil)
+		}
+		return nil
+	})
+}
+
+// RestoreDate implements Executor, only what was in the trash is recorded as restored
+func (a auditTx) RestoreDate(date time.Time) error {
+	kBefore, tBefore, err := a.saved(date)
+	if err != nil {
+		return err
+	}
+	return a.recordTrips([]time.Time{date}, "restore", func() error {
+		if err := a.Tx.RestoreDate(date); err != nil {
+			return err
+		}
+		k, t, err := a.saved(date)
+		if err != nil {
+			return err
+		}
+		if kBefore == nil && k != nil {
+			if err = a.record(date, "kilometers", "restore", nil, k); err != nil {
+				return err
+			}
+		}
+		if tBefore == nil && t != nil {
+			return a.record(date, "times", "restore", nil, t)
+		}
+		return nil
+	})
+}
+
+// GetHistory returns the changes made to date, oldest first
+func GetHistory(ex Executor, date time.Time) ([]AuditEntry, error) {
+	entries, err := ex.AuditForDate(date)
+	if err != nil {
+		return nil, CustomResponse(DbError, err)
+	}
+	return entries, nil
+}
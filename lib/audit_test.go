@@ -0,0 +1,93 @@
+package km
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRequestOrigin(t *testing.T) {
+	proxies, err := parseTrustedProxies([]string{"10.0.0.1", "172.16.0.0/12"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = parseTrustedProxies([]string{"proxy"}); err == nil {
+		t.Error("an invalid trusted proxy is accepted")
+	}
+	req, _ := http.NewRequest("POST", "/save/2014-01-01", nil)
+	req.RemoteAddr = "10.0.0.1:5432"
+	if origin := requestOrigin(req, proxies); origin.RemoteAddr != "10.0.0.1" || origin.User != "" || origin.RequestID == "" {
+		t.Errorf("unexpected origin of a direct request: %+v", origin)
+	}
+
+	// the user is the one logged in, whatever the request says
+	req.Header.Set("X-Forwarded-For", "6.6.6.6, 192.168.1.2, 172.16.0.5")
+	req.Header.Set("X-Request-Id", "abc")
+	req.Header.Set("X-Remote-User", "mallory")
+	req.SetBasicAuth("mallory", "secret")
+	req = withUser(req, User{ID: 1, Name: "freek"})
+	want := Origin{RemoteAddr: "192.168.1.2", User: "freek", RequestID: "abc"}
+	if origin := requestOrigin(req, proxies); origin != want {
+		t.Errorf("got %+v, want %+v", origin, want)
+	}
+
+	// only a trusted proxy can tell the address of the client
+	req.RemoteAddr = "192.168.1.2:5432"
+	if origin := requestOrigin(req, proxies); origin.RemoteAddr != "192.168.1.2" {
+		t.Errorf("the address forwarded by a client is believed: %+v", origin)
+	}
+}
+
+func TestAuditedStore(t *testing.T) {
+	memory := NewMemoryStore()
+	store := Audited(memory, Origin{RemoteAddr: "10.0.0.1", User: "freek", RequestID: "abc"})
+	date := time.Date(2014, time.January, 1, 0, 0, 0, 0, time.UTC)
+
+	store.PutKilometers(&Kilometers{Date: date, Begin: 1000})
+	inTx(store, func(tx Tx) error {
+		return tx.PutKilometers(&Kilometers{Date: date, Begin: 1010})
+	})
+	store.PutTimes(&Times{Date: date, Begin: 1388563200})
+	store.DeleteDate(date)
+	store.RestoreDate(date)
+	// a rolled back change is not recorded
+	tx, _ := store.Begin()
+	tx.PutKilometers(&Kilometers{Date: date, Begin: 2000})
+	tx.Rollback()
+
+	entries, err := memory.AuditForDate(date)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []struct{ kind, action, before, after string }{
+		{"kilometers", "save", "", "1000"},
+		{"kilometers", "save", "1000", "1010"},
+		{"times", "save", "", "1388563200"},
+		{"kilometers", "delete", "1010", ""},
+		{"times", "delete", "1388563200", ""},
+		{"kilometers", "restore", "", "1010"},
+		{"times", "restore", "", "1388563200"},
+	}
+	if len(entries) != len(want) {
+		t.Fatalf("expected %d entries, got: %+v", len(want), entries)
+	}
+	contains := func(v auditValue, s string) bool {
+		if s == "" {
+			return v == ""
+		}
+		return strings.Contains(string(v), `"Begin":`+s)
+	}
+	for i, w := range want {
+		e := entries[i]
+		if e.Kind != w.kind || e.Action != w.action || !contains(e.Before, w.before) || !contains(e.After, w.after) {
+			t.Errorf("entry %d: got %s %s %s -> %s, want %+v", i, e.Kind, e.Action, e.Before, e.After, w)
+		}
+		if e.User != "freek" || e.RemoteAddr != "10.0.0.1" || e.RequestID != "abc" || e.At.IsZero() {
+			t.Errorf("entry %d: origin not recorded: %+v", i, e)
+		}
+	}
+	if all, _ := memory.AuditLog(); len(all) != len(want) {
+		t.Errorf("expected the whole log to have %d entries, got %d", len(want), len(all))
+	}
+}
@@ -0,0 +1,659 @@
+package km
+
+import (
+	"archive/zip"
+	"context"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// BackupVersion is the version of the archives written by Backup, Restore reads the versions up to it
+const BackupVersion = 3
+
+// Tables are all rows of a store, the ones in the trash included
+type Tables struct {
+	Kilometers []Kilometers
+	Times      []Times
+	Trips      []Trip
+	Audit      []AuditEntry
+	Vehicles   []Vehicle
+	Users      []User
+}
+
+// empty tells whether there are no rows at all
+func (t Tables) empty() bool {
+	return len(t.Kilometers) == 0 && len(t.Times) == 0 && len(t.Trips) == 0 && len(t.Audit) == 0 && len(t.Vehicles) == 0 && len(t.Users) == 0
+}
+
+// Archiver is implemented by stores that can be backed up and restored
+type Archiver interface {
+	// Dump returns all rows saved, the audit log oldest first
+	Dump() (Tables, error)
+	// Load saves all rows of tables as they are, ids included, in one transaction
+	Load(tables Tables) error
+}
+
+// Manifest describes the files of a backup archive, it is saved in it as manifest.json
+type Manifest struct {
+	Version int            `json:"version"`
+	Created time.Time      `json:"created"`
+	Files   []ManifestFile `json:"files"`
+}
+
+// ManifestFile is a file of a backup archive, with the number of rows in it and its checksum
+type ManifestFile struct {
+	Name   string `json:"name"`
+	Rows   int    `json:"rows"`
+	SHA256 string `json:"sha256"`
+}
+
+// the rows are written with the time they were moved to the trash and the user they belong
+// to, and users with the hash of their password, which are left out of their JSON everywhere
+// else
+type (
+	backupKilometers struct {
+		Kilometers
+		DeletedAt *time.Time `json:"deletedAt,omitempty"`
+		UserID    int64      `json:"userId,omitempty"`
+	}
+	backupTimes struct {
+		Times
+		DeletedAt *time.Time `json:"deletedAt,omitempty"`
+		UserID    int64      `json:"userId,omitempty"`
+	}
+	backupTrip struct {
+		Trip
+		DeletedAt *time.Time `json:"deletedAt,omitempty"`
+		UserID    int64      `json:"userId,omitempty"`
+	}
+	backupAudit struct {
+		AuditEntry
+		UserID int64 `json:"userId,omitempty"`
+	}
+	backupVehicle struct {
+		Vehicle
+		UserID int64 `json:"userId,omitempty"`
+	}
+	backupUser struct {
+		User
+		PasswordHash string `json:"passwordHash,omitempty"`
+	}
+)
+
+// backupFile is a file of a backup archive, it encodes and decodes the rows of one table
+type backupFile struct {
+	name string
+	// since is the first version of the archives that have the file
+	since  int
+	encode func(t Tables) (rows int, content []byte, err error)
+	decode func(t *Tables, content []byte) (rows int, err error)
+}
+
+var backupFiles = []backupFile{
+	{"kilometers.json", 1,
+		func(t Tables) (int, []byte, error) {
+			rows := make([]backupKilometers, len(t.Kilometers))
+			for i, k := range t.Kilometers {
+				rows[i] = backupKilometers{k, k.DeletedAt, k.UserID}
+			}
+			content, err := json.Marshal(rows)
+			return len(rows), content, err
+		},
+		func(t *Tables, content []byte) (int, error) {
+			var rows []backupKilometers
+			if err := json.Unmarshal(content, &rows); err != nil {
+				return 0, err
+			}
+			for _, row := range rows {
+				row.Kilometers.DeletedAt, row.Kilometers.UserID = row.DeletedAt, row.UserID
+				t.Kilometers = append(t.Kilometers, row.Kilometers)
+			}
+			return len(rows), nil
+		}},
+	{"times.json", 1,
+		func(t Tables) (int, []byte, error) {
+			rows := make([]backupTimes, len(t.Times))
+			for i, times := range t.Times {
+				rows[i] = backupTimes{times, times.DeletedAt, times.UserID}
+			}
+			content, err := json.Marshal(rows)
+			return len(rows), content, err
+		},
+		func(t *Tables, content []byte) (int, error) {
+			var rows []backupTimes
+			if err := json.Unmarshal(content, &rows); err != nil {
+				return 0, err
+			}
+			for _, row := range rows {
+				row.Times.DeletedAt, row.Times.UserID = row.DeletedAt, row.UserID
+				t.Times = append(t.Times, row.Times)
+			}
+			return len(rows), nil
+		}},
+	{"trips.json", 1,
+		func(t Tables) (int, []byte, error) {
+			rows := make([]backupTrip, len(t.Trips))
+			for i, trip := range t.Trips {
+				rows[i] = backupTrip{trip, trip.DeletedAt, trip.UserID}
+			}
+			content, err := json.Marshal(rows)
+			return len(rows), content, err
+		},
+		func(t *Tables, content []byte) (int, error) {
+			var rows []backupTrip
+			if err := json.Unmarshal(content, &rows); err != nil {
+				return 0, err
+			}
+			for _, row := range rows {
+				row.Trip.DeletedAt, row.Trip.UserID = row.DeletedAt, row.UserID
+				t.Trips = append(t.Trips, row.Trip)
+			}
+			return len(rows), nil
+		}},
+	{"audit.json", 1,
+		func(t Tables) (int, []byte, error) {
+			rows := make([]backupAudit, len(t.Audit))
+			for i, e := range t.Audit {
+				rows[i] = backupAudit{e, e.UserID}
+			}
+			content, err := json.Marshal(rows)
+			return len(rows), content, err
+		},
+		func(t *Tables, content []byte) (int, error) {
+			var rows []backupAudit
+			if err := json.Unmarshal(content, &rows); err != nil {
+				return 0, err
+			}
+			for _, row := range rows {
+				row.AuditEntry.UserID = row.UserID
+				t.Audit = append(t.Audit, row.AuditEntry)
+			}
+			return len(rows), nil
+		}},
+	{"vehicles.json", 2,
+		func(t Tables) (int, []byte, error) {
+			rows := make([]backupVehicle, len(t.Vehicles))
+			for i, v := range t.Vehicles {
+				rows[i] = backupVehicle{v, v.UserID}
+			}
+			content, err := json.Marshal(rows)
+			return len(rows), content, err
+		},
+		func(t *Tables, content []byte) (int, error) {
+			var rows []backupVehicle
+			if err := json.Unmarshal(content, &rows); err != nil {
+				return 0, err
+			}
+			for _, row := range rows {
+				row.Vehicle.UserID = row.UserID
+				t.Vehicles = append(t.Vehicles, row.Vehicle)
+			}
+			return len(rows), nil
+		}},
+	{"users.json", 3,
+		func(t Tables) (int, []byte, error) {
+			rows := make([]backupUser, len(t.Users))
+			for i, u := range t.Users {
+				rows[i] = backupUser{u, u.PasswordHash}
+			}
+			content, err := json.Marshal(rows)
+			return len(rows), content, err
+		},
+		func(t *Tables, content []byte) (int, error) {
+			var rows []backupUser
+			if err := json.Unmarshal(content, &rows); err != nil {
+				return 0, err
+			}
+			for _, row := range rows {
+				row.User.PasswordHash = row.PasswordHash
+				t.Users = append(t.Users, row.User)
+			}
+			return len(rows), nil
+		}},
+}
+
+func checksum(content []byte) string {
+	sum := sha256.Sum256(content)
+	return hex.EncodeToString(sum[:])
+}
+
+// Backup writes everything saved in store to w, as a zip archive of a JSON file per table and
+// a manifest with their checksums
+func Backup(store Store, w io.Writer) (manifest Manifest, err error) {
+	archiver, ok := store.(Archiver)
+	if !ok {
+		return manifest, fmt.Errorf("this store can not be backed up")
+	}
+	tables, err := archiver.Dump()
+	if err != nil {
+		return manifest, err
+	}
+	manifest = Manifest{Version: BackupVersion, Created: time.Now().UTC()}
+	archive := zip.NewWriter(w)
+	for _, file := range backupFiles {
+		rows, content, err := file.encode(tables)
+		if err != nil {
+			return manifest, err
+		}
+		manifest.Files = append(manifest.Files, ManifestFile{Name: file.name, Rows: rows, SHA256: checksum(content)})
+		if err = writeZipFile(archive, file.name, content); err != nil {
+			return manifest, err
+		}
+	}
+	content, err := json.MarshalIndent(manifest, "", "  ")
+	if err != nil {
+		return manifest, err
+	}
+	if err = writeZipFile(archive, "manifest.json", content); err != nil {
+		return manifest, err
+	}
+	return manifest, archive.Close()
+}
+
+func writeZipFile(archive *zip.Writer, name string, content []byte) error {
+	f, err := archive.Create(name)
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(content)
+	return err
+}
+
+// Restore loads the backup archive in r, of size bytes, into store. The archive is checked
+// against its manifest first, and the store has to be empty: nothing is restored otherwise.
+// Everything is restored as it was, the audit log included, so nothing is added to it.
+func Restore(store Store, r io.ReaderAt, size int64) (manifest Manifest, err error) {
+	archiver, ok := store.(Archiver)
+	if !ok {
+		return manifest, fmt.Errorf("this store can not be restored")
+	}
+	archive, err := zip.NewReader(r, size)
+	if err != nil {
+		return manifest, fmt.Errorf("not a backup archive: %s", err)
+	}
+	files := make(map[string][]byte)
+	for _, f := range archive.File {
+		rc, err := f.Open()
+		if err != nil {
+			return manifest, err
+		}
+		files[f.Name], err = ioutil.ReadAll(rc)
+		rc.Close()
+		if err != nil {
+			return manifest, fmt.Errorf("reading %s: %s", f.Name, err)
+		}
+	}
+	content, ok := files["manifest.json"]
+	if !ok {
+		return manifest, fmt.Errorf("not a backup archive: there is no manifest.json")
+	}
+	if err = json.Unmarshal(content, &manifest); err != nil {
+		return manifest, fmt.Errorf("manifest.json: %s", err)
+	}
+	if manifest.Version < 1 || manifest.Version > BackupVersion {
+		return manifest, fmt.Errorf("backup version %d can not be restored, only versions up to %d", manifest.Version, BackupVersion)
+	}
+	inManifest := make(map[string]ManifestFile)
+	for _, f := range manifest.Files {
+		inManifest[f.Name] = f
+	}
+
+	var tables Tables
+	for _, file := range backupFiles {
+		if file.since > manifest.Version {
+			continue
+		}
+		entry, ok := inManifest[file.name]
+		content, saved := files[file.name]
+		switch {
+		case !ok || !saved:
+			return manifest, fmt.Errorf("%s is missing", file.name)
+		case checksum(content) != entry.SHA256:
+			return manifest, fmt.Errorf("%s does not match its checksum, the archive is damaged", file.name)
+		}
+		rows, err := file.decode(&tables, content)
+		if err != nil {
+			return manifest, fmt.Errorf("%s: %s", file.name, err)
+		}
+		if rows != entry.Rows {
+			return manifest, fmt.Errorf("%s has %d rows, the manifest says %d", file.name, rows, entry.Rows)
+		}
+	}
+
+	saved, err := archiver.Dump()
+	if err != nil {
+		return manifest, err
+	}
+	if !saved.empty() {
+		return manifest, fmt.Errorf("there is data saved already, a backup is only restored into an empty store")
+	}
+	return manifest, archiver.Load(tables)
+}
+
+// backupPrefix and backupSuffix surround the time in the names of the archives BackupTo writes
+const (
+	backupPrefix = "km-backup-"
+	backupSuffix = ".zip"
+)
+
+// BackupTo writes a backup of store to a new archive in dir, named after the time it is made,
+// and removes the oldest archives in there so no more than keep are left. It returns the path
+// of the archive.
+func BackupTo(store Store, dir string, keep int) (string, error) {
+	path := filepath.Join(dir, backupPrefix+time.Now().UTC().Format("20060102T150405Z")+backupSuffix)
+	// a partly written archive is never taken for a backup
+	tmp, err := ioutil.TempFile(dir, ".km-backup-")
+	if err != nil {
+		return "", err
+	}
+	if _, err = Backup(store, tmp); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return "", err
+	}
+	if err = tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return "", err
+	}
+	if err = os.Rename(tmp.Name(), path); err != nil {
+		os.Remove(tmp.Name())
+		return "", err
+	}
+	return path, rotateBackups(dir, keep)
+}
+
+// rotateBackups removes the oldest archives in dir, so no more than keep are left
+func rotateBackups(dir string, keep int) error {
+	entries, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return err
+	}
+	var archives []string
+	for _, entry := range entries {
+		if name := entry.Name(); strings.HasPrefix(name, backupPrefix) && strings.HasSuffix(name, backupSuffix) {
+			archives = append(archives, name)
+		}
+	}
+	// the names sort by the time they were made
+	sort.Strings(archives)
+	for len(archives) > keep {
+		if err = os.Remove(filepath.Join(dir, archives[0])); err != nil {
+			return err
+		}
+		archives = archives[1:]
+	}
+	return nil
+}
+
+// BackupEvery backs up the store to the configured directory every interval, it never returns
+func (s *Server) BackupEvery(interval time.Duration) {
+	for {
+		time.Sleep(interval)
+		path, err := BackupTo(s.Store, s.config.BackupDir, s.config.BackupsKept())
+		if err != nil {
+			log.Println("backup:", err)
+		} else {
+			log.Println("backed up to", path)
+		}
+	}
+}
+
+// Dump implements Archiver, all tables are read in one read only transaction so the dump is
+// a snapshot of the database even while it is written to
+func (m *migrator) Dump() (tables Tables, err error) {
+	tx, err := m.db.BeginTx(context.Background(), &sql.TxOptions{Isolation: sql.LevelRepeatableRead, ReadOnly: true})
+	if err != nil {
+		return Tables{}, err
+	}
+	defer tx.Rollback()
+	for _, query := range []struct {
+		sql  string
+		scan func(scan func(...interface{}) error) error
+	}{
+		{"select id, name, disabled, created_at, password_hash from users order by id",
+			func(scan func(...interface{}) error) error {
+				var u User
+				err := scan(&u.ID, &u.Name, &u.Disabled, &u.Created, &u.PasswordHash)
+				tables.Users = append(tables.Users, u)
+				return err
+			}},
+		{"select id, date, begin, eerste, laatste, terug, comment, inferred, deleted_at, vehicle_id, user_id from kilometers order by id",
+			func(scan func(...interface{}) error) error {
+				var k Kilometers
+				err := scan(&k.ID, &k.Date, &k.Begin, &k.Eerste, &k.Laatste, &k.Terug, &k.Comment, &k.Inferred, &k.DeletedAt, &k.VehicleID, &k.UserID)
+				tables.Kilometers = append(tables.Kilometers, k)
+				return err
+			}},
+		{"select id, date, begin, checkin, checkout, laatste, deleted_at, user_id from times order by id",
+			func(scan func(...interface{}) error) error {
+				var t Times
+				err := scan(&t.ID, &t.Date, &t.Begin, &t.CheckIn, &t.CheckOut, &t.Laatste, &t.DeletedAt, &t.UserID)
+				tables.Times = append(tables.Times, t)
+				return err
+			}},
+		{"select id, date, start_km, end_km, from_address, to_address, purpose, type, deleted_at, user_id from trips order by id",
+			func(scan func(...interface{}) error) error {
+				var t Trip
+				err := scan(&t.ID, &t.Date, &t.StartKm, &t.EndKm, &t.From, &t.To, &t.Purpose, &t.Type, &t.DeletedAt, &t.UserID)
+				tables.Trips = append(tables.Trips, t)
+				return err
+			}},
+		{"select id, date, at, kind, action, before, after, remote_addr, user_name, request_id, prev_hash, hash, user_id from audit order by id",
+			func(scan func(...interface{}) error) error {
+				var e AuditEntry
+				err := scan(&e.ID, &e.Date, &e.At, &e.Kind, &e.Action, &e.Before, &e.After, &e.RemoteAddr, &e.User, &e.RequestID, &e.PrevHash, &e.Hash, &e.UserID)
+				tables.Audit = append(tables.Audit, e)
+				return err
+			}},
+		{"select id, license_plate, make, start_date, end_date, start_km, active, user_id from vehicles order by id",
+			func(scan func(...interface{}) error) error {
+				var v Vehicle
+				err := scan(&v.ID, &v.LicensePlate, &v.Make, &v.StartDate, &v.EndDate, &v.StartKm, &v.Active, &v.UserID)
+				tables.Vehicles = append(tables.Vehicles, v)
+				return err
+			}},
+	} {
+		rows, err := tx.Query(query.sql)
+		if err != nil {
+			return Tables{}, err
+		}
+		for rows.Next() {
+			if err = query.scan(rows.Scan); err != nil {
+				rows.Close()
+				return Tables{}, err
+			}
+		}
+		rows.Close()
+		if err = rows.Err(); err != nil {
+			return Tables{}, err
+		}
+	}
+	return tables, nil
+}
+
+// Load implements Archiver
+func (m *migrator) Load(tables Tables) (err error) {
+	tx, err := m.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err != nil {
+			tx.Rollback()
+		}
+	}()
+	insert := func(table string, columns []string, values ...interface{}) error {
+		binds := make([]string, len(columns))
+		for i := range columns {
+			binds[i] = m.bindVar(i + 1)
+		}
+		_, err := tx.Exec(fmt.Sprintf("insert into %s (%s) values (%s)", table, strings.Join(columns, ", "), strings.Join(binds, ", ")), values...)
+		return err
+	}
+	for _, u := range tables.Users {
+		if err = insert("users", []string{"id", "name", "disabled", "created_at", "password_hash"}, u.ID, u.Name, u.Disabled, u.Created, u.PasswordHash); err != nil {
+			return fmt.Errorf("user %d: %s", u.ID, err)
+		}
+	}
+	for _, v := range tables.Vehicles {
+		if err = insert("vehicles", []string{"id", "license_plate", "make", "start_date", "end_date", "start_km", "active", "user_id"},
+			v.ID, v.LicensePlate, v.Make, truncateDate(v.StartDate), v.EndDate, v.StartKm, v.Active, v.UserID); err != nil {
+			return fmt.Errorf("vehicle %d: %s", v.ID, err)
+		}
+	}
+	for _, k := range tables.Kilometers {
+		if err = insert("kilometers", []string{"id", "date", "begin", "eerste", "laatste", "terug", "comment", "inferred", "deleted_at", "vehicle_id", "user_id"},
+			k.ID, truncateDate(k.Date), k.Begin, k.Eerste, k.Laatste, k.Terug, k.Comment, k.Inferred, k.DeletedAt, k.VehicleID, k.UserID); err != nil {
+			return fmt.Errorf("kilometers %d: %s", k.ID, err)
+		}
+	}
+	for _, t := range tables.Times {
+		if err = insert("times", []string{"id", "date", "begin", "checkin", "checkout", "laatste", "deleted_at", "user_id"},
+			t.ID, truncateDate(t.Date), t.Begin, t.CheckIn, t.CheckOut, t.Laatste, t.DeletedAt, t.UserID); err != nil {
+			return fmt.Errorf("times %d: %s", t.ID, err)
+		}
+	}
+	for _, t := range tables.Trips {
+		if err = insert("trips", []string{"id", "date", "start_km", "end_km", "from_address", "to_address", "purpose", "type", "deleted_at", "user_id"},
+			t.ID, truncateDate(t.Date), t.StartKm, t.EndKm, t.From, t.To, t.Purpose, t.Type, t.DeletedAt, t.UserID); err != nil {
+			return fmt.Errorf("trip %d: %s", t.ID, err)
+		}
+	}
+	for _, e := range tables.Audit {
+		if err = insert("audit", []string{"id", "date", "at", "kind", "action", "before", "after", "remote_addr", "user_name", "request_id", "prev_hash", "hash", "user_id"},
+			e.ID, truncateDate(e.Date), e.At, e.Kind, e.Action, e.Before, e.After, e.RemoteAddr, e.User, e.RequestID, e.PrevHash, e.Hash, e.UserID); err != nil {
+			return fmt.Errorf("audit entry %d: %s", e.ID, err)
+		}
+	}
+	if m.resetIDs != "" {
+		if _, err = tx.Exec(m.resetIDs); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// Dump implements Archiver
+func (m *MemoryStore) Dump() (Tables, error) {
+	m.Lock()
+	defer m.Unlock()
+	var tables Tables
+	for _, u := range m.users {
+		tables.Users = append(tables.Users, u)
+	}
+	sort.Sort(usersByID(tables.Users))
+	var owners []int
+	for user := range m.data {
+		owners = append(owners, int(user))
+	}
+	sort.Ints(owners)
+	for _, owner := range owners {
+		d := m.data[int64(owner)]
+		var dates []time.Time
+		for date := range d.kilometers {
+			dates = append(dates, date)
+		}
+		for date := range d.times {
+			if _, ok := d.kilometers[date]; !ok {
+				dates = append(dates, date)
+			}
+		}
+		sort.Sort(sort.Reverse(datesDesc(dates)))
+		for _, date := range dates {
+			if k, ok := d.kilometers[date]; ok {
+				tables.Kilometers = append(tables.Kilometers, k)
+			}
+			if t, ok := d.times[date]; ok {
+				tables.Times = append(tables.Times, t)
+			}
+		}
+		var trips []Trip
+		for _, t := range d.trips {
+			trips = append(trips, t)
+		}
+		sort.Sort(tripsInOrder(trips))
+		tables.Trips = append(tables.Trips, trips...)
+		tables.Audit = append(tables.Audit, d.audit...)
+		var vehicles []Vehicle
+		for _, v := range d.vehicles {
+			vehicles = append(vehicles, v)
+		}
+		sort.Sort(vehiclesInOrder(vehicles))
+		tables.Vehicles = append(tables.Vehicles, vehicles...)
+	}
+	return tables, nil
+}
+
+// Load implements Archiver
+func (m *MemoryStore) Load(tables Tables) error {
+	m.Lock()
+	defer m.Unlock()
+	data := make(map[int64]*memoryData)
+	for user, d := range m.data {
+		data[user] = d.copy()
+	}
+	rows := func(user int64) *memoryData {
+		if _, ok := data[user]; !ok {
+			data[user] = newMemoryData(m.memoryDB, user)
+		}
+		return data[user]
+	}
+	lastID := m.lastID
+	maxID := func(id int64) {
+		if id > lastID {
+			lastID = id
+		}
+	}
+	users := make(map[int64]User)
+	for id, u := range m.users {
+		users[id] = u
+	}
+	for _, u := range tables.Users {
+		users[u.ID] = u
+		maxID(u.ID)
+	}
+	for _, k := range tables.Kilometers {
+		k.Date = truncateDate(k.Date)
+		rows(k.UserID).kilometers[k.Date] = k
+		maxID(k.ID)
+	}
+	for _, t := range tables.Times {
+		t.Date = truncateDate(t.Date)
+		rows(t.UserID).times[t.Date] = t
+		maxID(t.ID)
+	}
+	for _, t := range tables.Trips {
+		t.Date = truncateDate(t.Date)
+		rows(t.UserID).trips[t.ID] = t
+		maxID(t.ID)
+	}
+	for _, e := range tables.Audit {
+		d := rows(e.UserID)
+		d.audit = append(d.audit, e)
+		maxID(e.ID)
+	}
+	for _, v := range tables.Vehicles {
+		rows(v.UserID).vehicles[v.ID] = v
+		maxID(v.ID)
+	}
+	m.data, m.users, m.lastID = data, users, lastID
+	return nil
+}
+
+// make sure the stores can be backed up
+var (
+	_ Archiver = (*PostgresStore)(nil)
+	_ Archiver = (*SqliteStore)(nil)
+	_ Archiver = (*MemoryStore)(nil)
+)
@@ -0,0 +1,176 @@
+package km
+
+import (
+	"archive/zip"
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// backupStore returns a store with a day, a day with a trip, a day in the trash and their audit log
+func backupStore(t *testing.T) *MemoryStore {
+	store := NewMemoryStore()
+	audited := Audited(store, Origin{User: "test"})
+	date := func(day int) time.Time { return time.Date(2014, time.January, day, 0, 0, 0, 0, time.UTC) }
+	if err := SaveKilometers(audited, date(2), []Field{Field{Name: "Begin", Km: 1000}, Field{Name: "Terug", Km: 1070}}); err != nil {
+		t.Fatal(err)
+	}
+	if err := SaveTimes(audited, date(2), []Field{Field{Name: "Begin", Time: "08:00"}}, time.UTC); err != nil {
+		t.Fatal(err)
+	}
+	if err := SaveTrip(audited, &Trip{Date: date(3), StartKm: 1070, EndKm: 1100, From: "Thuis", To: "A&B <Utrecht>", Type: TripBusiness}, 0, false); err != nil {
+		t.Fatal(err)
+	}
+	if err := SaveKilometers(audited, date(4), []Field{Field{Name: "Begin", Km: 1100}}); err != nil {
+		t.Fatal(err)
+	}
+	if err := audited.DeleteDate(date(4)); err != nil {
+		t.Fatal(err)
+	}
+	return store
+}
+
+func TestBackupRestore(t *testing.T) {
+	store := backupStore(t)
+	var b bytes.Buffer
+	manifest, err := Backup(store, &b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if manifest.Version != BackupVersion || len(manifest.Files) != len(backupFiles) {
+		t.Errorf("unexpected manifest: %+v", manifest)
+	}
+
+	restored := NewMemoryStore()
+	if _, err = Restore(restored, bytes.NewReader(b.Bytes()), int64(b.Len())); err != nil {
+		t.Fatal(err)
+	}
+	want, _ := store.Dump()
+	got, _ := restored.Dump()
+	if len(got.Kilometers) != len(want.Kilometers) || len(got.Times) != len(want.Times) || len(got.Trips) != len(want.Trips) || len(got.Audit) != len(want.Audit) {
+		t.Fatalf("got %+v, want %+v", got, want)
+	}
+	if got.Trips[0].ID != want.Trips[0].ID || got.Trips[0].To != want.Trips[0].To {
+		t.Errorf("trip: got %+v, want %+v", got.Trips[0], want.Trips[0])
+	}
+	if trash, _ := GetTrash(restored, time.UTC); len(trash) != 1 || trash[0].DeletedAt == nil {
+		t.Errorf("the trash is not restored: %+v", trash)
+	}
+	if problems, err := Verify(restored); err != nil || len(problems) > 0 {
+		t.Errorf("the restored audit log does not verify: %v %v", problems, err)
+	}
+	// new rows do not get the ids of restored ones
+	trip := Trip{Date: time.Date(2014, time.January, 5, 0, 0, 0, 0, time.UTC), StartKm: 1100, EndKm: 1110, Type: TripPrivate}
+	if err = SaveTrip(restored, &trip, 0, false); err != nil || trip.ID <= want.Trips[0].ID {
+		t.Errorf("new trip got id %d (%v), restored trip has %d", trip.ID, err, want.Trips[0].ID)
+	}
+
+	// only into an empty store
+	if _, err = Restore(restored, bytes.NewReader(b.Bytes()), int64(b.Len())); err == nil {
+		t.Error("a backup is restored into a store that is not empty")
+	}
+}
+
+// rezip copies the archive in b, changing the content of the files in changed
+func rezip(t *testing.T, b []byte, changed map[string]string) []byte {
+	archive, err := zip.NewReader(bytes.NewReader(b), int64(len(b)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var out bytes.Buffer
+	w := zip.NewWriter(&out)
+	for _, f := range archive.File {
+		rc, _ := f.Open()
+		content, _ := ioutil.ReadAll(rc)
+		rc.Close()
+		if c, ok := changed[f.Name]; ok {
+			if c == "" {
+				continue
+			}
+			content = []byte(c)
+		}
+		writeZipFile(w, f.Name, content)
+	}
+	w.Close()
+	return out.Bytes()
+}
+
+func TestRestoreDamaged(t *testing.T) {
+	var b bytes.Buffer
+	if _, err := Backup(backupStore(t), &b); err != nil {
+		t.Fatal(err)
+	}
+	var tests = []struct {
+		archive []byte
+		want    string
+	}{
+		{[]byte("not a zip"), "not a backup archive"},
+		{rezip(t, b.Bytes(), map[string]string{"manifest.json": ""}), "no manifest.json"},
+		{rezip(t, b.Bytes(), map[string]string{"manifest.json": `{"version": 4}`}), "version 4"},
+		{rezip(t, b.Bytes(), map[string]string{"trips.json": ""}), "trips.json is missing"},
+		{rezip(t, b.Bytes(), map[string]string{"kilometers.json": "[]"}), "kilometers.json does not match its checksum"},
+	}
+	for _, tt := range tests {
+		store := NewMemoryStore()
+		_, err := Restore(store, bytes.NewReader(tt.archive), int64(len(tt.archive)))
+		if err == nil || !strings.Contains(err.Error(), tt.want) {
+			t.Errorf("got %v, want %q", err, tt.want)
+		}
+		if tables, _ := store.Dump(); !tables.empty() {
+			t.Errorf("%q: a damaged archive is restored", tt.want)
+		}
+	}
+}
+
+func TestRestoreVersion1(t *testing.T) {
+	var b bytes.Buffer
+	manifest, err := Backup(backupStore(t), &b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the archives of version 1 have no vehicles
+	manifest.Version, manifest.Files = 1, manifest.Files[:4]
+	content, _ := json.Marshal(manifest)
+	archive := rezip(t, b.Bytes(), map[string]string{"manifest.json": string(content), "vehicles.json": ""})
+	store := NewMemoryStore()
+	if _, err = Restore(store, bytes.NewReader(archive), int64(len(archive))); err != nil {
+		t.Fatal(err)
+	}
+	if tables, _ := store.Dump(); len(tables.Kilometers) != 3 || len(tables.Vehicles) != 0 {
+		t.Errorf("unexpected restore of version 1: %+v", tables)
+	}
+}
+
+func TestBackupTo(t *testing.T) {
+	dir, err := ioutil.TempDir("", "km")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	for _, name := range []string{"km-backup-20140101T000000Z.zip", "km-backup-20140102T000000Z.zip", "notes.txt"} {
+		ioutil.WriteFile(filepath.Join(dir, name), nil, 0644)
+	}
+	path, err := BackupTo(backupStore(t), dir, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	entries, _ := ioutil.ReadDir(dir)
+	var names []string
+	for _, entry := range entries {
+		names = append(names, entry.Name())
+	}
+	if len(names) != 3 || names[0] != "km-backup-20140102T000000Z.zip" || names[1] != filepath.Base(path) || names[2] != "notes.txt" {
+		t.Errorf("got %v", names)
+	}
+	f, _ := os.Open(path)
+	defer f.Close()
+	info, _ := f.Stat()
+	if _, err = Restore(NewMemoryStore(), f, info.Size()); err != nil {
+		t.Errorf("the backup does not restore: %s", err)
+	}
+}
@@ -0,0 +1,254 @@
+package km
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"time"
+)
+
+// The audit log is a hash chain: every entry holds the hash of the entry before it, and
+// its own hash covers that and its contents. Changing or removing an entry breaks the
+// chain from there on, changing a saved row directly makes it differ from the row the
+// chain recorded last for it.
+
+// chain links e to last, the most recent entry of the audit log
+func chain(last, e AuditEntry) *AuditEntry {
+	e.PrevHash = last.Hash
+	e.Hash = e.chainHash()
+	return &e
+}
+
+// chainHash is the hash of the contents of e and the hash of the entry before it
+func (e AuditEntry) chainHash() string {
+	h := sha256.New()
+	for _, field := range []string{e.PrevHash, FormatURLDate(e.Date), e.At.UTC().Format(time.RFC3339Nano),
+		e.Kind, e.Action, string(e.Before), string(e.After), e.RemoteAddr, e.User, e.RequestID} {
+		// length prefixed, so no field can be moved into another
+		fmt.Fprintf(h, "%d:%s", len(field), field)
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// Problem is an entry of the audit log or a saved row that Verify found not to match the chain
+type Problem struct {
+	Date time.Time
+	Kind string
+	// Entry is the id of the audit entry with the problem, 0 when it is about a saved row
+	Entry  int64
+	Reason string
+}
+
+func (p Problem) String() string {
+	if p.Entry != 0 {
+		return fmt.Sprintf("audit entry %d (%s %s): %s", p.Entry, p.Kind, FormatURLDate(p.Date), p.Reason)
+	}
+	return fmt.Sprintf("%s %s: %s", p.Kind, FormatURLDate(p.Date), p.Reason)
+}
+
+// reasons of the problems found by Verify
+const (
+	reasonEdited    = "its contents do not match its hash, it was changed afterwards"
+	reasonUnlinked  = "it does not follow the entry before it, entries were removed or inserted"
+	reasonUnchained = "it is not chained to the entry before it"
+	reasonChanged   = "it does not match the chain, it was changed afterwards"
+	reasonUnsealed  = "it is not in the chain"
+	reasonMissing   = "it is in the chain but no longer saved"
+)
+
+// sealKey identifies the rows the chain records
+type sealKey struct {
+	date time.Time
+	kind string
+}
+
+// allDates is the range of dates the rows are looked up in
+var allDates = [2]time.Time{{}, time.Date(9999, time.December, 31, 0, 0, 0, 0, time.UTC)}
+
+// sealed returns the row the chain recorded last for every date and kind, empty when it was
+// deleted. Entries from before the chain existed are not in it.
+func sealed(entries []AuditEntry) map[sealKey]auditValue {
+	rows := make(map[sealKey]auditValue)
+	for _, e := range entries {
+		if e.Hash != "" {
+			rows[sealKey{truncateDate(e.Date), e.Kind}] = e.After
+		}
+	}
+	return rows
+}
+
+// sameRow tells whether row is the one recorded, as it was encoded in the chain. The user
+// a row belongs to is not recorded.
+func sameRow(recorded auditValue, row interface{}) bool {
+	switch row := row.(type) {
+	case Kilometers:
+		var k Kilometers
+		if err := json.Unmarshal([]byte(recorded), &k); err != nil {
+			return false
+		}
+		k.Date, row.Date, row.DeletedAt, row.UserID = truncateDate(k.Date), truncateDate(row.Date), nil, 0
+		return k == row
+	case Times:
+		var t Times
+		if err := json.Unmarshal([]byte(recorded), &t); err != nil {
+			return false
+		}
+		t.Date, row.Date, row.DeletedAt, row.UserID = truncateDate(t.Date), truncateDate(row.Date), nil, 0
+		return t == row
+	case []Trip:
+		var trips []Trip
+		if err := json.Unmarshal([]byte(recorded), &trips); err != nil || len(trips) != len(row) {
+			return false
+		}
+		for i, t := range trips {
+			r := row[i]
+			t.Date, r.Date, r.DeletedAt, r.UserID = truncateDate(t.Date), truncateDate(r.Date), nil, 0
+			if t != r {
+				return false
+			}
+		}
+		return true
+	}
+	return false
+}
+
+// savedRows returns all kilometers, times and trips saved, outside the trash, by date and kind
+func savedRows(ex Executor) (map[sealKey]interface{}, error) {
+	rows := make(map[sealKey]interface{})
+	kms, err := ex.KilometersBetween(allDates[0], allDates[1])
+	if err != nil {
+		return nil, err
+	}
+	for _, k := range kms {
+		rows[sealKey{truncateDate(k.Date), "kilometers"}] = k
+	}
+	times, err := ex.TimesBetween(allDates[0], allDates[1])
+	if err != nil {
+		return nil, err
+	}
+	for _, t := range times {
+		rows[sealKey{truncateDate(t.Date), "times"}] = t
+	}
+	trips, err := ex.TripsBetween(allDates[0], allDates[1])
+	if err != nil {
+		return nil, err
+	}
+	for _, t := range trips {
+		key := sealKey{truncateDate(t.Date), "trips"}
+		day, _ := rows[key].([]Trip)
+		rows[key] = append(day, t)
+	}
+	return rows, nil
+}
+
+// sortedKeys returns the keys of both rows and recorded, by date and kind
+func sortedKeys(rows map[sealKey]interface{}, recorded map[sealKey]auditValue) []sealKey {
+	seen := make(map[sealKey]bool)
+	var keys []sealKey
+	for key := range rows {
+		seen[key] = true
+		keys = append(keys, key)
+	}
+	for key := range recorded {
+		if !seen[key] {
+			keys = append(keys, key)
+		}
+	}
+	sort.Sort(byDateAndKind(keys))
+	return keys
+}
+
+// byDateAndKind sorts seal keys by date, oldest first, and then by kind
+type byDateAndKind []sealKey
+
+func (k byDateAndKind) Len() int      { return len(k) }
+func (k byDateAndKind) Swap(i, j int) { k[i], k[j] = k[j], k[i] }
+func (k byDateAndKind) Less(i, j int) bool {
+	if !k[i].date.Equal(k[j].date) {
+		return k[i].date.Before(k[j].date)
+	}
+	return k[i].kind < k[j].kind
+}
+
+// Verify checks that the audit log is an unbroken chain, and that the kilometers, times and trips
+// saved for every date are what the chain recorded last for them. It returns the problems found,
+// oldest first.
+func Verify(ex Executor) ([]Problem, error) {
+	entries, err := ex.AuditLog()
+	if err != nil {
+		return nil, CustomResponse(DbError, err)
+	}
+	var problems []Problem
+	prev, chained := "", false
+	for _, e := range entries {
+		problem := Problem{Date: e.Date, Kind: e.Kind, Entry: e.ID}
+		switch {
+		case e.Hash == "" && chained:
+			problem.Reason = reasonUnchained
+		case e.Hash == "":
+			// logged before the chain existed
+			continue
+		case e.PrevHash != prev:
+			problem.Reason = reasonUnlinked
+		case e.chainHash() != e.Hash:
+			problem.Reason = reasonEdited
+		}
+		if problem.Reason != "" {
+			problems = append(problems, problem)
+		}
+		prev, chained = e.Hash, true
+	}
+
+	rows, err := savedRows(ex)
+	if err != nil {
+		return nil, CustomResponse(DbError, err)
+	}
+	recorded := sealed(entries)
+	for _, key := range sortedKeys(rows, recorded) {
+		row, saved := rows[key]
+		after, inChain := recorded[key]
+		problem := Problem{Date: key.date, Kind: key.kind}
+		switch {
+		case saved && !inChain:
+			problem.Reason = reasonUnsealed
+		case saved && !sameRow(after, row):
+			problem.Reason = reasonChanged
+		case !saved && after != "":
+			problem.Reason = reasonMissing
+		default:
+			continue
+		}
+		problems = append(problems, problem)
+	}
+	return problems, nil
+}
+
+// Seal adds the kilometers and times that are not in the chain, like the ones saved before it
+// existed, to it as coming from origin. It returns the number of rows sealed.
+func Seal(store Store, origin Origin) (count int, err error) {
+	err = inTx(store, func(tx Tx) error {
+		entries, err := tx.AuditLog()
+		if err != nil {
+			return CustomResponse(DbError, err)
+		}
+		rows, err := savedRows(tx)
+		if err != nil {
+			return CustomResponse(DbError, err)
+		}
+		recorded := sealed(entries)
+		a := auditTx{tx, origin}
+		for _, key := range sortedKeys(rows, nil) {
+			if _, inChain := recorded[key]; inChain {
+				continue
+			}
+			if err := a.record(key.date, key.kind, "seal", nil, rows[key]); err != nil {
+				return CustomResponse(DbError, err)
+			}
+			count++
+		}
+		return nil
+	})
+	return count, err
+}
@@ -0,0 +1,75 @@
+package km
+
+import (
+	"testing"
+	"time"
+)
+
+func TestVerify(t *testing.T) {
+	memory := NewMemoryStore()
+	date := time.Date(2014, time.January, 1, 0, 0, 0, 0, time.UTC)
+	// saved before there was a chain
+	memory.PutKilometers(&Kilometers{Date: date.AddDate(0, 0, -1), Begin: 900})
+	if problems, _ := Verify(memory); len(problems) != 1 || problems[0].Reason != reasonUnsealed {
+		t.Errorf("expected the unsealed row to be reported, got: %v", problems)
+	}
+	if sealed, err := Seal(memory, Origin{User: "km seal"}); err != nil || sealed != 1 {
+		t.Errorf("expected 1 row sealed, got: %d, %v", sealed, err)
+	}
+
+	store := Audited(memory, Origin{RequestID: "abc"})
+	store.PutKilometers(&Kilometers{Date: date, Begin: 1000})
+	store.PutKilometers(&Kilometers{Date: date, Begin: 1000, Terug: 1050})
+	store.PutTimes(&Times{Date: date, Begin: 1388563200})
+	trip := Trip{Date: date, StartKm: 1000, EndKm: 1050, Type: TripBusiness}
+	store.PutTrip(&trip)
+	store.PutKilometers(&Kilometers{Date: date.AddDate(0, 0, 1), Begin: 1050})
+	store.DeleteDate(date.AddDate(0, 0, 1))
+	if problems, err := Verify(memory); err != nil || len(problems) != 0 {
+		t.Fatalf("expected an unbroken chain, got: %v, %v", problems, err)
+	}
+	if sealed, _ := Seal(memory, Origin{}); sealed != 0 {
+		t.Errorf("expected nothing left to seal, got: %d", sealed)
+	}
+
+	// a row changed behind the chain's back
+	k := memory.rows().kilometers[date]
+	k.Terug = 1040
+	memory.rows().kilometers[date] = k
+	// a row that was deleted in the chain brought back
+	deleted := memory.rows().kilometers[date.AddDate(0, 0, 1)]
+	deleted.DeletedAt = nil
+	memory.rows().kilometers[date.AddDate(0, 0, 1)] = deleted
+	// a trip changed
+	trip.Purpose = "holiday"
+	memory.rows().trips[trip.ID] = trip
+	// a row removed
+	delete(memory.rows().times, date)
+	// an entry of the log edited
+	edited, unlinked := memory.rows().audit[2].ID, memory.rows().audit[6].ID
+	memory.rows().audit[2].After = auditValue(`{"Begin": 950}`)
+	// and one removed
+	memory.rows().audit = append(memory.rows().audit[:5], memory.rows().audit[6:]...)
+
+	problems, err := Verify(memory)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []Problem{
+		{Entry: edited, Reason: reasonEdited},
+		{Entry: unlinked, Reason: reasonUnlinked},
+		{Date: date, Kind: "kilometers", Reason: reasonChanged},
+		{Date: date, Kind: "times", Reason: reasonMissing},
+		{Date: date, Kind: "trips", Reason: reasonChanged},
+		{Date: date.AddDate(0, 0, 1), Kind: "kilometers", Reason: reasonChanged},
+	}
+	if len(problems) != len(want) {
+		t.Fatalf("expected %d problems, got: %v", len(want), problems)
+	}
+	for i, w := range want {
+		p := problems[i]
+		if p.Entry != w.Entry || p.Reason != w.Reason || (w.Entry == 0 && (!p.Date.Equal(w.Date) || p.Kind != w.Kind)) {
+			t.Errorf("problem %d: got %v, want %v", i, p, w)
+		}
+	}
+}
@@ -0,0 +1,201 @@
+package km
+
+import (
+	"database/sql"
+	"sort"
+	"time"
+)
+
+// Day is everything saved for a date, it is the resource of the api
+type Day struct {
+	Date     time.Time `json:"date"`
+	Readings Readings  `json:"readings"`
+	Times    Stamps    `json:"times"`
+	// Hours is the time worked, it is ignored when a day is saved
+	Hours float64 `json:"hours"`
+	// DeletedAt is set for days in the trash
+	DeletedAt *time.Time `json:"deletedAt,omitempty"`
+	// Vehicle is the id of the vehicle driven, it is ignored when a day is saved
+	Vehicle int64 `json:"vehicle,omitempty"`
+}
+
+// Readings are the odometer readings of a day, 0 when not saved
+type Readings struct {
+	Begin   int `json:"begin"`
+	Eerste  int `json:"eerste"`
+	Laatste int `json:"laatste"`
+	Terug   int `json:"terug"`
+	// Inferred is set when Terug was copied from the next day, it is ignored when a day is saved
+	Inferred bool `json:"inferred"`
+}
+
+// Stamps are the times of a day, in the format posted to /save, empty when not saved
+type Stamps struct {
+	Begin   string `json:"begin"`
+	Eerste  string `json:"eerste"`
+	Laatste string `json:"laatste"`
+	Terug   string `json:"terug"`
+}
+
+func (r Readings) km(name string) int {
+	switch name {
+	case "Begin":
+		return r.Begin
+	case "Eerste":
+		return r.Eerste
+	case "Laatste":
+		return r.Laatste
+	case "Terug":
+		return r.Terug
+	}
+	return 0
+}
+
+func (s Stamps) time(name string) string {
+	switch name {
+	case "Begin":
+		return s.Begin
+	case "Eerste":
+		return s.Eerste
+	case "Laatste":
+		return s.Laatste
+	case "Terug":
+		return s.Terug
+	}
+	return ""
+}
+
+// newDay combines the kilometers and times saved for date, times are shown in the time zone loc
+func newDay(date time.Time, k Kilometers, t Times, loc *time.Location) Day {
+	convertTime := func(t int64) string {
+		ret := ""
+		if t != 0 {
+			ret = clockTime(t, date, loc)
+		}
+		return ret
+	}
+	day := Day{
+		Date:     truncateDate(date),
+		Readings: Readings{Begin: k.Begin, Eerste: k.Eerste, Laatste: k.Laatste, Terug: k.Terug, Inferred: k.Inferred},
+		Times:    Stamps{Begin: convertTime(t.Begin), Eerste: convertTime(t.CheckIn), Laatste: convertTime(t.CheckOut), Terug: convertTime(t.Laatste)},
+		Hours:    t.hours(),
+		Vehicle:  k.VehicleID,
+	}
+	if k.DeletedAt != nil {
+		day.DeletedAt = k.DeletedAt
+	} else {
+		day.DeletedAt = t.DeletedAt
+	}
+	return day
+}
+
+// GetDay returns the day saved for date, saved is false when there is nothing saved for it
+func GetDay(ex Executor, date time.Time, loc *time.Location) (day Day, saved bool, err error) {
+	k, kErr := ex.GetKilometers(date)
+	if kErr != nil && kErr != sql.ErrNoRows {
+		return Day{}, false, CustomResponse(DbError, kErr)
+	}
+	t, tErr := ex.GetTimes(date)
+	if tErr != nil && tErr != sql.ErrNoRows {
+		return Day{}, false, CustomResponse(DbError, tErr)
+	}
+	saved = kErr == nil || tErr == nil
+	return newDay(date, k, t, loc), saved, nil
+}
+
+// GetDays returns the days saved from one date up to and including another, most recent first
+func GetDays(ex Executor, from, to time.Time, loc *time.Location) ([]Day, error) {
+	kms, err := ex.KilometersBetween(from, to)
+	if err != nil {
+		return nil, CustomResponse(DbError, err)
+	}
+	times, err := ex.TimesBetween(from, to)
+	if err != nil {
+		return nil, CustomResponse(DbError, err)
+	}
+	return mergeDays(kms, times, loc), nil
+}
+
+// GetTrash returns the days in the trash, most recent first
+func GetTrash(ex Executor, loc *time.Location) ([]Day, error) {
+	kms, err := ex.DeletedKilometers()
+	if err != nil {
+		return nil, CustomResponse(DbError, err)
+	}
+	times, err := ex.DeletedTimes()
+	if err != nil {
+		return nil, CustomResponse(DbError, err)
+	}
+	return mergeDays(kms, times, loc), nil
+}
+
+// mergeDays combines kilometers and times into days, most recent first
+func mergeDays(kms []Kilometers, times []Times, loc *time.Location) []Day {
+	kmsByDate := make(map[time.Time]Kilometers)
+	timesByDate := make(map[time.Time]Times)
+	var dates []time.Time
+	for _, k := range kms {
+		date := truncateDate(k.Date)
+		kmsByDate[date] = k
+		dates = append(dates, date)
+	}
+	for _, t := range times {
+		date := truncateDate(t.Date)
+		if _, ok := kmsByDate[date]; !ok {
+			dates = append(dates, date)
+		}
+		timesByDate[date] = t
+	}
+	sort.Sort(datesDesc(dates))
+
+	days := make([]Day, 0, len(dates))
+	for _, date := range dates {
+		days = append(days, newDay(date, kmsByDate[date], timesByDate[date], loc))
+	}
+	return days
+}
+
+// RestoreDay takes the day saved for date out of the trash, it returns a NoDay response
+// when it is not in the trash
+func RestoreDay(ex Executor, date time.Time) error {
+	err := ex.RestoreDate(date)
+	switch {
+	case err == sql.ErrNoRows:
+		return NoDay
+	case err != nil:
+		return CustomResponse(DbError, err)
+	}
+	return nil
+}
+
+// PurgeTrash permanently deletes the days that are in the trash for longer than retention,
+// of all users
+func PurgeTrash(store Store, retention time.Duration) (purged int64, err error) {
+	before := time.Now().Add(-retention)
+	err = ForEachOwner(store, func(owner User, store Store) error {
+		n, err := store.PurgeDeleted(before)
+		purged += n
+		return err
+	})
+	if err != nil {
+		return purged, CustomResponse(DbError, err)
+	}
+	return purged, nil
+}
+
+// changedFields returns the fields to save to change day into changed, one for every
+// name of which the reading or the time is different
+func changedFields(day, changed Day) []Field {
+	var fields []Field
+	for _, name := range timeFields {
+		km, clock := changed.Readings.km(name), changed.Times.time(name)
+		if km == day.Readings.km(name) && clock == day.Times.time(name) {
+			continue
+		}
+		if clock == "" {
+			clock = "-"
+		}
+		fields = append(fields, Field{Km: km, Time: clock, Name: name})
+	}
+	return fields
+}
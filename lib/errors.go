@@ -1,13 +1,23 @@
 package km
 
-import "fmt"
-import "regexp"
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"regexp"
+	"strings"
+)
 
 // Response a custum error response that gives some more ditails on the error
 type Response struct {
-	Code  int
+	Code int
+	// Name is the machine readable code of the error, send to clients in the ErrorBody
+	Name  string
 	Regex *regexp.Regexp
 	Extra string
+	// Fields lists the fields that are rejected, if any
+	Fields []FieldError
 }
 
 // String impletent the Stringer interface for easy printing
@@ -15,33 +25,107 @@ func (r Response) String() string {
 	return fmt.Sprintf("%s : %s", r.Regex.String(), r.Extra)
 }
 
+// Body is the text send to the client, the error followed by a line per rejected field
+func (r Response) Body() string {
+	body := r.Error()
+	for _, f := range r.Fields {
+		body += fmt.Sprintf("%s: %s\n", f.Field, f.Reason)
+	}
+	return body
+}
+
 // Error implements the error interface
 func (r Response) Error() string {
 	return r.Regex.String()
 }
 
+// ErrorBody is the error envelope send to clients that accept JSON
+type ErrorBody struct {
+	Code    string       `json:"code"`
+	Error   string       `json:"error"`
+	Details string       `json:"details,omitempty"`
+	Field   string       `json:"field,omitempty"`
+	Fields  []FieldError `json:"fields,omitempty"`
+}
+
+// Envelope converts the response to the envelope send to JSON clients
+// Field is the first rejected field, Fields lists all of them
+func (r Response) Envelope() ErrorBody {
+	body := ErrorBody{Code: r.Name, Error: strings.TrimSpace(r.Error()), Details: r.Extra, Fields: r.Fields}
+	if len(r.Fields) > 0 {
+		body.Field = r.Fields[0].Field
+	}
+	return body
+}
+
+// WriteError writes an error to the client, as an ErrorBody when the request accepts JSON
+// and as text otherwise, errors that are no Response are written as a DbError
+func WriteError(w http.ResponseWriter, req *http.Request, err error) {
+	response, ok := err.(Response)
+	if !ok {
+		response = CustomResponse(DbError, err)
+	}
+	log.Println(req.Method, req.URL, response)
+	if !strings.Contains(req.Header.Get("Accept"), "application/json") {
+		http.Error(w, response.Body(), response.Code)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.WriteHeader(response.Code)
+	json.NewEncoder(w).Encode(response.Envelope())
+}
+
 // newResponse creates a new Response object
-func newResponse(regex string, code int) Response {
-	r := Response{Code: code}
+func newResponse(name, regex string, code int) Response {
+	r := Response{Code: code, Name: name}
 	r.Regex = regexp.MustCompile(regex)
 	return r
 }
 
 var (
 	// NotFound standard 404 not found
-	NotFound = newResponse("^404 page not found\n$", 404)
+	NotFound = newResponse("not_found", "404 page not found\n", 404)
+	// MethodNotAllowed 405 the url does not support the method of the request
+	MethodNotAllowed = newResponse("method_not_allowed", "method not allowed\n", 405)
+	// NoDay 404 nothing is saved for the requested date
+	NoDay = newResponse("no_day", "nothing saved for this date\n", 404)
+	// NoTrip 404 there is no trip with the requested id
+	NoTrip = newResponse("no_trip", "no trip with this id\n", 404)
+	// NoVehicle 404 there is no vehicle with the requested id
+	NoVehicle = newResponse("no_vehicle", "no vehicle with this id\n", 404)
 	// Ok 200 ok
-	Ok = newResponse("ok\n", 200)
+	Ok = newResponse("ok", "ok\n", 200)
 	// UnknownField 400 an unknown field encountered in supplied data
-	UnknownField = newResponse("invalid fieldname\n", 400)
+	UnknownField = newResponse("unknown_field", "invalid fieldname\n", 400)
 	// NotParsable 400 could not parse request
-	NotParsable = newResponse("could not parse request\n", 400)
+	NotParsable = newResponse("not_parsable", "could not parse request\n", 400)
 	// InvalidDate coudl not parse the date provided
-	InvalidDate = newResponse("invalid date\n", 400)
+	InvalidDate = newResponse("invalid_date", "invalid date\n", 400)
 	// InvalidURL 400 invalid url, correct structure, but invalid
-	InvalidURL = newResponse("invalid url", 400)
+	InvalidURL = newResponse("invalid_url", "invalid url", 400)
+	// InvalidReading 400 kilometers posted are not consistent with the ones already saved
+	InvalidReading = newResponse("invalid_reading", "invalid reading\n", 400)
+	// InvalidTrip 400 the trip posted goes back or overlaps another trip
+	InvalidTrip = newResponse("invalid_trip", "invalid trip\n", 400)
+	// InvalidVehicle 400 the vehicle posted has no license plate or start date, or ends before it starts
+	InvalidVehicle = newResponse("invalid_vehicle", "invalid vehicle\n", 400)
+	// InvalidTimeZone 400 the requested time zone is unknown
+	InvalidTimeZone = newResponse("invalid_time_zone", "invalid time zone\n", 400)
+	// DayHasTrips 409 the day is split in trips already
+	DayHasTrips = newResponse("day_has_trips", "this day has trips already, change their type instead\n", 409)
+	// Unauthorized 401 the request has no valid session
+	Unauthorized = newResponse("unauthorized", "not logged in\n", 401)
+	// SetupRequired 503 there are no user accounts to log in with yet
+	SetupRequired = newResponse("setup_required", "there are no accounts yet, add one with: km users add\n", 503)
+	// InvalidLogin 401 the user name or password to log in with is wrong
+	InvalidLogin = newResponse("invalid_login", "invalid user name or password\n", 401)
+	// UserDisabled 403 the account of the user making the request is disabled
+	UserDisabled = newResponse("user_disabled", "this account is disabled\n", 403)
 	// DbError error connecting to database
-	DbError = newResponse("database eror", 500)
+	DbError = newResponse("db_error", "database eror", 500)
+	// ReportError 500 the report could not be generated
+	ReportError = newResponse("report_error", "could not generate report\n", 500)
 )
 
 // CustomResponse takes a error and adds extra fields to convert it to a custom Response object
@@ -0,0 +1,135 @@
+package km
+
+import (
+	"encoding/csv"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// ExportDay is a day as it is exported, with its distance and comment
+type ExportDay struct {
+	Day
+	// Distance is the km driven from the first reading of the day to the last one
+	Distance int
+	Comment  string
+}
+
+// GetExportDays returns the days saved from one date up to and including another, oldest first,
+// with times in the time zone loc
+func GetExportDays(ex Executor, from, to time.Time, loc *time.Location) ([]ExportDay, error) {
+	kms, err := ex.KilometersBetween(from, to)
+	if err != nil {
+		return nil, CustomResponse(DbError, err)
+	}
+	times, err := ex.TimesBetween(from, to)
+	if err != nil {
+		return nil, CustomResponse(DbError, err)
+	}
+	kmsByDate := make(map[time.Time]Kilometers)
+	for _, k := range kms {
+		kmsByDate[truncateDate(k.Date)] = k
+	}
+	days := mergeDays(kms, times, loc)
+	export := make([]ExportDay, 0, len(days))
+	for i := len(days) - 1; i >= 0; i-- {
+		k := kmsByDate[days[i].Date]
+		day := ExportDay{Day: days[i], Comment: k.Comment}
+		if first := firstReading(k); first != 0 {
+			day.Distance = k.getMax() - first
+		}
+		export = append(export, day)
+	}
+	return export, nil
+}
+
+// exportColumns are the columns of an export, in order
+var exportColumns = []string{"date", "begin", "eerste", "laatste", "terug", "distance",
+	"begin time", "eerste time", "laatste time", "terug time", "hours", "comment"}
+
+// record returns the columns of d, readings that are not saved are left empty
+func (d ExportDay) record() []string {
+	km := func(km int) string {
+		if km == 0 {
+			return ""
+		}
+		return strconv.Itoa(km)
+	}
+	return []string{FormatURLDate(d.Date),
+		km(d.Readings.Begin), km(d.Readings.Eerste), km(d.Readings.Laatste), km(d.Readings.Terug),
+		strconv.Itoa(d.Distance),
+		d.Times.Begin, d.Times.Eerste, d.Times.Laatste, d.Times.Terug,
+		strconv.FormatFloat(d.Hours, 'f', 2, 64),
+		d.Comment}
+}
+
+// WriteCSV writes days as CSV, with a header
+func WriteCSV(w io.Writer, days []ExportDay) error {
+	writer := csv.NewWriter(w)
+	writer.Write(exportColumns)
+	for _, day := range days {
+		writer.Write(day.record())
+	}
+	writer.Flush()
+	return writer.Error()
+}
+
+// ParsePeriod parses a year, like 2014, or a month, like 2014-01, into its first and last date.
+// name is the name of a file to export the period to, without extension.
+func ParsePeriod(period string) (err error, from, to time.Time, name string) {
+	if from, err = time.Parse("2006-01", period); err == nil {
+		return nil, from, from.AddDate(0, 1, -1), "km-" + period
+	}
+	if from, err = time.Parse("2006", period); err == nil {
+		return nil, from, from.AddDate(1, 0, -1), "km-" + period
+	}
+	return CustomResponse(InvalidDate, err), from, to, ""
+}
+
+// exportRange returns the dates to export for r, a year like year=2014, a month like
+// month=2014-01, or from and to. name is the name of the file to export to, without extension.
+func exportRange(r *http.Request) (err error, from, to time.Time, name string) {
+	for _, param := range []string{"month", "year"} {
+		if period := r.URL.Query().Get(param); period != "" {
+			return ParsePeriod(period)
+		}
+	}
+	if r.URL.Query().Get("from") == "" || r.URL.Query().Get("to") == "" {
+		response := InvalidURL
+		response.Extra = "a year, a month or both from and to are required"
+		return response, from, to, ""
+	}
+	if err = queryDates(r, &from, &to); err != nil {
+		return err, from, to, ""
+	}
+	return nil, from, to, fmt.Sprintf("km-%s-%s", FormatURLDate(from), FormatURLDate(to))
+}
+
+// attachment sets the headers of a download of file name with content type contentType
+func attachment(w http.ResponseWriter, contentType, name string) {
+	w.Header().Set("Content-Type", contentType)
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", name))
+}
+
+// exportCSVHandler downloads the days of a month or date range as CSV
+func (s *Server) exportCSVHandler(w http.ResponseWriter, r *http.Request) {
+	err, from, to, name := exportRange(r)
+	if err != nil {
+		WriteError(w, r, err)
+		return
+	}
+	err, loc := s.requestLocation(r)
+	if err != nil {
+		WriteError(w, r, err)
+		return
+	}
+	days, err := GetExportDays(s.store(r), from, to, loc)
+	if err != nil {
+		WriteError(w, r, err)
+		return
+	}
+	attachment(w, "text/csv; charset=utf-8", name+".csv")
+	WriteCSV(w, days)
+}
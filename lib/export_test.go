@@ -0,0 +1,105 @@
+package km
+
+import (
+	"bytes"
+	"encoding/csv"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestGetExportDays(t *testing.T) {
+	store := NewMemoryStore()
+	date := func(day int) time.Time { return time.Date(2014, time.January, day, 0, 0, 0, 0, time.UTC) }
+	store.PutKilometers(&Kilometers{Date: date(2), Begin: 1000, Eerste: 1030, Laatste: 1040, Terug: 1070, Comment: "klant"})
+	store.PutKilometers(&Kilometers{Date: date(3), Eerste: 1100})
+	store.PutKilometers(&Kilometers{Date: date(31), Begin: 1200})
+	store.PutTimes(&Times{Date: date(4), Begin: date(4).Add(8 * time.Hour).Unix()})
+
+	days, err := GetExportDays(store, date(1), date(30), time.UTC)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(days) != 3 {
+		t.Fatalf("got %d days, want 3", len(days))
+	}
+	for i, want := range []struct {
+		date     time.Time
+		distance int
+		comment  string
+	}{{date(2), 70, "klant"}, {date(3), 0, ""}, {date(4), 0, ""}} {
+		if got := days[i]; !got.Date.Equal(want.date) || got.Distance != want.distance || got.Comment != want.comment {
+			t.Errorf("%d: got %+v, want %+v", i, got, want)
+		}
+	}
+	if days[2].Times.Begin != "08:00" {
+		t.Errorf("time of %s: got %q, want %q", FormatURLDate(date(4)), days[2].Times.Begin, "08:00")
+	}
+}
+
+func TestWriteCSV(t *testing.T) {
+	days := []ExportDay{ExportDay{
+		Day: Day{
+			Date:     time.Date(2014, time.January, 2, 0, 0, 0, 0, time.UTC),
+			Readings: Readings{Begin: 1000, Terug: 1070},
+			Times:    Stamps{Begin: "08:00", Terug: "17:30"},
+			Hours:    8.5,
+		},
+		Distance: 70,
+		Comment:  "klant, Utrecht",
+	}}
+	var b bytes.Buffer
+	if err := WriteCSV(&b, days); err != nil {
+		t.Fatal(err)
+	}
+	want := "date,begin,eerste,laatste,terug,distance,begin time,eerste time,laatste time,terug time,hours,comment\n" +
+		"2014-01-02,1000,,,1070,70,08:00,,,17:30,8.50,\"klant, Utrecht\"\n"
+	if b.String() != want {
+		t.Errorf("got:\n%s\nwant:\n%s", b.String(), want)
+	}
+}
+
+func TestExportCSVHandler(t *testing.T) {
+	initServer(t)
+	apiRequest(t, "PUT", "/api/v1/days/2014-01-02/readings", `{"begin": 1000, "terug": 1070}`, nil)
+	apiRequest(t, "PUT", "/api/v1/days/2014-02-03/readings", `{"begin": 1100, "terug": 1150}`, nil)
+
+	var tests = []struct {
+		url      string
+		code     int
+		filename string
+		rows     int
+	}{
+		{"/api/v1/export.csv?month=2014-01", 200, "km-2014-01.csv", 2},
+		{"/api/v1/export.csv?from=2014-01-01&to=2014-02-28", 200, "km-2014-01-01-2014-02-28.csv", 3},
+		{"/api/v1/export.csv?month=2014-03", 200, "km-2014-03.csv", 1},
+		{"/api/v1/export.csv?month=januari", InvalidDate.Code, "", 0},
+		{"/api/v1/export.csv?from=2014-01-01", InvalidURL.Code, "", 0},
+		{"/api/v1/export.csv?from=2014-02-01&to=2014-01-01", InvalidURL.Code, "", 0},
+	}
+	for _, tt := range tests {
+		req, _ := http.NewRequest("GET", tt.url, nil)
+		w := serve(req)
+		if w.Code != tt.code {
+			t.Errorf("GET %s: code = %d, want %d", tt.url, w.Code, tt.code)
+			continue
+		}
+		if tt.code != 200 {
+			continue
+		}
+		if got := w.Header().Get("Content-Type"); !strings.HasPrefix(got, "text/csv") {
+			t.Errorf("GET %s: Content-Type = %q, want text/csv", tt.url, got)
+		}
+		if got, want := w.Header().Get("Content-Disposition"), `attachment; filename="`+tt.filename+`"`; got != want {
+			t.Errorf("GET %s: Content-Disposition = %q, want %q", tt.url, got, want)
+		}
+		records, err := csv.NewReader(w.Body).ReadAll()
+		if err != nil {
+			t.Fatalf("GET %s: %s", tt.url, err)
+		}
+		if len(records) != tt.rows {
+			t.Errorf("GET %s: got %d rows, want %d", tt.url, len(records), tt.rows)
+		}
+	}
+}
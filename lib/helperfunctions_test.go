@@ -5,20 +5,41 @@ import (
 	"log"
 	"os"
 	"testing"
+	"time"
 
 	"github.com/DATA-DOG/go-sqlmock"
 	"github.com/coopernurse/gorp"
 )
 
+// amsterdam is the default time zone, the unix times in the tests are for this zone
+var amsterdam, _ = time.LoadLocation(DefaultTimeZone)
+
+// vehicleColumns are the columns of the vehicles table
+var vehicleColumns = []string{"id", "license_plate", "make", "start_date", "end_date", "start_km", "active", "user_id"}
+
+// expectSession expects the lookup of the session of a request made with testCookie, and of
+// testUser it belongs to
+func expectSession() {
+	now := time.Now()
+	sqlmock.ExpectQuery("select \\* from sessions where token_hash=(.+)").
+		WithArgs(hashToken(testCookie.Value)).
+		WillReturnRows(sqlmock.NewRows([]string{"token_hash", "user_id", "created_at", "expires_at"}).
+			AddRow(hashToken(testCookie.Value), testUser.ID, now, now.Add(time.Hour)))
+	sqlmock.ExpectQuery("select \\* from users where id=(.+)").
+		WithArgs(testUser.ID).
+		WillReturnRows(sqlmock.NewRows([]string{"id", "name", "disabled", "created_at", "password_hash"}).
+			AddRow(testUser.ID, testUser.Name, false, now, testUser.PasswordHash))
+}
+
 func MockSetup(table string) (err error, dbmap *gorp.DbMap, columns []string) {
 	db, err := sqlmock.New()
 	if err != nil {
 		return
 	}
 	if table == "kilometers" {
-		columns = []string{"Id", "Date", "Begin", "Eerste", "Laatste", "Terug", "Comment"}
+		columns = []string{"Id", "Date", "Begin", "Eerste", "Laatste", "Terug", "Comment", "Inferred", "deleted_at", "vehicle_id", "user_id"}
 	} else if table == "times" {
-		columns = []string{"Id", "Date", "Begin", "CheckIn", "CheckOut", "Laatste"}
+		columns = []string{"Id", "Date", "Begin", "CheckIn", "CheckOut", "Laatste", "deleted_at", "user_id"}
 
 	}
 	dbmap = &gorp.DbMap{Db: db, Dialect: gorp.PostgresDialect{}}
@@ -0,0 +1,313 @@
+package km
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ImportRow is a day to import, from CSV or JSON
+type ImportRow struct {
+	// Date is written as 2006-01-02, or as an RFC 3339 timestamp like the api returns
+	Date     string   `json:"date"`
+	Readings Readings `json:"readings"`
+	Times    Stamps   `json:"times"`
+	Comment  string   `json:"comment"`
+	// Row is the number of the row in the import, counting from 1
+	Row  int `json:"-"`
+	date time.Time
+}
+
+// ImportOptions change how rows are imported
+type ImportOptions struct {
+	// DryRun validates the rows without saving anything
+	DryRun bool
+	// Merge saves rows for dates that are already saved, over what is saved for them
+	Merge bool
+	// Override saves readings without validating them, like /save?override=true
+	Override bool
+	// MaxDistance is the largest distance accepted between two readings, see ValidateKilometers
+	MaxDistance int
+}
+
+// ImportResult is what an import saved, or would save in a dry run
+type ImportResult struct {
+	DryRun bool `json:"dryRun"`
+	// Saved is set when the import is saved
+	Saved bool `json:"saved"`
+	// Imported is the number of days saved, or that would be saved in a dry run
+	Imported int `json:"imported"`
+	// Conflicts are the dates in the import that already have something saved
+	Conflicts []string `json:"conflicts"`
+	// Errors are the rows rejected, nothing is saved when there are any
+	Errors []ImportError `json:"errors"`
+}
+
+// ImportError tells why a row of an import is rejected
+type ImportError struct {
+	Row    int          `json:"row"`
+	Date   string       `json:"date"`
+	Reason string       `json:"reason,omitempty"`
+	Fields []FieldError `json:"fields,omitempty"`
+}
+
+// importColumns are the names of the CSV columns of an import, the ones of an export. Others,
+// like distance and hours, are skipped.
+var importColumns = map[string]func(row *ImportRow, value string) error{
+	"date":         func(row *ImportRow, value string) error { row.Date = value; return nil },
+	"begin":        func(row *ImportRow, value string) error { return parseImportKm(&row.Readings.Begin, value) },
+	"eerste":       func(row *ImportRow, value string) error { return parseImportKm(&row.Readings.Eerste, value) },
+	"laatste":      func(row *ImportRow, value string) error { return parseImportKm(&row.Readings.Laatste, value) },
+	"terug":        func(row *ImportRow, value string) error { return parseImportKm(&row.Readings.Terug, value) },
+	"begin time":   func(row *ImportRow, value string) error { row.Times.Begin = value; return nil },
+	"eerste time":  func(row *ImportRow, value string) error { row.Times.Eerste = value; return nil },
+	"laatste time": func(row *ImportRow, value string) error { row.Times.Laatste = value; return nil },
+	"terug time":   func(row *ImportRow, value string) error { row.Times.Terug = value; return nil },
+	"comment":      func(row *ImportRow, value string) error { row.Comment = value; return nil },
+}
+
+func parseImportKm(km *int, value string) (err error) {
+	if value = strings.TrimSpace(value); value == "" {
+		return nil
+	}
+	*km, err = strconv.Atoi(value)
+	return err
+}
+
+// ParseImportCSV parses the rows of a CSV import, the first row names the columns
+func ParseImportCSV(r io.Reader) (err error, rows []ImportRow) {
+	records, err := csv.NewReader(r).ReadAll()
+	if err != nil {
+		return CustomResponse(NotParsable, err), nil
+	}
+	if len(records) == 0 {
+		return CustomResponse(NotParsable, errors.New("the first row has to name the columns")), nil
+	}
+	header := records[0]
+	hasDate := false
+	for _, column := range header {
+		hasDate = hasDate || strings.ToLower(strings.TrimSpace(column)) == "date"
+	}
+	if !hasDate {
+		return CustomResponse(NotParsable, errors.New("there is no date column")), nil
+	}
+	for i, record := range records[1:] {
+		row := ImportRow{Row: i + 1}
+		for j, value := range record {
+			set, ok := importColumns[strings.ToLower(strings.TrimSpace(header[j]))]
+			if !ok {
+				continue
+			}
+			if err = set(&row, strings.TrimSpace(value)); err != nil {
+				return CustomResponse(NotParsable, fmt.Errorf("row %d, %s: %s", row.Row, header[j], err)), nil
+			}
+		}
+		rows = append(rows, row)
+	}
+	return nil, rows
+}
+
+// importJSONRow is a row of a JSON import, the fields of a Day that are not saved are skipped
+type importJSONRow struct {
+	ImportRow
+	Hours     json.RawMessage `json:"hours"`
+	DeletedAt json.RawMessage `json:"deletedAt"`
+	Vehicle   json.RawMessage `json:"vehicle"`
+}
+
+// ParseImportJSON parses the rows of a JSON import, a list of days like the api returns
+func ParseImportJSON(r io.Reader) (err error, rows []ImportRow) {
+	var days []importJSONRow
+	if err = decodeJSON(r, &days); err != nil {
+		return err, nil
+	}
+	for i, day := range days {
+		day.ImportRow.Row = i + 1
+		rows = append(rows, day.ImportRow)
+	}
+	return nil, rows
+}
+
+// parseImportDate parses the date of a row, as written in urls or as an RFC 3339 timestamp
+func parseImportDate(value string) (time.Time, error) {
+	if err, date := ParseURLDate(value); err == nil {
+		return date, nil
+	}
+	date, err := time.Parse(time.RFC3339, value)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("%q is not a date", value)
+	}
+	return truncateDate(date), nil
+}
+
+// fields returns the readings and the times of row to save, only the ones that are filled in
+func (row ImportRow) fields() (kms, times []Field) {
+	for _, name := range timeFields {
+		if km := row.Readings.km(name); km != 0 {
+			kms = append(kms, Field{Km: km, Name: name})
+		}
+		if clock := row.Times.time(name); clock != "" {
+			times = append(times, Field{Time: clock, Name: name})
+		}
+	}
+	return kms, times
+}
+
+// importsByDate sorts rows by date, oldest first, so every row is validated against the one before
+type importsByDate []ImportRow
+
+func (r importsByDate) Len() int           { return len(r) }
+func (r importsByDate) Swap(i, j int)      { r[i], r[j] = r[j], r[i] }
+func (r importsByDate) Less(i, j int) bool { return r[i].date.Before(r[j].date) }
+
+// errDryRun rolls back the transaction of a dry run
+var errDryRun = errors.New("dry run")
+
+// Import validates rows, in the time zone loc, and saves them in one transaction on store. Rows are
+// saved like they are posted to /save, from the oldest date on. Nothing is saved when a row is
+// rejected, when a date is already saved and opts.Merge is not set, or in a dry run.
+func Import(store Store, rows []ImportRow, loc *time.Location, opts ImportOptions) (result ImportResult, err error) {
+	result = ImportResult{DryRun: opts.DryRun, Conflicts: []string{}, Errors: []ImportError{}}
+	seen := make(map[time.Time]int)
+	for i := range rows {
+		rows[i].date, err = parseImportDate(rows[i].Date)
+		switch {
+		case err != nil:
+			result.Errors = append(result.Errors, ImportError{Row: rows[i].Row, Date: rows[i].Date, Reason: err.Error()})
+		case seen[rows[i].date] != 0:
+			result.Errors = append(result.Errors, ImportError{Row: rows[i].Row, Date: rows[i].Date,
+				Reason: fmt.Sprintf("the date is imported in row %d already", seen[rows[i].date])})
+		default:
+			seen[rows[i].date] = rows[i].Row
+		}
+	}
+	if len(result.Errors) > 0 {
+		return result, nil
+	}
+	sort.Sort(importsByDate(rows))
+
+	err = inTx(store, func(tx Tx) error {
+		for _, row := range rows {
+			rowErr, err := importRow(tx, row, loc, opts, &result)
+			if err != nil {
+				return err
+			}
+			if rowErr != nil {
+				result.Errors = append(result.Errors, *rowErr)
+			} else {
+				result.Imported++
+			}
+		}
+		if opts.DryRun || len(result.Errors) > 0 || (len(result.Conflicts) > 0 && !opts.Merge) {
+			return errDryRun
+		}
+		return nil
+	})
+	switch {
+	case err == nil:
+		result.Saved = true
+	case err == errDryRun:
+		err = nil
+		if !opts.DryRun {
+			result.Imported = 0
+		}
+	}
+	return result, err
+}
+
+// importRow saves row in tx, it returns why it is rejected when it is
+func importRow(tx Tx, row ImportRow, loc *time.Location, opts ImportOptions, result *ImportResult) (*ImportError, error) {
+	rejected := &ImportError{Row: row.Row, Date: FormatURLDate(row.date)}
+	_, saved, err := GetDay(tx, row.date, loc)
+	if err != nil {
+		return nil, err
+	}
+	if saved {
+		result.Conflicts = append(result.Conflicts, FormatURLDate(row.date))
+	}
+
+	kms, times := row.fields()
+	if !opts.Override {
+		switch err := ValidateSave(tx, row.date, kms, opts.MaxDistance).(type) {
+		case nil:
+		case Response:
+			if err.Name != InvalidReading.Name {
+				return nil, err
+			}
+			rejected.Fields = err.Fields
+			return rejected, nil
+		default:
+			return nil, err
+		}
+	}
+
+	if len(kms) > 0 || row.Comment != "" {
+		k, err := dayKilometers(tx, row.date)
+		if err != nil {
+			return nil, CustomResponse(DbError, err)
+		}
+		k.AddFields(kms)
+		if row.Comment != "" {
+			k.Comment = row.Comment
+		}
+		if err = tx.PutKilometers(&k); err != nil {
+			return nil, CustomResponse(DbError, err)
+		}
+	}
+	if len(times) > 0 {
+		switch err := SaveTimes(tx, row.date, times, loc).(type) {
+		case nil:
+		case Response:
+			if err.Name != NotParsable.Name {
+				return nil, err
+			}
+			rejected.Reason = fmt.Sprintf("invalid time: %s", err.Extra)
+			return rejected, nil
+		default:
+			return nil, err
+		}
+	}
+	return nil, BackfillPrevious(tx, row.date, kms)
+}
+
+// importHandler imports the CSV or JSON rows posted, see Import. The result is sent back with
+// 400 Bad Request when nothing is imported because of rejected rows or conflicts.
+func (s *Server) importHandler(w http.ResponseWriter, r *http.Request) {
+	var opts ImportOptions
+	for param, option := range map[string]*bool{"dryRun": &opts.DryRun, "merge": &opts.Merge, "override": &opts.Override} {
+		*option, _ = strconv.ParseBool(r.URL.Query().Get(param))
+	}
+	opts.MaxDistance = s.config.MaxDistance
+	err, loc := s.requestLocation(r)
+	if err != nil {
+		WriteError(w, r, err)
+		return
+	}
+	var rows []ImportRow
+	if strings.HasPrefix(r.Header.Get("Content-Type"), "text/csv") {
+		err, rows = ParseImportCSV(r.Body)
+	} else {
+		err, rows = ParseImportJSON(r.Body)
+	}
+	if err != nil {
+		WriteError(w, r, err)
+		return
+	}
+	result, err := Import(s.auditedStore(w, r), rows, loc, opts)
+	if err != nil {
+		WriteError(w, r, err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	if !opts.DryRun && !result.Saved {
+		w.WriteHeader(http.StatusBadRequest)
+	}
+	json.NewEncoder(w).Encode(result)
+}
@@ -0,0 +1,185 @@
+package km
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseImportCSV(t *testing.T) {
+	// an export can be imported again
+	var b bytes.Buffer
+	WriteCSV(&b, []ExportDay{ExportDay{
+		Day:      Day{Date: time.Date(2014, time.January, 2, 0, 0, 0, 0, time.UTC), Readings: Readings{Begin: 1000, Terug: 1070}, Times: Stamps{Begin: "08:00", Terug: "06:00+1"}, Hours: 8},
+		Distance: 70,
+		Comment:  "klant",
+	}})
+	err, rows := ParseImportCSV(&b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := ImportRow{Date: "2014-01-02", Readings: Readings{Begin: 1000, Terug: 1070}, Times: Stamps{Begin: "08:00", Terug: "06:00+1"}, Comment: "klant", Row: 1}
+	if len(rows) != 1 || rows[0] != want {
+		t.Errorf("got %+v, want %+v", rows, want)
+	}
+
+	for _, csv := range []string{
+		"",
+		"begin,terug\n1000,1070\n",
+		"date,begin\n2014-01-02,duizend\n",
+		"date,begin\n2014-01-02,1000,1070\n",
+	} {
+		if err, _ := ParseImportCSV(strings.NewReader(csv)); err == nil || err.(Response).Name != NotParsable.Name {
+			t.Errorf("%q: got %v, want %s", csv, err, NotParsable.Name)
+		}
+	}
+}
+
+func TestParseImportJSON(t *testing.T) {
+	err, rows := ParseImportJSON(strings.NewReader(`[{"date": "2014-01-02", "readings": {"begin": 1000}},
+		{"date": "2014-01-03T00:00:00Z", "times": {"begin": "08:00"}, "comment": "klant"}]`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rows) != 2 || rows[1].Row != 2 || rows[1].Comment != "klant" {
+		t.Errorf("got %+v", rows)
+	}
+	// what the api returns for a day is not saved is skipped
+	err, rows = ParseImportJSON(strings.NewReader(`[{"date": "2014-01-02T00:00:00Z", "readings": {"begin": 1000, "inferred": false},
+		"hours": 8.5, "deletedAt": "2014-02-01T10:00:00Z", "vehicle": 2}]`))
+	want := ImportRow{Date: "2014-01-02T00:00:00Z", Readings: Readings{Begin: 1000}, Row: 1}
+	if err != nil || len(rows) != 1 || rows[0] != want {
+		t.Errorf("got %v %+v, want %+v", err, rows, want)
+	}
+	if err, _ := ParseImportJSON(strings.NewReader(`[{"datum": "2014-01-02"}]`)); err == nil || err.(Response).Name != UnknownField.Name {
+		t.Errorf("got %v, want %s", err, UnknownField.Name)
+	}
+}
+
+func TestImport(t *testing.T) {
+	date := func(day int) time.Time { return time.Date(2014, time.January, day, 0, 0, 0, 0, time.UTC) }
+	store := NewMemoryStore()
+	store.PutKilometers(&Kilometers{Date: date(3), Begin: 1100})
+	rows := func() []ImportRow {
+		// not in order, every row is validated against the day before it
+		return []ImportRow{
+			ImportRow{Date: "2014-01-03", Readings: Readings{Terug: 1150}, Row: 1},
+			ImportRow{Date: "2014-01-02", Readings: Readings{Begin: 1000, Terug: 1070}, Times: Stamps{Begin: "08:00"}, Comment: "klant", Row: 2},
+		}
+	}
+
+	result, err := Import(store, rows(), time.UTC, ImportOptions{DryRun: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.Saved || result.Imported != 2 || len(result.Errors) != 0 || len(result.Conflicts) != 1 || result.Conflicts[0] != "2014-01-03" {
+		t.Errorf("dry run: got %+v", result)
+	}
+	if _, err := store.GetKilometers(date(2)); err == nil {
+		t.Error("a dry run saved a day")
+	}
+
+	// a conflict is not saved over without merge, and nothing else is saved either
+	if result, _ = Import(store, rows(), time.UTC, ImportOptions{}); result.Saved || result.Imported != 0 {
+		t.Errorf("conflict: got %+v", result)
+	}
+	if _, err := store.GetKilometers(date(2)); err == nil {
+		t.Error("an import with a conflict saved a day")
+	}
+
+	// an invalid row rejects all of them
+	invalid := append(rows(), ImportRow{Date: "2014-01-04", Readings: Readings{Begin: 900}, Row: 3})
+	result, _ = Import(store, invalid, time.UTC, ImportOptions{Merge: true})
+	if result.Saved || len(result.Errors) != 1 || result.Errors[0].Row != 3 || result.Errors[0].Fields[0].Field != "Begin" {
+		t.Errorf("invalid row: got %+v", result)
+	}
+	if _, err := store.GetKilometers(date(2)); err == nil {
+		t.Error("an import with an invalid row saved a day")
+	}
+	for _, row := range []ImportRow{
+		ImportRow{Date: "2 januari", Row: 1},
+		ImportRow{Date: "2014-01-05", Times: Stamps{Begin: "acht uur"}, Row: 1},
+	} {
+		if result, _ = Import(store, []ImportRow{row}, time.UTC, ImportOptions{}); len(result.Errors) != 1 || result.Errors[0].Reason == "" {
+			t.Errorf("%+v: got %+v", row, result)
+		}
+	}
+	duplicate := append(rows(), ImportRow{Date: "2014-01-02", Row: 3})
+	if result, _ = Import(store, duplicate, time.UTC, ImportOptions{Merge: true}); len(result.Errors) != 1 || result.Errors[0].Row != 3 {
+		t.Errorf("duplicate date: got %+v", result)
+	}
+
+	audited := Audited(store, Origin{User: "km import"})
+	if result, err = Import(audited, rows(), time.UTC, ImportOptions{Merge: true}); err != nil || !result.Saved || result.Imported != 2 {
+		t.Fatalf("merge: got %+v, %v", result, err)
+	}
+	k, _ := store.GetKilometers(date(2))
+	if k.Begin != 1000 || k.Terug != 1070 || k.Comment != "klant" {
+		t.Errorf("2014-01-02: got %+v", k)
+	}
+	if times, _ := store.GetTimes(date(2)); times.Begin != date(2).Add(8*time.Hour).Unix() {
+		t.Errorf("2014-01-02: got times %+v", times)
+	}
+	if k, _ = store.GetKilometers(date(3)); k.Begin != 1100 || k.Terug != 1150 {
+		t.Errorf("2014-01-03 is not merged: got %+v", k)
+	}
+	entries, _ := store.AuditForDate(date(2))
+	if len(entries) == 0 || entries[0].User != "km import" {
+		t.Errorf("the import is not in the audit log: %+v", entries)
+	}
+}
+
+func TestImportHandler(t *testing.T) {
+	initServer(t)
+	apiRequest(t, "PUT", "/api/v1/days/2014-01-03/readings", `{"begin": 1100}`, nil)
+	post := func(url, contentType, body string) (int, ImportResult) {
+		req, _ := http.NewRequest("POST", url, strings.NewReader(body))
+		req.Header.Set("Content-Type", contentType)
+		w := serve(req)
+		var result ImportResult
+		json.Unmarshal(w.Body.Bytes(), &result)
+		return w.Code, result
+	}
+	csv := "date,begin,terug,begin time\n2014-01-02,1000,1070,08:00\n2014-01-03,,1150,\n"
+
+	code, result := post("/api/v1/import?dryRun=true", "text/csv", csv)
+	if code != 200 || !result.DryRun || result.Imported != 2 || len(result.Conflicts) != 1 {
+		t.Errorf("dry run: got %d %+v", code, result)
+	}
+	if code, result = post("/api/v1/import", "text/csv", csv); code != 400 || result.Saved {
+		t.Errorf("conflict: got %d %+v", code, result)
+	}
+	if code, result = post("/api/v1/import?merge=true", "text/csv", csv); code != 200 || !result.Saved || result.Imported != 2 {
+		t.Errorf("merge: got %d %+v", code, result)
+	}
+	var day Day
+	apiRequest(t, "GET", "/api/v1/days/2014-01-03", "", &day)
+	if day.Readings.Begin != 1100 || day.Readings.Terug != 1150 {
+		t.Errorf("2014-01-03: got %+v", day)
+	}
+
+	if code, result = post("/api/v1/import", "application/json", `[{"date": "2014-01-04", "readings": {"begin": 1200}}]`); code != 200 || result.Imported != 1 {
+		t.Errorf("json: got %d %+v", code, result)
+	}
+	if code, _ = post("/api/v1/import", "application/json", `{"date": "2014-01-04"}`); code != NotParsable.Code {
+		t.Errorf("not a list: got %d, want %d", code, NotParsable.Code)
+	}
+
+	// the days the api returns can be imported in a new server
+	req, _ := http.NewRequest("GET", "/api/v1/days", nil)
+	w := serve(req)
+	var before, after []Day
+	json.Unmarshal(w.Body.Bytes(), &before)
+	initServer(t)
+	if code, result = post("/api/v1/import", "application/json", w.Body.String()); len(before) != 3 || code != 200 || result.Imported != len(before) {
+		t.Errorf("days: got %d %+v", code, result)
+	}
+	apiRequest(t, "GET", "/api/v1/days", "", &after)
+	if !reflect.DeepEqual(after, before) {
+		t.Errorf("days: got %+v, want %+v", after, before)
+	}
+}
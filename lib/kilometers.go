@@ -1,12 +1,8 @@
 package km
 
 import (
-	"fmt"
+	"database/sql"
 	"time"
-
-	"github.com/coopernurse/gorp"
-	// import postgres for its side effects
-	_ "github.com/lib/pq"
 )
 
 // Kilometers is the struct representing a db row in the kilometers table
@@ -15,6 +11,16 @@ type Kilometers struct {
 	Date                          time.Time
 	Begin, Eerste, Laatste, Terug int
 	Comment                       string
+	// Inferred is set when Terug is copied from the Begin of the next day,
+	// until the user saves Terug
+	Inferred bool
+	// DeletedAt is set when the day is in the trash
+	DeletedAt *time.Time `db:"deleted_at" json:"-"`
+	// VehicleID is the vehicle driven, 0 for days saved before any vehicle was added
+	VehicleID int64 `db:"vehicle_id"`
+	// UserID is the user the day belongs to, it is left out of the JSON so the audit log
+	// records the same rows whoever they belong to
+	UserID int64 `db:"user_id" json:"-"`
 }
 
 // Field holds the data for 1 row in the ui form
@@ -24,6 +30,16 @@ type Field struct {
 	Name string
 }
 
+// getMin returns the first reading filled in, 0 when there is none
+func (k *Kilometers) getMin() int {
+	for _, km := range []int{k.Begin, k.Eerste, k.Laatste, k.Terug} {
+		if km > 0 {
+			return km
+		}
+	}
+	return 0
+}
+
 func (k *Kilometers) getMax() int {
 	if k.Terug > 0 {
 		return k.Terug
@@ -53,6 +69,7 @@ func (k *Kilometers) AddFields(fields []Field) {
 			k.Laatste = field.Km
 		case "Terug":
 			k.Terug = field.Km
+			k.Inferred = false
 		}
 
 	}
@@ -61,27 +78,50 @@ func (k *Kilometers) AddFields(fields []Field) {
 // SaveKilometers saves a the given Field array (wich is supplied by the user)
 // if no data is saved for today it results in an insert, otherwise a update of
 // the already saved data is done
-func SaveKilometers(dbmap *gorp.DbMap, date time.Time, fields []Field) (err error) {
-	dateStr := fmt.Sprintf("%d-%d-%d", date.Month(), date.Day(), date.Year())
-	kms := new(Kilometers)
-	err = dbmap.SelectOne(kms, "select * from kilometers where date=$1", dateStr)
-	if err == nil { // there is already data for km (so use update)
-		kms.AddFields(fields)
-		_, err = dbmap.Update(kms)
-		if err != nil {
-			return CustomResponse(DbError, err)
-		}
-	} else { // nog niks opgeslagen voor vandaag}
-		if err.Error() != "sql: no rows in result set" {
-			return CustomResponse(DbError, err)
-		}
-		kms := new(Kilometers)
-		kms.Date = date
-		kms.AddFields(fields)
-		err = dbmap.Insert(kms)
-		if err != nil {
-			return CustomResponse(DbError, err)
+func SaveKilometers(ex Executor, date time.Time, fields []Field) (err error) {
+	kms, err := dayKilometers(ex, date)
+	if err != nil {
+		return CustomResponse(DbError, err)
+	}
+	kms.AddFields(fields)
+	err = ex.PutKilometers(&kms)
+	if err != nil {
+		return CustomResponse(DbError, err)
+	}
+	return nil
+}
+
+// BackfillPrevious copies the Begin posted for date to the Terug of the previous
+// day saved for the same vehicle, when that was forgotten. The copied reading is marked as inferred.
+func BackfillPrevious(ex Executor, date time.Time, fields []Field) error {
+	begin := 0
+	for _, field := range fields {
+		if field.Name == "Begin" {
+			begin = field.Km
 		}
 	}
+	if begin == 0 {
+		return nil
+	}
+	k, err := dayKilometers(ex, date)
+	if err != nil {
+		return CustomResponse(DbError, err)
+	}
+	previous, err := ex.PreviousKilometers(k.VehicleID, date)
+	switch {
+	case err == sql.ErrNoRows:
+		return nil
+	case err != nil:
+		return CustomResponse(DbError, err)
+	}
+	// never infer a reading that goes back
+	if previous.Terug != 0 || begin < previous.getMax() {
+		return nil
+	}
+	previous.Terug = begin
+	previous.Inferred = true
+	if err = ex.PutKilometers(&previous); err != nil {
+		return CustomResponse(DbError, err)
+	}
 	return nil
 }
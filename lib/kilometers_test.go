@@ -12,10 +12,10 @@ import (
 
 func TestGetMax(t *testing.T) {
 	kiloTests := []Kilometers{
-		Kilometers{1, time.Now(), 1, 0, 0, 0, "test"},
-		Kilometers{1, time.Now(), 1, 2, 0, 0, "test"},
-		Kilometers{1, time.Now(), 1, 2, 3, 0, "test"},
-		Kilometers{1, time.Now(), 1, 2, 3, 4, "test"},
+		Kilometers{1, time.Now(), 1, 0, 0, 0, "test", false, nil, 0, 0},
+		Kilometers{1, time.Now(), 1, 2, 0, 0, "test", false, nil, 0, 0},
+		Kilometers{1, time.Now(), 1, 2, 3, 0, "test", false, nil, 0, 0},
+		Kilometers{1, time.Now(), 1, 2, 3, 4, "test", false, nil, 0, 0},
 	}
 	for i, k := range kiloTests {
 		if v := k.getMax(); v != i+1 {
@@ -43,20 +43,20 @@ func TestAddFields(t *testing.T) {
 }
 
 func TestUpdateKilometers(t *testing.T) {
-	// successfull update
+	// successfull update of an existing row
 	err, dbmap, columns := MockSetup("kilometers")
 	if err != nil {
 		t.Error(err)
 	}
 	date := time.Date(2014, time.January, 1, 0, 0, 0, 0, time.UTC)
-	sqlmock.ExpectQuery("select \\* from kilometers where date=(.+)").
-		WithArgs("1-1-2014").
-		WillReturnRows(sqlmock.NewRows(columns).AddRow(1, date, 1234, 0, 0, 0, ""))
-	sqlmock.ExpectExec("update \"kilometers\" set \"date\"=(.+)").
-		WithArgs(date, 1234, 0, 0, 12345, "", 1).
-		WillReturnResult(sqlmock.NewResult(1, 1))
+	sqlmock.ExpectQuery("select \\* from kilometers where user_id=(.+) and date=(.+)").
+		WithArgs(0, date).
+		WillReturnRows(sqlmock.NewRows(columns).AddRow(1, date, 1234, 0, 0, 0, "", false, nil, 0, 0))
+	sqlmock.ExpectQuery("insert into kilometers (.+) on conflict (.+)").
+		WithArgs(date, 1234, 0, 0, 12345, "", false, 0, 0).
+		WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow(1))
 	fields := []Field{Field{Name: "Terug", Km: 12345, Time: "13:00"}}
-	err = SaveKilometers(dbmap, date, fields)
+	err = SaveKilometers(newPostgresStore(dbmap), date, fields)
 	if err != nil {
 		t.Errorf("SaveKilometers returned: %s", err)
 	}
@@ -69,14 +69,14 @@ func TestUpdateKilometers(t *testing.T) {
 	if err != nil {
 		t.Error(err)
 	}
-	sqlmock.ExpectQuery("select \\* from kilometers where date=(.+)").
-		WithArgs("1-1-2014").
-		WillReturnRows(sqlmock.NewRows(columns).AddRow(1, date, 1234, 0, 0, 0, ""))
-	sqlmock.ExpectExec("update \"kilometers\" set \"date\"=(.+)").
-		WithArgs(date, 1234, 0, 0, 12345, "", 1).
+	sqlmock.ExpectQuery("select \\* from kilometers where user_id=(.+) and date=(.+)").
+		WithArgs(0, date).
+		WillReturnRows(sqlmock.NewRows(columns).AddRow(1, date, 1234, 0, 0, 0, "", false, nil, 0, 0))
+	sqlmock.ExpectQuery("insert into kilometers (.+) on conflict (.+)").
+		WithArgs(date, 1234, 0, 0, 12345, "", false, 0, 0).
 		WillReturnError(fmt.Errorf("failed update"))
 	fields = []Field{Field{Name: "Terug", Km: 12345, Time: "13:00"}}
-	err = SaveKilometers(dbmap, date, fields)
+	err = SaveKilometers(newPostgresStore(dbmap), date, fields)
 	if err == nil {
 		t.Errorf("Updating kilometers passed without error, when it should have returned one")
 	}
@@ -89,11 +89,11 @@ func TestUpdateKilometers(t *testing.T) {
 	if err != nil {
 		t.Error(err)
 	}
-	sqlmock.ExpectQuery("select \\* from kilometers where date=(.+)").
-		WithArgs("1-1-2014").
+	sqlmock.ExpectQuery("select \\* from kilometers where user_id=(.+) and date=(.+)").
+		WithArgs(0, date).
 		WillReturnError(fmt.Errorf("failed select"))
 	fields = []Field{Field{Name: "Terug", Km: 12345, Time: "13:00"}}
-	err = SaveKilometers(dbmap, date, fields)
+	err = SaveKilometers(newPostgresStore(dbmap), date, fields)
 	if err == nil {
 		t.Errorf("Updating kilometers passed without error, when it should have returned one")
 	}
@@ -111,17 +111,22 @@ func TestInsertKilometers(t *testing.T) {
 		t.Error(err)
 	}
 	date := time.Date(2014, time.January, 1, 0, 0, 0, 0, time.UTC)
-	sqlmock.ExpectQuery("select \\* from kilometers where date=(.+)").
-		WithArgs("1-1-2014").
+	sqlmock.ExpectQuery("select \\* from kilometers where user_id=(.+) and date=(.+)").
+		WithArgs(0, date).
 		WillReturnRows(sqlmock.NewRows(columns).FromCSVString(""))
+	// a day not saved yet is saved for the vehicle in use
+	sqlmock.ExpectQuery("select \\* from vehicles where user_id=(.+) order by start_date, id").
+		WithArgs(0).
+		WillReturnRows(sqlmock.NewRows(vehicleColumns).FromCSVString(""))
 
 	// INSERT is Query aparently, not Exec as my long struggle to get this working discovered
-	sqlmock.ExpectQuery("insert into \"kilometers\"(.+)").
-		WithArgs(date, 0, 0, 0, 12345, ""). //autoincrement field (id in this case) not given to WithArgs
+	// (the upsert returns the id, so it is a query anyway)
+	sqlmock.ExpectQuery("insert into kilometers (.+) on conflict (.+)").
+		WithArgs(date, 0, 0, 0, 12345, "", false, 0, 0). //autoincrement field (id in this case) not given to WithArgs
 		WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow(1))
 
 	fields := []Field{Field{Name: "Terug", Km: 12345, Time: "13:00"}}
-	err = SaveKilometers(dbmap, date, fields)
+	err = SaveKilometers(newPostgresStore(dbmap), date, fields)
 	if err != nil {
 		t.Errorf("SaveKilometers returned: %s", err)
 	}
@@ -134,15 +139,19 @@ func TestInsertKilometers(t *testing.T) {
 	if err != nil {
 		t.Error(err)
 	}
-	sqlmock.ExpectQuery("select \\* from kilometers where date=(.+)").
-		WithArgs("1-1-2014").
+	sqlmock.ExpectQuery("select \\* from kilometers where user_id=(.+) and date=(.+)").
+		WithArgs(0, date).
 		WillReturnRows(sqlmock.NewRows(columns).FromCSVString(""))
+	// a day not saved yet is saved for the vehicle in use
+	sqlmock.ExpectQuery("select \\* from vehicles where user_id=(.+) order by start_date, id").
+		WithArgs(0).
+		WillReturnRows(sqlmock.NewRows(vehicleColumns).FromCSVString(""))
 	// INSERT is Query aparently, not Exec as my long struggle to get this working discovered
-	sqlmock.ExpectQuery("insert into \"kilometers\"(.+)").
-		WithArgs(date, 0, 0, 0, 12345, ""). //autoincrement field (id in this case) not given to WithArgs
+	sqlmock.ExpectQuery("insert into kilometers (.+) on conflict (.+)").
+		WithArgs(date, 0, 0, 0, 12345, "", false, 0, 0). //autoincrement field (id in this case) not given to WithArgs
 		WillReturnError(fmt.Errorf("failed instert"))
 	fields = []Field{Field{Name: "Terug", Km: 12345, Time: "13:00"}}
-	err = SaveKilometers(dbmap, date, fields)
+	err = SaveKilometers(newPostgresStore(dbmap), date, fields)
 	if err == nil {
 		t.Errorf("Inserting kilometers passed without error, when it should have returned one")
 	}
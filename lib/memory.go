@@ -0,0 +1,865 @@
+package km
+
+import (
+	"database/sql"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+)
+
+// MemoryStore is a Store that keeps everything in memory, it is lost when the
+// process exits. Mainly useful for testing without a database.
+type MemoryStore struct {
+	*memoryDB
+	// user is the user the store is scoped to
+	user int64
+}
+
+// memoryDB holds the rows of all users of a MemoryStore, and the stores scoped to them
+// share it
+type memoryDB struct {
+	sync.Mutex
+	data  map[int64]*memoryData
+	users map[int64]User
+	// sessions are keyed by the hash of their token
+	sessions map[string]Session
+	// lastID is the id given out last, ids are unique over all tables and users
+	lastID int64
+}
+
+// NewMemoryStore creates a new empty MemoryStore
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{memoryDB: &memoryDB{
+		data:     make(map[int64]*memoryData),
+		users:    make(map[int64]User),
+		sessions: make(map[string]Session),
+	}}
+}
+
+// rows returns the rows of the user m is scoped to, m has to be locked
+func (m *MemoryStore) rows() *memoryData {
+	d, ok := m.data[m.user]
+	if !ok {
+		d = newMemoryData(m.memoryDB, m.user)
+		m.data[m.user] = d
+	}
+	return d
+}
+
+// memoryData holds the rows of a user of a MemoryStore, its methods implement Executor
+// without any locking
+type memoryData struct {
+	kilometers map[time.Time]Kilometers
+	times      map[time.Time]Times
+	trips      map[int64]Trip
+	vehicles   map[int64]Vehicle
+	audit      []AuditEntry
+	db         *memoryDB
+	user       int64
+}
+
+func newMemoryData(db *memoryDB, user int64) *memoryData {
+	return &memoryData{
+		kilometers: make(map[time.Time]Kilometers),
+		times:      make(map[time.Time]Times),
+		trips:      make(map[int64]Trip),
+		vehicles:   make(map[int64]Vehicle),
+		db:         db,
+		user:       user,
+	}
+}
+
+// nextID returns a new id, the ids given out by a transaction that is rolled back are
+// not reused
+func (d *memoryData) nextID() int64 {
+	d.db.lastID++
+	return d.db.lastID
+}
+
+func (d *memoryData) copy() *memoryData {
+	c := newMemoryData(d.db, d.user)
+	c.audit = append([]AuditEntry(nil), d.audit...)
+	for date, k := range d.kilometers {
+		c.kilometers[date] = k
+	}
+	for date, t := range d.times {
+		c.times[date] = t
+	}
+	for id, t := range d.trips {
+		c.trips[id] = t
+	}
+	for id, v := range d.vehicles {
+		c.vehicles[id] = v
+	}
+	return c
+}
+
+// datesDesc sorts dates with the most recent first
+type datesDesc []time.Time
+
+func (d datesDesc) Len() int           { return len(d) }
+func (d datesDesc) Swap(i, j int)      { d[i], d[j] = d[j], d[i] }
+func (d datesDesc) Less(i, j int) bool { return d[i].After(d[j]) }
+
+// kilometerDates returns the dates of the kilometers in the trash when deleted is set,
+// and of the other kilometers otherwise
+func (d *memoryData) kilometerDates(deleted bool) []time.Time {
+	var dates []time.Time
+	for date, k := range d.kilometers {
+		if (k.DeletedAt != nil) == deleted {
+			dates = append(dates, date)
+		}
+	}
+	sort.Sort(datesDesc(dates))
+	return dates
+}
+
+// timeDates returns the dates of the times in the trash when deleted is set,
+// and of the other times otherwise
+func (d *memoryData) timeDates(deleted bool) []time.Time {
+	var dates []time.Time
+	for date, t := range d.times {
+		if (t.DeletedAt != nil) == deleted {
+			dates = append(dates, date)
+		}
+	}
+	sort.Sort(datesDesc(dates))
+	return dates
+}
+
+func inMonth(date time.Time, year, month int64) bool {
+	return int64(date.Year()) == year && int64(date.Month()) == month
+}
+
+func between(date, from, to time.Time) bool {
+	return !date.Before(truncateDate(from)) && !date.After(truncateDate(to))
+}
+
+func (d *memoryData) GetKilometers(date time.Time) (Kilometers, error) {
+	k, ok := d.kilometers[truncateDate(date)]
+	if !ok || k.DeletedAt != nil {
+		return Kilometers{}, sql.ErrNoRows
+	}
+	return k, nil
+}
+
+func (d *memoryData) GetTimes(date time.Time) (Times, error) {
+	t, ok := d.times[truncateDate(date)]
+	if !ok || t.DeletedAt != nil {
+		return Times{}, sql.ErrNoRows
+	}
+	return t, nil
+}
+
+func (d *memoryData) LastKilometers(vehicleID int64) (Kilometers, error) {
+	for _, saved := range d.kilometerDates(false) {
+		if d.kilometers[saved].VehicleID == vehicleID {
+			return d.kilometers[saved], nil
+		}
+	}
+	return Kilometers{}, sql.ErrNoRows
+}
+
+func (d *memoryData) PreviousKilometers(vehicleID int64, date time.Time) (Kilometers, error) {
+	date = truncateDate(date)
+	for _, saved := range d.kilometerDates(false) {
+		if saved.Before(date) && d.kilometers[saved].VehicleID == vehicleID {
+			return d.kilometers[saved], nil
+		}
+	}
+	return Kilometers{}, sql.ErrNoRows
+}
+
+func (d *memoryData) NextKilometers(vehicleID int64, date time.Time) (Kilometers, error) {
+	date = truncateDate(date)
+	dates := d.kilometerDates(false)
+	for i := len(dates) - 1; i >= 0; i-- {
+		if dates[i].After(date) && d.kilometers[dates[i]].VehicleID == vehicleID {
+			return d.kilometers[dates[i]], nil
+		}
+	}
+	return Kilometers{}, sql.ErrNoRows
+}
+
+func (d *memoryData) LastTimes(n int) ([]Times, error) {
+	var all []Times
+	for i, date := range d.timeDates(false) {
+		if i == n {
+			break
+		}
+		all = append(all, d.times[date])
+	}
+	return all, nil
+}
+
+func (d *memoryData) PutKilometers(k *Kilometers) error {
+	k.Date = truncateDate(k.Date)
+	k.DeletedAt = nil
+	if saved, ok := d.kilometers[k.Date]; ok {
+		k.ID = saved.ID
+	} else {
+		k.ID = d.nextID()
+	}
+	k.UserID = d.user
+	d.kilometers[k.Date] = *k
+	return nil
+}
+
+func (d *memoryData) PutTimes(t *Times) error {
+	t.Date = truncateDate(t.Date)
+	t.DeletedAt = nil
+	if saved, ok := d.times[t.Date]; ok {
+		t.ID = saved.ID
+	} else {
+		t.ID = d.nextID()
+	}
+	t.UserID = d.user
+	d.times[t.Date] = *t
+	return nil
+}
+
+func (d *memoryData) KilometersInMonth(year, month int64) ([]Kilometers, error) {
+	all := make([]Kilometers, 0)
+	for _, date := range d.kilometerDates(false) {
+		if inMonth(date, year, month) {
+			all = append(all, d.kilometers[date])
+		}
+	}
+	return all, nil
+}
+
+func (d *memoryData) TimesInMonth(year, month int64) ([]Times, error) {
+	all := make([]Times, 0)
+	for _, date := range d.timeDates(false) {
+		if inMonth(date, year, month) {
+			all = append(all, d.times[date])
+		}
+	}
+	return all, nil
+}
+
+func (d *memoryData) KilometersBetween(from, to time.Time) ([]Kilometers, error) {
+	all := make([]Kilometers, 0)
+	for _, date := range d.kilometerDates(false) {
+		if between(date, from, to) {
+			all = append(all, d.kilometers[date])
+		}
+	}
+	return all, nil
+}
+
+func (d *memoryData) TimesBetween(from, to time.Time) ([]Times, error) {
+	all := make([]Times, 0)
+	for _, date := range d.timeDates(false) {
+		if between(date, from, to) {
+			all = append(all, d.times[date])
+		}
+	}
+	return all, nil
+}
+
+func (d *memoryData) DeleteDate(date time.Time) error {
+	date = truncateDate(date)
+	now := time.Now().UTC()
+	if k, ok := d.kilometers[date]; ok && k.DeletedAt == nil {
+		k.DeletedAt = &now
+		d.kilometers[date] = k
+	}
+	if t, ok := d.times[date]; ok && t.DeletedAt == nil {
+		t.DeletedAt = &now
+		d.times[date] = t
+	}
+	for id, t := range d.trips {
+		if t.Date.Equal(date) && t.DeletedAt == nil {
+			t.DeletedAt = &now
+			d.trips[id] = t
+		}
+	}
+	return nil
+}
+
+func (d *memoryData) DeletedKilometers() ([]Kilometers, error) {
+	all := make([]Kilometers, 0)
+	for _, date := range d.kilometerDates(true) {
+		all = append(all, d.kilometers[date])
+	}
+	return all, nil
+}
+
+func (d *memoryData) DeletedTimes() ([]Times, error) {
+	all := make([]Times, 0)
+	for _, date := range d.timeDates(true) {
+		all = append(all, d.times[date])
+	}
+	return all, nil
+}
+
+func (d *memoryData) RestoreDate(date time.Time) error {
+	date = truncateDate(date)
+	restored := false
+	if k, ok := d.kilometers[date]; ok && k.DeletedAt != nil {
+		k.DeletedAt = nil
+		d.kilometers[date] = k
+		restored = true
+	}
+	if t, ok := d.times[date]; ok && t.DeletedAt != nil {
+		t.DeletedAt = nil
+		d.times[date] = t
+		restored = true
+	}
+	for id, t := range d.trips {
+		if t.Date.Equal(date) && t.DeletedAt != nil {
+			t.DeletedAt = nil
+			d.trips[id] = t
+			restored = true
+		}
+	}
+	if !restored {
+		return sql.ErrNoRows
+	}
+	return nil
+}
+
+func (d *memoryData) PurgeDeleted(before time.Time) (int64, error) {
+	var purged int64
+	for date, k := range d.kilometers {
+		if k.DeletedAt != nil && k.DeletedAt.Before(before) {
+			delete(d.kilometers, date)
+			purged++
+		}
+	}
+	for date, t := range d.times {
+		if t.DeletedAt != nil && t.DeletedAt.Before(before) {
+			delete(d.times, date)
+			purged++
+		}
+	}
+	for id, t := range d.trips {
+		if t.DeletedAt != nil && t.DeletedAt.Before(before) {
+			delete(d.trips, id)
+			purged++
+		}
+	}
+	return purged, nil
+}
+
+// tripsWhere returns the trips outside the trash for which match is true, by date and odometer reading
+func (d *memoryData) tripsWhere(match func(t Trip) bool) []Trip {
+	all := make([]Trip, 0)
+	for _, t := range d.trips {
+		if t.DeletedAt == nil && match(t) {
+			all = append(all, t)
+		}
+	}
+	sort.Sort(tripsInOrder(all))
+	return all
+}
+
+func (d *memoryData) TripsForDate(date time.Time) ([]Trip, error) {
+	return d.tripsWhere(func(t Trip) bool { return t.Date.Equal(truncateDate(date)) }), nil
+}
+
+func (d *memoryData) TripsBetween(from, to time.Time) ([]Trip, error) {
+	return d.tripsWhere(func(t Trip) bool { return between(t.Date, from, to) }), nil
+}
+
+func (d *memoryData) GetTrip(id int64) (Trip, error) {
+	t, ok := d.trips[id]
+	if !ok || t.DeletedAt != nil {
+		return Trip{}, sql.ErrNoRows
+	}
+	return t, nil
+}
+
+func (d *memoryData) PutTrip(t *Trip) error {
+	t.Date = truncateDate(t.Date)
+	if t.ID == 0 {
+		t.ID = d.nextID()
+	} else if _, err := d.GetTrip(t.ID); err != nil {
+		return err
+	}
+	t.UserID = d.user
+	d.trips[t.ID] = *t
+	return nil
+}
+
+func (d *memoryData) DeleteTrip(id int64) error {
+	if _, err := d.GetTrip(id); err != nil {
+		return err
+	}
+	delete(d.trips, id)
+	return nil
+}
+
+func (d *memoryData) Vehicles() ([]Vehicle, error) {
+	all := make([]Vehicle, 0, len(d.vehicles))
+	for _, v := range d.vehicles {
+		all = append(all, v)
+	}
+	sort.Sort(vehiclesInOrder(all))
+	return all, nil
+}
+
+func (d *memoryData) GetVehicle(id int64) (Vehicle, error) {
+	v, ok := d.vehicles[id]
+	if !ok {
+		return Vehicle{}, sql.ErrNoRows
+	}
+	return v, nil
+}
+
+func (d *memoryData) PutVehicle(v *Vehicle) error {
+	v.StartDate = truncateDate(v.StartDate)
+	if v.ID == 0 {
+		v.ID = d.nextID()
+	} else if _, err := d.GetVehicle(v.ID); err != nil {
+		return err
+	}
+	v.UserID = d.user
+	d.vehicles[v.ID] = *v
+	return nil
+}
+
+func (d *memoryData) ActivateVehicle(id int64) error {
+	if _, err := d.GetVehicle(id); err != nil {
+		return err
+	}
+	for vid, v := range d.vehicles {
+		v.Active = vid == id
+		d.vehicles[vid] = v
+	}
+	return nil
+}
+
+func (d *memoryData) PutAudit(e *AuditEntry) error {
+	e.Date = truncateDate(e.Date)
+	e.ID = d.nextID()
+	e.UserID = d.user
+	d.audit = append(d.audit, *e)
+	return nil
+}
+
+func (d *memoryData) LastAudit() (AuditEntry, error) {
+	if len(d.audit) == 0 {
+		return AuditEntry{}, sql.ErrNoRows
+	}
+	return d.audit[len(d.audit)-1], nil
+}
+
+func (d *memoryData) AuditForDate(date time.Time) ([]AuditEntry, error) {
+	all := make([]AuditEntry, 0)
+	for _, e := range d.audit {
+		if e.Date.Equal(truncateDate(date)) {
+			all = append(all, e)
+		}
+	}
+	return all, nil
+}
+
+func (d *memoryData) AuditLog() ([]AuditEntry, error) {
+	return append(make([]AuditEntry, 0, len(d.audit)), d.audit...), nil
+}
+
+// GetKilometers implements Executor
+func (m *MemoryStore) GetKilometers(date time.Time) (Kilometers, error) {
+	m.Lock()
+	defer m.Unlock()
+	return m.rows().GetKilometers(date)
+}
+
+// GetTimes implements Executor
+func (m *MemoryStore) GetTimes(date time.Time) (Times, error) {
+	m.Lock()
+	defer m.Unlock()
+	return m.rows().GetTimes(date)
+}
+
+// LastKilometers implements Executor
+func (m *MemoryStore) LastKilometers(vehicleID int64) (Kilometers, error) {
+	m.Lock()
+	defer m.Unlock()
+	return m.rows().LastKilometers(vehicleID)
+}
+
+// PreviousKilometers implements Executor
+func (m *MemoryStore) PreviousKilometers(vehicleID int64, date time.Time) (Kilometers, error) {
+	m.Lock()
+	defer m.Unlock()
+	return m.rows().PreviousKilometers(vehicleID, date)
+}
+
+// NextKilometers implements Executor
+func (m *MemoryStore) NextKilometers(vehicleID int64, date time.Time) (Kilometers, error) {
+	m.Lock()
+	defer m.Unlock()
+	return m.rows().NextKilometers(vehicleID, date)
+}
+
+// LastTimes implements Executor
+func (m *MemoryStore) LastTimes(n int) ([]Times, error) {
+	m.Lock()
+	defer m.Unlock()
+	return m.rows().LastTimes(n)
+}
+
+// PutKilometers implements Executor
+func (m *MemoryStore) PutKilometers(k *Kilometers) error {
+	m.Lock()
+	defer m.Unlock()
+	return m.rows().PutKilometers(k)
+}
+
+// PutTimes implements Executor
+func (m *MemoryStore) PutTimes(t *Times) error {
+	m.Lock()
+	defer m.Unlock()
+	return m.rows().PutTimes(t)
+}
+
+// KilometersInMonth implements Executor
+func (m *MemoryStore) KilometersInMonth(year, month int64) ([]Kilometers, error) {
+	m.Lock()
+	defer m.Unlock()
+	return m.rows().KilometersInMonth(year, month)
+}
+
+// TimesInMonth implements Executor
+func (m *MemoryStore) TimesInMonth(year, month int64) ([]Times, error) {
+	m.Lock()
+	defer m.Unlock()
+	return m.rows().TimesInMonth(year, month)
+}
+
+// DeletedKilometers implements Executor
+func (m *MemoryStore) DeletedKilometers() ([]Kilometers, error) {
+	m.Lock()
+	defer m.Unlock()
+	return m.rows().DeletedKilometers()
+}
+
+// DeletedTimes implements Executor
+func (m *MemoryStore) DeletedTimes() ([]Times, error) {
+	m.Lock()
+	defer m.Unlock()
+	return m.rows().DeletedTimes()
+}
+
+// RestoreDate implements Executor
+func (m *MemoryStore) RestoreDate(date time.Time) error {
+	m.Lock()
+	defer m.Unlock()
+	return m.rows().RestoreDate(date)
+}
+
+// PurgeDeleted implements Executor
+func (m *MemoryStore) PurgeDeleted(before time.Time) (int64, error) {
+	m.Lock()
+	defer m.Unlock()
+	return m.rows().PurgeDeleted(before)
+}
+
+// KilometersBetween implements Executor
+func (m *MemoryStore) KilometersBetween(from, to time.Time) ([]Kilometers, error) {
+	m.Lock()
+	defer m.Unlock()
+	return m.rows().KilometersBetween(from, to)
+}
+
+// TimesBetween implements Executor
+func (m *MemoryStore) TimesBetween(from, to time.Time) ([]Times, error) {
+	m.Lock()
+	defer m.Unlock()
+	return m.rows().TimesBetween(from, to)
+}
+
+// DeleteDate implements Executor
+func (m *MemoryStore) DeleteDate(date time.Time) error {
+	m.Lock()
+	defer m.Unlock()
+	return m.rows().DeleteDate(date)
+}
+
+// TripsForDate implements Executor
+func (m *MemoryStore) TripsForDate(date time.Time) ([]Trip, error) {
+	m.Lock()
+	defer m.Unlock()
+	return m.rows().TripsForDate(date)
+}
+
+// TripsBetween implements Executor
+func (m *MemoryStore) TripsBetween(from, to time.Time) ([]Trip, error) {
+	m.Lock()
+	defer m.Unlock()
+	return m.rows().TripsBetween(from, to)
+}
+
+// GetTrip implements Executor
+func (m *MemoryStore) GetTrip(id int64) (Trip, error) {
+	m.Lock()
+	defer m.Unlock()
+	return m.rows().GetTrip(id)
+}
+
+// PutTrip implements Executor
+func (m *MemoryStore) PutTrip(t *Trip) error {
+	m.Lock()
+	defer m.Unlock()
+	return m.rows().PutTrip(t)
+}
+
+// DeleteTrip implements Executor
+func (m *MemoryStore) DeleteTrip(id int64) error {
+	m.Lock()
+	defer m.Unlock()
+	return m.rows().DeleteTrip(id)
+}
+
+// Vehicles implements Executor
+func (m *MemoryStore) Vehicles() ([]Vehicle, error) {
+	m.Lock()
+	defer m.Unlock()
+	return m.rows().Vehicles()
+}
+
+// GetVehicle implements Executor
+func (m *MemoryStore) GetVehicle(id int64) (Vehicle, error) {
+	m.Lock()
+	defer m.Unlock()
+	return m.rows().GetVehicle(id)
+}
+
+// PutVehicle implements Executor
+func (m *MemoryStore) PutVehicle(v *Vehicle) error {
+	m.Lock()
+	defer m.Unlock()
+	return m.rows().PutVehicle(v)
+}
+
+// ActivateVehicle implements Executor
+func (m *MemoryStore) ActivateVehicle(id int64) error {
+	m.Lock()
+	defer m.Unlock()
+	return m.rows().ActivateVehicle(id)
+}
+
+// PutAudit implements Executor
+func (m *MemoryStore) PutAudit(e *AuditEntry) error {
+	m.Lock()
+	defer m.Unlock()
+	return m.rows().PutAudit(e)
+}
+
+// LastAudit implements Executor
+func (m *MemoryStore) LastAudit() (AuditEntry, error) {
+	m.Lock()
+	defer m.Unlock()
+	return m.rows().LastAudit()
+}
+
+// AuditForDate implements Executor
+func (m *MemoryStore) AuditForDate(date time.Time) ([]AuditEntry, error) {
+	m.Lock()
+	defer m.Unlock()
+	return m.rows().AuditForDate(date)
+}
+
+// AuditLog implements Executor
+func (m *MemoryStore) AuditLog() ([]AuditEntry, error) {
+	m.Lock()
+	defer m.Unlock()
+	return m.rows().AuditLog()
+}
+
+// memoryTx works on a copy of the data of a MemoryStore, which replaces the data
+// of the store on commit. The store is locked until the transaction is done, so
+// transactions are serialized.
+type memoryTx struct {
+	*memoryData
+	store *MemoryStore
+	done  bool
+}
+
+// Begin implements Store
+func (m *MemoryStore) Begin() (Tx, error) {
+	m.Lock()
+	return &memoryTx{memoryData: m.rows().copy(), store: m}, nil
+}
+
+// Commit implements Tx
+func (t *memoryTx) Commit() error {
+	if t.done {
+		return sql.ErrTxDone
+	}
+	t.done = true
+	t.store.data[t.store.user] = t.memoryData
+	t.store.Unlock()
+	return nil
+}
+
+// Rollback implements Tx
+func (t *memoryTx) Rollback() error {
+	if t.done {
+		return sql.ErrTxDone
+	}
+	t.done = true
+	t.store.Unlock()
+	return nil
+}
+
+// ForUser implements Store
+func (m *MemoryStore) ForUser(id int64) Store {
+	return &MemoryStore{memoryDB: m.memoryDB, user: id}
+}
+
+// Users implements Accounts
+func (m *MemoryStore) Users() ([]User, error) {
+	m.Lock()
+	defer m.Unlock()
+	all := make([]User, 0, len(m.users))
+	for _, u := range m.users {
+		all = append(all, u)
+	}
+	sort.Sort(usersByID(all))
+	return all, nil
+}
+
+// GetUser implements Accounts
+func (m *MemoryStore) GetUser(id int64) (User, error) {
+	m.Lock()
+	defer m.Unlock()
+	u, ok := m.users[id]
+	if !ok {
+		return User{}, sql.ErrNoRows
+	}
+	return u, nil
+}
+
+// UserByName implements Accounts
+func (m *MemoryStore) UserByName(name string) (User, error) {
+	m.Lock()
+	defer m.Unlock()
+	for _, u := range m.users {
+		if u.Name == name {
+			return u, nil
+		}
+	}
+	return User{}, sql.ErrNoRows
+}
+
+// PutUser implements Accounts
+func (m *MemoryStore) PutUser(u *User) error {
+	m.Lock()
+	defer m.Unlock()
+	for _, other := range m.users {
+		if other.Name == u.Name && other.ID != u.ID {
+			return fmt.Errorf("there is a user %s already", u.Name)
+		}
+	}
+	if u.ID == 0 {
+		m.lastID++
+		u.ID = m.lastID
+	} else if _, ok := m.users[u.ID]; !ok {
+		return sql.ErrNoRows
+	}
+	m.users[u.ID] = *u
+	return nil
+}
+
+// ClaimRows implements Accounts
+func (m *MemoryStore) ClaimRows(id int64) (int64, error) {
+	m.Lock()
+	defer m.Unlock()
+	unowned, ok := m.data[0]
+	if !ok {
+		return 0, nil
+	}
+	if owned, ok := m.data[id]; ok && (len(owned.kilometers) > 0 || len(owned.times) > 0 || len(owned.vehicles) > 0 || len(owned.audit) > 0) {
+		return 0, fmt.Errorf("user %d has rows saved already", id)
+	}
+	claimed := newMemoryData(m.memoryDB, id)
+	for date, k := range unowned.kilometers {
+		k.UserID = id
+		claimed.kilometers[date] = k
+	}
+	for date, t := range unowned.times {
+		t.UserID = id
+		claimed.times[date] = t
+	}
+	for tid, t := range unowned.trips {
+		t.UserID = id
+		claimed.trips[tid] = t
+	}
+	for vid, v := range unowned.vehicles {
+		v.UserID = id
+		claimed.vehicles[vid] = v
+	}
+	for _, e := range unowned.audit {
+		e.UserID = id
+		claimed.audit = append(claimed.audit, e)
+	}
+	delete(m.data, 0)
+	m.data[id] = claimed
+	return int64(len(claimed.kilometers) + len(claimed.times) + len(claimed.trips) + len(claimed.vehicles) + len(claimed.audit)), nil
+}
+
+// PutSession implements Accounts
+func (m *MemoryStore) PutSession(session *Session) error {
+	m.Lock()
+	defer m.Unlock()
+	if _, ok := m.sessions[session.TokenHash]; ok {
+		return fmt.Errorf("there is a session with this token already")
+	}
+	m.sessions[session.TokenHash] = *session
+	return nil
+}
+
+// GetSession implements Accounts
+func (m *MemoryStore) GetSession(tokenHash string) (Session, error) {
+	m.Lock()
+	defer m.Unlock()
+	session, ok := m.sessions[tokenHash]
+	if !ok {
+		return Session{}, sql.ErrNoRows
+	}
+	return session, nil
+}
+
+// DeleteSession implements Accounts
+func (m *MemoryStore) DeleteSession(tokenHash string) error {
+	m.Lock()
+	defer m.Unlock()
+	if _, ok := m.sessions[tokenHash]; !ok {
+		return sql.ErrNoRows
+	}
+	delete(m.sessions, tokenHash)
+	return nil
+}
+
+// DeleteSessions implements Accounts
+func (m *MemoryStore) DeleteSessions(userID int64) (int64, error) {
+	return m.deleteSessions(func(session Session) bool { return session.UserID == userID })
+}
+
+// DeleteExpiredSessions implements Accounts
+func (m *MemoryStore) DeleteExpiredSessions(before time.Time) (int64, error) {
+	return m.deleteSessions(func(session Session) bool { return session.Expires.Before(before) })
+}
+
+// deleteSessions removes the sessions matching f
+func (m *MemoryStore) deleteSessions(f func(Session) bool) (deleted int64, err error) {
+	m.Lock()
+	defer m.Unlock()
+	for hash, session := range m.sessions {
+		if f(session) {
+			delete(m.sessions, hash)
+			deleted++
+		}
+	}
+	return deleted, nil
+}
+
+// Close implements Store
+func (m *MemoryStore) Close() error {
+	return nil
+}
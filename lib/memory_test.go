@@ -0,0 +1,155 @@
+package km
+
+import (
+	"database/sql"
+	"testing"
+	"time"
+)
+
+func TestMemoryStoreUpsert(t *testing.T) {
+	store := NewMemoryStore()
+	date := time.Date(2014, time.January, 1, 0, 0, 0, 0, time.UTC)
+	if _, err := store.GetKilometers(date); err != sql.ErrNoRows {
+		t.Errorf("expected sql.ErrNoRows on empty store, got: %v", err)
+	}
+
+	if err := store.PutKilometers(&Kilometers{Date: date, Begin: 1}); err != nil {
+		t.Fatal(err)
+	}
+	// a new row for a date already saved replaces the saved one
+	if err := store.PutKilometers(&Kilometers{Date: date.Add(8 * time.Hour), Begin: 2}); err != nil {
+		t.Fatal(err)
+	}
+	k, err := store.GetKilometers(date)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if k.Begin != 2 || k.ID != 1 {
+		t.Errorf("expected updated row with id 1, got: %+v", k)
+	}
+	if all, _ := store.KilometersInMonth(2014, 1); len(all) != 1 {
+		t.Errorf("expected 1 row, got %d", len(all))
+	}
+}
+
+func TestMemoryStoreLastAndMonth(t *testing.T) {
+	store := NewMemoryStore()
+	if _, err := store.LastKilometers(0); err != sql.ErrNoRows {
+		t.Errorf("expected sql.ErrNoRows on empty store, got: %v", err)
+	}
+	for i, date := range []time.Time{
+		time.Date(2014, time.January, 30, 0, 0, 0, 0, time.UTC),
+		time.Date(2014, time.February, 2, 0, 0, 0, 0, time.UTC),
+		time.Date(2014, time.January, 31, 0, 0, 0, 0, time.UTC),
+	} {
+		store.PutKilometers(&Kilometers{Date: date, Terug: i + 1})
+		store.PutTimes(&Times{Date: date, Begin: int64(i + 1)})
+	}
+
+	k, err := store.LastKilometers(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if k.Terug != 2 {
+		t.Errorf("expected february 2nd as last day, got: %+v", k)
+	}
+	times, _ := store.LastTimes(2)
+	if len(times) != 2 || times[0].Begin != 2 || times[1].Begin != 3 {
+		t.Errorf("expected the 2 most recent times, got: %+v", times)
+	}
+
+	if k, _ = store.PreviousKilometers(0, time.Date(2014, time.February, 2, 0, 0, 0, 0, time.UTC)); k.Terug != 3 {
+		t.Errorf("expected january 31st as previous day, got: %+v", k)
+	}
+	if _, err = store.PreviousKilometers(0, time.Date(2014, time.January, 30, 0, 0, 0, 0, time.UTC)); err != sql.ErrNoRows {
+		t.Errorf("expected sql.ErrNoRows before the first day, got: %v", err)
+	}
+	if k, _ = store.NextKilometers(0, time.Date(2014, time.January, 30, 0, 0, 0, 0, time.UTC)); k.Terug != 3 {
+		t.Errorf("expected january 31st as next day, got: %+v", k)
+	}
+	if _, err = store.NextKilometers(0, time.Date(2014, time.February, 2, 0, 0, 0, 0, time.UTC)); err != sql.ErrNoRows {
+		t.Errorf("expected sql.ErrNoRows after the last day, got: %v", err)
+	}
+
+	january, _ := store.KilometersInMonth(2014, 1)
+	if len(january) != 2 || january[0].Terug != 3 || january[1].Terug != 1 {
+		t.Errorf("expected the 2 january rows most recent first, got: %+v", january)
+	}
+	if all, _ := store.TimesInMonth(2013, 1); len(all) != 0 {
+		t.Errorf("expected no rows in 2013, got: %+v", all)
+	}
+	between, _ := store.KilometersBetween(time.Date(2014, time.January, 31, 0, 0, 0, 0, time.UTC), time.Date(2014, time.February, 2, 0, 0, 0, 0, time.UTC))
+	if len(between) != 2 || between[0].Terug != 2 || between[1].Terug != 3 {
+		t.Errorf("expected january 31st and february 2nd most recent first, got: %+v", between)
+	}
+	if all, _ := store.TimesBetween(time.Date(2014, time.January, 30, 0, 0, 0, 0, time.UTC), time.Date(2014, time.January, 30, 0, 0, 0, 0, time.UTC)); len(all) != 1 || all[0].Begin != 1 {
+		t.Errorf("expected only january 30th, got: %+v", all)
+	}
+
+	store.DeleteDate(time.Date(2014, time.February, 2, 0, 0, 0, 0, time.UTC))
+	if k, _ = store.LastKilometers(0); k.Terug != 3 {
+		t.Errorf("expected january 31st as last day after delete, got: %+v", k)
+	}
+}
+
+func TestMemoryStoreTx(t *testing.T) {
+	store := NewMemoryStore()
+	date := time.Date(2014, time.January, 1, 0, 0, 0, 0, time.UTC)
+
+	tx, _ := store.Begin()
+	tx.PutKilometers(&Kilometers{Date: date, Begin: 1})
+	if err := tx.Rollback(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := store.GetKilometers(date); err != sql.ErrNoRows {
+		t.Errorf("rolled back row should not be saved, got: %v", err)
+	}
+
+	tx, _ = store.Begin()
+	tx.PutKilometers(&Kilometers{Date: date, Begin: 2})
+	if err := tx.Commit(); err != nil {
+		t.Fatal(err)
+	}
+	if err := tx.Rollback(); err != sql.ErrTxDone {
+		t.Errorf("expected sql.ErrTxDone on rollback after commit, got: %v", err)
+	}
+	if k, _ := store.GetKilometers(date); k.Begin != 2 {
+		t.Errorf("committed row should be saved, got: %+v", k)
+	}
+}
+
+func TestMemoryStoreTrash(t *testing.T) {
+	store := NewMemoryStore()
+	date := time.Date(2014, time.January, 1, 0, 0, 0, 0, time.UTC)
+	store.PutKilometers(&Kilometers{Date: date, Begin: 1})
+	store.PutTimes(&Times{Date: date, Begin: 1})
+
+	store.DeleteDate(date)
+	if _, err := store.GetKilometers(date); err != sql.ErrNoRows {
+		t.Errorf("expected sql.ErrNoRows for a deleted day, got: %v", err)
+	}
+	if kms, _ := store.DeletedKilometers(); len(kms) != 1 || kms[0].DeletedAt == nil {
+		t.Errorf("expected the deleted day in the trash, got: %+v", kms)
+	}
+	if purged, _ := store.PurgeDeleted(time.Now().Add(-time.Hour)); purged != 0 {
+		t.Errorf("expected nothing purged within retention, got: %d", purged)
+	}
+
+	if err := store.RestoreDate(date); err != nil {
+		t.Fatal(err)
+	}
+	if k, err := store.GetKilometers(date); err != nil || k.Begin != 1 {
+		t.Errorf("expected the restored day, got: %+v, %v", k, err)
+	}
+	if err := store.RestoreDate(date); err != sql.ErrNoRows {
+		t.Errorf("expected sql.ErrNoRows restoring a day not in the trash, got: %v", err)
+	}
+
+	store.DeleteDate(date)
+	if purged, _ := store.PurgeDeleted(time.Now().Add(time.Hour)); purged != 2 {
+		t.Errorf("expected both rows purged, got: %d", purged)
+	}
+	if times, _ := store.DeletedTimes(); len(times) != 0 {
+		t.Errorf("expected an empty trash after purge, got: %+v", times)
+	}
+}
@@ -0,0 +1,112 @@
+package km
+
+import (
+	"database/sql"
+	"fmt"
+)
+
+// Migration is a numbered change to the database schema, Up applies it and Down reverts it
+type Migration struct {
+	Version int
+	Name    string
+	Up      string
+	Down    string
+}
+
+// Migrator is implemented by stores with a database schema that needs migrating
+type Migrator interface {
+	// MigrateUp applies all migrations not applied yet
+	MigrateUp() error
+	// MigrateDown reverts the last applied migration
+	MigrateDown() error
+	// MigrationStatus returns the current schema version and all known migrations
+	MigrationStatus() (version int, migrations []Migration, err error)
+}
+
+// migrator runs migrations against a database and keeps track of the applied ones
+// in the schema_version table
+type migrator struct {
+	db         *sql.DB
+	migrations []Migration
+	// versionTable creates the schema_version table if it does not exist yet
+	versionTable string
+	// bindVar formats the i-th (starting at 1) query parameter
+	bindVar func(i int) string
+	// resetIDs makes new rows get ids after the ones loaded by Load, if the database needs that
+	resetIDs string
+}
+
+func (m *migrator) version() (int, error) {
+	if _, err := m.db.Exec(m.versionTable); err != nil {
+		return 0, fmt.Errorf("creating schema_version: %s", err)
+	}
+	var version sql.NullInt64
+	if err := m.db.QueryRow("select max(version) from schema_version").Scan(&version); err != nil {
+		return 0, fmt.Errorf("reading schema_version: %s", err)
+	}
+	return int(version.Int64), nil
+}
+
+// run executes the sql of a migration and records the new version in the same transaction
+func (m *migrator) run(query, record string, version int) error {
+	tx, err := m.db.Begin()
+	if err != nil {
+		return err
+	}
+	if _, err = tx.Exec(query); err != nil {
+		tx.Rollback()
+		return err
+	}
+	if _, err = tx.Exec(record, version); err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
+
+// MigrateUp implements Migrator
+func (m *migrator) MigrateUp() error {
+	current, err := m.version()
+	if err != nil {
+		return err
+	}
+	for _, migration := range m.migrations {
+		if migration.Version <= current {
+			continue
+		}
+		err = m.run(migration.Up, "insert into schema_version (version) values ("+m.bindVar(1)+")", migration.Version)
+		if err != nil {
+			return fmt.Errorf("migration %d (%s) up: %s", migration.Version, migration.Name, err)
+		}
+	}
+	return nil
+}
+
+// MigrateDown implements Migrator
+func (m *migrator) MigrateDown() error {
+	current, err := m.version()
+	if err != nil {
+		return err
+	}
+	for i := len(m.migrations) - 1; i >= 0; i-- {
+		migration := m.migrations[i]
+		if migration.Version != current {
+			continue
+		}
+		err = m.run(migration.Down, "delete from schema_version where version="+m.bindVar(1), migration.Version)
+		if err != nil {
+			return fmt.Errorf("migration %d (%s) down: %s", migration.Version, migration.Name, err)
+		}
+		return nil
+	}
+	if current == 0 {
+		return fmt.Errorf("no migrations applied")
+	}
+	return fmt.Errorf("unknown schema version: %d", current)
+}
+
+// MigrationStatus implements Migrator
+func (m *migrator) MigrationStatus() (version int, migrations []Migration, err error) {
+	version, err = m.version()
+	return version, m.migrations, err
+}
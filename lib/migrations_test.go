@@ -0,0 +1,81 @@
+package km
+
+import (
+	"database/sql"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	_ "github.com/mattn/go-sqlite3"
+)
+
+func MigratorSetup(t *testing.T) (m *migrator, cleanup func()) {
+	dir, err := ioutil.TempDir("", "km")
+	if err != nil {
+		t.Fatal(err)
+	}
+	db, err := sql.Open("sqlite3", filepath.Join(dir, "km_test.db"))
+	if err != nil {
+		os.RemoveAll(dir)
+		t.Fatal(err)
+	}
+	m = &migrator{
+		db:           db,
+		migrations:   sqliteMigrations,
+		versionTable: "create table if not exists schema_version (version integer primary key, applied_at datetime not null default current_timestamp)",
+		bindVar:      func(i int) string { return "?" },
+	}
+	return m, func() {
+		db.Close()
+		os.RemoveAll(dir)
+	}
+}
+
+func TestMigrateUpDown(t *testing.T) {
+	m, cleanup := MigratorSetup(t)
+	defer cleanup()
+
+	version, migrations, err := m.MigrationStatus()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if version != 0 {
+		t.Errorf("expected version 0 on a new database, got %d", version)
+	}
+	latest := migrations[len(migrations)-1].Version
+
+	if err = m.MigrateUp(); err != nil {
+		t.Fatal(err)
+	}
+	if version, _, _ = m.MigrationStatus(); version != latest {
+		t.Errorf("expected version %d after migrating up, got %d", latest, version)
+	}
+	if _, err = m.db.Exec("insert into kilometers (date, comment) values ('2014-01-01', 'test')"); err != nil {
+		t.Errorf("kilometers table not usable after migrating up: %s", err)
+	}
+	// migrating up again is a no-op
+	if err = m.MigrateUp(); err != nil {
+		t.Fatal(err)
+	}
+
+	if err = m.MigrateDown(); err != nil {
+		t.Fatal(err)
+	}
+	if version, _, _ = m.MigrationStatus(); version != latest-1 {
+		t.Errorf("expected version %d after migrating down, got %d", latest-1, version)
+	}
+
+	for version > 0 {
+		if err = m.MigrateDown(); err != nil {
+			t.Fatal(err)
+		}
+		version, _, _ = m.MigrationStatus()
+	}
+	if err = m.MigrateDown(); err == nil {
+		t.Error("migrating down without any migrations applied should fail")
+	}
+	if _, err = m.db.Exec("select * from kilometers"); err == nil {
+		t.Error("kilometers table should be gone after migrating all the way down")
+	}
+}
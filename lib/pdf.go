@@ -0,0 +1,271 @@
+package km
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/jung-kurt/gofpdf"
+)
+
+// PDFReport is a report of the km driven and the hours worked in a month or year, to be signed
+// by the driver
+type PDFReport struct {
+	// Title is the period of the report, like "January 2014"
+	Title string
+	// Name and LicensePlate are of the driver and the cars driven in the period
+	Name         string
+	LicensePlate string
+	// Days are the days saved in the period, oldest first
+	Days []ExportDay
+}
+
+// reportMonth is a month of a report, with its totals
+type reportMonth struct {
+	month    time.Month
+	year     int
+	days     []ExportDay
+	distance int
+	hours    float64
+}
+
+// byMonth groups days, oldest first, by month
+func byMonth(days []ExportDay) []reportMonth {
+	var months []reportMonth
+	for _, day := range days {
+		if n := len(months); n == 0 || months[n-1].month != day.Date.Month() || months[n-1].year != day.Date.Year() {
+			months = append(months, reportMonth{month: day.Date.Month(), year: day.Date.Year()})
+		}
+		month := &months[len(months)-1]
+		month.days = append(month.days, day)
+		month.distance += day.Distance
+		month.hours += day.Hours
+	}
+	return months
+}
+
+// pdfColumn is a column of the table of days of a report
+type pdfColumn struct {
+	title string
+	width float64
+	align string
+	value func(ExportDay) string
+}
+
+// pdfColumns are the columns of the table of days, they fit landscape A4
+var pdfColumns = []pdfColumn{
+	{"Date", 22, "L", func(d ExportDay) string { return d.Date.Format("Mon 02-01") }},
+	{"Begin", 18, "R", func(d ExportDay) string { return pdfKm(d.Readings.Begin) }},
+	{"Eerste", 18, "R", func(d ExportDay) string { return pdfKm(d.Readings.Eerste) }},
+	{"Laatste", 18, "R", func(d ExportDay) string { return pdfKm(d.Readings.Laatste) }},
+	{"Terug", 18, "R", func(d ExportDay) string { return pdfKm(d.Readings.Terug) }},
+	{"Km", 15, "R", func(d ExportDay) string { return strconv.Itoa(d.Distance) }},
+	{"Begin", 16, "C", func(d ExportDay) string { return d.Times.Begin }},
+	{"Eerste", 16, "C", func(d ExportDay) string { return d.Times.Eerste }},
+	{"Laatste", 16, "C", func(d ExportDay) string { return d.Times.Laatste }},
+	{"Terug", 16, "C", func(d ExportDay) string { return d.Times.Terug }},
+	{"Hours", 15, "R", func(d ExportDay) string { return pdfHours(d.Hours) }},
+	{"Comment", 89, "L", func(d ExportDay) string { return d.Comment }},
+}
+
+func pdfKm(km int) string {
+	if km == 0 {
+		return ""
+	}
+	return strconv.Itoa(km)
+}
+
+func pdfHours(hours float64) string {
+	return strconv.FormatFloat(hours, 'f', 2, 64)
+}
+
+// WritePDF writes report as a PDF: a header with the driver and the car, a table of the days with
+// the km driven and the hours worked, totals for every month and a line to sign
+func WritePDF(w io.Writer, report PDFReport) error {
+	pdf := gofpdf.New("L", "mm", "A4", "")
+	// the core fonts are cp1252
+	tr := pdf.UnicodeTranslatorFromDescriptor("")
+	pdf.SetTitle(report.Title, true)
+	pdf.SetCreator("km", false)
+	pdf.AliasNbPages("")
+	pdf.SetFooterFunc(func() {
+		pdf.SetY(-15)
+		pdf.SetFont("Helvetica", "I", 8)
+		pdf.CellFormat(0, 10, fmt.Sprintf("%s - %d/{nb}", tr(report.Title), pdf.PageNo()), "", 0, "C", false, 0, "")
+	})
+	pdf.AddPage()
+
+	pdf.SetFont("Helvetica", "B", 16)
+	pdf.CellFormat(0, 10, tr("Kilometers and hours "+report.Title), "", 1, "L", false, 0, "")
+	pdf.SetFont("Helvetica", "", 11)
+	pdf.CellFormat(0, 6, tr("Name: "+report.Name), "", 1, "L", false, 0, "")
+	pdf.CellFormat(0, 6, tr("License plate: "+report.LicensePlate), "", 1, "L", false, 0, "")
+	pdf.Ln(4)
+
+	header := func() {
+		pdf.SetFont("Helvetica", "B", 9)
+		pdf.SetFillColor(220, 220, 220)
+		for _, column := range pdfColumns {
+			pdf.CellFormat(column.width, 7, column.title, "1", 0, "C", true, 0, "")
+		}
+		pdf.Ln(-1)
+		pdf.SetFont("Helvetica", "", 9)
+	}
+	// row is called before every row, to start a new page with the header when it is full
+	_, pageHeight := pdf.GetPageSize()
+	_, _, _, bottom := pdf.GetMargins()
+	row := func() {
+		if pdf.GetY()+6 > pageHeight-bottom {
+			pdf.AddPage()
+			header()
+		}
+	}
+	total := func(label string, distance int, hours float64) {
+		row()
+		pdf.SetFont("Helvetica", "B", 9)
+		for i, column := range pdfColumns {
+			text := ""
+			switch {
+			case i == 0:
+				text = label
+			case column.title == "Km":
+				text = strconv.Itoa(distance)
+			case column.title == "Hours":
+				text = pdfHours(hours)
+			}
+			border := "TB"
+			if i == 0 {
+				border = "LTB"
+			} else if i == len(pdfColumns)-1 {
+				border = "RTB"
+			}
+			pdf.CellFormat(column.width, 6, tr(text), border, 0, column.align, false, 0, "")
+		}
+		pdf.Ln(-1)
+		pdf.SetFont("Helvetica", "", 9)
+	}
+
+	header()
+	months := byMonth(report.Days)
+	if len(months) == 0 {
+		pdf.CellFormat(0, 6, "Nothing is saved for this period.", "", 1, "L", false, 0, "")
+	}
+	distance, hours := 0, 0.0
+	for _, month := range months {
+		for _, day := range month.days {
+			row()
+			for _, column := range pdfColumns {
+				text := tr(column.value(day))
+				// the comment is cut off rather than run into the next cell
+				for pdf.GetStringWidth(text) > column.width-2 {
+					text = text[:len(text)-1]
+				}
+				pdf.CellFormat(column.width, 6, text, "1", 0, column.align, false, 0, "")
+			}
+			pdf.Ln(-1)
+		}
+		total(fmt.Sprintf("Total %s %d", month.month, month.year), month.distance, month.hours)
+		distance += month.distance
+		hours += month.hours
+	}
+	if len(months) > 1 {
+		total("Total "+report.Title, distance, hours)
+	}
+
+	// the signature needs room for itself
+	if pdf.GetY()+30 > pageHeight-bottom {
+		pdf.AddPage()
+	}
+	pdf.Ln(16)
+	pdf.SetFont("Helvetica", "", 11)
+	x, y := pdf.GetXY()
+	pdf.Line(x, y, x+60, y)
+	pdf.Line(x+80, y, x+180, y)
+	pdf.CellFormat(80, 6, "Date", "", 0, "L", false, 0, "")
+	pdf.CellFormat(100, 6, tr("Signature "+report.Name), "", 1, "L", false, 0, "")
+	return pdf.Output(w)
+}
+
+// licensePlates returns the license plates of the vehicles driven on days, in the order they were
+// first driven. Days saved before there were vehicles were driven in the car with fallback.
+func licensePlates(ex Executor, days []ExportDay, fallback string) (string, error) {
+	vehicles, err := ex.Vehicles()
+	if err != nil {
+		return "", err
+	}
+	plates := make(map[int64]string)
+	for _, v := range vehicles {
+		plates[v.ID] = v.LicensePlate
+	}
+	var driven []string
+	seen := make(map[string]bool)
+	for _, day := range days {
+		r := day.Readings
+		if r.Begin == 0 && r.Eerste == 0 && r.Laatste == 0 && r.Terug == 0 {
+			continue
+		}
+		plate, ok := plates[day.Vehicle]
+		if !ok {
+			plate = fallback
+		}
+		if plate != "" && !seen[plate] {
+			seen[plate] = true
+			driven = append(driven, plate)
+		}
+	}
+	if len(driven) == 0 {
+		return fallback, nil
+	}
+	return strings.Join(driven, ", "), nil
+}
+
+// reportPDFHandler downloads the PDF report of a year, or of a month of it, for the user logged in
+func (s *Server) reportPDFHandler(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	// the routes only match digits
+	year, _ := strconv.Atoi(vars["year"])
+	from := time.Date(year, time.January, 1, 0, 0, 0, 0, time.UTC)
+	to, title, name := from.AddDate(1, 0, -1), vars["year"], "km-"+vars["year"]
+	if vars["month"] != "" {
+		month, _ := strconv.Atoi(vars["month"])
+		if month < 1 || month > 12 {
+			response := InvalidURL
+			response.Extra = fmt.Sprintf("there is no month %d", month)
+			WriteError(w, r, response)
+			return
+		}
+		from = time.Date(year, time.Month(month), 1, 0, 0, 0, 0, time.UTC)
+		to, title, name = from.AddDate(0, 1, -1), from.Format("January 2006"), from.Format("km-2006-01")
+	}
+	err, loc := s.requestLocation(r)
+	if err != nil {
+		WriteError(w, r, err)
+		return
+	}
+	days, err := GetExportDays(s.store(r), from, to, loc)
+	if err != nil {
+		WriteError(w, r, err)
+		return
+	}
+	plates, err := licensePlates(s.store(r), days, s.config.LicensePlate)
+	if err != nil {
+		WriteError(w, r, CustomResponse(DbError, err))
+		return
+	}
+	report := PDFReport{Title: title, Name: userOf(r).Name, LicensePlate: plates, Days: days}
+	if report.Name == "" {
+		report.Name = s.config.Name
+	}
+	var b bytes.Buffer
+	if err = WritePDF(&b, report); err != nil {
+		WriteError(w, r, CustomResponse(ReportError, err))
+		return
+	}
+	attachment(w, "application/pdf", name+".pdf")
+	b.WriteTo(w)
+}
@@ -0,0 +1,117 @@
+package km
+
+import (
+	"bytes"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestByMonth(t *testing.T) {
+	day := func(month time.Month, d, distance int, hours float64) ExportDay {
+		return ExportDay{Day: Day{Date: time.Date(2014, month, d, 0, 0, 0, 0, time.UTC), Hours: hours}, Distance: distance}
+	}
+	months := byMonth([]ExportDay{
+		day(time.January, 2, 70, 8),
+		day(time.January, 3, 30, 7.5),
+		day(time.March, 1, 10, 0),
+	})
+	if len(months) != 2 {
+		t.Fatalf("got %d months, want 2", len(months))
+	}
+	if m := months[0]; m.month != time.January || len(m.days) != 2 || m.distance != 100 || m.hours != 15.5 {
+		t.Errorf("january: got %+v", m)
+	}
+	if m := months[1]; m.month != time.March || len(m.days) != 1 || m.distance != 10 || m.hours != 0 {
+		t.Errorf("march: got %+v", m)
+	}
+}
+
+func TestWritePDF(t *testing.T) {
+	var days []ExportDay
+	// enough days for more than one page
+	for d := 1; d <= 60; d++ {
+		days = append(days, ExportDay{
+			Day:      Day{Date: time.Date(2014, time.January, d, 0, 0, 0, 0, time.UTC), Times: Stamps{Begin: "08:00"}, Hours: 8},
+			Distance: 50,
+			Comment:  "a comment that is much too long to fit in its column of the table of days, it is cut off",
+		})
+	}
+	for _, report := range []PDFReport{
+		PDFReport{Title: "2014", Name: "Jöns", LicensePlate: "12-AB-34", Days: days},
+		PDFReport{Title: "January 2014"},
+	} {
+		var b bytes.Buffer
+		if err := WritePDF(&b, report); err != nil {
+			t.Fatalf("%s: %s", report.Title, err)
+		}
+		if !bytes.HasPrefix(b.Bytes(), []byte("%PDF-")) {
+			t.Errorf("%s: not a pdf", report.Title)
+		}
+	}
+}
+
+func TestLicensePlates(t *testing.T) {
+	store := NewMemoryStore()
+	date := func(day int) time.Time { return time.Date(2014, time.January, day, 0, 0, 0, 0, time.UTC) }
+	day := func(d int, vehicle int64, begin int) ExportDay {
+		return ExportDay{Day: Day{Date: date(d), Readings: Readings{Begin: begin}, Vehicle: vehicle}}
+	}
+	if plates, err := licensePlates(store, nil, "12-AB-34"); err != nil || plates != "12-AB-34" {
+		t.Errorf("no days: got %q %v, want %q", plates, err, "12-AB-34")
+	}
+	for _, v := range []Vehicle{
+		Vehicle{LicensePlate: "56-CD-78", StartDate: date(10)},
+		Vehicle{LicensePlate: "90-EF-12", StartDate: date(20)},
+		Vehicle{LicensePlate: "34-GH-56", StartDate: date(30)},
+	} {
+		if err := SaveVehicle(store, &v); err != nil {
+			t.Fatal(err)
+		}
+	}
+	days := []ExportDay{day(2, 0, 1000), day(11, 1, 1100), day(12, 1, 1200), day(21, 2, 1300), day(30, 3, 0)}
+	want := "12-AB-34, 56-CD-78, 90-EF-12"
+	if plates, err := licensePlates(store, days, "12-AB-34"); err != nil || plates != want {
+		t.Errorf("got %q %v, want %q", plates, err, want)
+	}
+}
+
+func TestReportPDFHandler(t *testing.T) {
+	initServer(t)
+	apiRequest(t, "PUT", "/api/v1/days/2014-01-02/readings", `{"begin": 1000, "terug": 1070}`, nil)
+
+	var tests = []struct {
+		url      string
+		code     int
+		filename string
+	}{
+		{"/api/v1/reports/2014/01.pdf", 200, "km-2014-01.pdf"},
+		{"/api/v1/reports/2014/1.pdf", 200, "km-2014-01.pdf"},
+		{"/api/v1/reports/2014.pdf", 200, "km-2014.pdf"},
+		{"/api/v1/reports/2014/13.pdf", InvalidURL.Code, ""},
+	}
+	for _, tt := range tests {
+		req, _ := http.NewRequest("GET", tt.url, nil)
+		w := serve(req)
+		if w.Code != tt.code {
+			t.Errorf("GET %s: code = %d, want %d", tt.url, w.Code, tt.code)
+			continue
+		}
+		if tt.code != 200 {
+			continue
+		}
+		if got := w.Header().Get("Content-Type"); got != "application/pdf" {
+			t.Errorf("GET %s: Content-Type = %q, want application/pdf", tt.url, got)
+		}
+		if got, want := w.Header().Get("Content-Disposition"), `attachment; filename="`+tt.filename+`"`; got != want {
+			t.Errorf("GET %s: Content-Disposition = %q, want %q", tt.url, got, want)
+		}
+		if !bytes.HasPrefix(w.Body.Bytes(), []byte("%PDF-")) {
+			t.Errorf("GET %s: not a pdf", tt.url)
+		}
+	}
+	// the year report is still there
+	if code := apiRequest(t, "GET", "/api/v1/reports/2014", "", nil); code != 200 {
+		t.Errorf("GET /api/v1/reports/2014: code = %d, want %d", code, 200)
+	}
+}
@@ -0,0 +1,585 @@
+package km
+
+import (
+	"database/sql"
+	"fmt"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/coopernurse/gorp"
+	// postgres for its side effects
+	_ "github.com/lib/pq"
+)
+
+// PostgresStore is a Store backed by a postgres database
+type PostgresStore struct {
+	postgresExecutor
+	Dbmap *gorp.DbMap
+	*migrator
+	// offline is set for test databases that could not be reached
+	offline bool
+}
+
+var postgresMigrations = []Migration{
+	{
+		Version: 1,
+		Name:    "create kilometers and times tables",
+		Up: `create table if not exists kilometers (
+			id serial primary key,
+			date date not null,
+			begin integer not null default 0,
+			eerste integer not null default 0,
+			laatste integer not null default 0,
+			terug integer not null default 0
+		);
+		create table if not exists times (
+			id serial primary key,
+			date date not null,
+			begin bigint not null default 0,
+			checkin bigint not null default 0,
+			checkout bigint not null default 0,
+			laatste bigint not null default 0
+		)`,
+		Down: "drop table times; drop table kilometers",
+	},
+	{
+		Version: 2,
+		Name:    "add comment to kilometers",
+		Up:      "alter table kilometers add column if not exists comment text not null default ''",
+		Down:    "alter table kilometers drop column comment",
+	},
+	{
+		Version: 3,
+		Name:    "one row per date",
+		Up: `create unique index if not exists kilometers_date_key on kilometers (date);
+		create unique index if not exists times_date_key on times (date)`,
+		Down: "drop index times_date_key; drop index kilometers_date_key",
+	},
+	{
+		Version: 4,
+		Name:    "mark inferred readings",
+		Up:      "alter table kilometers add column if not exists inferred boolean not null default false",
+		Down:    "alter table kilometers drop column inferred",
+	},
+	{
+		Version: 5,
+		Name:    "keep deleted days in the trash",
+		Up: `alter table kilometers add column if not exists deleted_at timestamp with time zone;
+		alter table times add column if not exists deleted_at timestamp with time zone`,
+		Down: "alter table times drop column deleted_at; alter table kilometers drop column deleted_at",
+	},
+	{
+		Version: 6,
+		Name:    "audit log",
+		Up: `create table if not exists audit (
+			id serial primary key,
+			date date not null,
+			at timestamp with time zone not null,
+			kind text not null,
+			action text not null,
+			before text not null default '',
+			after text not null default '',
+			remote_addr text not null default '',
+			user_name text not null default '',
+			request_id text not null default ''
+		);
+		create index if not exists audit_date on audit (date)`,
+		Down: "drop table audit",
+	},
+	{
+		Version: 7,
+		Name:    "chain the audit log",
+		Up: `alter table audit add column if not exists prev_hash text not null default '';
+		alter table audit add column if not exists hash text not null default '';
+		create unique index if not exists audit_prev_hash_key on audit (prev_hash) where hash <> ''`,
+		Down: "drop index audit_prev_hash_key; alter table audit drop column hash; alter table audit drop column prev_hash",
+	},
+	{
+		Version: 8,
+		Name:    "trips",
+		Up: `create table if not exists trips (
+			id serial primary key,
+			date date not null,
+			start_km integer not null,
+			end_km integer not null,
+			from_address text not null default '',
+			to_address text not null default '',
+			purpose text not null default '',
+			type text not null,
+			deleted_at timestamp with time zone
+		);
+		create index if not exists trips_date on trips (date)`,
+		Down: "drop table trips",
+	},
+	{
+		Version: 9,
+		Name:    "vehicles",
+		Up: `create table if not exists vehicles (
+			id serial primary key,
+			license_plate text not null,
+			make text not null default '',
+			start_date date not null,
+			end_date date,
+			start_km integer not null default 0,
+			active boolean not null default false
+		);
+		alter table kilometers add column if not exists vehicle_id integer not null default 0`,
+		Down: "alter table kilometers drop column vehicle_id; drop table vehicles",
+	},
+	{
+		Version: 10,
+		Name:    "users",
+		Up: `create table if not exists users (
+			id serial primary key,
+			name text not null unique,
+			disabled boolean not null default false,
+			created_at timestamp with time zone not null default now()
+		);
+		alter table kilometers add column if not exists user_id integer not null default 0;
+		alter table times add column if not exists user_id integer not null default 0;
+		alter table trips add column if not exists user_id integer not null default 0;
+		alter table vehicles add column if not exists user_id integer not null default 0;
+		alter table audit add column if not exists user_id integer not null default 0;
+		drop index if exists kilometers_date_key;
+		drop index if exists times_date_key;
+		drop index if exists audit_prev_hash_key;
+		create unique index if not exists kilometers_user_date_key on kilometers (user_id, date);
+		create unique index if not exists times_user_date_key on times (user_id, date);
+		create unique index if not exists audit_user_prev_hash_key on audit (user_id, prev_hash) where hash <> ''`,
+		Down: `drop index audit_user_prev_hash_key;
+		drop index times_user_date_key;
+		drop index kilometers_user_date_key;
+		create unique index audit_prev_hash_key on audit (prev_hash) where hash <> '';
+		create unique index times_date_key on times (date);
+		create unique index kilometers_date_key on kilometers (date);
+		alter table audit drop column user_id;
+		alter table vehicles drop column user_id;
+		alter table trips drop column user_id;
+		alter table times drop column user_id;
+		alter table kilometers drop column user_id;
+		drop table users`,
+	},
+	{
+		Version: 11,
+		Name:    "sessions",
+		Up: `alter table users add column if not exists password_hash text not null default '';
+		create table if not exists sessions (
+			token_hash text primary key,
+			user_id integer not null references users (id) on delete cascade,
+			created_at timestamp with time zone not null,
+			expires_at timestamp with time zone not null
+		);
+		create index if not exists sessions_user_id on sessions (user_id)`,
+		Down: `drop table sessions;
+		alter table users drop column password_hash`,
+	},
+}
+
+// NewPostgresStore connects to the database dbName on the postgres server at hostPort
+// databases with a name ending in _test are allowed to be unreachable
+func NewPostgresStore(dbName, hostPort string) (*PostgresStore, error) {
+	host := strings.Split(hostPort, ":")
+	if len(host) != 2 {
+		return nil, fmt.Errorf("invalid postgres address: %q", hostPort)
+	}
+	db, creatingDbError := sql.Open("postgres", fmt.Sprintf("host=%s port=%s user=docker dbname=%s password=docker sslmode=disable", host[0], host[1], dbName))
+	testDbRegex := regexp.MustCompile("_test$")
+	err := db.Ping()
+	if !testDbRegex.MatchString(dbName) && err != nil {
+		if creatingDbError != nil {
+			return nil, fmt.Errorf("sql.Open result: %s", creatingDbError)
+		}
+		return nil, fmt.Errorf("ping result: %s", err)
+	}
+	dbmap := &gorp.DbMap{Db: db, Dialect: gorp.PostgresDialect{}}
+	dbmap.AddTable(Kilometers{}).SetKeys(true, "Id")
+	dbmap.AddTable(Times{}).SetKeys(true, "Id")
+	store := newPostgresStore(dbmap)
+	store.offline = err != nil
+	return store, nil
+}
+
+// newPostgresStore creates a PostgresStore on an already set up DbMap
+func newPostgresStore(dbmap *gorp.DbMap) *PostgresStore {
+	return &PostgresStore{
+		postgresExecutor: postgresExecutor{ex: dbmap},
+		Dbmap:            dbmap,
+		migrator: &migrator{
+			db:           dbmap.Db,
+			migrations:   postgresMigrations,
+			versionTable: "create table if not exists schema_version (version integer primary key, applied_at timestamp with time zone not null default now())",
+			bindVar:      func(i int) string { return fmt.Sprintf("$%d", i) },
+			resetIDs: `select setval(pg_get_serial_sequence('kilometers', 'id'), coalesce(max(id), 0) + 1, false) from kilometers;
+			select setval(pg_get_serial_sequence('times', 'id'), coalesce(max(id), 0) + 1, false) from times;
+			select setval(pg_get_serial_sequence('trips', 'id'), coalesce(max(id), 0) + 1, false) from trips;
+			select setval(pg_get_serial_sequence('vehicles', 'id'), coalesce(max(id), 0) + 1, false) from vehicles;
+			select setval(pg_get_serial_sequence('users', 'id'), coalesce(max(id), 0) + 1, false) from users;
+			select setval(pg_get_serial_sequence('audit', 'id'), coalesce(max(id), 0) + 1, false) from audit`,
+		},
+	}
+}
+
+// postgresExecutor runs the queries of a PostgresStore, directly on the database
+// or within a transaction, on the rows of user
+type postgresExecutor struct {
+	ex   gorp.SqlExecutor
+	user int64
+}
+
+// postgresTx is a transaction on a PostgresStore
+type postgresTx struct {
+	postgresExecutor
+	tx *gorp.Transaction
+}
+
+// Begin implements Store
+func (p *PostgresStore) Begin() (Tx, error) {
+	tx, err := p.Dbmap.Begin()
+	if err != nil {
+		return nil, err
+	}
+	return &postgresTx{postgresExecutor{ex: tx, user: p.user}, tx}, nil
+}
+
+// Commit implements Tx
+func (t *postgresTx) Commit() error {
+	return t.tx.Commit()
+}
+
+// Rollback implements Tx
+func (t *postgresTx) Rollback() error {
+	return t.tx.Rollback()
+}
+
+// MigrateUp implements Migrator, there is nothing to migrate on an unreachable test database
+func (p *PostgresStore) MigrateUp() error {
+	if p.offline {
+		return nil
+	}
+	return p.migrator.MigrateUp()
+}
+
+// GetKilometers implements Executor
+func (p postgresExecutor) GetKilometers(date time.Time) (k Kilometers, err error) {
+	err = p.ex.SelectOne(&k, "select * from kilometers where user_id=$1 and date=$2 and deleted_at is null", p.user, truncateDate(date))
+	return
+}
+
+// GetTimes implements Executor
+func (p postgresExecutor) GetTimes(date time.Time) (t Times, err error) {
+	err = p.ex.SelectOne(&t, "select * from times where user_id=$1 and date=$2 and deleted_at is null", p.user, truncateDate(date))
+	return
+}
+
+// LastKilometers implements Executor
+func (p postgresExecutor) LastKilometers(vehicleID int64) (k Kilometers, err error) {
+	err = p.ex.SelectOne(&k, "select * from kilometers where user_id=$1 and vehicle_id=$2 and deleted_at is null order by date desc limit 1", p.user, vehicleID)
+	return
+}
+
+// PreviousKilometers implements Executor
+func (p postgresExecutor) PreviousKilometers(vehicleID int64, date time.Time) (k Kilometers, err error) {
+	err = p.ex.SelectOne(&k, "select * from kilometers where user_id=$1 and vehicle_id=$2 and date < $3 and deleted_at is null order by date desc limit 1", p.user, vehicleID, truncateDate(date))
+	return
+}
+
+// NextKilometers implements Executor
+func (p postgresExecutor) NextKilometers(vehicleID int64, date time.Time) (k Kilometers, err error) {
+	err = p.ex.SelectOne(&k, "select * from kilometers where user_id=$1 and vehicle_id=$2 and date > $3 and deleted_at is null order by date limit 1", p.user, vehicleID, truncateDate(date))
+	return
+}
+
+// LastTimes implements Executor
+func (p postgresExecutor) LastTimes(n int) (times []Times, err error) {
+	_, err = p.ex.Select(&times, fmt.Sprintf("select * from times where user_id=$1 and deleted_at is null order by date desc limit %d", n), p.user)
+	return
+}
+
+// PutKilometers implements Executor
+func (p postgresExecutor) PutKilometers(k *Kilometers) (err error) {
+	k.UserID = p.user
+	k.ID, err = p.ex.SelectInt("insert into kilometers (date, begin, eerste, laatste, terug, comment, inferred, vehicle_id, user_id) "+
+		"values ($1, $2, $3, $4, $5, $6, $7, $8, $9) "+
+		"on conflict (user_id, date) do update set begin=excluded.begin, eerste=excluded.eerste, "+
+		"laatste=excluded.laatste, terug=excluded.terug, comment=excluded.comment, inferred=excluded.inferred, "+
+		"vehicle_id=excluded.vehicle_id, deleted_at=null "+
+		"returning id", k.Date, k.Begin, k.Eerste, k.Laatste, k.Terug, k.Comment, k.Inferred, k.VehicleID, k.UserID)
+	if err == nil && k.ID == 0 {
+		err = fmt.Errorf("upsert of kilometers did not return an id")
+	}
+	return
+}
+
+// PutTimes implements Executor
+func (p postgresExecutor) PutTimes(t *Times) (err error) {
+	t.UserID = p.user
+	t.ID, err = p.ex.SelectInt("insert into times (date, begin, checkin, checkout, laatste, user_id) "+
+		"values ($1, $2, $3, $4, $5, $6) "+
+		"on conflict (user_id, date) do update set begin=excluded.begin, checkin=excluded.checkin, "+
+		"checkout=excluded.checkout, laatste=excluded.laatste, deleted_at=null "+
+		"returning id", t.Date, t.Begin, t.CheckIn, t.CheckOut, t.Laatste, t.UserID)
+	if err == nil && t.ID == 0 {
+		err = fmt.Errorf("upsert of times did not return an id")
+	}
+	return
+}
+
+// KilometersInMonth implements Executor
+func (p postgresExecutor) KilometersInMonth(year, month int64) (all []Kilometers, err error) {
+	_, err = p.ex.Select(&all, "select * from kilometers where user_id=$1 and extract (year from date)=$2 and extract (month from date)=$3 and deleted_at is null order by date desc ", p.user, year, month)
+	return
+}
+
+// TimesInMonth implements Executor
+func (p postgresExecutor) TimesInMonth(year, month int64) (all []Times, err error) {
+	_, err = p.ex.Select(&all, "select * from times where user_id=$1 and extract (year from date)=$2 and extract (month from date)=$3 and deleted_at is null order by date desc ", p.user, year, month)
+	return
+}
+
+// KilometersBetween implements Executor
+func (p postgresExecutor) KilometersBetween(from, to time.Time) (all []Kilometers, err error) {
+	_, err = p.ex.Select(&all, "select * from kilometers where user_id=$1 and date >= $2 and date <= $3 and deleted_at is null order by date desc", p.user, truncateDate(from), truncateDate(to))
+	return
+}
+
+// TimesBetween implements Executor
+func (p postgresExecutor) TimesBetween(from, to time.Time) (all []Times, err error) {
+	_, err = p.ex.Select(&all, "select * from times where user_id=$1 and date >= $2 and date <= $3 and deleted_at is null order by date desc", p.user, truncateDate(from), truncateDate(to))
+	return
+}
+
+// DeleteDate implements Executor
+func (p postgresExecutor) DeleteDate(date time.Time) (err error) {
+	for _, table := range []string{"kilometers", "times", "trips"} {
+		if _, err = p.ex.Exec("update "+table+" set deleted_at=now() where user_id=$1 and date=$2 and deleted_at is null", p.user, truncateDate(date)); err != nil {
+			return
+		}
+	}
+	return
+}
+
+// DeletedKilometers implements Executor
+func (p postgresExecutor) DeletedKilometers() (all []Kilometers, err error) {
+	_, err = p.ex.Select(&all, "select * from kilometers where user_id=$1 and deleted_at is not null order by date desc", p.user)
+	return
+}
+
+// DeletedTimes implements Executor
+func (p postgresExecutor) DeletedTimes() (all []Times, err error) {
+	_, err = p.ex.Select(&all, "select * from times where user_id=$1 and deleted_at is not null order by date desc", p.user)
+	return
+}
+
+// RestoreDate implements Executor
+func (p postgresExecutor) RestoreDate(date time.Time) error {
+	var restored int64
+	for _, table := range []string{"kilometers", "times", "trips"} {
+		result, err := p.ex.Exec("update "+table+" set deleted_at=null where user_id=$1 and date=$2 and deleted_at is not null", p.user, truncateDate(date))
+		if err != nil {
+			return err
+		}
+		n, err := result.RowsAffected()
+		if err != nil {
+			return err
+		}
+		restored += n
+	}
+	if restored == 0 {
+		return sql.ErrNoRows
+	}
+	return nil
+}
+
+// PurgeDeleted implements Executor
+func (p postgresExecutor) PurgeDeleted(before time.Time) (purged int64, err error) {
+	for _, table := range []string{"kilometers", "times", "trips"} {
+		result, err := p.ex.Exec("delete from "+table+" where user_id=$1 and deleted_at < $2", p.user, before)
+		if err != nil {
+			return purged, err
+		}
+		n, err := result.RowsAffected()
+		if err != nil {
+			return purged, err
+		}
+		purged += n
+	}
+	return purged, nil
+}
+
+// PutAudit implements Executor
+func (p postgresExecutor) PutAudit(e *AuditEntry) (err error) {
+	e.UserID = p.user
+	e.ID, err = p.ex.SelectInt("insert into audit (date, at, kind, action, before, after, remote_addr, user_name, request_id, prev_hash, hash, user_id) "+
+		"values ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12) returning id",
+		truncateDate(e.Date), e.At, e.Kind, e.Action, e.Before, e.After, e.RemoteAddr, e.User, e.RequestID, e.PrevHash, e.Hash, e.UserID)
+	return
+}
+
+// LastAudit implements Executor
+func (p postgresExecutor) LastAudit() (e AuditEntry, err error) {
+	err = p.ex.SelectOne(&e, "select * from audit where user_id=$1 order by id desc limit 1", p.user)
+	return
+}
+
+// AuditForDate implements Executor
+func (p postgresExecutor) AuditForDate(date time.Time) (all []AuditEntry, err error) {
+	_, err = p.ex.Select(&all, "select * from audit where user_id=$1 and date=$2 order by id", p.user, truncateDate(date))
+	return
+}
+
+// AuditLog implements Executor
+func (p postgresExecutor) AuditLog() (all []AuditEntry, err error) {
+	_, err = p.ex.Select(&all, "select * from audit where user_id=$1 order by id", p.user)
+	return
+}
+
+// TripsForDate implements Executor
+func (p postgresExecutor) TripsForDate(date time.Time) (all []Trip, err error) {
+	_, err = p.ex.Select(&all, "select * from trips where user_id=$1 and date=$2 and deleted_at is null order by start_km, id", p.user, truncateDate(date))
+	return
+}
+
+// TripsBetween implements Executor
+func (p postgresExecutor) TripsBetween(from, to time.Time) (all []Trip, err error) {
+	_, err = p.ex.Select(&all, "select * from trips where user_id=$1 and date >= $2 and date <= $3 and deleted_at is null order by date, start_km, id", p.user, truncateDate(from), truncateDate(to))
+	return
+}
+
+// GetTrip implements Executor
+func (p postgresExecutor) GetTrip(id int64) (t Trip, err error) {
+	err = p.ex.SelectOne(&t, "select * from trips where user_id=$1 and id=$2 and deleted_at is null", p.user, id)
+	return
+}
+
+// PutTrip implements Executor
+func (p postgresExecutor) PutTrip(t *Trip) error {
+	t.Date, t.UserID = truncateDate(t.Date), p.user
+	if t.ID == 0 {
+		id, err := p.ex.SelectInt("insert into trips (date, start_km, end_km, from_address, to_address, purpose, type, user_id) "+
+			"values ($1, $2, $3, $4, $5, $6, $7, $8) returning id", t.Date, t.StartKm, t.EndKm, t.From, t.To, t.Purpose, t.Type, t.UserID)
+		t.ID = id
+		return err
+	}
+	result, err := p.ex.Exec("update trips set date=$1, start_km=$2, end_km=$3, from_address=$4, to_address=$5, purpose=$6, type=$7 "+
+		"where user_id=$8 and id=$9 and deleted_at is null", t.Date, t.StartKm, t.EndKm, t.From, t.To, t.Purpose, t.Type, t.UserID, t.ID)
+	return affectedOne(result, err)
+}
+
+// DeleteTrip implements Executor
+func (p postgresExecutor) DeleteTrip(id int64) error {
+	return affectedOne(p.ex.Exec("delete from trips where user_id=$1 and id=$2 and deleted_at is null", p.user, id))
+}
+
+// Vehicles implements Executor
+func (p postgresExecutor) Vehicles() (all []Vehicle, err error) {
+	_, err = p.ex.Select(&all, "select * from vehicles where user_id=$1 order by start_date, id", p.user)
+	return
+}
+
+// GetVehicle implements Executor
+func (p postgresExecutor) GetVehicle(id int64) (v Vehicle, err error) {
+	err = p.ex.SelectOne(&v, "select * from vehicles where user_id=$1 and id=$2", p.user, id)
+	return
+}
+
+// PutVehicle implements Executor
+func (p postgresExecutor) PutVehicle(v *Vehicle) error {
+	v.StartDate, v.UserID = truncateDate(v.StartDate), p.user
+	if v.ID == 0 {
+		id, err := p.ex.SelectInt("insert into vehicles (license_plate, make, start_date, end_date, start_km, active, user_id) "+
+			"values ($1, $2, $3, $4, $5, $6, $7) returning id", v.LicensePlate, v.Make, v.StartDate, v.EndDate, v.StartKm, v.Active, v.UserID)
+		v.ID = id
+		return err
+	}
+	result, err := p.ex.Exec("update vehicles set license_plate=$1, make=$2, start_date=$3, end_date=$4, start_km=$5, active=$6 "+
+		"where user_id=$7 and id=$8", v.LicensePlate, v.Make, v.StartDate, v.EndDate, v.StartKm, v.Active, v.UserID, v.ID)
+	return affectedOne(result, err)
+}
+
+// ActivateVehicle implements Executor
+func (p postgresExecutor) ActivateVehicle(id int64) error {
+	if err := affectedOne(p.ex.Exec("update vehicles set active=true where user_id=$1 and id=$2", p.user, id)); err != nil {
+		return err
+	}
+	_, err := p.ex.Exec("update vehicles set active=false where user_id=$1 and id<>$2", p.user, id)
+	return err
+}
+
+// ForUser implements Store
+func (p *PostgresStore) ForUser(id int64) Store {
+	scoped := *p
+	scoped.user = id
+	return &scoped
+}
+
+// Users implements Accounts
+func (p *PostgresStore) Users() (all []User, err error) {
+	_, err = p.Dbmap.Select(&all, "select * from users order by id")
+	return
+}
+
+// GetUser implements Accounts
+func (p *PostgresStore) GetUser(id int64) (u User, err error) {
+	err = p.Dbmap.SelectOne(&u, "select * from users where id=$1", id)
+	return
+}
+
+// UserByName implements Accounts
+func (p *PostgresStore) UserByName(name string) (u User, err error) {
+	err = p.Dbmap.SelectOne(&u, "select * from users where name=$1", name)
+	return
+}
+
+// PutUser implements Accounts
+func (p *PostgresStore) PutUser(u *User) error {
+	if u.ID == 0 {
+		id, err := p.Dbmap.SelectInt("insert into users (name, disabled, created_at, password_hash) values ($1, $2, $3, $4) returning id", u.Name, u.Disabled, u.Created, u.PasswordHash)
+		u.ID = id
+		return err
+	}
+	return affectedOne(p.Dbmap.Exec("update users set name=$1, disabled=$2, password_hash=$3 where id=$4", u.Name, u.Disabled, u.PasswordHash, u.ID))
+}
+
+// ClaimRows implements Accounts
+func (p *PostgresStore) ClaimRows(id int64) (int64, error) {
+	return claimRows(p.Dbmap.Db, id, "select count(*) from %s where user_id=$1", "update %s set user_id=$1 where user_id=0")
+}
+
+// PutSession implements Accounts
+func (p *PostgresStore) PutSession(session *Session) error {
+	_, err := p.Dbmap.Exec("insert into sessions (token_hash, user_id, created_at, expires_at) values ($1, $2, $3, $4)",
+		session.TokenHash, session.UserID, session.Created, session.Expires)
+	return err
+}
+
+// GetSession implements Accounts
+func (p *PostgresStore) GetSession(tokenHash string) (session Session, err error) {
+	err = p.Dbmap.SelectOne(&session, "select * from sessions where token_hash=$1", tokenHash)
+	return
+}
+
+// DeleteSession implements Accounts
+func (p *PostgresStore) DeleteSession(tokenHash string) error {
+	return affectedOne(p.Dbmap.Exec("delete from sessions where token_hash=$1", tokenHash))
+}
+
+// DeleteSessions implements Accounts
+func (p *PostgresStore) DeleteSessions(userID int64) (int64, error) {
+	return rowsAffected(p.Dbmap.Exec("delete from sessions where user_id=$1", userID))
+}
+
+// DeleteExpiredSessions implements Accounts
+func (p *PostgresStore) DeleteExpiredSessions(before time.Time) (int64, error) {
+	return rowsAffected(p.Dbmap.Exec("delete from sessions where expires_at<$1", before))
+}
+
+// Close implements Store
+func (p *PostgresStore) Close() error {
+	return p.Dbmap.Db.Close()
+}
+
+// TraceOn logs all sql statements to logger
+func (p *PostgresStore) TraceOn(prefix string, logger gorp.GorpLogger) {
+	p.Dbmap.TraceOn(prefix, logger)
+}
@@ -0,0 +1,171 @@
+package km
+
+import (
+	"fmt"
+	"time"
+)
+
+// uniqueDatesVersion is the schema version since which there is only one row per date, of a
+// user once there are users
+const uniqueDatesVersion = 3
+
+// Repairer is implemented by stores that can contain more than one row for a date,
+// saved before dates had to be unique
+type Repairer interface {
+	// Repair merges all rows saved for the same date, it returns the dates repaired
+	Repair() ([]time.Time, error)
+}
+
+// mergeKilometers merges rows saved for the same date into the first one, in the
+// order they were saved. Later rows overwrite the readings they have filled in.
+func mergeKilometers(rows []Kilometers) Kilometers {
+	merged := rows[0]
+	for _, k := range rows[1:] {
+		if k.Begin != 0 {
+			merged.Begin = k.Begin
+		}
+		if k.Eerste != 0 {
+			merged.Eerste = k.Eerste
+		}
+		if k.Laatste != 0 {
+			merged.Laatste = k.Laatste
+		}
+		if k.Terug != 0 {
+			merged.Terug = k.Terug
+		}
+		if k.Comment != "" {
+			merged.Comment = k.Comment
+		}
+	}
+	return merged
+}
+
+// mergeTimes merges rows saved for the same date like mergeKilometers
+func mergeTimes(rows []Times) Times {
+	merged := rows[0]
+	for _, t := range rows[1:] {
+		if t.Begin != 0 {
+			merged.Begin = t.Begin
+		}
+		if t.CheckIn != 0 {
+			merged.CheckIn = t.CheckIn
+		}
+		if t.CheckOut != 0 {
+			merged.CheckOut = t.CheckOut
+		}
+		if t.Laatste != 0 {
+			merged.Laatste = t.Laatste
+		}
+	}
+	return merged
+}
+
+// appendDate appends date to dates when it is not in there yet
+func appendDate(dates []time.Time, date time.Time) []time.Time {
+	for _, d := range dates {
+		if d.Equal(date) {
+			return dates
+		}
+	}
+	return append(dates, date)
+}
+
+// Repair implements Repairer. It is run on a schema from before dates had to be unique
+// (version 2), so it only uses the columns that existed back then. A newer schema has no
+// duplicates to merge, and rows of different users or in the trash that share a date must not
+// be merged, so it is refused.
+func (m *migrator) Repair() (dates []time.Time, err error) {
+	version, err := m.version()
+	if err != nil {
+		return nil, err
+	}
+	if version >= uniqueDatesVersion {
+		return nil, fmt.Errorf("schema version %d has one row per date already, there is nothing to repair", version)
+	}
+	tx, err := m.db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		if err != nil {
+			tx.Rollback()
+		}
+	}()
+
+	rows, err := tx.Query("select id, date, begin, eerste, laatste, terug, comment from kilometers where date in (select date from kilometers group by date having count(*) > 1) order by date, id")
+	if err != nil {
+		return nil, err
+	}
+	var kms []Kilometers
+	for rows.Next() {
+		var k Kilometers
+		if err = rows.Scan(&k.ID, &k.Date, &k.Begin, &k.Eerste, &k.Laatste, &k.Terug, &k.Comment); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		kms = append(kms, k)
+	}
+	rows.Close()
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+	for len(kms) > 0 {
+		n := 1
+		for n < len(kms) && kms[n].Date.Equal(kms[0].Date) {
+			n++
+		}
+		merged := mergeKilometers(kms[:n])
+		for _, k := range kms[1:n] {
+			if _, err = tx.Exec("delete from kilometers where id="+m.bindVar(1), k.ID); err != nil {
+				return nil, err
+			}
+		}
+		_, err = tx.Exec(fmt.Sprintf("update kilometers set begin=%s, eerste=%s, laatste=%s, terug=%s, comment=%s where id=%s",
+			m.bindVar(1), m.bindVar(2), m.bindVar(3), m.bindVar(4), m.bindVar(5), m.bindVar(6)),
+			merged.Begin, merged.Eerste, merged.Laatste, merged.Terug, merged.Comment, merged.ID)
+		if err != nil {
+			return nil, err
+		}
+		dates = appendDate(dates, merged.Date)
+		kms = kms[n:]
+	}
+
+	rows, err = tx.Query("select id, date, begin, checkin, checkout, laatste from times where date in (select date from times group by date having count(*) > 1) order by date, id")
+	if err != nil {
+		return nil, err
+	}
+	var times []Times
+	for rows.Next() {
+		var t Times
+		if err = rows.Scan(&t.ID, &t.Date, &t.Begin, &t.CheckIn, &t.CheckOut, &t.Laatste); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		times = append(times, t)
+	}
+	rows.Close()
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+	for len(times) > 0 {
+		n := 1
+		for n < len(times) && times[n].Date.Equal(times[0].Date) {
+			n++
+		}
+		merged := mergeTimes(times[:n])
+		for _, t := range times[1:n] {
+			if _, err = tx.Exec("delete from times where id="+m.bindVar(1), t.ID); err != nil {
+				return nil, err
+			}
+		}
+		_, err = tx.Exec(fmt.Sprintf("update times set begin=%s, checkin=%s, checkout=%s, laatste=%s where id=%s",
+			m.bindVar(1), m.bindVar(2), m.bindVar(3), m.bindVar(4), m.bindVar(5)),
+			merged.Begin, merged.CheckIn, merged.CheckOut, merged.Laatste, merged.ID)
+		if err != nil {
+			return nil, err
+		}
+		dates = appendDate(dates, merged.Date)
+		times = times[n:]
+	}
+	return dates, tx.Commit()
+}
@@ -0,0 +1,114 @@
+package km
+
+import (
+	"testing"
+	"time"
+)
+
+func TestMergeKilometers(t *testing.T) {
+	date := time.Date(2014, time.January, 1, 0, 0, 0, 0, time.UTC)
+	rows := []Kilometers{
+		Kilometers{1, date, 100, 110, 0, 0, "first", false, nil, 0, 0},
+		Kilometers{2, date, 0, 0, 150, 0, "", false, nil, 0, 0},
+		Kilometers{3, date, 101, 0, 0, 160, "last", false, nil, 0, 0},
+	}
+	merged := mergeKilometers(rows)
+	expected := Kilometers{1, date, 101, 110, 150, 160, "last", false, nil, 0, 0}
+	if merged != expected {
+		t.Errorf("merged: %+v, want: %+v", merged, expected)
+	}
+}
+
+func TestMergeTimes(t *testing.T) {
+	date := time.Date(2014, time.January, 1, 0, 0, 0, 0, time.UTC)
+	rows := []Times{
+		Times{ID: 4, Date: date, Begin: 1, CheckIn: 2},
+		Times{ID: 7, Date: date, CheckIn: 3, Laatste: 5},
+	}
+	merged := mergeTimes(rows)
+	expected := Times{ID: 4, Date: date, Begin: 1, CheckIn: 3, Laatste: 5}
+	if merged != expected {
+		t.Errorf("merged: %+v, want: %+v", merged, expected)
+	}
+}
+
+func TestRepair(t *testing.T) {
+	m, cleanup := MigratorSetup(t)
+	defer cleanup()
+
+	// back to before dates were unique, to be able to save duplicates
+	if err := m.MigrateUp(); err != nil {
+		t.Fatal(err)
+	}
+	for version, _, _ := m.MigrationStatus(); version > 2; version, _, _ = m.MigrationStatus() {
+		if err := m.MigrateDown(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	date := time.Date(2014, time.January, 1, 0, 0, 0, 0, time.UTC)
+	for _, k := range []Kilometers{
+		Kilometers{Date: date, Begin: 1234},
+		Kilometers{Date: date, Terug: 1300},
+		Kilometers{Date: date.AddDate(0, 0, 1), Begin: 1300},
+	} {
+		_, err := m.db.Exec("insert into kilometers (date, begin, terug) values (?, ?, ?)", k.Date, k.Begin, k.Terug)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := m.db.Exec("insert into times (date, begin) values (?, 1), (?, 2)", date, date); err != nil {
+		t.Fatal(err)
+	}
+	if err := m.MigrateUp(); err == nil {
+		t.Fatal("migrating up should fail with duplicate dates")
+	}
+
+	dates, err := m.Repair()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(dates) != 1 || !dates[0].Equal(date) {
+		t.Errorf("expected only %s to be repaired, got: %v", date, dates)
+	}
+	var begin, terug int
+	if err = m.db.QueryRow("select begin, terug from kilometers where date=?", date).Scan(&begin, &terug); err != nil {
+		t.Fatal(err)
+	}
+	if begin != 1234 || terug != 1300 {
+		t.Errorf("unexpected merged row: begin %d, terug %d", begin, terug)
+	}
+	if err = m.MigrateUp(); err != nil {
+		t.Errorf("migrating up after repair: %s", err)
+	}
+}
+
+func TestRepairUniqueDates(t *testing.T) {
+	m, cleanup := MigratorSetup(t)
+	defer cleanup()
+	if err := m.MigrateUp(); err != nil {
+		t.Fatal(err)
+	}
+
+	// two users share a date, one of them has deleted it
+	date := time.Date(2014, time.January, 1, 0, 0, 0, 0, time.UTC)
+	if _, err := m.db.Exec("insert into users (id, name) values (1, 'alice'), (2, 'bob')"); err != nil {
+		t.Fatal(err)
+	}
+	_, err := m.db.Exec("insert into kilometers (date, begin, user_id) values (?, 1234, 1), (?, 5678, 2)", date, date)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = m.db.Exec("update kilometers set deleted_at=? where user_id=2", date); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = m.Repair(); err == nil {
+		t.Error("repairing a schema with unique dates should fail")
+	}
+	var count int
+	if err = m.db.QueryRow("select count(*) from kilometers where date=?", date).Scan(&count); err != nil {
+		t.Fatal(err)
+	}
+	if count != 2 {
+		t.Errorf("got %d rows for %s, want the 2 of both users", count, date)
+	}
+}
@@ -0,0 +1,180 @@
+package km
+
+import (
+	"fmt"
+	"time"
+)
+
+// PrivateLimit is the number of private km a year that can be driven in a company car
+// without bijtelling
+const PrivateLimit = 500
+
+// privateWarning is the part of PrivateLimit after which the report warns
+const privateWarning = 0.8
+
+// Totals are the km driven per type of trip
+type Totals struct {
+	Business int `json:"business"`
+	Commute  int `json:"commute"`
+	Private  int `json:"private"`
+}
+
+func (t *Totals) add(tripType string, km int) {
+	if km <= 0 {
+		// readings corrected with override can go back
+		return
+	}
+	switch tripType {
+	case TripBusiness:
+		t.Business += km
+	case TripCommute:
+		t.Commute += km
+	default:
+		t.Private += km
+	}
+}
+
+func (t *Totals) addAll(other Totals) {
+	t.Business += other.Business
+	t.Commute += other.Commute
+	t.Private += other.Private
+}
+
+// MonthTotals are the totals of a month of a YearReport
+type MonthTotals struct {
+	Month int `json:"month"`
+	Totals
+}
+
+// YearReport totals the km driven in a year per type of trip
+type YearReport struct {
+	Year   int           `json:"year"`
+	Months []MonthTotals `json:"months"`
+	Totals
+	PrivateLimit int `json:"privateLimit"`
+	// Warning is set when the private km approach PrivateLimit, or go over it
+	Warning string `json:"warning,omitempty"`
+}
+
+// daySegments are the types of the km driven between two readings of a day without trips
+var daySegments = map[[2]string]string{
+	{"Begin", "Eerste"}:  TripCommute,
+	{"Laatste", "Terug"}: TripCommute,
+}
+
+// daySegment is what is driven between two consecutive readings of a day, as a trip
+type daySegment struct {
+	// Start is the name of the reading the segment starts at
+	Start string
+	Trip
+}
+
+// readingSegments splits the day of k in a segment for every stretch between two consecutive
+// readings, typed as daySegments says, or business. Stretches where nothing is driven, or
+// where the readings go back, are left out.
+func readingSegments(k Kilometers) (segments []daySegment) {
+	readings := Readings{Begin: k.Begin, Eerste: k.Eerste, Laatste: k.Laatste, Terug: k.Terug}
+	last, lastName := 0, ""
+	for _, name := range timeFields {
+		km := readings.km(name)
+		if km == 0 {
+			continue
+		}
+		if last != 0 && km > last {
+			tripType, ok := daySegments[[2]string{lastName, name}]
+			if !ok {
+				tripType = TripBusiness
+			}
+			segments = append(segments, daySegment{lastName, Trip{Date: k.Date, StartKm: last, EndKm: km, Type: tripType}})
+		}
+		last, lastName = km, name
+	}
+	return segments
+}
+
+// dayTotals returns the km driven on the day of k, per type. A day with trips is split by
+// its trips, what is driven between them is private. The readings of a day without trips
+// are from home to work and back: from Begin to Eerste and from Laatste to Terug is commute,
+// the rest business, until the day is classified (see ClassifyDay).
+func dayTotals(k Kilometers, trips []Trip) (totals Totals) {
+	if len(trips) > 0 {
+		for i, trip := range trips {
+			if i > 0 {
+				totals.add(TripPrivate, trip.StartKm-trips[i-1].EndKm)
+			}
+			totals.add(trip.Type, trip.EndKm-trip.StartKm)
+		}
+		return totals
+	}
+	for _, segment := range readingSegments(k) {
+		totals.add(segment.Type, segment.EndKm-segment.StartKm)
+	}
+	return totals
+}
+
+// firstReading returns the first reading of the day of k, 0 when none is saved
+func firstReading(k Kilometers) int {
+	for _, km := range []int{k.Begin, k.Eerste, k.Laatste, k.Terug} {
+		if km != 0 {
+			return km
+		}
+	}
+	return 0
+}
+
+// GetYearReport totals the km driven in year per type of trip, for every month and for the
+// whole year. What is driven between the last reading of a day and the first of the next
+// day saved for the same vehicle is private, and counts for the month of that next day.
+func GetYearReport(ex Executor, year int) (report YearReport, err error) {
+	report = YearReport{Year: year, PrivateLimit: PrivateLimit}
+	first := time.Date(year, time.January, 1, 0, 0, 0, 0, time.UTC)
+	allTrips, err := ex.TripsBetween(first, first.AddDate(1, 0, -1))
+	if err != nil {
+		return report, CustomResponse(DbError, err)
+	}
+	trips := make(map[time.Time][]Trip)
+	for _, t := range allTrips {
+		trips[truncateDate(t.Date)] = append(trips[truncateDate(t.Date)], t)
+	}
+
+	// ends are the last readings of every vehicle
+	ends := make(map[int64]int)
+	for month := 1; month <= 12; month++ {
+		kms, err := ex.KilometersInMonth(int64(year), int64(month))
+		if err != nil {
+			return report, CustomResponse(DbError, err)
+		}
+		totals := MonthTotals{Month: month}
+		// the month is most recent first
+		for i := len(kms) - 1; i >= 0; i-- {
+			k := kms[i]
+			start := firstReading(k)
+			if start == 0 {
+				continue
+			}
+			end, ok := ends[k.VehicleID]
+			if !ok {
+				previous, err := previousKilometers(ex, k)
+				if err != nil {
+					return report, CustomResponse(DbError, err)
+				}
+				end = previous.getMax()
+			}
+			if end != 0 {
+				totals.add(TripPrivate, start-end)
+			}
+			totals.addAll(dayTotals(k, trips[truncateDate(k.Date)]))
+			ends[k.VehicleID] = k.getMax()
+		}
+		report.Months = append(report.Months, totals)
+		report.addAll(totals.Totals)
+	}
+
+	switch left := PrivateLimit - report.Private; {
+	case left < 0:
+		report.Warning = fmt.Sprintf("%d private km is %d km over the limit of %d", report.Private, -left, PrivateLimit)
+	case float64(report.Private) >= privateWarning*PrivateLimit:
+		report.Warning = fmt.Sprintf("%d private km, only %d km left before the limit of %d", report.Private, left, PrivateLimit)
+	}
+	return report, nil
+}
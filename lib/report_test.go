@@ -0,0 +1,75 @@
+package km
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestDayTotals(t *testing.T) {
+	var tests = []struct {
+		k     Kilometers
+		trips []Trip
+		want  Totals
+	}{
+		{Kilometers{Begin: 1000, Eerste: 1030, Laatste: 1040, Terug: 1070}, nil, Totals{Business: 10, Commute: 60}},
+		{Kilometers{Begin: 1000, Terug: 1070}, nil, Totals{Business: 70}},
+		{Kilometers{Begin: 1000, Eerste: 1030}, nil, Totals{Commute: 30}},
+		{Kilometers{Begin: 1000}, nil, Totals{}},
+		{Kilometers{Begin: 1000, Eerste: 990}, nil, Totals{}},
+		{Kilometers{}, []Trip{
+			Trip{StartKm: 1000, EndKm: 1030, Type: TripCommute},
+			Trip{StartKm: 1030, EndKm: 1040, Type: TripBusiness},
+			Trip{StartKm: 1050, EndKm: 1060, Type: TripPrivate},
+		}, Totals{Business: 10, Commute: 30, Private: 20}},
+	}
+	for i, tt := range tests {
+		if got := dayTotals(tt.k, tt.trips); got != tt.want {
+			t.Errorf("%d: got %+v, want %+v", i, got, tt.want)
+		}
+	}
+}
+
+func TestYearReport(t *testing.T) {
+	store := NewMemoryStore()
+	date := func(month time.Month, day int) time.Time { return time.Date(2014, month, day, 0, 0, 0, 0, time.UTC) }
+	store.PutKilometers(&Kilometers{Date: date(time.January, 1).AddDate(0, 0, -1), Terug: 900})
+	store.PutKilometers(&Kilometers{Date: date(time.January, 2), Begin: 1000, Eerste: 1030, Laatste: 1040, Terug: 1070})
+	for _, trip := range []Trip{
+		Trip{Date: date(time.January, 3), StartKm: 1070, EndKm: 1100, Type: TripBusiness},
+		Trip{Date: date(time.January, 3), StartKm: 1120, EndKm: 1130, Type: TripPrivate},
+	} {
+		if err := SaveTrip(store, &trip, 0, false); err != nil {
+			t.Fatal(err)
+		}
+	}
+	store.PutKilometers(&Kilometers{Date: date(time.February, 1), Begin: 1400})
+
+	report, err := GetYearReport(store, 2014)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(report.Months) != 12 {
+		t.Fatalf("expected 12 months, got: %+v", report.Months)
+	}
+	if report.Months[0].Totals != (Totals{Business: 40, Commute: 60, Private: 130}) {
+		t.Errorf("unexpected totals for january: %+v", report.Months[0])
+	}
+	if report.Months[1].Totals != (Totals{Private: 270}) {
+		t.Errorf("unexpected totals for february: %+v", report.Months[1])
+	}
+	if report.Totals != (Totals{Business: 40, Commute: 60, Private: 400}) {
+		t.Errorf("unexpected totals for the year: %+v", report.Totals)
+	}
+	if !strings.Contains(report.Warning, "100 km left") {
+		t.Errorf("expected a warning when the limit comes near, got: %q", report.Warning)
+	}
+
+	store.PutKilometers(&Kilometers{Date: date(time.March, 1), Begin: 1600})
+	if report, _ = GetYearReport(store, 2014); !strings.Contains(report.Warning, "100 km over") {
+		t.Errorf("expected a warning when over the limit, got: %q", report.Warning)
+	}
+	if report, _ = GetYearReport(store, 2013); report.Warning != "" || report.Totals != (Totals{}) {
+		t.Errorf("expected nothing for 2013, got: %+v", report)
+	}
+}
@@ -9,17 +9,13 @@ import (
 	"log"
 	"net/http"
 	"os"
-	"regexp"
 	"strconv"
-	"strings"
 	"syscall"
 	"text/template"
 	"time"
 
 	"github.com/coopernurse/gorp"
 	"github.com/gorilla/mux"
-	// postgres for its side effects
-	_ "github.com/lib/pq"
 )
 
 // Config is configuration for the app, parsed from config file
@@ -27,30 +23,124 @@ type Config struct {
 	Env  string
 	Log  string
 	Port int
-	Db   string
+	// Store is the storage backend to use, "postgres" (default), "sqlite" or "memory"
+	Store string
+	// Db is host:port of the postgres server, or the path of the sqlite database file
+	Db string
+	// MaxDistance is the largest distance in km between two consecutive readings
+	// that is accepted, DefaultMaxDistance when not set
+	MaxDistance int
+	// TimeZone is the IANA name of the zone times are entered in, DefaultTimeZone when not set
+	// a request can use another zone with the X-Time-Zone header or the tz query parameter
+	TimeZone string
+	// TrashDays is the number of days deleted days are kept in the trash, DefaultTrashDays when not set
+	TrashDays int
+	// Name and LicensePlate are printed on the reports, of the driver when no one is logged in
+	// and of the car driven on the days saved before there were vehicles
+	Name         string
+	LicensePlate string
+	// BackupDir is the directory the server backs up to every BackupHours hours, keeping the
+	// last BackupKeep archives. There are no backups when it is not set.
+	BackupDir   string
+	BackupHours int
+	BackupKeep  int
+	// SessionHours is how long a login lasts, DefaultSessionHours when not set
+	SessionHours int
+	// InsecureCookie sends the session cookie over plain http too, for a server that is not
+	// served over https
+	InsecureCookie bool
+	// TrustedProxies are the addresses or CIDR ranges of the proxies in front of the app, the
+	// client address in X-Forwarded-For is only believed when they send it
+	TrustedProxies []string
+}
+
+// DefaultSessionHours is how long a login lasts when not configured, a week
+const DefaultSessionHours = 7 * 24
+
+// SessionLifetime is how long a session lasts after logging in
+func (c Config) SessionLifetime() time.Duration {
+	hours := c.SessionHours
+	if hours <= 0 {
+		hours = DefaultSessionHours
+	}
+	return time.Duration(hours) * time.Hour
+}
+
+// DefaultBackupHours and DefaultBackupKeep are used for the backups when they are not configured
+const (
+	DefaultBackupHours = 24
+	DefaultBackupKeep  = 7
+)
+
+// BackupInterval is how often the server backs up
+func (c Config) BackupInterval() time.Duration {
+	hours := c.BackupHours
+	if hours <= 0 {
+		hours = DefaultBackupHours
+	}
+	return time.Duration(hours) * time.Hour
+}
+
+// BackupsKept is the number of backups kept in BackupDir
+func (c Config) BackupsKept() int {
+	if c.BackupKeep <= 0 {
+		return DefaultBackupKeep
+	}
+	return c.BackupKeep
+}
+
+// DefaultTrashDays is the number of days deleted days are kept in the trash when not configured
+const DefaultTrashDays = 30
+
+// Retention is how long deleted days are kept in the trash before they are purged
+func (c Config) Retention() time.Duration {
+	days := c.TrashDays
+	if days <= 0 {
+		days = DefaultTrashDays
+	}
+	return time.Duration(days) * 24 * time.Hour
+}
+
+// DefaultTimeZone is the zone times are entered in when none is configured
+const DefaultTimeZone = "Europe/Amsterdam"
+
+// Location loads the configured time zone
+func (c Config) Location() (*time.Location, error) {
+	if c.TimeZone == "" {
+		return time.LoadLocation(DefaultTimeZone)
+	}
+	return time.LoadLocation(c.TimeZone)
 }
 
 // StateGetter is the interface to swap out the GetState function when testing
-type StateGetter func(dbmap *gorp.DbMap, dateStr string) (err error, state State)
+type StateGetter func(store Store, date time.Time, loc *time.Location) (err error, state State)
 
 // SaveInterface is the interface to swap out the Save function when testing
-type SaveInterface func(dbmap *gorp.DbMap, date time.Time, fields []Field) (err error)
+// it is called with the transaction both kilometers and times are saved in
+type SaveInterface func(ex Executor, date time.Time, fields []Field) (err error)
+
+// SaveTimesInterface is the interface to swap out the SaveTimes function when testing
+type SaveTimesInterface func(ex Executor, date time.Time, fields []Field, loc *time.Location) (err error)
 
 // GetTimesInterface is the interface to swap out the GetTimes function when testing
-type GetTimesInterface func(dbmap *gorp.DbMap, year, month int64) (rows []TimeRow, err error)
+type GetTimesInterface func(store Store, year, month int64, loc *time.Location) (rows []TimeRow, err error)
 
 // Server is the main type of this package
-// it holds all the data required to run the app, the database connection,
+// it holds all the data required to run the app, the storage backend,
 // the webserver routes to handle, and the templates to parse
 type Server struct {
 	mux.Router
-	Dbmap     *gorp.DbMap
+	Store     Store
 	templates *template.Template
 	config    Config
+	location  *time.Location
 	StateFunc StateGetter
 	SaveKilos SaveInterface
-	SaveTimes SaveInterface
+	SaveTimes SaveTimesInterface
 	GetTimes  GetTimesInterface
+	// publicRoutes can be used without logging in
+	publicRoutes map[*mux.Route]bool
+	proxies      trustedProxies
 }
 
 // NewServer creates a new server object with a given name and with a specific configuration
@@ -66,56 +156,104 @@ func NewServer(dbName string, config Config) (s *Server, err error) {
 		log.SetPrefix(fmt.Sprintf("km-app %s:\t", os.Getenv("OUTSIDEPORT")))
 	}
 
-	hostPort := strings.Split(config.Db, ":")
-	db, creatingDbError := sql.Open("postgres", fmt.Sprintf("host=%s port=%s user=docker dbname=%s password=docker sslmode=disable", hostPort[0], hostPort[1], dbName))
-	testDbRegex := regexp.MustCompile("_test$")
-	err = db.Ping()
-	if !testDbRegex.MatchString(dbName) && err != nil {
-		if creatingDbError != nil {
-			return nil, fmt.Errorf("sql.Open result: %s", creatingDbError)
-		}
-		if err != nil {
-			return nil, fmt.Errorf("ping result: %s", err)
+	location, err := config.Location()
+	if err != nil {
+		return nil, fmt.Errorf("invalid time zone: %s", err)
+	}
+	proxies, err := parseTrustedProxies(config.TrustedProxies)
+	if err != nil {
+		return nil, err
+	}
 
+	store, err := OpenStore(dbName, config)
+	if err != nil {
+		return nil, err
+	}
+	if migrator, ok := store.(Migrator); ok {
+		if err = migrator.MigrateUp(); err != nil {
+			return nil, fmt.Errorf("migrating database: %s (days saved more than once can be merged with: km repair)", err)
 		}
 	}
-	var Dbmap *gorp.DbMap
-	Dbmap = &gorp.DbMap{Db: db, Dialect: gorp.PostgresDialect{}}
-	Dbmap.AddTable(Kilometers{}).SetKeys(true, "Id")
-	Dbmap.AddTable(Times{}).SetKeys(true, "Id")
+	if users, err := store.Users(); err != nil {
+		return nil, err
+	} else if len(users) == 0 {
+		log.Println("there are no users, requests are refused until one is added with: km users add")
+	}
 
 	var templates *template.Template
 	if config.Env == "testing" {
-		Dbmap.TraceOn("[gorp]", log.New(logFile, "DB:\t", log.LstdFlags))
+		if tracer, ok := store.(interface {
+			TraceOn(string, gorp.GorpLogger)
+		}); ok {
+			tracer.TraceOn("[gorp]", log.New(logFile, "DB:\t", log.LstdFlags))
+		}
 	} else {
 		templates = template.Must(template.ParseFiles("index.html"))
 	}
-	s = &Server{Dbmap: Dbmap,
-		templates: templates,
-		config:    config,
-		StateFunc: GetState,
-		SaveKilos: SaveKilometers,
-		SaveTimes: SaveTimes,
-		GetTimes:  GetAllTimes,
+	s = &Server{Store: store,
+		templates:    templates,
+		config:       config,
+		location:     location,
+		StateFunc:    GetState,
+		SaveKilos:    SaveKilometers,
+		SaveTimes:    SaveTimes,
+		GetTimes:     GetAllTimes,
+		publicRoutes: make(map[*mux.Route]bool),
+		proxies:      proxies,
 	}
 
 	// static files get served directly
 	if config.Env == "testing" {
-		s.PathPrefix("/js/").Handler(http.StripPrefix("/js/", http.FileServer(http.Dir("js/"))))
-		s.PathPrefix("/img/").Handler(http.StripPrefix("/img/", http.FileServer(http.Dir("img/"))))
-		s.PathPrefix("/css/").Handler(http.StripPrefix("/css/", http.FileServer(http.Dir("css/"))))
-		s.PathPrefix("/partials/").Handler(http.StripPrefix("/partials/", http.FileServer(http.Dir("partials/"))))
-		s.Handle("/favicon.ico", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) { http.ServeFile(w, r, "favicon.ico") }))
+		for _, dir := range []string{"js", "img", "css", "partials"} {
+			prefix := "/" + dir + "/"
+			s.public(s.PathPrefix(prefix).Handler(http.StripPrefix(prefix, http.FileServer(http.Dir(dir+"/")))))
+		}
+		s.public(s.Handle("/favicon.ico", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) { http.ServeFile(w, r, "favicon.ico") })))
 	}
 
-	s.HandleFunc("/", s.homeHandler).Methods("GET")
+	s.NotFoundHandler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) { WriteError(w, r, NotFound) })
+	s.MethodNotAllowedHandler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) { WriteError(w, r, MethodNotAllowed) })
+	// the page itself holds no data, it has to load to show the login form
+	s.public(s.HandleFunc("/", s.homeHandler).Methods("GET"))
 	s.HandleFunc("/state/{date}", s.stateHandler).Methods("GET")
 	s.HandleFunc("/save/{date}", s.saveHandler).Methods("POST")
 	s.HandleFunc("/overview/{category}/{year}/{month}", s.overviewHandler).Methods("GET")
-	s.HandleFunc("/delete/{date}", s.deleteHandler).Methods("GET")
+	s.HandleFunc("/delete/{date}", s.deleteHandler).Methods("DELETE")
+	s.apiRoutes()
+	s.Use(s.authenticate)
 	return s, nil
 }
 
+// requestLocation returns the time zone for a request, the configured one unless
+// the X-Time-Zone header or the tz query parameter asks for another
+func (s *Server) requestLocation(r *http.Request) (err error, loc *time.Location) {
+	name := r.Header.Get("X-Time-Zone")
+	if tz := r.URL.Query().Get("tz"); tz != "" {
+		name = tz
+	}
+	if name == "" {
+		return nil, s.location
+	}
+	loc, err = time.LoadLocation(name)
+	if err != nil {
+		return CustomResponse(InvalidTimeZone, err), nil
+	}
+	return nil, loc
+}
+
+// store returns the store scoped to the user making r
+func (s *Server) store(r *http.Request) Store {
+	return s.Store.ForUser(userOf(r).ID)
+}
+
+// auditedStore returns the store to make the changes of r with, it records them in the audit log
+// with the id of the request, which is sent back in the X-Request-Id header
+func (s *Server) auditedStore(w http.ResponseWriter, r *http.Request) Store {
+	origin := requestOrigin(r, s.proxies)
+	w.Header().Set("X-Request-Id", origin.RequestID)
+	return Audited(s.store(r), origin)
+}
+
 func (s *Server) homeHandler(w http.ResponseWriter, r *http.Request) {
 	if s.config.Env == "testing" {
 		t, _ := template.ParseFiles("index.html")
@@ -130,6 +268,12 @@ type State struct {
 	Fields       []Field
 	LastDayError string
 	LastDayKm    int
+	// InferredDay links to the previous day when its Terug was copied from
+	// the Begin of this day, Notice asks the user to confirm or correct it
+	InferredDay string
+	Notice      string
+	// Vehicle is the license plate of the vehicle driven, empty when no vehicle is added
+	Vehicle string
 }
 
 // ParseJSONBody parse the posted data into a Field array
@@ -150,99 +294,125 @@ func (s *Server) saveHandler(w http.ResponseWriter, r *http.Request) {
 	vars := mux.Vars(r)
 	err, date := ParseURLDate(vars["date"])
 	if err != nil {
-		myError := err.(Response)
-		http.Error(w, myError.String(), myError.Code)
+		WriteError(w, r, err)
 		return
 	}
 
-	// parse posted data
-	err, fields := ParseJSONBody(r.Body)
+	err, loc := s.requestLocation(r)
 	if err != nil {
-		response := err.(Response)
-		http.Error(w, response.Error(), response.Code)
+		WriteError(w, r, err)
 		return
 	}
 
-	/// Save kilometers
-	err = s.SaveKilos(s.Dbmap, date, fields)
+	// parse posted data
+	err, fields := ParseJSONBody(r.Body)
 	if err != nil {
-		response := err.(Response)
-		http.Error(w, response.Error(), response.Code)
+		WriteError(w, r, err)
 		return
 	}
-	// save Times
-	err = s.SaveTimes(s.Dbmap, date, fields)
+
+	// readings can be saved without validating them to correct the odometer
+	override, _ := strconv.ParseBool(r.URL.Query().Get("override"))
+
+	err = inTx(s.auditedStore(w, r), func(tx Tx) error {
+		return s.saveFields(tx, date, fields, loc, override)
+	})
 	if err != nil {
-		response := err.(Response)
-		http.Error(w, response.Error(), response.Code)
+		WriteError(w, r, err)
 		return
 	}
 	w.Write([]byte("ok\n"))
+}
+
+// saveFields validates and saves the fields posted for date in tx, the posted times are in
+// the time zone loc, readings are not validated when override is set
+func (s *Server) saveFields(tx Tx, date time.Time, fields []Field, loc *time.Location, override bool) error {
+	if len(fields) == 0 {
+		return nil
+	}
+	if !override {
+		if err := ValidateSave(tx, date, fields, s.config.MaxDistance); err != nil {
+			return err
+		}
+	}
+	if err := s.SaveKilos(tx, date, fields); err != nil {
+		return err
+	}
+	if err := s.SaveTimes(tx, date, fields, loc); err != nil {
+		return err
+	}
 	// sla eerste stand van vandaag op als laatste stand van gister (als die vergeten is)
+	return BackfillPrevious(tx, date, fields)
 }
 
 func (s *Server) stateHandler(w http.ResponseWriter, r *http.Request) {
 	vars := mux.Vars(r)
 	err, date := ParseURLDate(vars["date"])
 	if err != nil {
-		myError := err.(Response)
-		log.Println(myError)
-		http.Error(w, myError.String(), myError.Code)
+		WriteError(w, r, err)
+		return
+	}
+	err, loc := s.requestLocation(r)
+	if err != nil {
+		WriteError(w, r, err)
 		return
 	}
-	dateStr := fmt.Sprintf("%d-%d-%d", date.Month(), date.Day(), date.Year())
-	err, state := s.StateFunc(s.Dbmap, dateStr)
+	err, state := s.StateFunc(s.store(r), date, loc)
 	if err != nil {
-		response := err.(Response)
-		log.Println(response.Extra)
-		http.Error(w, response.Error(), response.Code)
+		WriteError(w, r, err)
+		return
 	}
 	jsonEncoder := json.NewEncoder(w)
 	jsonEncoder.Encode(state)
 }
 
 // GetState returns the data already saved in the databse to fill the form with
-func GetState(dbmap *gorp.DbMap, dateStr string) (err error, state State) {
+// times are shown in the time zone loc
+func GetState(store Store, date time.Time, loc *time.Location) (err error, state State) {
 	state.Fields = make([]Field, 4)
 	// Get data save for this date
-	var today Kilometers
-	err = dbmap.SelectOne(&today, "select * from kilometers where date=$1", dateStr)
+	today, err := store.GetKilometers(date)
 	switch {
-	case err != nil && err.Error() != "sql: no rows in result set":
+	case err != nil && err != sql.ErrNoRows:
 		return CustomResponse(DbError, err), State{}
-	case err != nil && err.Error() == "sql: no rows in result set": // today not saved yet
-		var lastDay Kilometers
-		err := dbmap.SelectOne(&lastDay, "select * from kilometers where date = (select max(date) as date from kilometers)")
+	case err == sql.ErrNoRows: // today not saved yet
+		vehicle, err := vehicleFor(store, date)
 		if err != nil {
 			return CustomResponse(DbError, err), State{}
 		}
+		state.Vehicle = vehicle.LicensePlate
+		lastDay, err := store.LastKilometers(vehicle.ID)
+		if err != nil && err != sql.ErrNoRows {
+			return CustomResponse(DbError, err), State{}
+		}
+		if lastDay == (Kilometers{}) && vehicle.StartKm > 0 {
+			// the first day of a vehicle starts at the reading it is taken into use with
+			lastDay = Kilometers{VehicleID: vehicle.ID, Begin: vehicle.StartKm}
+		}
 		if lastDay != (Kilometers{}) { // Nothing in db yet
-			log.Println("nothing in db yet for todag:", dateStr)
+			log.Println("nothing in db yet for todag:", date)
 			state.LastDayKm = lastDay.getMax()
 			state.Fields[0] = Field{Name: "Begin"}
 			state.Fields[1] = Field{Name: "Eerste"}
 			state.Fields[2] = Field{Name: "Laatste"}
 			state.Fields[3] = Field{Name: "Terug"}
 		}
-		var lastDayTimes Times
-		err = dbmap.SelectOne(&lastDayTimes, "select * from times where date=(select max(date) as date from times)")
+		lastDayTimes, err := store.LastTimes(1)
 		log.Println("na select laatste tijden:", err, lastDayTimes)
-		if lastDayTimes.CheckIn == 0 || lastDayTimes.CheckOut == 0 {
-			state.LastDayError = fmt.Sprintf("input/%02d%02d%04d", lastDayTimes.Date.Day(), lastDayTimes.Date.Month(), lastDayTimes.Date.Year())
+		if len(lastDayTimes) > 0 && (lastDayTimes[0].CheckIn == 0 || lastDayTimes[0].CheckOut == 0) {
+			state.LastDayError = "input/" + FormatURLDate(lastDayTimes[0].Date)
 		}
 
 	default: // Something is already filled in for today
 		log.Println("today:", today)
-		var times Times
-		err = dbmap.SelectOne(&times, "select * from times where date=$1", dateStr)
+		times, err := store.GetTimes(date)
 		if err != nil {
 			return CustomResponse(DbError, err), State{}
 		}
-		loc, _ := time.LoadLocation("Europe/Amsterdam") // should not be hardcoded but idgaf
 		convertTime := func(t int64) string {
 			ret := ""
 			if t != 0 {
-				ret = time.Unix(t, 0).In(loc).Format("15:04")
+				ret = clockTime(t, date, loc)
 			}
 			return ret
 		}
@@ -252,18 +422,34 @@ func GetState(dbmap *gorp.DbMap, dateStr string) (err error, state State) {
 		state.Fields[3] = Field{Km: today.Terug, Name: "Terug", Time: convertTime(times.Laatste)}
 		log.Printf("state: %+v", state)
 
-		var lastDayTimes []Times
-		_, err = dbmap.Select(&lastDayTimes, "select * from times order by date desc limit 2")
+		lastDayTimes, err := store.LastTimes(2)
 		if err != nil {
 			return CustomResponse(DbError, err), State{}
 		}
 		if len(lastDayTimes) > 1 {
 			log.Println("tijden van gisteren, (vandaag al half ingevuld):", err, lastDayTimes[1])
 			if lastDayTimes[1].CheckIn == 0 || lastDayTimes[1].CheckOut == 0 {
-				state.LastDayError = fmt.Sprintf("input/%02d%02d%04d", lastDayTimes[1].Date.Day(), lastDayTimes[1].Date.Month(), lastDayTimes[1].Date.Year())
+				state.LastDayError = "input/" + FormatURLDate(lastDayTimes[1].Date)
 			}
 
 		}
+
+		if today.VehicleID != 0 {
+			vehicle, err := store.GetVehicle(today.VehicleID)
+			if err != nil && err != sql.ErrNoRows {
+				return CustomResponse(DbError, err), State{}
+			}
+			state.Vehicle = vehicle.LicensePlate
+		}
+
+		previous, err := store.PreviousKilometers(today.VehicleID, date)
+		if err != nil && err != sql.ErrNoRows {
+			return CustomResponse(DbError, err), State{}
+		}
+		if previous.Inferred {
+			state.InferredDay = "input/" + FormatURLDate(previous.Date)
+			state.Notice = fmt.Sprintf("Terug of %s was copied from Begin: %d, please confirm or correct it", FormatURLDate(previous.Date), previous.Terug)
+		}
 	}
 	return nil, state
 }
@@ -273,14 +459,12 @@ func (s *Server) overviewHandler(w http.ResponseWriter, r *http.Request) {
 	category := vars["category"]
 	year, err := strconv.ParseInt(vars["year"], 10, 64)
 	if err != nil {
-		http.Error(w, InvalidURL.String(), InvalidURL.Code)
-		log.Println("overview:", err)
+		WriteError(w, r, CustomResponse(InvalidURL, err))
 		return
 	}
 	month, err := strconv.ParseInt(vars["month"], 10, 64)
 	if err != nil {
-		http.Error(w, InvalidURL.String(), InvalidURL.Code)
-		log.Println("overview:", err)
+		WriteError(w, r, CustomResponse(InvalidURL, err))
 		return
 	}
 	log.Println("overview", year, month)
@@ -288,52 +472,74 @@ func (s *Server) overviewHandler(w http.ResponseWriter, r *http.Request) {
 	jsonEncoder := json.NewEncoder(w)
 	switch category {
 	case "kilometers":
-		var all []Kilometers
-		_, err := s.Dbmap.Select(&all, "select * from kilometers where extract (year from date)=$1 and extract (month from date)=$2 order by date desc ", year, month)
+		all, err := s.store(r).KilometersInMonth(year, month)
 		if err != nil {
-			http.Error(w, fmt.Sprintf("%s\n%s", DbError.String(), err), DbError.Code)
-			log.Println("overview:", err)
+			WriteError(w, r, CustomResponse(DbError, err))
 			return
 		}
+		// only the days of one vehicle with ?vehicle=id
+		if vehicle := r.URL.Query().Get("vehicle"); vehicle != "" {
+			id, err := strconv.ParseInt(vehicle, 10, 64)
+			if err != nil {
+				WriteError(w, r, CustomResponse(InvalidURL, err))
+				return
+			}
+			all = kilometersOfVehicle(all, id)
+		}
 		jsonEncoder.Encode(all)
 	case "tijden":
-		rows, err := s.GetTimes(s.Dbmap, year, month)
+		err, loc := s.requestLocation(r)
+		if err != nil {
+			WriteError(w, r, err)
+			return
+		}
+		rows, err := s.GetTimes(s.store(r), year, month, loc)
 		if err != nil {
-			http.Error(w, DbError.String(), DbError.Code)
-			log.Println("overview tijden getalltimes return:", err)
+			WriteError(w, r, err)
 			return
 		}
 		jsonEncoder.Encode(rows)
 	default:
-		http.Error(w, InvalidURL.String(), InvalidURL.Code)
+		WriteError(w, r, InvalidURL)
 		return
 	}
 }
 
-// DeleteHandler delete all saved times and kilometers for a given date
+// DeleteHandler moves all saved times and kilometers for a given date to the trash
 func (s *Server) deleteHandler(w http.ResponseWriter, r *http.Request) {
 	vars := mux.Vars(r)
 	err, date := ParseURLDate(vars["date"])
 	if err != nil {
-		myError := err.(Response)
-		http.Error(w, myError.String(), myError.Code)
+		WriteError(w, r, err)
 		return
 	}
-	err = deleteAllForDate(s.Dbmap, fmt.Sprintf("%d-%d-%d", date.Month(), date.Day(), date.Year()))
+	err = deleteAllForDate(s.auditedStore(w, r), date)
 	if err != nil {
-		myError := err.(Response)
-		http.Error(w, myError.String(), myError.Code)
+		WriteError(w, r, err)
 	}
 }
 
-func deleteAllForDate(dbmap *gorp.DbMap, dateStr string) (err error) {
-	_, err = dbmap.Exec("delete from kilometers where date=$1", dateStr)
-	if err != nil {
-		return CustomResponse(DbError, err)
-	}
-	_, err = dbmap.Exec("delete from times where date=$1", dateStr)
-	if err != nil {
-		return CustomResponse(DbError, err)
+// PurgeEvery purges the trash and the expired sessions every interval, it never returns
+func (s *Server) PurgeEvery(interval time.Duration) {
+	for {
+		purged, err := PurgeTrash(s.Store, s.config.Retention())
+		if err != nil {
+			log.Println("purging trash:", err)
+		} else if purged > 0 {
+			log.Printf("purged %d rows from the trash", purged)
+		}
+		if _, err = s.Store.DeleteExpiredSessions(time.Now()); err != nil {
+			log.Println("purging sessions:", err)
+		}
+		time.Sleep(interval)
 	}
-	return nil
+}
+
+func deleteAllForDate(store Store, date time.Time) (err error) {
+	return inTx(store, func(tx Tx) error {
+		if err := tx.DeleteDate(date); err != nil {
+			return CustomResponse(DbError, err)
+		}
+		return nil
+	})
 }
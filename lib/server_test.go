@@ -1,35 +1,55 @@
 package km
 
 import (
+	"database/sql"
 	"encoding/json"
 	"fmt"
 	"io/ioutil"
 	"net/http"
 	"net/http/httptest"
+	"os"
 	"reflect"
 	"strings"
 	"testing"
 	"time"
 
 	"github.com/DATA-DOG/go-sqlmock"
-	"github.com/coopernurse/gorp"
 	_ "github.com/lib/pq"
 )
 
 var (
 	config Config
 	s      *Server
-	db     *gorp.DbMap
+	// testUser is logged in with testCookie, serve makes the requests without a session as them
+	testUser   User
+	testCookie *http.Cookie
 )
 
+// initServer sets up a server backed by an empty MemoryStore
 func initServer(t *testing.T) {
+	config = Config{Env: "testing", Store: "memory", Port: 4001}
+	startServer(t)
+}
+
+// startServer sets up a server with config and logs testUser in. The store of the server is
+// the one of testUser, so what the tests save in it is theirs.
+func startServer(t *testing.T) {
 	var err error
-	config = Config{Env: "production", Log: "./test.log", Db: "127.0.0.1:5432", Port: 4001}
-	s, err = NewServer("km_test", config)
+	if s, err = NewServer("km_test", config); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = CreateUser(s.Store, "test"); err != nil {
+		t.Fatal(err)
+	}
+	if testUser, err = SetPassword(s.Store, "test", testPassword); err != nil {
+		t.Fatal(err)
+	}
+	_, token, _, err := Login(s.Store, "test", testPassword, time.Hour)
 	if err != nil {
-		t.Error(err)
+		t.Fatal(err)
 	}
-	db = s.Dbmap
+	testCookie = &http.Cookie{Name: SessionCookie, Value: token}
+	s.Store = s.Store.ForUser(testUser.ID)
 }
 
 func TestServerInitErrors(t *testing.T) {
@@ -51,26 +71,15 @@ func TestServerInitErrors(t *testing.T) {
 		t.Errorf("a server with a name not ending in test should fail on init when no postgres server running to connect to")
 	}
 
-}
-
-func clearTable(t *testing.T, tableName string) {
-	_, err := db.Exec("truncate kilometers")
-	if err != nil {
-		t.Fatal("truncating db: ", err)
-	}
-	slice, err := db.Select(Kilometers{}, "select * from kilometers")
-	if len(slice) > 0 {
-		t.Errorf("expected empty kilometers table to start with")
-	}
-	if err != nil {
-		t.Errorf("could not select from kilometers")
+	_, err = NewServer("km_test", Config{Env: "testing", Store: "memory", TimeZone: "Europe/Nowhere"})
+	if err == nil {
+		t.Errorf("NewServer should fail on an unknown time zone")
 	}
 }
 
 func tableDrivenTest(t *testing.T, table []*TestCombo) {
 	for _, tc := range table {
-		w := httptest.NewRecorder()
-		s.ServeHTTP(w, tc.req)
+		w := serve(tc.req)
 		resp := tc.resp
 
 		if w.Code != resp.Code {
@@ -108,7 +117,13 @@ func dateFormat(t time.Time) string {
 }
 
 func TestHome(t *testing.T) {
-	initServer(t)
+	// index.html lives in the root of the project
+	if err := os.Chdir(".."); err != nil {
+		t.Fatal(err)
+	}
+	defer os.Chdir("lib")
+	config = Config{Env: "production", Store: "memory"}
+	startServer(t)
 	var table = []*TestCombo{
 		NewTestCombo("/", Response{Code: 200}),
 	}
@@ -125,21 +140,24 @@ func TestGetStateSuccessfulWithTodayPartialySaved(t *testing.T) {
 	if err != nil {
 		t.Error(err)
 	}
-	timeColumns := []string{"Id", "Date", "Begin", "CheckIn", "CheckOut", "Laatste"}
+	timeColumns := []string{"Id", "Date", "Begin", "CheckIn", "CheckOut", "Laatste", "deleted_at", "user_id"}
 	date := time.Date(2014, time.January, 1, 0, 0, 0, 0, time.UTC)
-	dateStr := fmt.Sprintf("%d-%d-%d", date.Month(), date.Day(), date.Year())
-	sqlmock.ExpectQuery("select \\* from kilometers where date=(.+)").
-		WithArgs("1-1-2014").
-		WillReturnRows(sqlmock.NewRows(kiloColumns).AddRow(1, date, 12345, 12346, 12347, 0, ""))
-	sqlmock.ExpectQuery("select \\* from times where date=(.+)").
-		WithArgs("1-1-2014").
-		WillReturnRows(sqlmock.NewRows(timeColumns).AddRow(1, date, 1388577600, 1388577720, 0, 0))
-	sqlmock.ExpectQuery("select \\* from times order by date desc limit 2").
+	sqlmock.ExpectQuery("select \\* from kilometers where user_id=(.+) and date=(.+)").
+		WithArgs(0, date).
+		WillReturnRows(sqlmock.NewRows(kiloColumns).AddRow(1, date, 12345, 12346, 12347, 0, "", false, nil, 0, 0))
+	sqlmock.ExpectQuery("select \\* from times where user_id=(.+) and date=(.+)").
+		WithArgs(0, date).
+		WillReturnRows(sqlmock.NewRows(timeColumns).AddRow(1, date, 1388577600, 1388577720, 0, 0, nil, 0))
+	sqlmock.ExpectQuery("select \\* from times where user_id=(.+) and deleted_at is null order by date desc limit 2").
+		WithArgs(0).
 		WillReturnRows(sqlmock.NewRows(timeColumns).
-		AddRow(1, date, 1388577600, 1388577720, 0, 0).
-		AddRow(1, date, 0, 0, 0, 0))
+		AddRow(1, date, 1388577600, 1388577720, 0, 0, nil, 0).
+		AddRow(1, date, 0, 0, 0, 0, nil, 0))
+	sqlmock.ExpectQuery("select \\* from kilometers where user_id=(.+) and vehicle_id=(.+) and date < (.+)").
+		WithArgs(0, 0, date).
+		WillReturnRows(sqlmock.NewRows(kiloColumns).AddRow(2, date.AddDate(0, 0, -1), 12300, 12310, 12320, 12345, "", true, nil, 0, 0))
 
-	err, state := GetState(dbmap, dateStr)
+	err, state := GetState(newPostgresStore(dbmap), date, amsterdam)
 	if err != nil {
 		t.Errorf("GetState returned unexpected: %s", err)
 	}
@@ -147,6 +165,9 @@ func TestGetStateSuccessfulWithTodayPartialySaved(t *testing.T) {
 	if reflect.DeepEqual(state, emptyState) {
 		t.Errorf("GetState returned empty")
 	}
+	if state.InferredDay != "input/2013-12-31" {
+		t.Errorf("expected notice for the inferred reading of the day before, got: %+v", state)
+	}
 	if err = dbmap.Db.Close(); err != nil {
 		t.Errorf("Error '%s' was not expected while closing the database", err)
 	}
@@ -159,14 +180,17 @@ func TestGetStateSuccessfulWithNoDataForToday(t *testing.T) {
 	}
 	//timeColumns := []string{"Id", "Date", "Begin", "CheckIn", "CheckOut", "Laatste"}
 	date := time.Date(2014, time.January, 1, 0, 0, 0, 0, time.UTC)
-	dateStr := fmt.Sprintf("%d-%d-%d", date.Month(), date.Day(), date.Year())
-	sqlmock.ExpectQuery("select \\* from kilometers where date=(.+)").
-		WithArgs("1-1-2014").
+	sqlmock.ExpectQuery("select \\* from kilometers where user_id=(.+) and date=(.+)").
+		WithArgs(0, date).
 		WillReturnRows(sqlmock.NewRows(kiloColumns).FromCSVString(""))
-	sqlmock.ExpectQuery("select \\* from kilometers where date =(.+)").
-		WillReturnRows(sqlmock.NewRows(kiloColumns).AddRow(1, date, 12345, 12346, 12347, 0, ""))
-
-	err, state := GetState(dbmap, dateStr)
+	sqlmock.ExpectQuery("select \\* from vehicles where user_id=(.+) order by start_date, id").
+		WithArgs(0).
+		WillReturnRows(sqlmock.NewRows(vehicleColumns).FromCSVString(""))
+	sqlmock.ExpectQuery("select \\* from kilometers where user_id=(.+) and vehicle_id=(.+)").
+		WithArgs(0, 0).
+		WillReturnRows(sqlmock.NewRows(kiloColumns).AddRow(1, date, 12345, 12346, 12347, 0, "", false, nil, 0, 0))
+
+	err, state := GetState(newPostgresStore(dbmap), date, amsterdam)
 	if err != nil {
 		t.Errorf("GetState returned unexpected: %s", err)
 	}
@@ -179,14 +203,14 @@ func TestGetStateSuccessfulWithNoDataForToday(t *testing.T) {
 	}
 }
 
-func GetStateMock(dbmap *gorp.DbMap, dateStr string) (err error, state State) {
-	if dateStr == "1-1-2014" {
+func GetStateMock(store Store, date time.Time, loc *time.Location) (err error, state State) {
+	if date.Equal(time.Date(2014, time.January, 1, 0, 0, 0, 0, time.UTC)) {
 		return nil, State{}
 	}
 	return DbError, State{}
 }
 
-func GetStateMockAlwaysError(dbmap *gorp.DbMap, dateStr string) (err error, state State) {
+func GetStateMockAlwaysError(store Store, date time.Time, loc *time.Location) (err error, state State) {
 	return DbError, State{}
 }
 
@@ -206,8 +230,7 @@ func TestStateHandler(t *testing.T) {
 	tableDrivenTest(t, table)
 
 	req, _ := http.NewRequest("GET", "/state/"+dateStr, nil)
-	w := httptest.NewRecorder()
-	s.ServeHTTP(w, req)
+	w := serve(req)
 	var unMarschalled interface{}
 	err := json.Unmarshal(w.Body.Bytes(), &unMarschalled)
 	t.Logf("unmarshalled return value fo getstate: %+v", unMarschalled)
@@ -216,13 +239,14 @@ func TestStateHandler(t *testing.T) {
 	}
 
 	s.StateFunc = GetStateMockAlwaysError
-	w = httptest.NewRecorder()
-	s.ServeHTTP(w, req)
+	w = serve(req)
 	err = json.Unmarshal(w.Body.Bytes(), &unMarschalled)
 	if err == nil {
 		t.Fatal("expected error when getstate fails")
 	}
-
+	if w.Code != DbError.Code || w.Body.String() != DbError.Body()+"\n" {
+		t.Errorf("expected only the error when getstate fails, got %d: %q", w.Code, w.Body.String())
+	}
 }
 
 //func TestOverview(t *testing.T) {
@@ -270,15 +294,21 @@ func TestDeleteAllSuccess(t *testing.T) {
 		t.Error(err)
 	}
 	//timeColumns := []string{"Id", "Date", "Begin", "CheckIn", "CheckOut", "Laatste"}
-	sqlmock.ExpectExec("delete from kilometers where date=(.+)").
-		WithArgs("1-1-2014").
+	date := time.Date(2014, time.January, 1, 0, 0, 0, 0, time.UTC)
+	sqlmock.ExpectBegin()
+	sqlmock.ExpectExec("update kilometers set deleted_at=(.+) where user_id=(.+) and date=(.+)").
+		WithArgs(0, date).
 		WillReturnResult(sqlmock.NewResult(1, 1))
 
-	sqlmock.ExpectExec("delete from times where date=(.+)").
-		WithArgs("1-1-2014").
+	sqlmock.ExpectExec("update times set deleted_at=(.+) where user_id=(.+) and date=(.+)").
+		WithArgs(0, date).
 		WillReturnResult(sqlmock.NewResult(1, 1))
+	sqlmock.ExpectExec("update trips set deleted_at=(.+) where user_id=(.+) and date=(.+)").
+		WithArgs(0, date).
+		WillReturnResult(sqlmock.NewResult(0, 0))
+	sqlmock.ExpectCommit()
 
-	if err = deleteAllForDate(dbmap, "1-1-2014"); err != nil {
+	if err = deleteAllForDate(newPostgresStore(dbmap), date); err != nil {
 		t.Errorf("DeleteAllForDate returned error: %s", err)
 	}
 
@@ -293,10 +323,13 @@ func TestDeleteAllKilometersFail(t *testing.T) {
 	if err != nil {
 		t.Error(err)
 	}
-	sqlmock.ExpectExec("delete from kilometers where date=(.+)").
-		WithArgs("1-1-2014").
+	date := time.Date(2014, time.January, 1, 0, 0, 0, 0, time.UTC)
+	sqlmock.ExpectBegin()
+	sqlmock.ExpectExec("update kilometers set deleted_at=(.+) where user_id=(.+) and date=(.+)").
+		WithArgs(0, date).
 		WillReturnError(fmt.Errorf("unkown id"))
-	if err = deleteAllForDate(dbmap, "1-1-2014"); err == nil {
+	sqlmock.ExpectRollback()
+	if err = deleteAllForDate(newPostgresStore(dbmap), date); err == nil {
 		t.Errorf("DeleteAllForDate did not return error on db failure")
 	}
 	if err = dbmap.Db.Close(); err != nil {
@@ -311,13 +344,16 @@ func TestDeleteAllTimesFail(t *testing.T) {
 	if err != nil {
 		t.Error(err)
 	}
-	sqlmock.ExpectExec("delete from kilometers where date=(.+)").
-		WithArgs("1-1-2014").
+	date := time.Date(2014, time.January, 1, 0, 0, 0, 0, time.UTC)
+	sqlmock.ExpectBegin()
+	sqlmock.ExpectExec("update kilometers set deleted_at=(.+) where user_id=(.+) and date=(.+)").
+		WithArgs(0, date).
 		WillReturnResult(sqlmock.NewResult(1, 1))
-	sqlmock.ExpectExec("delete from times where date=(.+)").
-		WithArgs("1-1-2014").
+	sqlmock.ExpectExec("update times set deleted_at=(.+) where user_id=(.+) and date=(.+)").
+		WithArgs(0, date).
 		WillReturnError(fmt.Errorf("unkown id"))
-	if err = deleteAllForDate(dbmap, "1-1-2014"); err == nil {
+	sqlmock.ExpectRollback()
+	if err = deleteAllForDate(newPostgresStore(dbmap), date); err == nil {
 		t.Errorf("DeleteAllForDate did not return error on db failure")
 	}
 	if err = dbmap.Db.Close(); err != nil {
@@ -325,7 +361,11 @@ func TestDeleteAllTimesFail(t *testing.T) {
 	}
 }
 
-func SaveMockReturnError(dbmap *gorp.DbMap, date time.Time, fields []Field) (err error) {
+func SaveMockReturnError(ex Executor, date time.Time, fields []Field) (err error) {
+	return CustomResponse(DbError, fmt.Errorf("blaat"))
+}
+
+func SaveTimesMockReturnError(ex Executor, date time.Time, fields []Field, loc *time.Location) (err error) {
 	return CustomResponse(DbError, fmt.Errorf("blaat"))
 }
 
@@ -341,23 +381,23 @@ func TestSaveParseErrors(t *testing.T) {
 
 	//test failure of SaveKilos
 	s.SaveKilos = SaveMockReturnError
-	s.SaveTimes = func(dbmap *gorp.DbMap, date time.Time, fields []Field) (err error) { return nil }
+	s.SaveTimes = func(ex Executor, date time.Time, fields []Field, loc *time.Location) (err error) { return nil }
 	req, _ = http.NewRequest("POST", "/save/01012014", strings.NewReader(`[{"Name": "Begin", "Km": 1234}]`))
 	table = append(table, &TestCombo{req, Response{Code: DbError.Code}})
 	tableDrivenTest(t, table)
 
 	//test failure of SaveTimes
 	table = []*TestCombo{}
-	s.SaveTimes = SaveMockReturnError
-	s.SaveKilos = func(dbmap *gorp.DbMap, date time.Time, fields []Field) (err error) { return nil }
+	s.SaveTimes = SaveTimesMockReturnError
+	s.SaveKilos = func(ex Executor, date time.Time, fields []Field) (err error) { return nil }
 	req, _ = http.NewRequest("POST", "/save/01012014", strings.NewReader(`[{"Name": "Begin", "Km": 1234}]`))
 	table = append(table, &TestCombo{req, Response{Code: DbError.Code}})
 	tableDrivenTest(t, table)
 
 	// test all correct data
 	table = []*TestCombo{}
-	s.SaveKilos = func(dbmap *gorp.DbMap, date time.Time, fields []Field) (err error) { return nil }
-	s.SaveTimes = func(dbmap *gorp.DbMap, date time.Time, fields []Field) (err error) { return nil }
+	s.SaveKilos = func(ex Executor, date time.Time, fields []Field) (err error) { return nil }
+	s.SaveTimes = func(ex Executor, date time.Time, fields []Field, loc *time.Location) (err error) { return nil }
 	req, _ = http.NewRequest("POST", "/save/01012014", strings.NewReader(`[{"Name": "Begin", "Km": 1234}]`))
 	table = append(table, &TestCombo{req, Response{Code: 200}})
 	tableDrivenTest(t, table)
@@ -391,14 +431,14 @@ func TestOverview(t *testing.T) {
 	if err != nil {
 		t.Error(err)
 	}
-	s.Dbmap = dbmap
-	sqlmock.ExpectQuery("select \\* from kilometers where(.+)").
-		WithArgs(2014, 1).
+	s.Store = newPostgresStore(dbmap)
+	expectSession()
+	sqlmock.ExpectQuery("select \\* from kilometers where user_id=(.+) and (.+)").
+		WithArgs(testUser.ID, 2014, 1).
 		WillReturnError(fmt.Errorf("unkown id"))
 
 	req, _ := http.NewRequest("GET", "/overview/kilometers/2014/1", nil)
-	w := httptest.NewRecorder()
-	s.ServeHTTP(w, req)
+	w := serve(req)
 	if w.Code != DbError.Code {
 		t.Errorf("%s : code = %d, want %d", "/overview/kilometers/2014/1", w.Code, DbError.Code)
 	}
@@ -412,15 +452,15 @@ func TestOverview(t *testing.T) {
 	if err != nil {
 		t.Error(err)
 	}
-	s.Dbmap = dbmap
+	s.Store = newPostgresStore(dbmap)
 	date := time.Date(2014, time.January, 1, 0, 0, 0, 0, time.UTC)
-	sqlmock.ExpectQuery("select \\* from kilometers where (.+)").
-		WithArgs(2014, 1).
-		WillReturnRows(sqlmock.NewRows(columns).AddRow(1, date, 12345, 123456, 1234567, 12345678, ""))
+	expectSession()
+	sqlmock.ExpectQuery("select \\* from kilometers where user_id=(.+) and (.+)").
+		WithArgs(testUser.ID, 2014, 1).
+		WillReturnRows(sqlmock.NewRows(columns).AddRow(1, date, 12345, 123456, 1234567, 12345678, "", false, nil, 0, 0))
 
 	req, _ = http.NewRequest("GET", "/overview/kilometers/2014/1", nil)
-	w = httptest.NewRecorder()
-	s.ServeHTTP(w, req)
+	w = serve(req)
 	if w.Code != 200 {
 		t.Errorf("%s : code = %d, want %d", "/overview/kilometers/2014/1", w.Code, 200)
 	}
@@ -430,22 +470,20 @@ func TestOverview(t *testing.T) {
 
 	// test overview/tijden
 	initServer(t)
-	s.GetTimes = func(dbmap *gorp.DbMap, year, month int64) (rows []TimeRow, err error) {
+	s.GetTimes = func(store Store, year, month int64, loc *time.Location) (rows []TimeRow, err error) {
 		return []TimeRow{}, DbError
 	}
 	req, err = http.NewRequest("GET", "/overview/tijden/2014/1", nil)
-	w = httptest.NewRecorder()
-	s.ServeHTTP(w, req)
+	w = serve(req)
 	if w.Code != DbError.Code {
 		t.Errorf("%s : code = %d, want %d", "/overview/kilometers/2014/1", w.Code, DbError.Code)
 	}
 
-	s.GetTimes = func(dbmap *gorp.DbMap, year, month int64) (rows []TimeRow, err error) {
+	s.GetTimes = func(store Store, year, month int64, loc *time.Location) (rows []TimeRow, err error) {
 		return []TimeRow{}, nil
 	}
 	req, err = http.NewRequest("GET", "/overview/tijden/2014/1", nil)
-	w = httptest.NewRecorder()
-	s.ServeHTTP(w, req)
+	w = serve(req)
 	if w.Code != 200 {
 		t.Errorf("%s : code = %d, want %d", "/overview/kilometers/2014/1", w.Code, 200)
 	}
@@ -453,19 +491,322 @@ func TestOverview(t *testing.T) {
 
 func TestDeleteHandler(t *testing.T) {
 	initServer(t)
-	req, _ := http.NewRequest("GET", "/delete/2014", nil)
-	w := httptest.NewRecorder()
-	s.ServeHTTP(w, req)
+	req, _ := http.NewRequest("DELETE", "/delete/2014", nil)
+	w := serve(req)
 	if w.Code != InvalidURL.Code {
 		t.Errorf("%s : code = %d, want %d", "/delete/2014", w.Code, InvalidURL.Code)
 	}
+	// deleting is DELETE only
+	for _, method := range []string{"GET", "POST"} {
+		req, _ = http.NewRequest(method, "/delete/2014-01-01", nil)
+		w = serve(req)
+		if w.Code != MethodNotAllowed.Code {
+			t.Errorf("%s %s : code = %d, want %d", method, "/delete/2014-01-01", w.Code, MethodNotAllowed.Code)
+		}
+	}
 
-	req, _ = http.NewRequest("GET", "/delete/01012014", nil)
-	w = httptest.NewRecorder()
-	s.ServeHTTP(w, req)
+	// the day is moved to the trash, not deleted for good
+	date := time.Date(2014, time.January, 1, 0, 0, 0, 0, time.UTC)
+	if err := SaveKilometers(s.Store, date, []Field{Field{Name: "Begin", Km: 1234}}); err != nil {
+		t.Fatal(err)
+	}
+	req, _ = http.NewRequest("DELETE", "/delete/01012014", nil)
+	w = serve(req)
+	if w.Code != 200 {
+		t.Errorf("%s : code = %d, want %d", "/delete/01012014", w.Code, 200)
+	}
+	if _, err := s.Store.GetKilometers(date); err != sql.ErrNoRows {
+		t.Errorf("the deleted day is still saved: %v", err)
+	}
+	if trash, _ := s.Store.DeletedKilometers(); len(trash) != 1 || trash[0].Begin != 1234 || trash[0].DeletedAt == nil {
+		t.Errorf("the deleted day is not in the trash: %+v", trash)
+	}
+
+	// delete fails
+	err, dbmap, columns := MockSetup("kilometers")
+	if err != nil {
+		t.Error(err)
+	}
+	s.Store = newPostgresStore(dbmap)
+	expectSession()
+	sqlmock.ExpectBegin()
+	// what is deleted is looked up first for the audit log
+	sqlmock.ExpectQuery("select \\* from kilometers where user_id=(.+) and date=(.+) and deleted_at is null").
+		WithArgs(testUser.ID, date).
+		WillReturnRows(sqlmock.NewRows(columns).FromCSVString(""))
+	sqlmock.ExpectQuery("select \\* from times where user_id=(.+) and date=(.+) and deleted_at is null").
+		WithArgs(testUser.ID, date).
+		WillReturnRows(sqlmock.NewRows([]string{"Id", "Date", "Begin", "CheckIn", "CheckOut", "Laatste", "deleted_at", "user_id"}).FromCSVString(""))
+	sqlmock.ExpectQuery("select \\* from trips where user_id=(.+) and date=(.+) and deleted_at is null").
+		WithArgs(testUser.ID, date).
+		WillReturnRows(sqlmock.NewRows([]string{"id", "date", "start_km", "end_km", "from_address", "to_address", "purpose", "type", "deleted_at", "user_id"}).FromCSVString(""))
+	sqlmock.ExpectExec("update kilometers set deleted_at=now\\(\\) where user_id=(.+) and date=(.+) and deleted_at is null").
+		WithArgs(testUser.ID, date).
+		WillReturnError(fmt.Errorf("unkown id"))
+	sqlmock.ExpectRollback()
+	req, _ = http.NewRequest("DELETE", "/delete/01012014", nil)
+	w = serve(req)
 
 	if w.Code != DbError.Code {
 		body, _ := ioutil.ReadAll(w.Body)
-		t.Errorf("%s : code = %d, want %d", "/delete/01012014", string(body), w.Code, DbError.Code)
+		t.Errorf("%s : code = %d, want %d, body: %s", "/delete/01012014", w.Code, DbError.Code, string(body))
+	}
+	if err = dbmap.Db.Close(); err != nil {
+		t.Errorf("Error '%s' was not expected while closing the database", err)
+	}
+}
+
+// serve serves req, as testUser when it has no session cookie of its own
+func serve(req *http.Request) *httptest.ResponseRecorder {
+	if _, err := req.Cookie(SessionCookie); err != nil {
+		req.AddCookie(testCookie)
+	}
+	return serveAnonymous(req)
+}
+
+// serveAnonymous serves req as it is
+func serveAnonymous(req *http.Request) *httptest.ResponseRecorder {
+	w := httptest.NewRecorder()
+	s.ServeHTTP(w, req)
+	return w
+}
+
+func TestSaveIsAtomic(t *testing.T) {
+	initServer(t)
+	defer initServer(t)
+	date := time.Date(2014, time.January, 1, 0, 0, 0, 0, time.UTC)
+	if err := SaveKilometers(s.Store, date, []Field{Field{Name: "Begin", Km: 1234}}); err != nil {
+		t.Fatal(err)
+	}
+
+	s.SaveTimes = SaveTimesMockReturnError
+	req, _ := http.NewRequest("POST", "/save/01012014", strings.NewReader(`[{"Name": "Eerste", "Km": 1250, "Time": "08:30"}]`))
+	if w := serve(req); w.Code != DbError.Code {
+		t.Fatalf("/save/01012014 : code = %d, want %d", w.Code, DbError.Code)
+	}
+	k, err := s.Store.GetKilometers(date)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if k.Begin != 1234 || k.Eerste != 0 {
+		t.Errorf("kilometers should be left as they were when saving times fails, got: %+v", k)
+	}
+}
+
+func TestSaveValidation(t *testing.T) {
+	initServer(t)
+	req, _ := http.NewRequest("POST", "/save/01012014", strings.NewReader(`[{"Name": "Terug", "Km": 1300}]`))
+	if w := serve(req); w.Code != 200 {
+		t.Fatalf("/save/01012014 : code = %d, want %d", w.Code, 200)
+	}
+
+	// lower than yesterday, and going back within the day
+	req, _ = http.NewRequest("POST", "/save/02012014", strings.NewReader(`[{"Name": "Begin", "Km": 1200}, {"Name": "Eerste", "Km": 1310}, {"Name": "Laatste", "Km": 1305}]`))
+	w := serve(req)
+	if w.Code != InvalidReading.Code {
+		t.Fatalf("/save/02012014 : code = %d, want %d", w.Code, InvalidReading.Code)
+	}
+	body := w.Body.String()
+	if !InvalidReading.Regex.MatchString(body) || !strings.Contains(body, "Begin: ") || !strings.Contains(body, "Laatste: ") || strings.Contains(body, "Eerste: ") {
+		t.Errorf("expected Begin and Laatste to be rejected, got: %q", body)
+	}
+	if _, err := s.Store.GetKilometers(time.Date(2014, time.January, 2, 0, 0, 0, 0, time.UTC)); err != sql.ErrNoRows {
+		t.Errorf("rejected readings should not be saved")
+	}
+
+	// an odometer correction can be forced
+	req, _ = http.NewRequest("POST", "/save/02012014?override=true", strings.NewReader(`[{"Name": "Begin", "Km": 1200}]`))
+	if w = serve(req); w.Code != 200 {
+		t.Fatalf("/save/02012014?override=true : code = %d, want %d", w.Code, 200)
+	}
+}
+
+func TestSaveBackfillsPreviousDay(t *testing.T) {
+	initServer(t)
+	req, _ := http.NewRequest("POST", "/save/01012014", strings.NewReader(`[{"Name": "Begin", "Km": 1200}, {"Name": "Laatste", "Km": 1250}]`))
+	if w := serve(req); w.Code != 200 {
+		t.Fatalf("/save/01012014 : code = %d, want %d", w.Code, 200)
+	}
+	req, _ = http.NewRequest("POST", "/save/02012014", strings.NewReader(`[{"Name": "Begin", "Km": 1300, "Time": "08:00"}]`))
+	if w := serve(req); w.Code != 200 {
+		t.Fatalf("/save/02012014 : code = %d, want %d", w.Code, 200)
+	}
+	yesterday := time.Date(2014, time.January, 1, 0, 0, 0, 0, time.UTC)
+	k, _ := s.Store.GetKilometers(yesterday)
+	if k.Terug != 1300 || !k.Inferred {
+		t.Fatalf("expected Terug of yesterday to be inferred from Begin of today, got: %+v", k)
+	}
+
+	req, _ = http.NewRequest("GET", "/state/02012014", nil)
+	var state State
+	json.Unmarshal(serve(req).Body.Bytes(), &state)
+	if state.InferredDay != "input/2014-01-01" || state.Notice == "" {
+		t.Errorf("expected a notice about the inferred reading, got: %+v", state)
+	}
+
+	// saving Terug confirms it
+	req, _ = http.NewRequest("POST", "/save/01012014", strings.NewReader(`[{"Name": "Terug", "Km": 1290}]`))
+	if w := serve(req); w.Code != 200 {
+		t.Fatalf("/save/01012014 : code = %d, want %d", w.Code, 200)
+	}
+	if k, _ = s.Store.GetKilometers(yesterday); k.Terug != 1290 || k.Inferred {
+		t.Errorf("expected corrected Terug to be no longer inferred, got: %+v", k)
+	}
+}
+
+func TestSaveStateOverviewDelete(t *testing.T) {
+	initServer(t)
+
+	req, _ := http.NewRequest("POST", "/save/2014-01-01", strings.NewReader(`[{"Name": "Begin", "Km": 1234, "Time": "08:00"}]`))
+	if w := serve(req); w.Code != 200 {
+		t.Fatalf("/save/2014-01-01 : code = %d, want %d", w.Code, 200)
+	}
+	req, _ = http.NewRequest("POST", "/save/2014-01-01", strings.NewReader(`[{"Name": "Eerste", "Km": 1250, "Time": "08:30"}]`))
+	if w := serve(req); w.Code != 200 {
+		t.Fatalf("/save/2014-01-01 : code = %d, want %d", w.Code, 200)
+	}
+
+	req, _ = http.NewRequest("GET", "/state/2014-01-01", nil)
+	w := serve(req)
+	var state State
+	if err := json.Unmarshal(w.Body.Bytes(), &state); err != nil {
+		t.Fatalf("/state/2014-01-01 not a valid json response: %s", err)
+	}
+	if state.Fields[0].Km != 1234 || state.Fields[1].Km != 1250 || state.Fields[1].Time != "08:30" {
+		t.Errorf("unexpected state: %+v", state)
+	}
+
+	req, _ = http.NewRequest("GET", "/state/2014-01-02", nil)
+	w = serve(req)
+	state = State{}
+	if err := json.Unmarshal(w.Body.Bytes(), &state); err != nil {
+		t.Fatalf("/state/2014-01-02 not a valid json response: %s", err)
+	}
+	if state.LastDayKm != 1250 {
+		t.Errorf("LastDayKm = %d, want %d", state.LastDayKm, 1250)
+	}
+	if state.LastDayError != "input/2014-01-01" {
+		t.Errorf("LastDayError = %q, want %q", state.LastDayError, "input/2014-01-01")
+	}
+
+	req, _ = http.NewRequest("GET", "/overview/kilometers/2014/1", nil)
+	w = serve(req)
+	if !strings.Contains(w.Body.String(), `"Date":"2014-01-01T00:00:00Z"`) {
+		t.Errorf("expected RFC 3339 dates in the overview, got: %s", w.Body.String())
+	}
+	var kms []Kilometers
+	if err := json.Unmarshal(w.Body.Bytes(), &kms); err != nil {
+		t.Fatalf("/overview/kilometers/2014/1 not a valid json response: %s", err)
+	}
+	if len(kms) != 1 || kms[0].Begin != 1234 || kms[0].Eerste != 1250 {
+		t.Errorf("unexpected kilometers overview: %+v", kms)
+	}
+	req, _ = http.NewRequest("GET", "/overview/tijden/2014/2", nil)
+	w = serve(req)
+	var rows []TimeRow
+	if err := json.Unmarshal(w.Body.Bytes(), &rows); err != nil {
+		t.Fatalf("/overview/tijden/2014/2 not a valid json response: %s", err)
+	}
+	if len(rows) != 0 {
+		t.Errorf("expected no times in february, got: %+v", rows)
+	}
+
+	req, _ = http.NewRequest("DELETE", "/delete/2014-01-01", nil)
+	if w = serve(req); w.Code != 200 {
+		t.Fatalf("/delete/2014-01-01 : code = %d, want %d", w.Code, 200)
+	}
+	req, _ = http.NewRequest("GET", "/overview/kilometers/2014/1", nil)
+	w = serve(req)
+	kms = nil
+	json.Unmarshal(w.Body.Bytes(), &kms)
+	if len(kms) != 0 {
+		t.Errorf("expected no kilometers after delete, got: %+v", kms)
+	}
+}
+
+func TestTimeZone(t *testing.T) {
+	initServer(t)
+	config.TimeZone = "UTC"
+	startServer(t)
+	defer initServer(t)
+
+	req, _ := http.NewRequest("POST", "/save/01012014", strings.NewReader(`[{"Name": "Begin", "Km": 1234, "Time": "08:00"}]`))
+	if w := serve(req); w.Code != 200 {
+		t.Fatalf("/save/01012014 : code = %d, want %d", w.Code, 200)
+	}
+	times, err := s.Store.GetTimes(time.Date(2014, time.January, 1, 0, 0, 0, 0, time.UTC))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := time.Date(2014, time.January, 1, 8, 0, 0, 0, time.UTC).Unix(); times.Begin != want {
+		t.Errorf("Begin saved as %d, want %d", times.Begin, want)
+	}
+
+	for _, tc := range []struct {
+		header, query, want string
+	}{
+		{"", "", "08:00"},
+		{"Europe/Amsterdam", "", "09:00"},
+		{"", "?tz=America/New_York", "03:00"},
+		{"Europe/Amsterdam", "?tz=UTC", "08:00"},
+	} {
+		req, _ = http.NewRequest("GET", "/state/01012014"+tc.query, nil)
+		req.Header.Set("X-Time-Zone", tc.header)
+		var state State
+		if err := json.Unmarshal(serve(req).Body.Bytes(), &state); err != nil {
+			t.Fatalf("/state/01012014%s not a valid json response: %s", tc.query, err)
+		}
+		if state.Fields[0].Time != tc.want {
+			t.Errorf("Begin in %q%s = %q, want %q", tc.header, tc.query, state.Fields[0].Time, tc.want)
+		}
+	}
+
+	var table = []*TestCombo{
+		NewTestCombo("/state/01012014?tz=Europe/Nowhere", InvalidTimeZone),
+		NewTestCombo("/overview/tijden/2014/1?tz=Europe/Nowhere", InvalidTimeZone),
+		NewTestComboPost("/save/01012014?tz=Europe/Nowhere", InvalidTimeZone),
+	}
+	tableDrivenTest(t, table)
+}
+
+func TestErrorEnvelope(t *testing.T) {
+	initServer(t)
+	req, _ := http.NewRequest("POST", "/save/2014-01-01", strings.NewReader(`[{"Name": "Terug", "Km": 1300}]`))
+	if w := serve(req); w.Code != 200 {
+		t.Fatalf("/save/2014-01-01 : code = %d, want %d", w.Code, 200)
+	}
+
+	for _, tc := range []struct {
+		method, url, body string
+		want              ErrorBody
+	}{
+		{"GET", "/state/today", "", ErrorBody{Code: "invalid_date", Error: "invalid date"}},
+		{"GET", "/nothing/here", "", ErrorBody{Code: "not_found", Error: "404 page not found"}},
+		{"GET", "/overview/kilometers/year/1", "", ErrorBody{Code: "invalid_url", Error: "invalid url"}},
+		{"GET", "/overview/tijden/2014/1?tz=Europe/Nowhere", "", ErrorBody{Code: "invalid_time_zone", Error: "invalid time zone"}},
+		{"POST", "/save/2014-01-01", "[", ErrorBody{Code: "not_parsable", Error: "could not parse request"}},
+		{"POST", "/save/2014-01-02", `[{"Name": "Begin", "Km": 1200}]`, ErrorBody{Code: "invalid_reading", Error: "invalid reading", Field: "Begin"}},
+	} {
+		req, _ := http.NewRequest(tc.method, tc.url, strings.NewReader(tc.body))
+		req.Header.Set("Accept", "application/json, text/plain, */*")
+		w := serve(req)
+		if ct := w.Header().Get("Content-Type"); !strings.HasPrefix(ct, "application/json") {
+			t.Errorf("%s: Content-Type = %q, want application/json", tc.url, ct)
+		}
+		var body ErrorBody
+		if err := json.Unmarshal(w.Body.Bytes(), &body); err != nil {
+			t.Fatalf("%s: not a valid json response: %s", tc.url, err)
+		}
+		if body.Code != tc.want.Code || body.Error != tc.want.Error || body.Field != tc.want.Field {
+			t.Errorf("%s: got %+v, want %+v", tc.url, body, tc.want)
+		}
+	}
+
+	// without asking for JSON, curl gets text
+	req, _ = http.NewRequest("GET", "/state/today", nil)
+	req.Header.Set("Accept", "*/*")
+	w := serve(req)
+	if ct := w.Header().Get("Content-Type"); !strings.HasPrefix(ct, "text/plain") || !InvalidDate.Regex.MatchString(w.Body.String()) {
+		t.Errorf("expected a text error, got %q: %q", ct, w.Body.String())
 	}
 }
@@ -0,0 +1,222 @@
+package km
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/gorilla/mux"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// Session is a login of a user, the browser holds its token in the session cookie
+type Session struct {
+	// TokenHash is the SHA-256 of the token, the token itself is never saved
+	TokenHash string    `db:"token_hash"`
+	UserID    int64     `db:"user_id"`
+	Created   time.Time `db:"created_at"`
+	Expires   time.Time `db:"expires_at"`
+}
+
+// SessionCookie is the name of the cookie holding the session token
+const SessionCookie = "km_session"
+
+// the length of passwords, bcrypt only uses the first 72 bytes
+const (
+	minPasswordLength = 8
+	maxPasswordLength = 72
+)
+
+// dummyHash is compared with the password of unknown users, so a login takes as long whether
+// the user exists or not
+var dummyHash, _ = bcrypt.GenerateFromPassword([]byte("not a password"), bcrypt.DefaultCost)
+
+// hashToken returns the hash a session is saved under
+func hashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// ValidatePassword checks that password is long enough, and not longer than bcrypt uses
+func ValidatePassword(password string) error {
+	if len(password) < minPasswordLength || len(password) > maxPasswordLength {
+		return fmt.Errorf("a password has %d to %d characters", minPasswordLength, maxPasswordLength)
+	}
+	return nil
+}
+
+// SetPassword sets the password of the user with name and revokes their sessions
+func SetPassword(store Store, name, password string) (User, error) {
+	if err := ValidatePassword(password); err != nil {
+		return User{}, err
+	}
+	user, err := GetUserByName(store, name)
+	if err != nil {
+		return User{}, err
+	}
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	if err != nil {
+		return User{}, err
+	}
+	user.PasswordHash = string(hash)
+	if err = store.PutUser(&user); err != nil {
+		return User{}, err
+	}
+	_, err = store.DeleteSessions(user.ID)
+	return user, err
+}
+
+// Login checks the password of the user with name and starts a session of lifetime for them. It
+// returns the token of the session, to send in the session cookie. An unknown or disabled user
+// and a wrong password all get the same InvalidLogin response.
+func Login(store Store, name, password string, lifetime time.Duration) (user User, token string, session Session, err error) {
+	user, err = store.UserByName(name)
+	switch {
+	case err == sql.ErrNoRows:
+		bcrypt.CompareHashAndPassword(dummyHash, []byte(password))
+		return User{}, "", Session{}, InvalidLogin
+	case err != nil:
+		return User{}, "", Session{}, CustomResponse(DbError, err)
+	}
+	if bcrypt.CompareHashAndPassword([]byte(user.PasswordHash), []byte(password)) != nil || user.Disabled {
+		return User{}, "", Session{}, InvalidLogin
+	}
+	b := make([]byte, 32)
+	if _, err = rand.Read(b); err != nil {
+		return User{}, "", Session{}, err
+	}
+	token = hex.EncodeToString(b)
+	now := time.Now().UTC().Truncate(time.Second)
+	session = Session{TokenHash: hashToken(token), UserID: user.ID, Created: now, Expires: now.Add(lifetime)}
+	if err = store.PutSession(&session); err != nil {
+		return User{}, "", Session{}, CustomResponse(DbError, err)
+	}
+	return user, token, session, nil
+}
+
+// sessionUser returns the user logged in with the session cookie of r. A request without a
+// valid session is refused, with SetupRequired as long as there are no accounts to log in with.
+func sessionUser(store Store, r *http.Request) (User, error) {
+	if cookie, err := r.Cookie(SessionCookie); err == nil {
+		session, err := store.GetSession(hashToken(cookie.Value))
+		switch {
+		case err == nil && time.Now().After(session.Expires):
+			store.DeleteSession(session.TokenHash)
+		case err == nil:
+			user, err := store.GetUser(session.UserID)
+			switch {
+			case err == nil && user.Disabled:
+				return User{}, UserDisabled
+			case err == nil:
+				return user, nil
+			case err != sql.ErrNoRows:
+				return User{}, CustomResponse(DbError, err)
+			}
+		case err != sql.ErrNoRows:
+			return User{}, CustomResponse(DbError, err)
+		}
+	}
+	users, err := store.Users()
+	if err != nil {
+		return User{}, CustomResponse(DbError, err)
+	}
+	if len(users) == 0 {
+		return User{}, SetupRequired
+	}
+	return User{}, Unauthorized
+}
+
+// public marks route as reachable without logging in
+func (s *Server) public(route *mux.Route) {
+	s.publicRoutes[route] = true
+}
+
+// authenticate is the middleware letting requests through to the routes that are not public
+// only when they are made by a logged in user, who is put in the context of the request
+func (s *Server) authenticate(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if s.publicRoutes[mux.CurrentRoute(r)] {
+			next.ServeHTTP(w, r)
+			return
+		}
+		user, err := sessionUser(s.Store, r)
+		if err != nil {
+			WriteError(w, r, err)
+			return
+		}
+		next.ServeHTTP(w, withUser(r, user))
+	})
+}
+
+// setSessionCookie sends the session cookie with token, it expires with the session
+func (s *Server) setSessionCookie(w http.ResponseWriter, token string, expires time.Time) {
+	http.SetCookie(w, &http.Cookie{
+		Name:     SessionCookie,
+		Value:    token,
+		Path:     "/",
+		Expires:  expires,
+		HttpOnly: true,
+		Secure:   !s.config.InsecureCookie,
+		SameSite: http.SameSiteStrictMode,
+	})
+}
+
+// clearSessionCookie makes the browser drop the session cookie
+func (s *Server) clearSessionCookie(w http.ResponseWriter) {
+	http.SetCookie(w, &http.Cookie{
+		Name:     SessionCookie,
+		Path:     "/",
+		MaxAge:   -1,
+		HttpOnly: true,
+		Secure:   !s.config.InsecureCookie,
+		SameSite: http.SameSiteStrictMode,
+	})
+}
+
+// loginRequest is the body posted to log in
+type loginRequest struct {
+	Name     string `json:"name"`
+	Password string `json:"password"`
+}
+
+// loginHandler logs a user in, starting a session and sending its cookie
+func (s *Server) loginHandler(w http.ResponseWriter, r *http.Request) {
+	var login loginRequest
+	if err := decodeJSON(r.Body, &login); err != nil {
+		WriteError(w, r, err)
+		return
+	}
+	user, token, session, err := Login(s.Store, login.Name, login.Password, s.config.SessionLifetime())
+	if err != nil {
+		WriteError(w, r, err)
+		return
+	}
+	s.setSessionCookie(w, token, session.Expires)
+	writeJSON(w, user)
+}
+
+// logoutHandler ends the session of the request, when there is one
+func (s *Server) logoutHandler(w http.ResponseWriter, r *http.Request) {
+	if cookie, err := r.Cookie(SessionCookie); err == nil {
+		if err = s.Store.DeleteSession(hashToken(cookie.Value)); err != nil && err != sql.ErrNoRows {
+			WriteError(w, r, CustomResponse(DbError, err))
+			return
+		}
+	}
+	s.clearSessionCookie(w)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// revokeSessionsHandler ends all sessions of the user logged in, on every device
+func (s *Server) revokeSessionsHandler(w http.ResponseWriter, r *http.Request) {
+	if _, err := s.Store.DeleteSessions(userOf(r).ID); err != nil {
+		WriteError(w, r, CustomResponse(DbError, err))
+		return
+	}
+	s.clearSessionCookie(w)
+	w.WriteHeader(http.StatusNoContent)
+}
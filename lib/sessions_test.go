@@ -0,0 +1,285 @@
+package km
+
+import (
+	"bytes"
+	"database/sql"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+const testPassword = "correct horse"
+
+// loginCookie adds the user name to the store of the server and logs them in, it returns the
+// session cookie
+func loginCookie(t *testing.T, name string) *http.Cookie {
+	if _, err := CreateUser(s.Store, name); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := SetPassword(s.Store, name, testPassword); err != nil {
+		t.Fatal(err)
+	}
+	w := serve(loginRequestFor(name, testPassword))
+	if w.Code != 200 {
+		t.Fatalf("logging in %s: code = %d %s", name, w.Code, w.Body.String())
+	}
+	for _, cookie := range w.Result().Cookies() {
+		if cookie.Name == SessionCookie {
+			return cookie
+		}
+	}
+	t.Fatalf("logging in %s sets no session cookie", name)
+	return nil
+}
+
+func loginRequestFor(name, password string) *http.Request {
+	req, _ := http.NewRequest("POST", "/api/v1/login", strings.NewReader(`{"name": "`+name+`", "password": "`+password+`"}`))
+	req.Header.Set("Accept", "application/json")
+	return req
+}
+
+// getDays gets the days of January 2014 with cookie, or without a session when it is nil
+func getDays(cookie *http.Cookie) int {
+	req, _ := http.NewRequest("GET", "/api/v1/days?from=2014-01-01&to=2014-01-31", nil)
+	req.Header.Set("Accept", "application/json")
+	if cookie != nil {
+		req.AddCookie(cookie)
+	}
+	return serveAnonymous(req).Code
+}
+
+func isInvalidLogin(err error) bool {
+	resp, ok := err.(Response)
+	return ok && resp.Name == InvalidLogin.Name
+}
+
+func TestSetPassword(t *testing.T) {
+	store := NewMemoryStore()
+	if _, err := CreateUser(store, "alice"); err != nil {
+		t.Fatal(err)
+	}
+	for _, password := range []string{"", "short", strings.Repeat("x", 73)} {
+		if ValidatePassword(password) == nil {
+			t.Errorf("password of %d characters is valid", len(password))
+		}
+		if _, err := SetPassword(store, "alice", password); err == nil {
+			t.Errorf("password of %d characters is accepted", len(password))
+		}
+	}
+	if err := ValidatePassword(testPassword); err != nil {
+		t.Error(err)
+	}
+	if _, err := SetPassword(store, "bob", testPassword); err == nil {
+		t.Error("a password is set for a user that does not exist")
+	}
+	alice, err := SetPassword(store, "alice", testPassword)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if saved, _ := store.UserByName("alice"); saved.PasswordHash == "" || strings.Contains(saved.PasswordHash, testPassword) {
+		t.Errorf("the password is saved as %q", saved.PasswordHash)
+	}
+
+	_, token, _, err := Login(store, "alice", testPassword, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = store.GetSession(token); err != sql.ErrNoRows {
+		t.Error("the session is saved under its token")
+	}
+	// changing the password ends the sessions
+	if _, err = SetPassword(store, "alice", "another password"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = store.GetSession(hashToken(token)); err != sql.ErrNoRows {
+		t.Errorf("the session of %s survives a new password: %v", alice.Name, err)
+	}
+}
+
+func TestLogin(t *testing.T) {
+	store := NewMemoryStore()
+	CreateUser(store, "alice")
+	SetPassword(store, "alice", testPassword)
+	CreateUser(store, "bob")
+	for _, tc := range []struct{ name, password string }{
+		{"alice", "wrong password"},
+		{"alice", ""},
+		{"mallory", testPassword},
+		// bob has no password yet
+		{"bob", ""},
+	} {
+		if _, _, _, err := Login(store, tc.name, tc.password, time.Hour); !isInvalidLogin(err) {
+			t.Errorf("%s with %q: got %v", tc.name, tc.password, err)
+		}
+	}
+	user, token, session, err := Login(store, "alice", testPassword, time.Hour)
+	if err != nil || user.Name != "alice" || token == "" {
+		t.Fatalf("got %+v %q %v", user, token, err)
+	}
+	if session.UserID != user.ID || session.Expires.Sub(session.Created) != time.Hour {
+		t.Errorf("got session %+v", session)
+	}
+	DisableUser(store, "alice", true)
+	if _, _, _, err = Login(store, "alice", testPassword, time.Hour); !isInvalidLogin(err) {
+		t.Errorf("a disabled user logs in: %v", err)
+	}
+	if _, err = store.GetSession(session.TokenHash); err != sql.ErrNoRows {
+		t.Error("disabling a user leaves their sessions")
+	}
+}
+
+func TestLoginHandler(t *testing.T) {
+	initServer(t)
+	cookie := loginCookie(t, "alice")
+	if !cookie.HttpOnly || !cookie.Secure || cookie.SameSite != http.SameSiteStrictMode || cookie.Path != "/" {
+		t.Errorf("got cookie %+v", cookie)
+	}
+	if cookie.Expires.Before(time.Now().Add(DefaultSessionHours*time.Hour - time.Minute)) {
+		t.Errorf("the cookie expires at %s", cookie.Expires)
+	}
+	if w := serve(loginRequestFor("alice", "wrong password")); w.Code != InvalidLogin.Code || len(w.Result().Cookies()) != 0 {
+		t.Errorf("wrong password: code = %d, cookies %v", w.Code, w.Result().Cookies())
+	}
+	req, _ := http.NewRequest("POST", "/api/v1/login", strings.NewReader(`{"name": "alice", "password": "x", "remember": true}`))
+	if w := serve(req); w.Code != UnknownField.Code {
+		t.Errorf("unknown field: code = %d", w.Code)
+	}
+
+	// a server that is not served over https sends the cookie over http too
+	config.InsecureCookie = true
+	startServer(t)
+	defer initServer(t)
+	if cookie = loginCookie(t, "alice"); cookie.Secure {
+		t.Errorf("got a secure cookie %+v", cookie)
+	}
+}
+
+func TestSessionRequired(t *testing.T) {
+	// without accounts no one can log in, requests are refused all the same
+	var err error
+	if s, err = NewServer("km_test", Config{Env: "testing", Store: "memory"}); err != nil {
+		t.Fatal(err)
+	}
+	if code := getDays(nil); code != SetupRequired.Code {
+		t.Errorf("without accounts: code = %d, want %d", code, SetupRequired.Code)
+	}
+	if code := getDays(&http.Cookie{Name: SessionCookie, Value: "forged"}); code != SetupRequired.Code {
+		t.Errorf("without accounts, forged session: code = %d, want %d", code, SetupRequired.Code)
+	}
+
+	initServer(t)
+	cookie := loginCookie(t, "alice")
+	for _, tc := range []struct {
+		cookie *http.Cookie
+		want   int
+	}{
+		{nil, Unauthorized.Code},
+		{&http.Cookie{Name: SessionCookie, Value: "forged"}, Unauthorized.Code},
+		{cookie, 200},
+	} {
+		if code := getDays(tc.cookie); code != tc.want {
+			t.Errorf("cookie %v: code = %d, want %d", tc.cookie, code, tc.want)
+		}
+	}
+	// the login, the page and the static files are public
+	for _, url := range []string{"/", "/favicon.ico", "/js/app.js"} {
+		req, _ := http.NewRequest("GET", url, nil)
+		if code := serveAnonymous(req).Code; code == Unauthorized.Code {
+			t.Errorf("GET %s needs a session", url)
+		}
+	}
+
+	// a user disabled while logged in is turned away
+	user, _ := s.Store.UserByName("alice")
+	user.Disabled = true
+	s.Store.PutUser(&user)
+	if code := getDays(cookie); code != UserDisabled.Code {
+		t.Errorf("disabled user: code = %d, want %d", code, UserDisabled.Code)
+	}
+}
+
+func TestSessionExpiry(t *testing.T) {
+	initServer(t)
+	cookie := loginCookie(t, "alice")
+	session, err := s.Store.GetSession(hashToken(cookie.Value))
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.Store.DeleteSession(session.TokenHash)
+	session.Expires = time.Now().Add(-time.Minute)
+	s.Store.PutSession(&session)
+	if code := getDays(cookie); code != Unauthorized.Code {
+		t.Errorf("expired session: code = %d", code)
+	}
+	if _, err = s.Store.GetSession(session.TokenHash); err != sql.ErrNoRows {
+		t.Error("the expired session is kept")
+	}
+
+	s.Store.PutSession(&session)
+	if deleted, err := s.Store.DeleteExpiredSessions(time.Now()); err != nil || deleted != 1 {
+		t.Errorf("deleted %d expired sessions: %v", deleted, err)
+	}
+}
+
+func TestLogout(t *testing.T) {
+	initServer(t)
+	cookie := loginCookie(t, "alice")
+	other := loginCookie(t, "bob")
+	req, _ := http.NewRequest("POST", "/api/v1/logout", nil)
+	req.AddCookie(cookie)
+	w := serve(req)
+	if w.Code != http.StatusNoContent {
+		t.Fatalf("logout: code = %d", w.Code)
+	}
+	if cookies := w.Result().Cookies(); len(cookies) != 1 || cookies[0].MaxAge >= 0 {
+		t.Errorf("the session cookie is not cleared: %v", cookies)
+	}
+	if code := getDays(cookie); code != Unauthorized.Code {
+		t.Errorf("after logging out: code = %d", code)
+	}
+	if code := getDays(other); code != 200 {
+		t.Errorf("logging out ends the session of another user: code = %d", code)
+	}
+}
+
+func TestRevokeSessions(t *testing.T) {
+	initServer(t)
+	laptop := loginCookie(t, "alice")
+	w := serve(loginRequestFor("alice", testPassword))
+	phone := w.Result().Cookies()[0]
+	bob := loginCookie(t, "bob")
+
+	req, _ := http.NewRequest("DELETE", "/api/v1/sessions", nil)
+	if code := serveAnonymous(req).Code; code != Unauthorized.Code {
+		t.Errorf("revoking without a session: code = %d", code)
+	}
+	req.AddCookie(phone)
+	if code := serve(req).Code; code != http.StatusNoContent {
+		t.Fatalf("revoking: code = %d", code)
+	}
+	for name, cookie := range map[string]*http.Cookie{"laptop": laptop, "phone": phone} {
+		if code := getDays(cookie); code != Unauthorized.Code {
+			t.Errorf("the %s session survives: code = %d", name, code)
+		}
+	}
+	if code := getDays(bob); code != 200 {
+		t.Errorf("the session of bob is revoked: code = %d", code)
+	}
+}
+
+func TestBackupPasswords(t *testing.T) {
+	initServer(t)
+	loginCookie(t, "alice")
+	var b bytes.Buffer
+	if _, err := Backup(s.Store, &b); err != nil {
+		t.Fatal(err)
+	}
+	restored := NewMemoryStore()
+	if _, err := Restore(restored, bytes.NewReader(b.Bytes()), int64(b.Len())); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, _, err := Login(restored, "alice", testPassword, time.Hour); err != nil {
+		t.Errorf("alice can not log in to the restored store: %v", err)
+	}
+}
@@ -0,0 +1,564 @@
+package km
+
+import (
+	"database/sql"
+	"fmt"
+	"time"
+
+	"github.com/coopernurse/gorp"
+	// sqlite for its side effects
+	_ "github.com/mattn/go-sqlite3"
+)
+
+// SqliteStore is a Store backed by an embedded sqlite database file,
+// for running without a separate database server
+type SqliteStore struct {
+	sqliteExecutor
+	Dbmap *gorp.DbMap
+	*migrator
+}
+
+var sqliteMigrations = []Migration{
+	{
+		Version: 1,
+		Name:    "create kilometers and times tables",
+		Up: `create table if not exists kilometers (
+			id integer primary key autoincrement,
+			date date not null,
+			begin integer not null default 0,
+			eerste integer not null default 0,
+			laatste integer not null default 0,
+			terug integer not null default 0
+		);
+		create table if not exists times (
+			id integer primary key autoincrement,
+			date date not null,
+			begin integer not null default 0,
+			checkin integer not null default 0,
+			checkout integer not null default 0,
+			laatste integer not null default 0
+		)`,
+		Down: "drop table times; drop table kilometers",
+	},
+	{
+		Version: 2,
+		Name:    "add comment to kilometers",
+		Up:      "alter table kilometers add column comment text not null default ''",
+		Down:    "alter table kilometers drop column comment",
+	},
+	{
+		Version: 3,
+		Name:    "one row per date",
+		Up: `create unique index if not exists kilometers_date_key on kilometers (date);
+		create unique index if not exists times_date_key on times (date)`,
+		Down: "drop index times_date_key; drop index kilometers_date_key",
+	},
+	{
+		Version: 4,
+		Name:    "mark inferred readings",
+		Up:      "alter table kilometers add column inferred boolean not null default false",
+		Down:    "alter table kilometers drop column inferred",
+	},
+	{
+		Version: 5,
+		Name:    "keep deleted days in the trash",
+		Up: `alter table kilometers add column deleted_at datetime;
+		alter table times add column deleted_at datetime`,
+		Down: "alter table times drop column deleted_at; alter table kilometers drop column deleted_at",
+	},
+	{
+		Version: 6,
+		Name:    "audit log",
+		Up: `create table if not exists audit (
+			id integer primary key autoincrement,
+			date date not null,
+			at datetime not null,
+			kind text not null,
+			action text not null,
+			before text not null default '',
+			after text not null default '',
+			remote_addr text not null default '',
+			user_name text not null default '',
+			request_id text not null default ''
+		);
+		create index if not exists audit_date on audit (date)`,
+		Down: "drop table audit",
+	},
+	{
+		Version: 7,
+		Name:    "chain the audit log",
+		Up: `alter table audit add column prev_hash text not null default '';
+		alter table audit add column hash text not null default '';
+		create unique index audit_prev_hash_key on audit (prev_hash) where hash <> ''`,
+		Down: "drop index audit_prev_hash_key; alter table audit drop column hash; alter table audit drop column prev_hash",
+	},
+	{
+		Version: 8,
+		Name:    "trips",
+		Up: `create table if not exists trips (
+			id integer primary key autoincrement,
+			date date not null,
+			start_km integer not null,
+			end_km integer not null,
+			from_address text not null default '',
+			to_address text not null default '',
+			purpose text not null default '',
+			type text not null,
+			deleted_at datetime
+		);
+		create index if not exists trips_date on trips (date)`,
+		Down: "drop table trips",
+	},
+	{
+		Version: 9,
+		Name:    "vehicles",
+		Up: `create table if not exists vehicles (
+			id integer primary key autoincrement,
+			license_plate text not null,
+			make text not null default '',
+			start_date date not null,
+			end_date date,
+			start_km integer not null default 0,
+			active boolean not null default false
+		);
+		alter table kilometers add column vehicle_id integer not null default 0`,
+		Down: "alter table kilometers drop column vehicle_id; drop table vehicles",
+	},
+	{
+		Version: 10,
+		Name:    "users",
+		Up: `create table if not exists users (
+			id integer primary key autoincrement,
+			name text not null unique,
+			disabled boolean not null default false,
+			created_at datetime not null default current_timestamp
+		);
+		alter table kilometers add column user_id integer not null default 0;
+		alter table times add column user_id integer not null default 0;
+		alter table trips add column user_id integer not null default 0;
+		alter table vehicles add column user_id integer not null default 0;
+		alter table audit add column user_id integer not null default 0;
+		drop index kilometers_date_key;
+		drop index times_date_key;
+		drop index audit_prev_hash_key;
+		create unique index kilometers_user_date_key on kilometers (user_id, date);
+		create unique index times_user_date_key on times (user_id, date);
+		create unique index audit_user_prev_hash_key on audit (user_id, prev_hash) where hash <> ''`,
+		Down: `drop index audit_user_prev_hash_key;
+		drop index times_user_date_key;
+		drop index kilometers_user_date_key;
+		create unique index audit_prev_hash_key on audit (prev_hash) where hash <> '';
+		create unique index times_date_key on times (date);
+		create unique index kilometers_date_key on kilometers (date);
+		alter table audit drop column user_id;
+		alter table vehicles drop column user_id;
+		alter table trips drop column user_id;
+		alter table times drop column user_id;
+		alter table kilometers drop column user_id;
+		drop table users`,
+	},
+	{
+		Version: 11,
+		Name:    "sessions",
+		Up: `alter table users add column password_hash text not null default '';
+		create table if not exists sessions (
+			token_hash text primary key,
+			user_id integer not null references users (id) on delete cascade,
+			created_at datetime not null,
+			expires_at datetime not null
+		);
+		create index if not exists sessions_user_id on sessions (user_id)`,
+		Down: `drop table sessions;
+		alter table users drop column password_hash`,
+	},
+}
+
+// NewSqliteStore opens the sqlite database at path, creating it when it does not exist.
+// The schema is created by migrating the store up.
+func NewSqliteStore(path string) (*SqliteStore, error) {
+	db, err := sql.Open("sqlite3", path)
+	if err != nil {
+		return nil, fmt.Errorf("sql.Open result: %s", err)
+	}
+	if err = db.Ping(); err != nil {
+		return nil, fmt.Errorf("ping result: %s", err)
+	}
+	dbmap := &gorp.DbMap{Db: db, Dialect: gorp.SqliteDialect{}}
+	dbmap.AddTableWithName(Kilometers{}, "kilometers").SetKeys(true, "Id")
+	dbmap.AddTableWithName(Times{}, "times").SetKeys(true, "Id")
+	return &SqliteStore{
+		sqliteExecutor: sqliteExecutor{ex: dbmap},
+		Dbmap:          dbmap,
+		migrator: &migrator{
+			db:           db,
+			migrations:   sqliteMigrations,
+			versionTable: "create table if not exists schema_version (version integer primary key, applied_at datetime not null default current_timestamp)",
+			bindVar:      func(i int) string { return "?" },
+		},
+	}, nil
+}
+
+// sqliteExecutor runs the queries of a SqliteStore, directly on the database
+// or within a transaction, on the rows of user
+type sqliteExecutor struct {
+	ex   gorp.SqlExecutor
+	user int64
+}
+
+// sqliteTx is a transaction on a SqliteStore
+type sqliteTx struct {
+	sqliteExecutor
+	tx *gorp.Transaction
+}
+
+// Begin implements Store
+func (s *SqliteStore) Begin() (Tx, error) {
+	tx, err := s.Dbmap.Begin()
+	if err != nil {
+		return nil, err
+	}
+	return &sqliteTx{sqliteExecutor{ex: tx, user: s.user}, tx}, nil
+}
+
+// Commit implements Tx
+func (t *sqliteTx) Commit() error {
+	return t.tx.Commit()
+}
+
+// Rollback implements Tx
+func (t *sqliteTx) Rollback() error {
+	return t.tx.Rollback()
+}
+
+// sqlite has no date type, dates are stored as text and are compared as text
+// so they have to be normalized first
+func sqliteMonth(year, month int64) (string, string) {
+	return fmt.Sprintf("%04d", year), fmt.Sprintf("%02d", month)
+}
+
+// GetKilometers implements Executor
+func (s sqliteExecutor) GetKilometers(date time.Time) (k Kilometers, err error) {
+	err = s.ex.SelectOne(&k, "select * from kilometers where user_id=? and date=? and deleted_at is null", s.user, truncateDate(date))
+	return
+}
+
+// GetTimes implements Executor
+func (s sqliteExecutor) GetTimes(date time.Time) (t Times, err error) {
+	err = s.ex.SelectOne(&t, "select * from times where user_id=? and date=? and deleted_at is null", s.user, truncateDate(date))
+	return
+}
+
+// LastKilometers implements Executor
+func (s sqliteExecutor) LastKilometers(vehicleID int64) (k Kilometers, err error) {
+	err = s.ex.SelectOne(&k, "select * from kilometers where user_id=? and vehicle_id=? and deleted_at is null order by date desc limit 1", s.user, vehicleID)
+	return
+}
+
+// PreviousKilometers implements Executor
+func (s sqliteExecutor) PreviousKilometers(vehicleID int64, date time.Time) (k Kilometers, err error) {
+	err = s.ex.SelectOne(&k, "select * from kilometers where user_id=? and vehicle_id=? and date < ? and deleted_at is null order by date desc limit 1", s.user, vehicleID, truncateDate(date))
+	return
+}
+
+// NextKilometers implements Executor
+func (s sqliteExecutor) NextKilometers(vehicleID int64, date time.Time) (k Kilometers, err error) {
+	err = s.ex.SelectOne(&k, "select * from kilometers where user_id=? and vehicle_id=? and date > ? and deleted_at is null order by date limit 1", s.user, vehicleID, truncateDate(date))
+	return
+}
+
+// LastTimes implements Executor
+func (s sqliteExecutor) LastTimes(n int) (times []Times, err error) {
+	_, err = s.ex.Select(&times, "select * from times where user_id=? and deleted_at is null order by date desc limit ?", s.user, n)
+	return
+}
+
+// PutKilometers implements Executor
+func (s sqliteExecutor) PutKilometers(k *Kilometers) (err error) {
+	k.Date, k.UserID = truncateDate(k.Date), s.user
+	k.ID, err = s.ex.SelectInt("insert into kilometers (date, begin, eerste, laatste, terug, comment, inferred, vehicle_id, user_id) "+
+		"values (?, ?, ?, ?, ?, ?, ?, ?, ?) "+
+		"on conflict (user_id, date) do update set begin=excluded.begin, eerste=excluded.eerste, "+
+		"laatste=excluded.laatste, terug=excluded.terug, comment=excluded.comment, inferred=excluded.inferred, "+
+		"vehicle_id=excluded.vehicle_id, deleted_at=null "+
+		"returning id", k.Date, k.Begin, k.Eerste, k.Laatste, k.Terug, k.Comment, k.Inferred, k.VehicleID, k.UserID)
+	if err == nil && k.ID == 0 {
+		err = fmt.Errorf("upsert of kilometers did not return an id")
+	}
+	return
+}
+
+// PutTimes implements Executor
+func (s sqliteExecutor) PutTimes(t *Times) (err error) {
+	t.Date, t.UserID = truncateDate(t.Date), s.user
+	t.ID, err = s.ex.SelectInt("insert into times (date, begin, checkin, checkout, laatste, user_id) "+
+		"values (?, ?, ?, ?, ?, ?) "+
+		"on conflict (user_id, date) do update set begin=excluded.begin, checkin=excluded.checkin, "+
+		"checkout=excluded.checkout, laatste=excluded.laatste, deleted_at=null "+
+		"returning id", t.Date, t.Begin, t.CheckIn, t.CheckOut, t.Laatste, t.UserID)
+	if err == nil && t.ID == 0 {
+		err = fmt.Errorf("upsert of times did not return an id")
+	}
+	return
+}
+
+// KilometersInMonth implements Executor
+func (s sqliteExecutor) KilometersInMonth(year, month int64) (all []Kilometers, err error) {
+	y, m := sqliteMonth(year, month)
+	_, err = s.ex.Select(&all, "select * from kilometers where user_id=? and strftime('%Y', date)=? and strftime('%m', date)=? and deleted_at is null order by date desc", s.user, y, m)
+	return
+}
+
+// TimesInMonth implements Executor
+func (s sqliteExecutor) TimesInMonth(year, month int64) (all []Times, err error) {
+	y, m := sqliteMonth(year, month)
+	_, err = s.ex.Select(&all, "select * from times where user_id=? and strftime('%Y', date)=? and strftime('%m', date)=? and deleted_at is null order by date desc", s.user, y, m)
+	return
+}
+
+// KilometersBetween implements Executor
+func (s sqliteExecutor) KilometersBetween(from, to time.Time) (all []Kilometers, err error) {
+	_, err = s.ex.Select(&all, "select * from kilometers where user_id=? and date >= ? and date <= ? and deleted_at is null order by date desc", s.user, truncateDate(from), truncateDate(to))
+	return
+}
+
+// TimesBetween implements Executor
+func (s sqliteExecutor) TimesBetween(from, to time.Time) (all []Times, err error) {
+	_, err = s.ex.Select(&all, "select * from times where user_id=? and date >= ? and date <= ? and deleted_at is null order by date desc", s.user, truncateDate(from), truncateDate(to))
+	return
+}
+
+// DeleteDate implements Executor
+func (s sqliteExecutor) DeleteDate(date time.Time) (err error) {
+	for _, table := range []string{"kilometers", "times", "trips"} {
+		if _, err = s.ex.Exec("update "+table+" set deleted_at=current_timestamp where user_id=? and date=? and deleted_at is null", s.user, truncateDate(date)); err != nil {
+			return
+		}
+	}
+	return
+}
+
+// DeletedKilometers implements Executor
+func (s sqliteExecutor) DeletedKilometers() (all []Kilometers, err error) {
+	_, err = s.ex.Select(&all, "select * from kilometers where user_id=? and deleted_at is not null order by date desc", s.user)
+	return
+}
+
+// DeletedTimes implements Executor
+func (s sqliteExecutor) DeletedTimes() (all []Times, err error) {
+	_, err = s.ex.Select(&all, "select * from times where user_id=? and deleted_at is not null order by date desc", s.user)
+	return
+}
+
+// RestoreDate implements Executor
+func (s sqliteExecutor) RestoreDate(date time.Time) error {
+	var restored int64
+	for _, table := range []string{"kilometers", "times", "trips"} {
+		result, err := s.ex.Exec("update "+table+" set deleted_at=null where user_id=? and date=? and deleted_at is not null", s.user, truncateDate(date))
+		if err != nil {
+			return err
+		}
+		n, err := result.RowsAffected()
+		if err != nil {
+			return err
+		}
+		restored += n
+	}
+	if restored == 0 {
+		return sql.ErrNoRows
+	}
+	return nil
+}
+
+// PurgeDeleted implements Executor, deleted_at is set with current_timestamp, which is UTC text,
+// so before is compared in the same representation
+func (s sqliteExecutor) PurgeDeleted(before time.Time) (purged int64, err error) {
+	for _, table := range []string{"kilometers", "times", "trips"} {
+		result, err := s.ex.Exec("delete from "+table+" where user_id=? and deleted_at < ?", s.user, before.UTC().Format("2006-01-02 15:04:05"))
+		if err != nil {
+			return purged, err
+		}
+		n, err := result.RowsAffected()
+		if err != nil {
+			return purged, err
+		}
+		purged += n
+	}
+	return purged, nil
+}
+
+// PutAudit implements Executor
+func (s sqliteExecutor) PutAudit(e *AuditEntry) (err error) {
+	e.UserID = s.user
+	e.ID, err = s.ex.SelectInt("insert into audit (date, at, kind, action, before, after, remote_addr, user_name, request_id, prev_hash, hash, user_id) "+
+		"values (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?) returning id",
+		truncateDate(e.Date), e.At, e.Kind, e.Action, e.Before, e.After, e.RemoteAddr, e.User, e.RequestID, e.PrevHash, e.Hash, e.UserID)
+	return
+}
+
+// LastAudit implements Executor
+func (s sqliteExecutor) LastAudit() (e AuditEntry, err error) {
+	err = s.ex.SelectOne(&e, "select * from audit where user_id=? order by id desc limit 1", s.user)
+	return
+}
+
+// AuditForDate implements Executor
+func (s sqliteExecutor) AuditForDate(date time.Time) (all []AuditEntry, err error) {
+	_, err = s.ex.Select(&all, "select * from audit where user_id=? and date=? order by id", s.user, truncateDate(date))
+	return
+}
+
+// AuditLog implements Executor
+func (s sqliteExecutor) AuditLog() (all []AuditEntry, err error) {
+	_, err = s.ex.Select(&all, "select * from audit where user_id=? order by id", s.user)
+	return
+}
+
+// TripsForDate implements Executor
+func (s sqliteExecutor) TripsForDate(date time.Time) (all []Trip, err error) {
+	_, err = s.ex.Select(&all, "select * from trips where user_id=? and date=? and deleted_at is null order by start_km, id", s.user, truncateDate(date))
+	return
+}
+
+// TripsBetween implements Executor
+func (s sqliteExecutor) TripsBetween(from, to time.Time) (all []Trip, err error) {
+	_, err = s.ex.Select(&all, "select * from trips where user_id=? and date >= ? and date <= ? and deleted_at is null order by date, start_km, id", s.user, truncateDate(from), truncateDate(to))
+	return
+}
+
+// GetTrip implements Executor
+func (s sqliteExecutor) GetTrip(id int64) (t Trip, err error) {
+	err = s.ex.SelectOne(&t, "select * from trips where user_id=? and id=? and deleted_at is null", s.user, id)
+	return
+}
+
+// PutTrip implements Executor
+func (s sqliteExecutor) PutTrip(t *Trip) error {
+	t.Date, t.UserID = truncateDate(t.Date), s.user
+	if t.ID == 0 {
+		id, err := s.ex.SelectInt("insert into trips (date, start_km, end_km, from_address, to_address, purpose, type, user_id) "+
+			"values (?, ?, ?, ?, ?, ?, ?, ?) returning id", t.Date, t.StartKm, t.EndKm, t.From, t.To, t.Purpose, t.Type, t.UserID)
+		t.ID = id
+		return err
+	}
+	result, err := s.ex.Exec("update trips set date=?, start_km=?, end_km=?, from_address=?, to_address=?, purpose=?, type=? "+
+		"where user_id=? and id=? and deleted_at is null", t.Date, t.StartKm, t.EndKm, t.From, t.To, t.Purpose, t.Type, t.UserID, t.ID)
+	return affectedOne(result, err)
+}
+
+// DeleteTrip implements Executor
+func (s sqliteExecutor) DeleteTrip(id int64) error {
+	return affectedOne(s.ex.Exec("delete from trips where user_id=? and id=? and deleted_at is null", s.user, id))
+}
+
+// Vehicles implements Executor
+func (s sqliteExecutor) Vehicles() (all []Vehicle, err error) {
+	_, err = s.ex.Select(&all, "select * from vehicles where user_id=? order by start_date, id", s.user)
+	return
+}
+
+// GetVehicle implements Executor
+func (s sqliteExecutor) GetVehicle(id int64) (v Vehicle, err error) {
+	err = s.ex.SelectOne(&v, "select * from vehicles where user_id=? and id=?", s.user, id)
+	return
+}
+
+// PutVehicle implements Executor
+func (s sqliteExecutor) PutVehicle(v *Vehicle) error {
+	v.StartDate, v.UserID = truncateDate(v.StartDate), s.user
+	if v.ID == 0 {
+		id, err := s.ex.SelectInt("insert into vehicles (license_plate, make, start_date, end_date, start_km, active, user_id) "+
+			"values (?, ?, ?, ?, ?, ?, ?) returning id", v.LicensePlate, v.Make, v.StartDate, v.EndDate, v.StartKm, v.Active, v.UserID)
+		v.ID = id
+		return err
+	}
+	result, err := s.ex.Exec("update vehicles set license_plate=?, make=?, start_date=?, end_date=?, start_km=?, active=? "+
+		"where user_id=? and id=?", v.LicensePlate, v.Make, v.StartDate, v.EndDate, v.StartKm, v.Active, v.UserID, v.ID)
+	return affectedOne(result, err)
+}
+
+// ActivateVehicle implements Executor
+func (s sqliteExecutor) ActivateVehicle(id int64) error {
+	if err := affectedOne(s.ex.Exec("update vehicles set active=1 where user_id=? and id=?", s.user, id)); err != nil {
+		return err
+	}
+	_, err := s.ex.Exec("update vehicles set active=0 where user_id=? and id<>?", s.user, id)
+	return err
+}
+
+// ForUser implements Store
+func (s *SqliteStore) ForUser(id int64) Store {
+	scoped := *s
+	scoped.user = id
+	return &scoped
+}
+
+// Users implements Accounts
+func (s *SqliteStore) Users() (all []User, err error) {
+	_, err = s.Dbmap.Select(&all, "select * from users order by id")
+	return
+}
+
+// GetUser implements Accounts
+func (s *SqliteStore) GetUser(id int64) (u User, err error) {
+	err = s.Dbmap.SelectOne(&u, "select * from users where id=?", id)
+	return
+}
+
+// UserByName implements Accounts
+func (s *SqliteStore) UserByName(name string) (u User, err error) {
+	err = s.Dbmap.SelectOne(&u, "select * from users where name=?", name)
+	return
+}
+
+// PutUser implements Accounts
+func (s *SqliteStore) PutUser(u *User) error {
+	if u.ID == 0 {
+		id, err := s.Dbmap.SelectInt("insert into users (name, disabled, created_at, password_hash) values (?, ?, ?, ?) returning id", u.Name, u.Disabled, u.Created, u.PasswordHash)
+		u.ID = id
+		return err
+	}
+	return affectedOne(s.Dbmap.Exec("update users set name=?, disabled=?, password_hash=? where id=?", u.Name, u.Disabled, u.PasswordHash, u.ID))
+}
+
+// ClaimRows implements Accounts
+func (s *SqliteStore) ClaimRows(id int64) (int64, error) {
+	return claimRows(s.Dbmap.Db, id, "select count(*) from %s where user_id=?", "update %s set user_id=? where user_id=0")
+}
+
+// PutSession implements Accounts
+func (s *SqliteStore) PutSession(session *Session) error {
+	_, err := s.Dbmap.Exec("insert into sessions (token_hash, user_id, created_at, expires_at) values (?, ?, ?, ?)",
+		session.TokenHash, session.UserID, session.Created, session.Expires)
+	return err
+}
+
+// GetSession implements Accounts
+func (s *SqliteStore) GetSession(tokenHash string) (session Session, err error) {
+	err = s.Dbmap.SelectOne(&session, "select * from sessions where token_hash=?", tokenHash)
+	return
+}
+
+// DeleteSession implements Accounts
+func (s *SqliteStore) DeleteSession(tokenHash string) error {
+	return affectedOne(s.Dbmap.Exec("delete from sessions where token_hash=?", tokenHash))
+}
+
+// DeleteSessions implements Accounts
+func (s *SqliteStore) DeleteSessions(userID int64) (int64, error) {
+	return rowsAffected(s.Dbmap.Exec("delete from sessions where user_id=?", userID))
+}
+
+// DeleteExpiredSessions implements Accounts
+func (s *SqliteStore) DeleteExpiredSessions(before time.Time) (int64, error) {
+	return rowsAffected(s.Dbmap.Exec("delete from sessions where expires_at<?", before))
+}
+
+// Close implements Store
+func (s *SqliteStore) Close() error {
+	return s.Dbmap.Db.Close()
+}
+
+// TraceOn logs all sql statements to logger
+func (s *SqliteStore) TraceOn(prefix string, logger gorp.GorpLogger) {
+	s.Dbmap.TraceOn(prefix, logger)
+}
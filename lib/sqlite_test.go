@@ -0,0 +1,222 @@
+package km
+
+import (
+	"database/sql"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func SqliteSetup(t *testing.T) (store *SqliteStore, cleanup func()) {
+	dir, err := ioutil.TempDir("", "km")
+	if err != nil {
+		t.Fatal(err)
+	}
+	store, err = NewSqliteStore(filepath.Join(dir, "km_test.db"))
+	if err != nil {
+		os.RemoveAll(dir)
+		t.Fatal(err)
+	}
+	if err = store.MigrateUp(); err != nil {
+		os.RemoveAll(dir)
+		t.Fatal(err)
+	}
+	return store, func() {
+		store.Close()
+		os.RemoveAll(dir)
+	}
+}
+
+func TestSqliteSaveAndState(t *testing.T) {
+	store, cleanup := SqliteSetup(t)
+	defer cleanup()
+
+	date := time.Date(2014, time.January, 1, 0, 0, 0, 0, time.UTC)
+	fields := []Field{Field{Name: "Begin", Km: 1234, Time: "08:00"}}
+	if err := SaveKilometers(store, date, fields); err != nil {
+		t.Fatalf("SaveKilometers returned: %s", err)
+	}
+	if err := SaveTimes(store, date, fields, amsterdam); err != nil {
+		t.Fatalf("SaveTimes returned: %s", err)
+	}
+	// a second save for the same date updates the saved row
+	fields = []Field{Field{Name: "Terug", Km: 1300, Time: "18:00"}}
+	if err := SaveKilometers(store, date, fields); err != nil {
+		t.Fatalf("SaveKilometers returned: %s", err)
+	}
+	if err := SaveTimes(store, date, fields, amsterdam); err != nil {
+		t.Fatalf("SaveTimes returned: %s", err)
+	}
+
+	err, state := GetState(store, date, amsterdam)
+	if err != nil {
+		t.Fatalf("GetState returned: %s", err)
+	}
+	if state.Fields[0].Km != 1234 || state.Fields[0].Time != "08:00" {
+		t.Errorf("unexpected Begin field: %+v", state.Fields[0])
+	}
+	if state.Fields[3].Km != 1300 || state.Fields[3].Time != "18:00" {
+		t.Errorf("unexpected Terug field: %+v", state.Fields[3])
+	}
+
+	kms, err := store.KilometersInMonth(2014, 1)
+	if err != nil {
+		t.Fatalf("KilometersInMonth returned: %s", err)
+	}
+	if len(kms) != 1 {
+		t.Fatalf("expected 1 row for january, got %d", len(kms))
+	}
+	if kms, _ = store.KilometersInMonth(2014, 2); len(kms) != 0 {
+		t.Errorf("expected no rows for february, got %d", len(kms))
+	}
+	rows, err := GetAllTimes(store, 2014, 1, amsterdam)
+	if err != nil {
+		t.Fatalf("GetAllTimes returned: %s", err)
+	}
+	if len(rows) != 1 || rows[0].Begin != "08:00" || rows[0].Laatste != "18:00" {
+		t.Errorf("unexpected time rows: %+v", rows)
+	}
+
+	// the next day starts from the last saved kilometers
+	err, state = GetState(store, date.AddDate(0, 0, 1), amsterdam)
+	if err != nil {
+		t.Fatalf("GetState returned: %s", err)
+	}
+	if state.LastDayKm != 1300 {
+		t.Errorf("LastDayKm = %d, want %d", state.LastDayKm, 1300)
+	}
+}
+
+func TestSqliteDelete(t *testing.T) {
+	store, cleanup := SqliteSetup(t)
+	defer cleanup()
+
+	date := time.Date(2014, time.January, 1, 0, 0, 0, 0, time.UTC)
+	fields := []Field{Field{Name: "Begin", Km: 1234, Time: "08:00"}}
+	if err := SaveKilometers(store, date, fields); err != nil {
+		t.Fatalf("SaveKilometers returned: %s", err)
+	}
+	if err := SaveTimes(store, date, fields, amsterdam); err != nil {
+		t.Fatalf("SaveTimes returned: %s", err)
+	}
+	if err := deleteAllForDate(store, date); err != nil {
+		t.Fatalf("deleteAllForDate returned: %s", err)
+	}
+	if _, err := store.GetKilometers(date); err != sql.ErrNoRows {
+		t.Errorf("expected no kilometers after delete, got: %v", err)
+	}
+	if _, err := store.GetTimes(date); err != sql.ErrNoRows {
+		t.Errorf("expected no times after delete, got: %v", err)
+	}
+}
+
+func TestSqliteOneRowPerDate(t *testing.T) {
+	store, cleanup := SqliteSetup(t)
+	defer cleanup()
+
+	date := time.Date(2014, time.January, 1, 0, 0, 0, 0, time.UTC)
+	first := Kilometers{Date: date, Begin: 1234}
+	second := Kilometers{Date: date, Begin: 1235}
+	if err := store.PutKilometers(&first); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.PutKilometers(&second); err != nil {
+		t.Fatal(err)
+	}
+	if first.ID != second.ID {
+		t.Errorf("saving the same date twice should update the same row, got ids %d and %d", first.ID, second.ID)
+	}
+	if kms, _ := store.KilometersInMonth(2014, 1); len(kms) != 1 || kms[0].Begin != 1235 {
+		t.Errorf("expected a single updated row, got: %+v", kms)
+	}
+}
+
+func TestSqlitePurgeDeleted(t *testing.T) {
+	store, cleanup := SqliteSetup(t)
+	defer cleanup()
+
+	date := time.Date(2014, time.January, 1, 0, 0, 0, 0, time.UTC)
+	if err := SaveKilometers(store, date, []Field{Field{Name: "Begin", Km: 1234}}); err != nil {
+		t.Fatalf("SaveKilometers returned: %s", err)
+	}
+	if err := deleteAllForDate(store, date); err != nil {
+		t.Fatalf("deleteAllForDate returned: %s", err)
+	}
+	// a time in another zone than UTC is the same moment, the day was deleted after it
+	before := time.Now().In(time.FixedZone("", 10*3600)).Add(-time.Minute)
+	if purged, err := store.PurgeDeleted(before); err != nil || purged != 0 {
+		t.Errorf("expected nothing purged before the delete, got %d, %v", purged, err)
+	}
+	if purged, err := store.PurgeDeleted(time.Now().Add(time.Minute)); err != nil || purged != 1 {
+		t.Errorf("expected the deleted day purged, got %d, %v", purged, err)
+	}
+}
+
+func TestSqliteClaimRows(t *testing.T) {
+	store, cleanup := SqliteSetup(t)
+	defer cleanup()
+
+	date := time.Date(2014, time.January, 1, 0, 0, 0, 0, time.UTC)
+	if err := SaveKilometers(store, date, []Field{Field{Name: "Begin", Km: 1234}}); err != nil {
+		t.Fatalf("SaveKilometers returned: %s", err)
+	}
+	alice, err := CreateUser(store, "alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = SaveKilometers(store.ForUser(alice.ID), date.AddDate(0, 0, 1), []Field{Field{Name: "Begin", Km: 1300}}); err != nil {
+		t.Fatalf("SaveKilometers returned: %s", err)
+	}
+	if claimed, err := store.ClaimRows(alice.ID); err == nil {
+		t.Errorf("claimed %d rows for a user with rows saved already", claimed)
+	}
+	if _, err = store.GetKilometers(date); err != nil {
+		t.Errorf("the day saved before there were users is not left to no one: %v", err)
+	}
+}
+
+func TestSqliteArchiver(t *testing.T) {
+	store, cleanup := SqliteSetup(t)
+	defer cleanup()
+	want, _ := backupStore(t).Dump()
+	end := time.Date(2014, time.June, 30, 0, 0, 0, 0, time.UTC)
+	want.Vehicles = []Vehicle{Vehicle{ID: 100, LicensePlate: "12-AB-34", StartDate: end.AddDate(-1, 0, 0), EndDate: &end, StartKm: 10, Active: true}}
+	want.Kilometers[0].VehicleID = 100
+	want.Users = []User{User{ID: 7, Name: "alice", Created: end}}
+	want.Kilometers[0].UserID, want.Vehicles[0].UserID = 7, 7
+	if err := store.Load(want); err != nil {
+		t.Fatal(err)
+	}
+	got, err := store.Dump()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(got.Kilometers) != len(want.Kilometers) || len(got.Times) != len(want.Times) || len(got.Trips) != len(want.Trips) || len(got.Audit) != len(want.Audit) {
+		t.Fatalf("got %+v, want %+v", got, want)
+	}
+	for i, k := range got.Kilometers {
+		w := want.Kilometers[i]
+		if k.ID != w.ID || !k.Date.Equal(w.Date) || k.Begin != w.Begin || k.Terug != w.Terug || (k.DeletedAt == nil) != (w.DeletedAt == nil) || k.VehicleID != w.VehicleID || k.UserID != w.UserID {
+			t.Errorf("kilometers %d: got %+v, want %+v", i, k, w)
+		}
+	}
+	if got.Trips[0].ID != want.Trips[0].ID || got.Trips[0].To != want.Trips[0].To {
+		t.Errorf("trip: got %+v, want %+v", got.Trips[0], want.Trips[0])
+	}
+	if v := got.Vehicles; len(v) != 1 || v[0].ID != 100 || v[0].EndDate == nil || !v[0].EndDate.Equal(end) || !v[0].Active {
+		t.Errorf("vehicles: got %+v, want %+v", v, want.Vehicles)
+	}
+	if u := got.Users; len(u) != 1 || u[0].ID != 7 || u[0].Name != "alice" || !u[0].Created.Equal(end) || got.Vehicles[0].UserID != 7 {
+		t.Errorf("users: got %+v, want %+v", u, want.Users)
+	}
+	for i, e := range got.Audit {
+		if e.ID != want.Audit[i].ID || e.Hash != want.Audit[i].Hash || e.chainHash() != e.Hash {
+			t.Errorf("audit entry %d does not survive: got %+v", i, e)
+		}
+	}
+	if err := store.Load(want); err == nil {
+		t.Error("rows with the same ids are loaded twice")
+	}
+}
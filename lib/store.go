@@ -0,0 +1,166 @@
+package km
+
+import (
+	"database/sql"
+	"fmt"
+	"time"
+)
+
+// Executor reads and writes the kilometers and times saved by a user, every method only
+// sees the rows of the user the store is scoped to. There is at most one row of each per
+// date. Methods looking up a single row return sql.ErrNoRows when there is nothing saved.
+// Executor is implemented by both a Store and a transaction on it.
+type Executor interface {
+	// GetKilometers returns the kilometers saved for date
+	GetKilometers(date time.Time) (Kilometers, error)
+	// GetTimes returns the times saved for date
+	GetTimes(date time.Time) (Times, error)
+	// LastKilometers returns the kilometers of the most recent date saved for the vehicle with vehicleID
+	LastKilometers(vehicleID int64) (Kilometers, error)
+	// PreviousKilometers returns the kilometers of the most recent date saved before date for
+	// the vehicle with vehicleID
+	PreviousKilometers(vehicleID int64, date time.Time) (Kilometers, error)
+	// NextKilometers returns the kilometers of the first date saved after date for the
+	// vehicle with vehicleID
+	NextKilometers(vehicleID int64, date time.Time) (Kilometers, error)
+	// LastTimes returns the times of the n most recent dates saved, most recent first
+	LastTimes(n int) ([]Times, error)
+	// PutKilometers inserts k, or updates the row already saved for its date
+	PutKilometers(k *Kilometers) error
+	// PutTimes inserts t, or updates the row already saved for its date
+	PutTimes(t *Times) error
+	// KilometersInMonth returns all kilometers saved in a month, most recent first
+	KilometersInMonth(year, month int64) ([]Kilometers, error)
+	// TimesInMonth returns all times saved in a month, most recent first
+	TimesInMonth(year, month int64) ([]Times, error)
+	// KilometersBetween returns all kilometers saved from one date up to and including another, most recent first
+	KilometersBetween(from, to time.Time) ([]Kilometers, error)
+	// TimesBetween returns all times saved from one date up to and including another, most recent first
+	TimesBetween(from, to time.Time) ([]Times, error)
+	// TripsForDate returns the trips of date, in the order of their odometer readings
+	TripsForDate(date time.Time) ([]Trip, error)
+	// TripsBetween returns all trips from one date up to and including another, by date
+	// and odometer reading
+	TripsBetween(from, to time.Time) ([]Trip, error)
+	// GetTrip returns the trip with id
+	GetTrip(id int64) (Trip, error)
+	// PutTrip inserts t when it has no id yet, and updates it otherwise, it returns
+	// sql.ErrNoRows when there is no trip with its id
+	PutTrip(t *Trip) error
+	// DeleteTrip permanently deletes the trip with id, it returns sql.ErrNoRows when
+	// there is none
+	DeleteTrip(id int64) error
+	// DeleteDate moves the kilometers, times and trips saved for date to the trash, the other
+	// methods ignore what is in the trash
+	DeleteDate(date time.Time) error
+	// DeletedKilometers returns all kilometers in the trash, most recent date first
+	DeletedKilometers() ([]Kilometers, error)
+	// DeletedTimes returns all times in the trash, most recent date first
+	DeletedTimes() ([]Times, error)
+	// RestoreDate takes the kilometers, times and trips of date out of the trash, it returns
+	// sql.ErrNoRows when there is nothing in the trash for date
+	RestoreDate(date time.Time) error
+	// PurgeDeleted permanently deletes everything moved to the trash before a time,
+	// it returns the number of rows deleted
+	PurgeDeleted(before time.Time) (int64, error)
+	// Vehicles returns all vehicles, by start date
+	Vehicles() ([]Vehicle, error)
+	// GetVehicle returns the vehicle with id
+	GetVehicle(id int64) (Vehicle, error)
+	// PutVehicle inserts v when it has no id yet, and updates it otherwise, it returns
+	// sql.ErrNoRows when there is no vehicle with its id
+	PutVehicle(v *Vehicle) error
+	// ActivateVehicle makes the vehicle with id the only active one, it returns
+	// sql.ErrNoRows when there is none
+	ActivateVehicle(id int64) error
+	// PutAudit adds e to the audit log
+	PutAudit(e *AuditEntry) error
+	// LastAudit returns the most recent entry of the audit log
+	LastAudit() (AuditEntry, error)
+	// AuditForDate returns the audit log of date, oldest first
+	AuditForDate(date time.Time) ([]AuditEntry, error)
+	// AuditLog returns the whole audit log, oldest first
+	AuditLog() ([]AuditEntry, error)
+}
+
+// Store is the interface to the storage backend
+type Store interface {
+	Executor
+	Accounts
+	// ForUser returns the store scoped to the rows of the user with id, 0 for the rows that
+	// belong to no one. A new store is scoped to no one.
+	ForUser(id int64) Store
+	// Begin starts a transaction, nothing done through it is saved before it is committed
+	Begin() (Tx, error)
+	// Close releases the resources held by the store
+	Close() error
+}
+
+// Tx is a transaction on a Store
+type Tx interface {
+	Executor
+	Commit() error
+	Rollback() error
+}
+
+// inTx runs f in a transaction on store, which is committed when f returns
+// nil and rolled back otherwise
+func inTx(store Store, f func(tx Tx) error) error {
+	tx, err := store.Begin()
+	if err != nil {
+		return CustomResponse(DbError, err)
+	}
+	if err = f(tx); err != nil {
+		tx.Rollback()
+		return err
+	}
+	if err = tx.Commit(); err != nil {
+		return CustomResponse(DbError, err)
+	}
+	return nil
+}
+
+// OpenStore opens the store selected in config, postgres when nothing is selected
+func OpenStore(dbName string, config Config) (Store, error) {
+	switch config.Store {
+	case "memory":
+		return NewMemoryStore(), nil
+	case "", "postgres":
+		return NewPostgresStore(dbName, config.Db)
+	case "sqlite":
+		path := config.Db
+		if path == "" {
+			path = dbName + ".db"
+		}
+		return NewSqliteStore(path)
+	}
+	return nil, fmt.Errorf("unknown store: %s", config.Store)
+}
+
+// affectedOne returns sql.ErrNoRows when the statement with result did not change any row
+func affectedOne(result sql.Result, err error) error {
+	if err != nil {
+		return err
+	}
+	n, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return sql.ErrNoRows
+	}
+	return nil
+}
+
+// rowsAffected returns the number of rows the statement with result changed
+func rowsAffected(result sql.Result, err error) (int64, error) {
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected()
+}
+
+// truncateDate strips the time of day from a date, so dates can be compared as is
+func truncateDate(date time.Time) time.Time {
+	return time.Date(date.Year(), date.Month(), date.Day(), 0, 0, 0, 0, time.UTC)
+}
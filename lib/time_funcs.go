@@ -2,11 +2,27 @@ package km
 
 import "time"
 
+const (
+	// DateLayout is the format of dates in urls
+	DateLayout = "2006-01-02"
+	// legacyDateLayout is the format of dates in urls before DateLayout, it is still accepted
+	legacyDateLayout = "02012006"
+)
+
 // ParseURLDate parse a datestring used in the url to a time.Time object
+// both DateLayout and the legacy format are accepted
 func ParseURLDate(dateStr string) (err error, date time.Time) {
-	date, err = time.Parse("02012006", dateStr)
+	date, err = time.Parse(DateLayout, dateStr)
 	if err != nil {
-		return CustomResponse(InvalidDate, err), time.Time{}
+		var legacyErr error
+		if date, legacyErr = time.Parse(legacyDateLayout, dateStr); legacyErr != nil {
+			return CustomResponse(InvalidDate, err), time.Time{}
+		}
 	}
 	return nil, date
 }
+
+// FormatURLDate formats a date to be used in a url
+func FormatURLDate(date time.Time) string {
+	return date.Format(DateLayout)
+}
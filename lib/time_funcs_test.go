@@ -0,0 +1,27 @@
+package km
+
+import (
+	"testing"
+	"time"
+)
+
+func TestParseURLDate(t *testing.T) {
+	want := time.Date(2014, time.January, 2, 0, 0, 0, 0, time.UTC)
+	for _, dateStr := range []string{"2014-01-02", "02012014"} {
+		err, date := ParseURLDate(dateStr)
+		if err != nil {
+			t.Errorf("ParseURLDate(%q) returned: %s", dateStr, err)
+		}
+		if !date.Equal(want) {
+			t.Errorf("ParseURLDate(%q) = %s, want %s", dateStr, date, want)
+		}
+	}
+	for _, dateStr := range []string{"", "2014-1-2", "2014-13-01", "20140102", "1", "today"} {
+		if err, _ := ParseURLDate(dateStr); err == nil {
+			t.Errorf("ParseURLDate(%q) should fail", dateStr)
+		}
+	}
+	if s := FormatURLDate(want); s != "2014-01-02" {
+		t.Errorf("FormatURLDate = %q, want %q", s, "2014-01-02")
+	}
+}
@@ -1,11 +1,10 @@
 package km
 
 import (
-	"fmt"
+	"database/sql"
 	"log"
+	"strings"
 	"time"
-
-	"github.com/coopernurse/gorp"
 )
 
 // Times represents a db row in the times table
@@ -13,6 +12,10 @@ type Times struct {
 	ID                                int64 `db:"Id"`
 	Date                              time.Time
 	Begin, CheckIn, CheckOut, Laatste int64
+	// DeletedAt is set when the day is in the trash
+	DeletedAt *time.Time `db:"deleted_at" json:"-"`
+	// UserID is the user the day belongs to
+	UserID int64 `db:"user_id" json:"-"`
 }
 
 // TimeRow is a Times row converted to the format displayed in the frontend
@@ -33,98 +36,149 @@ func NewTimeRow() TimeRow {
 	return t
 }
 
+// timeFields are the names of the posted fields that hold a time, in the order of a day
+var timeFields = []string{"Begin", "Eerste", "Laatste", "Terug"}
+
+// field returns a pointer to the time of the field with the given name
+func (t *Times) field(name string) *int64 {
+	switch name {
+	case "Begin":
+		return &t.Begin
+	case "Eerste":
+		return &t.CheckIn
+	case "Laatste":
+		return &t.CheckOut
+	case "Terug":
+		return &t.Laatste
+	}
+	return nil
+}
+
 // UpdateObject updates the times struct with posted data coming from the user
 // this struct can used to update the current state in the db
-func (t *Times) UpdateObject(date string, fields []Field) error {
-	loc, _ := time.LoadLocation("Europe/Amsterdam") // should not be hardcoded but idgaf
+// the posted times are in the time zone loc, on the given date unless they are before the time of
+// an earlier field of that day (a night shift), or end with "+1", then they are on the next day
+// a time of "-" clears the field
+func (t *Times) UpdateObject(date time.Time, fields []Field, loc *time.Location) error {
+	posted := make(map[string]string)
 	for _, field := range fields {
-		if field.Time == "" {
-			continue
+		if field.Time != "" {
+			posted[field.Name] = field.Time
 		}
-		fieldLocalTime, err := time.ParseInLocation("1-2-2006 15:04", fmt.Sprintf("%s %s", date, field.Time), loc)
-		if err != nil {
-			return CustomResponse(NotParsable, err)
+	}
+	var last int64
+	for _, name := range timeFields {
+		fieldTime := t.field(name)
+		clock, ok := posted[name]
+		switch {
+		case !ok:
+		case clock == "-":
+			*fieldTime = 0
+		default:
+			parsed, err := parseClockTime(date, clock, loc, last)
+			if err != nil {
+				return CustomResponse(NotParsable, err)
+			}
+			*fieldTime = parsed
 		}
-		fieldTime := fieldLocalTime.UTC().Unix()
-		switch field.Name {
-		case "Begin":
-			t.Begin = fieldTime
-		case "Eerste":
-			t.CheckIn = fieldTime
-		case "Laatste":
-			t.CheckOut = fieldTime
-		case "Terug":
-			t.Laatste = fieldTime
+		if *fieldTime > last {
+			last = *fieldTime
 		}
 	}
 	return nil
 }
 
-// SaveTimes saves a given fields array to the db backend
-func SaveTimes(dbmap *gorp.DbMap, date time.Time, fields []Field) (err error) {
-	dateStr := fmt.Sprintf("%d-%d-%d", date.Month(), date.Day(), date.Year())
-	times := new(Times)
-	err = dbmap.SelectOne(times, "select * from times where date=$1", dateStr)
-	//if err != nil && err.Error() == "sql: no rows in result set" {
-	if err == nil {
-		log.Printf("times object to update VOOR invoegen van de op te slaan velden: %+v\n", times)
-		err = times.UpdateObject(dateStr, fields)
-		if err != nil {
-			return CustomResponse(DbError, err)
-		}
-		log.Printf("times object to update NA invoegen van de op te slaan velden: %+v\n", times)
-		var count int64
-		count, err = dbmap.Update(times)
-		if err != nil {
-			return CustomResponse(DbError, err)
-		}
-		if count != 1 {
-			return CustomResponse(DbError, fmt.Errorf("update did not return a count of 1, instead: %d", count))
-		}
-	} else {
-		if err.Error() != "sql: no rows in result set" {
-			return CustomResponse(DbError, err)
+// parseClockTime converts a time of day (15:04) on date in the time zone loc to a unix time
+// a time before after is taken to be on the next day, as is a time ending with "+1"
+func parseClockTime(date time.Time, clock string, loc *time.Location, after int64) (int64, error) {
+	nextDay := strings.HasSuffix(clock, "+1")
+	parsed, err := time.Parse("15:04", strings.TrimSuffix(clock, "+1"))
+	if err != nil {
+		return 0, err
+	}
+	onDay := func(days int) time.Time {
+		return time.Date(date.Year(), date.Month(), date.Day()+days, parsed.Hour(), parsed.Minute(), 0, 0, loc)
+	}
+	if nextDay {
+		return onDay(1).Unix(), nil
+	}
+	// the hour the clock is set back happens twice, take the first one that is not before after
+	local := onDay(0)
+	for _, candidate := range []time.Time{local.Add(-time.Hour), local, local.Add(time.Hour)} {
+		if candidate.Format("15:04") == local.Format("15:04") && candidate.Day() == local.Day() && candidate.Unix() >= after {
+			return candidate.Unix(), nil
 		}
-		times := new(Times)
-		times.Date = date
-		times.UpdateObject(dateStr, fields)
-		times.ID = -1
-		log.Printf("object to be insterted: %+v\n", times)
-		err = dbmap.Insert(times)
+	}
+	return onDay(1).Unix(), nil
+}
+
+// clockTime formats a unix time as the time of day in the time zone loc, with "+1"
+// appended when it is on the day after date
+func clockTime(t int64, date time.Time, loc *time.Location) string {
+	local := time.Unix(t, 0).In(loc)
+	if local.Format("2006-01-02") > date.Format("2006-01-02") {
+		return local.Format("15:04") + "+1"
+	}
+	return local.Format("15:04")
+}
+
+// SaveTimes saves a given fields array to the db backend
+func SaveTimes(ex Executor, date time.Time, fields []Field, loc *time.Location) (err error) {
+	times, err := ex.GetTimes(date)
+	switch {
+	case err == sql.ErrNoRows:
+		times = Times{Date: date}
+	case err != nil:
+		return CustomResponse(DbError, err)
+	}
+	log.Printf("times object to update VOOR invoegen van de op te slaan velden: %+v\n", times)
+	err = times.UpdateObject(date, fields, loc)
+	if err != nil {
+		return err
+	}
+	log.Printf("times object to update NA invoegen van de op te slaan velden: %+v\n", times)
+	err = ex.PutTimes(&times)
+	if err != nil {
+		return CustomResponse(DbError, err)
 	}
 	return nil
 }
 
+// hours returns the hours worked, between checking in and checking out
+func (t Times) hours() float64 {
+	// unix times are absolute, so this is right on days the clock changes as well
+	if hours := (time.Duration(t.CheckOut-t.CheckIn) * time.Second).Hours(); hours > 0 && hours < 24 {
+		return hours
+	}
+	return 0
+}
+
 // GetAllTimes pulls all rows for a given month from the db and converts it all to TimeRow for
-// displaying in the frontend
-func GetAllTimes(dbmap *gorp.DbMap, year, month int64) (rows []TimeRow, err error) {
-	var all []Times
+// displaying in the frontend, in the time zone loc
+func GetAllTimes(store Store, year, month int64, loc *time.Location) (rows []TimeRow, err error) {
 	rows = make([]TimeRow, 0)
-	_, err = dbmap.Select(&all, "select * from times where extract (year from date)=$1 and extract (month from date)=$2 order by date desc ", year, month)
+	all, err := store.TimesInMonth(year, month)
 	if err != nil {
 		return rows, err
 	}
-	loc, _ := time.LoadLocation("Europe/Amsterdam") // should not be hardcoded but idgaf
 	for _, c := range all {
 		row := NewTimeRow()
 		row.ID = c.ID
 		row.Date = c.Date
 		if c.Begin != 0 {
-			row.Begin = time.Unix(c.Begin, 0).In(loc).Format("15:04")
+			row.Begin = clockTime(c.Begin, c.Date, loc)
 		}
 		if c.CheckIn != 0 {
-			row.CheckIn = time.Unix(c.CheckIn, 0).In(loc).Format("15:04")
+			row.CheckIn = clockTime(c.CheckIn, c.Date, loc)
 		}
 		if c.CheckOut != 0 {
-			row.CheckOut = time.Unix(c.CheckOut, 0).In(loc).Format("15:04")
+			row.CheckOut = clockTime(c.CheckOut, c.Date, loc)
 		}
 		if c.Laatste != 0 {
-			row.Laatste = time.Unix(c.Laatste, 0).In(loc).Format("15:04")
+			row.Laatste = clockTime(c.Laatste, c.Date, loc)
 
 		}
-		if hours := (time.Duration(c.CheckOut-c.CheckIn) * time.Second).Hours(); hours > 0 && hours < 24 {
-			row.Hours = hours
-		}
+		row.Hours = c.hours()
 		rows = append(rows, row)
 	}
 	return rows, nil
@@ -21,9 +21,8 @@ func TestStructUpdate(t *testing.T) {
 	fields := []Field{Field{Km: 123456, Time: "13:00", Name: "Begin"}, Field{}}
 	cmpDate := int64(1257854400) // 10-11-2009 13:00 uur (in unix formaat)
 
-	dateStr := fmt.Sprintf("%d-%d-%d", testDate.Month(), testDate.Day(), testDate.Year())
 	ti := Times{}
-	err := ti.UpdateObject(dateStr, fields)
+	err := ti.UpdateObject(testDate, fields, amsterdam)
 	if err != nil {
 		t.Error(err)
 	}
@@ -38,7 +37,7 @@ func TestStructUpdate(t *testing.T) {
 
 	ti = Times{}
 	fields = []Field{Field{Km: 123456, Time: "jemoeder", Name: "Begin"}}
-	if ti.UpdateObject(dateStr, fields) == nil {
+	if ti.UpdateObject(testDate, fields, amsterdam) == nil {
 		t.Fatal("updateObjects should fail on invalid time field")
 	}
 
@@ -48,7 +47,7 @@ func TestStructUpdate(t *testing.T) {
 		Field{Km: 123456, Time: "13:00", Name: "Terug"},
 	}
 	ti = Times{}
-	if ti.UpdateObject(dateStr, fields) != nil {
+	if ti.UpdateObject(testDate, fields, amsterdam) != nil {
 		t.Error("Error updating times struct ", err)
 	}
 	if ti.Begin != cmpDate || ti.CheckIn != cmpDate || ti.CheckOut != cmpDate || ti.Laatste != cmpDate {
@@ -56,6 +55,100 @@ func TestStructUpdate(t *testing.T) {
 	}
 }
 
+func TestNightShift(t *testing.T) {
+	date := time.Date(2014, time.January, 1, 0, 0, 0, 0, time.UTC)
+	at := func(day, hour, min int) int64 {
+		return time.Date(2014, time.January, day, hour, min, 0, 0, amsterdam).Unix()
+	}
+
+	ti := Times{}
+	fields := []Field{
+		Field{Time: "21:30", Name: "Begin"},
+		Field{Time: "22:00", Name: "Eerste"},
+		Field{Time: "06:00", Name: "Laatste"},
+		Field{Time: "06:30", Name: "Terug"},
+	}
+	if err := ti.UpdateObject(date, fields, amsterdam); err != nil {
+		t.Fatal(err)
+	}
+	want := Times{Begin: at(1, 21, 30), CheckIn: at(1, 22, 0), CheckOut: at(2, 6, 0), Laatste: at(2, 6, 30)}
+	if ti != want {
+		t.Errorf("expected times after midnight to be on the next day, got: %+v, want: %+v", ti, want)
+	}
+
+	// saved one by one, times are compared to the ones saved before
+	ti = Times{}
+	for _, f := range fields {
+		if err := ti.UpdateObject(date, []Field{f}, amsterdam); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if ti != want {
+		t.Errorf("saving fields one by one: got: %+v, want: %+v", ti, want)
+	}
+
+	// a time can be marked explicitly to be on the next day
+	ti = Times{}
+	if err := ti.UpdateObject(date, []Field{Field{Time: "00:30+1", Name: "Terug"}}, amsterdam); err != nil {
+		t.Fatal(err)
+	}
+	if ti.Laatste != at(2, 0, 30) {
+		t.Errorf("00:30+1 should be on the next day, got: %d, want: %d", ti.Laatste, at(2, 0, 30))
+	}
+	if s := clockTime(ti.Laatste, date, amsterdam); s != "00:30+1" {
+		t.Errorf("clockTime = %q, want %q", s, "00:30+1")
+	}
+
+	store := NewMemoryStore()
+	if err := store.PutTimes(&Times{Date: date, CheckIn: at(1, 22, 0), CheckOut: at(2, 6, 0)}); err != nil {
+		t.Fatal(err)
+	}
+	rows, err := GetAllTimes(store, 2014, 1, amsterdam)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rows[0].Hours != 8 || rows[0].CheckIn != "22:00" || rows[0].CheckOut != "06:00+1" {
+		t.Errorf("unexpected row for a night shift: %+v", rows[0])
+	}
+}
+
+func TestDST(t *testing.T) {
+	fields := []Field{Field{Time: "01:00", Name: "Eerste"}, Field{Time: "04:00", Name: "Laatste"}}
+	for _, tc := range []struct {
+		date  time.Time
+		hours float64
+	}{
+		// the clock is set forward from 02:00 to 03:00
+		{time.Date(2014, time.March, 30, 0, 0, 0, 0, time.UTC), 2},
+		// the clock is set back from 03:00 to 02:00
+		{time.Date(2014, time.October, 26, 0, 0, 0, 0, time.UTC), 4},
+		{time.Date(2014, time.October, 27, 0, 0, 0, 0, time.UTC), 3},
+	} {
+		store := NewMemoryStore()
+		if err := SaveTimes(store, tc.date, fields, amsterdam); err != nil {
+			t.Fatal(err)
+		}
+		rows, err := GetAllTimes(store, int64(tc.date.Year()), int64(tc.date.Month()), amsterdam)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if rows[0].Hours != tc.hours || rows[0].CheckIn != "01:00" || rows[0].CheckOut != "04:00" {
+			t.Errorf("%s: got %+v, want %v hours", tc.date.Format("2006-01-02"), rows[0], tc.hours)
+		}
+	}
+
+	// 02:30 happens twice when the clock is set back, the second one is after 02:45
+	date := time.Date(2014, time.October, 26, 0, 0, 0, 0, time.UTC)
+	ti := Times{}
+	fields = []Field{Field{Time: "02:45", Name: "Eerste"}, Field{Time: "02:30", Name: "Laatste"}}
+	if err := ti.UpdateObject(date, fields, amsterdam); err != nil {
+		t.Fatal(err)
+	}
+	if d := time.Duration(ti.CheckOut-ti.CheckIn) * time.Second; d != 45*time.Minute {
+		t.Errorf("expected 45 minutes between 02:45 and the repeated 02:30, got %s", d)
+	}
+}
+
 func TestTimeInsert(t *testing.T) {
 	err, dbmap, columns := MockSetup("times")
 	if err != nil {
@@ -63,17 +156,18 @@ func TestTimeInsert(t *testing.T) {
 	}
 	date := time.Date(2014, time.January, 1, 0, 0, 0, 0, time.UTC)
 
-	sqlmock.ExpectQuery("select \\* from times where date=(.+)").
-		WithArgs("1-1-2014").
+	sqlmock.ExpectQuery("select \\* from times where user_id=(.+) and date=(.+)").
+		WithArgs(0, date).
 		WillReturnRows(sqlmock.NewRows(columns).FromCSVString(""))
 
 	// INSERT is Query aparently, not Exec as my long struggle to get this working discovered
-	sqlmock.ExpectQuery("insert into \"times\"(.+)").
-		WithArgs(date, 1388577600, 0, 0, 0). //autoincrement field (id in this case) not given to WithArgs
+	// (the upsert returns the id, so it is a query anyway)
+	sqlmock.ExpectQuery("insert into times (.+) on conflict (.+)").
+		WithArgs(date, 1388577600, 0, 0, 0, 0). //autoincrement field (id in this case) not given to WithArgs
 		WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow(1))
 
 	fields := []Field{Field{Time: "13:00", Name: "Begin"}}
-	err = SaveTimes(dbmap, date, fields)
+	err = SaveTimes(newPostgresStore(dbmap), date, fields, amsterdam)
 	if err != nil {
 		t.Errorf("SaveTimes returned: %s", err)
 	}
@@ -83,20 +177,20 @@ func TestTimeInsert(t *testing.T) {
 }
 
 func TestTimeUpdate(t *testing.T) {
-	// succesful update
+	// succesful update of an existing row
 	err, dbmap, columns := MockSetup("times")
 	if err != nil {
 		t.Error(err)
 	}
 	date := time.Date(2014, time.January, 1, 0, 0, 0, 0, time.UTC)
-	sqlmock.ExpectQuery("select \\* from times where date=(.+)").
-		WithArgs("1-1-2014").
-		WillReturnRows(sqlmock.NewRows(columns).AddRow(1, date, 1388577600, 0, 0, 0))
-	sqlmock.ExpectExec("update \"times\" set \"date\"=(.+)").
-		WithArgs(date, 1388577600, 1388577720, 0, 0, 1).
-		WillReturnResult(sqlmock.NewResult(1, 1))
+	sqlmock.ExpectQuery("select \\* from times where user_id=(.+) and date=(.+)").
+		WithArgs(0, date).
+		WillReturnRows(sqlmock.NewRows(columns).AddRow(1, date, 1388577600, 0, 0, 0, nil, 0))
+	sqlmock.ExpectQuery("insert into times (.+) on conflict (.+)").
+		WithArgs(date, 1388577600, 1388577720, 0, 0, 0).
+		WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow(1))
 	fields := []Field{Field{Time: "13:02", Name: "Eerste"}}
-	err = SaveTimes(dbmap, date, fields)
+	err = SaveTimes(newPostgresStore(dbmap), date, fields, amsterdam)
 	if err != nil {
 		t.Errorf("SaveTimes returned: %s", err)
 	}
@@ -109,10 +203,10 @@ func TestTimeUpdate(t *testing.T) {
 	if err != nil {
 		t.Error(err)
 	}
-	sqlmock.ExpectQuery("select \\* from times where date=(.+)").
-		WithArgs("1-1-2014").
+	sqlmock.ExpectQuery("select \\* from times where user_id=(.+) and date=(.+)").
+		WithArgs(0, date).
 		WillReturnError(fmt.Errorf("failed select *"))
-	err = SaveTimes(dbmap, date, fields)
+	err = SaveTimes(newPostgresStore(dbmap), date, fields, amsterdam)
 	if err == nil {
 		t.Errorf("SaveTimes returned: %s", err)
 	}
@@ -125,13 +219,13 @@ func TestTimeUpdate(t *testing.T) {
 	if err != nil {
 		t.Error(err)
 	}
-	sqlmock.ExpectQuery("select \\* from times where date=(.+)").
-		WithArgs("1-1-2014").
-		WillReturnRows(sqlmock.NewRows(columns).AddRow(1, date, 1388577600, 0, 0, 0))
-	sqlmock.ExpectExec("update \"times\" set \"date\"=(.+)").
-		WithArgs(date, 1388577600, 1388577720, 0, 0, 1).
+	sqlmock.ExpectQuery("select \\* from times where user_id=(.+) and date=(.+)").
+		WithArgs(0, date).
+		WillReturnRows(sqlmock.NewRows(columns).AddRow(1, date, 1388577600, 0, 0, 0, nil, 0))
+	sqlmock.ExpectQuery("insert into times (.+) on conflict (.+)").
+		WithArgs(date, 1388577600, 1388577720, 0, 0, 0).
 		WillReturnError(fmt.Errorf("update failed"))
-	err = SaveTimes(dbmap, date, fields)
+	err = SaveTimes(newPostgresStore(dbmap), date, fields, amsterdam)
 	if err == nil {
 		t.Errorf("SaveTimes returned: %s", err)
 	}
@@ -139,18 +233,18 @@ func TestTimeUpdate(t *testing.T) {
 		t.Errorf("Error '%s' was not expected while closing the database", err)
 	}
 
-	//update returns 0 affected rows
+	//upsert does not return an id
 	err, dbmap, columns = MockSetup("times")
 	if err != nil {
 		t.Error(err)
 	}
-	sqlmock.ExpectQuery("select \\* from times where date=(.+)").
-		WithArgs("1-1-2014").
-		WillReturnRows(sqlmock.NewRows(columns).AddRow(1, date, 1388577600, 0, 0, 0))
-	sqlmock.ExpectExec("update \"times\" set \"date\"=(.+)").
-		WithArgs(date, 1388577600, 1388577720, 0, 0, 1).
-		WillReturnResult(sqlmock.NewResult(0, 0))
-	err = SaveTimes(dbmap, date, fields)
+	sqlmock.ExpectQuery("select \\* from times where user_id=(.+) and date=(.+)").
+		WithArgs(0, date).
+		WillReturnRows(sqlmock.NewRows(columns).AddRow(1, date, 1388577600, 0, 0, 0, nil, 0))
+	sqlmock.ExpectQuery("insert into times (.+) on conflict (.+)").
+		WithArgs(date, 1388577600, 1388577720, 0, 0, 0).
+		WillReturnRows(sqlmock.NewRows([]string{"id"}))
+	err = SaveTimes(newPostgresStore(dbmap), date, fields, amsterdam)
 	if err == nil {
 		t.Errorf("SaveTimes returned: %s", err)
 	}
@@ -166,17 +260,17 @@ func TestGetAllTimes(t *testing.T) {
 	}
 	var year, month int64 = 2014, 1
 	date1 := time.Date(2014, time.January, 1, 0, 0, 0, 0, time.UTC)
-	sqlmock.ExpectQuery("select \\* from times where (.+)").
-		WithArgs(year, month).
-		WillReturnRows(sqlmock.NewRows(columns).AddRow(1, date1, 1388577600, 1388577600, 1388578800, 1388578860))
-	rows, err := GetAllTimes(dbmap, year, month)
+	sqlmock.ExpectQuery("select \\* from times where user_id=(.+) and (.+)").
+		WithArgs(0, year, month).
+		WillReturnRows(sqlmock.NewRows(columns).AddRow(1, date1, 1388577600, 1388577600, 1388578800, 1388578860, nil, 0))
+	rows, err := GetAllTimes(newPostgresStore(dbmap), year, month, amsterdam)
 	if err != nil {
 		t.Errorf("GetAllTimes returned: %s", err)
 	}
 	if len(rows) != 1 {
 		t.Errorf("GetAlltimes returned unexpected number of rows")
 	}
-	rowExpected := TimeRow{ID: 1, Date: date1, Begin: "13:00", CheckIn: "13:00", CheckOut: "13:20", Laatste: "13:21", Hours: 0.33333333333333337}
+	rowExpected := TimeRow{ID: 1, Date: date1, Begin: "13:00", CheckIn: "13:00", CheckOut: "13:20", Laatste: "13:21", Hours: 20.0 / 60}
 	if rows[0] != rowExpected {
 		t.Errorf("row expected: %+v, got: %+v", rowExpected, rows[0])
 	}
@@ -190,11 +284,11 @@ func TestGetAllTimes(t *testing.T) {
 		t.Errorf("setting up mock db: %s", err)
 	}
 
-	sqlmock.ExpectQuery("select \\* from times where (.+)").
-		WithArgs(year, month).
+	sqlmock.ExpectQuery("select \\* from times where user_id=(.+) and (.+)").
+		WithArgs(0, year, month).
 		WillReturnError(fmt.Errorf("FAIL"))
 
-	rows, err = GetAllTimes(dbmap, year, month)
+	rows, err = GetAllTimes(newPostgresStore(dbmap), year, month, amsterdam)
 	if err == nil {
 		t.Error("GetAllTimes should return error when select * from times fails")
 	}
@@ -0,0 +1,291 @@
+package km
+
+import (
+	"database/sql"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Trip is one trip of a day in the trip register (ritregistratie)
+type Trip struct {
+	ID      int64     `db:"id" json:"id"`
+	Date    time.Time `db:"date" json:"date"`
+	StartKm int       `db:"start_km" json:"startKm"`
+	EndKm   int       `db:"end_km" json:"endKm"`
+	From    string    `db:"from_address" json:"from"`
+	To      string    `db:"to_address" json:"to"`
+	Purpose string    `db:"purpose" json:"purpose"`
+	// Type is one of TripTypes
+	Type string `db:"type" json:"type"`
+	// DeletedAt is set when the day of the trip is in the trash
+	DeletedAt *time.Time `db:"deleted_at" json:"-"`
+	// UserID is the user the trip belongs to
+	UserID int64 `db:"user_id" json:"-"`
+}
+
+// the types of trips, commute is between home and work
+const (
+	TripBusiness = "business"
+	TripCommute  = "commute"
+	TripPrivate  = "private"
+)
+
+// TripTypes are the types a trip can have
+var TripTypes = []string{TripBusiness, TripCommute, TripPrivate}
+
+// tripsInOrder sorts trips by date and odometer reading
+type tripsInOrder []Trip
+
+func (t tripsInOrder) Len() int      { return len(t) }
+func (t tripsInOrder) Swap(i, j int) { t[i], t[j] = t[j], t[i] }
+func (t tripsInOrder) Less(i, j int) bool {
+	switch {
+	case !t[i].Date.Equal(t[j].Date):
+		return t[i].Date.Before(t[j].Date)
+	case t[i].StartKm != t[j].StartKm:
+		return t[i].StartKm < t[j].StartKm
+	}
+	return t[i].ID < t[j].ID
+}
+
+// ValidateTrip checks that trip has a known type and does not go back, and that it does not
+// overlap any of the other trips of its day
+func ValidateTrip(trip Trip, others []Trip) (errs []FieldError) {
+	known := false
+	for _, t := range TripTypes {
+		known = known || trip.Type == t
+	}
+	if !known {
+		errs = append(errs, FieldError{"type", fmt.Sprintf("%q is not one of %s", trip.Type, strings.Join(TripTypes, ", "))})
+	}
+	switch {
+	case trip.StartKm <= 0:
+		return append(errs, FieldError{"startKm", "the reading at the start of the trip is required"})
+	case trip.EndKm < trip.StartKm:
+		return append(errs, FieldError{"endKm", fmt.Sprintf("%d is lower than the reading at the start of the trip (%d)", trip.EndKm, trip.StartKm)})
+	}
+	for _, other := range others {
+		if other.ID != trip.ID && trip.StartKm < other.EndKm && other.StartKm < trip.EndKm {
+			errs = append(errs, FieldError{"startKm", fmt.Sprintf("the trip overlaps the trip from %d to %d", other.StartKm, other.EndKm)})
+		}
+	}
+	return errs
+}
+
+// readingsFromTrips returns k with the readings of its day derived from the trips of that day,
+// in the order of their odometer readings. Begin and Eerste are the start and end of the first
+// trip, Laatste and Terug those of the last one. With a single trip only Begin and Terug are set.
+func readingsFromTrips(k Kilometers, trips []Trip) Kilometers {
+	if len(trips) == 0 {
+		return k
+	}
+	first, last := trips[0], trips[len(trips)-1]
+	k.Begin, k.Terug, k.Inferred = first.StartKm, last.EndKm, false
+	k.Eerste, k.Laatste = 0, 0
+	if len(trips) > 1 {
+		k.Eerste, k.Laatste = first.EndKm, last.StartKm
+	}
+	return k
+}
+
+// validateAgainstTrips checks that the readings posted in fields for date are the ones derived
+// from the trips of that day, when it has any
+func validateAgainstTrips(ex Executor, date time.Time, fields []Field) ([]FieldError, error) {
+	trips, err := ex.TripsForDate(date)
+	if err != nil || len(trips) == 0 {
+		return nil, err
+	}
+	derived := readingsFromTrips(Kilometers{}, trips)
+	readings := Readings{Begin: derived.Begin, Eerste: derived.Eerste, Laatste: derived.Laatste, Terug: derived.Terug}
+	var errs []FieldError
+	for _, field := range fields {
+		if km := readings.km(field.Name); field.Km != km {
+			errs = append(errs, FieldError{field.Name, fmt.Sprintf("%d does not match the trips of this day (%d)", field.Km, km)})
+		}
+	}
+	return errs, nil
+}
+
+// deriveReadings saves the readings of date derived from its trips, nothing changes when it has none
+func deriveReadings(ex Executor, date time.Time) error {
+	trips, err := ex.TripsForDate(date)
+	if err != nil {
+		return CustomResponse(DbError, err)
+	}
+	if len(trips) == 0 {
+		return nil
+	}
+	k, err := dayKilometers(ex, date)
+	if err != nil {
+		return CustomResponse(DbError, err)
+	}
+	derived := readingsFromTrips(k, trips)
+	if derived == k {
+		return nil
+	}
+	if err = ex.PutKilometers(&derived); err != nil {
+		return CustomResponse(DbError, err)
+	}
+	return nil
+}
+
+// SaveTrip validates trip, unless override is set, and saves it. The readings of its day are
+// derived from its trips again. It returns an InvalidTrip response listing what is rejected.
+func SaveTrip(ex Executor, trip *Trip, maxDistance int, override bool) error {
+	trip.Date = truncateDate(trip.Date)
+	others, err := ex.TripsForDate(trip.Date)
+	if err != nil {
+		return CustomResponse(DbError, err)
+	}
+	if !override {
+		errs := ValidateTrip(*trip, others)
+		if len(errs) == 0 {
+			// the readings the day would get may not go back compared to the previous day
+			trips := []Trip{*trip}
+			for _, other := range others {
+				if other.ID != trip.ID {
+					trips = append(trips, other)
+				}
+			}
+			sort.Sort(tripsInOrder(trips))
+			k, err := dayKilometers(ex, trip.Date)
+			if err != nil {
+				return CustomResponse(DbError, err)
+			}
+			previous, err := previousKilometers(ex, k)
+			if err != nil {
+				return CustomResponse(DbError, err)
+			}
+			next, err := nextKilometers(ex, k)
+			if err != nil {
+				return CustomResponse(DbError, err)
+			}
+			readings := readingsFromTrips(Kilometers{}, trips)
+			errs = append(ValidateKilometers(readings, previous, maxDistance), ValidateBeforeNext(readings, next)...)
+		}
+		if len(errs) > 0 {
+			response := InvalidTrip
+			response.Fields = errs
+			return response
+		}
+	}
+	switch err = ex.PutTrip(trip); {
+	case err == sql.ErrNoRows:
+		return NoTrip
+	case err != nil:
+		return CustomResponse(DbError, err)
+	}
+	return deriveReadings(ex, trip.Date)
+}
+
+// ClassifyDay stores the type of what is driven on date, a day without trips, by adding a trip
+// for every stretch between two of its readings. types has the type of a stretch by the name of
+// the reading it starts at, the others get the type the report would give them. From then on
+// the types can be changed like those of any trip. It returns a DayHasTrips response when the
+// day has trips already, and NoDay when nothing is driven on it.
+func ClassifyDay(ex Executor, date time.Time, types map[string]string) ([]Trip, error) {
+	date = truncateDate(date)
+	trips, err := ex.TripsForDate(date)
+	if err != nil {
+		return nil, CustomResponse(DbError, err)
+	}
+	if len(trips) > 0 {
+		return nil, DayHasTrips
+	}
+	k, err := ex.GetKilometers(date)
+	switch {
+	case err == sql.ErrNoRows:
+		return nil, NoDay
+	case err != nil:
+		return nil, CustomResponse(DbError, err)
+	}
+	segments := readingSegments(k)
+	if len(segments) == 0 {
+		return nil, NoDay
+	}
+	var errs []FieldError
+	// the readings of a day with trips are derived from them, they may be filled in but not move
+	saved := Readings{Begin: k.Begin, Eerste: k.Eerste, Laatste: k.Laatste, Terug: k.Terug}
+	derivedKm := readingsFromTrips(Kilometers{}, tripsOf(segments))
+	derived := Readings{Begin: derivedKm.Begin, Eerste: derivedKm.Eerste, Laatste: derivedKm.Laatste, Terug: derivedKm.Terug}
+	for _, name := range timeFields {
+		if km := saved.km(name); km != 0 && km != derived.km(name) {
+			errs = append(errs, FieldError{name, fmt.Sprintf("%d would become %d as a trip, add the trips of this day one by one", km, derived.km(name))})
+		}
+	}
+	for name, tripType := range types {
+		found := false
+		for i := range segments {
+			if strings.EqualFold(segments[i].Start, name) {
+				segments[i].Type, found = tripType, true
+			}
+		}
+		if !found {
+			errs = append(errs, FieldError{name, "no stretch of this day starts at this reading"})
+		}
+	}
+	for _, segment := range segments {
+		for _, e := range ValidateTrip(segment.Trip, nil) {
+			errs = append(errs, FieldError{segment.Start, e.Reason})
+		}
+	}
+	if len(errs) > 0 {
+		response := InvalidTrip
+		response.Fields = errs
+		return nil, response
+	}
+	trips = tripsOf(segments)
+	for i := range trips {
+		if err = ex.PutTrip(&trips[i]); err != nil {
+			return nil, CustomResponse(DbError, err)
+		}
+	}
+	return trips, deriveReadings(ex, date)
+}
+
+// tripsOf returns the trips of segments
+func tripsOf(segments []daySegment) []Trip {
+	trips := make([]Trip, len(segments))
+	for i, segment := range segments {
+		trips[i] = segment.Trip
+	}
+	return trips
+}
+
+// RemoveTrip deletes the trip with id, the readings of its day are derived from the trips left
+func RemoveTrip(ex Executor, id int64) error {
+	trip, err := GetTrip(ex, id)
+	if err != nil {
+		return err
+	}
+	if err = ex.DeleteTrip(id); err != nil {
+		return CustomResponse(DbError, err)
+	}
+	return deriveReadings(ex, trip.Date)
+}
+
+// GetTrip returns the trip with id, or a NoTrip response when there is none
+func GetTrip(ex Executor, id int64) (Trip, error) {
+	trip, err := ex.GetTrip(id)
+	switch {
+	case err == sql.ErrNoRows:
+		return Trip{}, NoTrip
+	case err != nil:
+		return Trip{}, CustomResponse(DbError, err)
+	}
+	return trip, nil
+}
+
+// GetTrips returns the trips of date, in the order of their odometer readings
+func GetTrips(ex Executor, date time.Time) ([]Trip, error) {
+	trips, err := ex.TripsForDate(date)
+	if err != nil {
+		return nil, CustomResponse(DbError, err)
+	}
+	if trips == nil {
+		trips = []Trip{}
+	}
+	return trips, nil
+}
@@ -0,0 +1,157 @@
+package km
+
+import (
+	"testing"
+	"time"
+)
+
+func TestValidateTrip(t *testing.T) {
+	others := []Trip{
+		Trip{ID: 1, StartKm: 1000, EndKm: 1020, Type: TripBusiness},
+		Trip{ID: 2, StartKm: 1050, EndKm: 1080, Type: TripPrivate},
+	}
+	var tests = []struct {
+		trip    Trip
+		invalid []string
+	}{
+		{Trip{StartKm: 1020, EndKm: 1050, Type: TripBusiness}, nil},
+		{Trip{StartKm: 1080, EndKm: 1080, Type: TripPrivate}, nil},
+		// a trip does not overlap itself
+		{Trip{ID: 1, StartKm: 1000, EndKm: 1030, Type: TripBusiness}, nil},
+		{Trip{StartKm: 1020, EndKm: 1050, Type: "holiday"}, []string{"type"}},
+		{Trip{EndKm: 1050, Type: TripBusiness}, []string{"startKm"}},
+		{Trip{StartKm: 1100, EndKm: 1090, Type: TripBusiness}, []string{"endKm"}},
+		{Trip{StartKm: 1010, EndKm: 1060, Type: TripBusiness}, []string{"startKm", "startKm"}},
+	}
+	for i, tt := range tests {
+		errs := ValidateTrip(tt.trip, others)
+		if len(errs) != len(tt.invalid) {
+			t.Errorf("%d: expected %v to be rejected, got: %+v", i, tt.invalid, errs)
+			continue
+		}
+		for j, e := range errs {
+			if e.Field != tt.invalid[j] || e.Reason == "" {
+				t.Errorf("%d: expected %v to be rejected, got: %+v", i, tt.invalid, errs)
+			}
+		}
+	}
+}
+
+func TestReadingsFromTrips(t *testing.T) {
+	k := Kilometers{Begin: 1, Eerste: 2, Laatste: 3, Terug: 4, Comment: "kept", Inferred: true}
+	if got := readingsFromTrips(k, nil); got != k {
+		t.Errorf("expected the readings to stay without trips, got: %+v", got)
+	}
+	single := []Trip{Trip{StartKm: 1000, EndKm: 1020}}
+	if got := readingsFromTrips(k, single); got != (Kilometers{Begin: 1000, Terug: 1020, Comment: "kept"}) {
+		t.Errorf("unexpected readings of a single trip: %+v", got)
+	}
+	trips := []Trip{Trip{StartKm: 1000, EndKm: 1020}, Trip{StartKm: 1020, EndKm: 1025}, Trip{StartKm: 1050, EndKm: 1070}}
+	if got := readingsFromTrips(k, trips); got != (Kilometers{Begin: 1000, Eerste: 1020, Laatste: 1050, Terug: 1070, Comment: "kept"}) {
+		t.Errorf("unexpected readings of three trips: %+v", got)
+	}
+}
+
+func TestSaveTrip(t *testing.T) {
+	store := NewMemoryStore()
+	date := time.Date(2014, time.January, 2, 0, 0, 0, 0, time.UTC)
+	store.PutKilometers(&Kilometers{Date: date.AddDate(0, 0, -1), Begin: 900, Terug: 1000})
+
+	back := Trip{Date: date, StartKm: 1050, EndKm: 1080, Type: TripBusiness}
+	if err := SaveTrip(store, &back, 0, false); err != nil {
+		t.Fatal(err)
+	}
+	there := Trip{Date: date, StartKm: 1000, EndKm: 1030, Type: TripBusiness}
+	if err := SaveTrip(store, &there, 0, false); err != nil {
+		t.Fatal(err)
+	}
+	if k, _ := store.GetKilometers(date); k.Begin != 1000 || k.Eerste != 1030 || k.Laatste != 1050 || k.Terug != 1080 {
+		t.Errorf("expected the readings to be derived from the trips, got: %+v", k)
+	}
+
+	// going back compared to the previous day
+	early := Trip{Date: date, StartKm: 990, EndKm: 995, Type: TripPrivate}
+	if err := SaveTrip(store, &early, 0, false); err == nil || err.(Response).Name != InvalidTrip.Name {
+		t.Errorf("expected an InvalidTrip response, got: %v", err)
+	}
+	if err := SaveTrip(store, &Trip{ID: 1234, Date: date, StartKm: 1100, EndKm: 1110, Type: TripPrivate}, 0, false); err == nil || err.(Response).Name != NoTrip.Name {
+		t.Errorf("expected NoTrip saving an unknown trip, got: %v", err)
+	}
+
+	// readings have to match the trips
+	if err := ValidateSave(store, date, []Field{Field{Km: 1001, Name: "Begin"}}, 0); err == nil {
+		t.Error("expected a reading that does not match the trips to be rejected")
+	}
+	if err := ValidateSave(store, date, []Field{Field{Km: 1000, Name: "Begin"}}, 0); err != nil {
+		t.Errorf("expected a reading that matches the trips to be accepted, got: %v", err)
+	}
+
+	if err := RemoveTrip(store, back.ID); err != nil {
+		t.Fatal(err)
+	}
+	if k, _ := store.GetKilometers(date); k.Begin != 1000 || k.Eerste != 0 || k.Laatste != 0 || k.Terug != 1030 {
+		t.Errorf("expected the readings to be derived from the trip left, got: %+v", k)
+	}
+	if err := RemoveTrip(store, back.ID); err == nil || err.(Response).Name != NoTrip.Name {
+		t.Errorf("expected NoTrip removing a removed trip, got: %v", err)
+	}
+
+	// trips go to the trash with their day
+	store.DeleteDate(date)
+	if trips, _ := GetTrips(store, date); len(trips) != 0 {
+		t.Errorf("expected no trips for a deleted day, got: %+v", trips)
+	}
+	store.RestoreDate(date)
+	if trips, _ := GetTrips(store, date); len(trips) != 1 || trips[0].ID != there.ID {
+		t.Errorf("expected the trip back with its day, got: %+v", trips)
+	}
+}
+
+func TestClassifyDay(t *testing.T) {
+	store := NewMemoryStore()
+	date := time.Date(2014, time.January, 2, 0, 0, 0, 0, time.UTC)
+	if _, err := ClassifyDay(store, date, nil); err == nil || err.(Response).Name != NoDay.Name {
+		t.Errorf("expected NoDay classifying a day without readings, got: %v", err)
+	}
+	store.PutKilometers(&Kilometers{Date: date, Begin: 1000, Eerste: 1030, Laatste: 1040, Terug: 1070})
+
+	for _, types := range []map[string]string{
+		{"Eerste": "holiday"},
+		{"Terug": TripPrivate},
+	} {
+		if _, err := ClassifyDay(store, date, types); err == nil || err.(Response).Name != InvalidTrip.Name {
+			t.Errorf("%v: expected an InvalidTrip response, got: %v", types, err)
+		}
+	}
+	trips, err := ClassifyDay(store, date, map[string]string{"eerste": TripPrivate})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []Trip{
+		Trip{StartKm: 1000, EndKm: 1030, Type: TripCommute},
+		Trip{StartKm: 1030, EndKm: 1040, Type: TripPrivate},
+		Trip{StartKm: 1040, EndKm: 1070, Type: TripCommute},
+	}
+	saved, _ := GetTrips(store, date)
+	if len(trips) != len(want) || len(saved) != len(want) {
+		t.Fatalf("expected %d trips, got: %+v", len(want), saved)
+	}
+	for i, trip := range saved {
+		if trip.ID == 0 || trip.StartKm != want[i].StartKm || trip.EndKm != want[i].EndKm || trip.Type != want[i].Type {
+			t.Errorf("%d: got %+v, want %+v", i, trip, want[i])
+		}
+	}
+	if k, _ := store.GetKilometers(date); k.Begin != 1000 || k.Eerste != 1030 || k.Laatste != 1040 || k.Terug != 1070 {
+		t.Errorf("expected the readings to stay the same, got: %+v", k)
+	}
+	if _, err = ClassifyDay(store, date, nil); err == nil || err.(Response).Name != DayHasTrips.Name {
+		t.Errorf("expected DayHasTrips classifying a day twice, got: %v", err)
+	}
+
+	// a reading that would move when the day is split in trips is refused
+	other := date.AddDate(0, 0, 1)
+	store.PutKilometers(&Kilometers{Date: other, Begin: 1070, Eerste: 1100})
+	if _, err = ClassifyDay(store, other, nil); err == nil || err.(Response).Name != InvalidTrip.Name {
+		t.Errorf("expected an InvalidTrip response, got: %v", err)
+	}
+}
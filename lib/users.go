@@ -0,0 +1,168 @@
+package km
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// User is an account, every row saved belongs to the user that saved it. Rows saved before
+// there were accounts belong to no one (0), as long as there are no accounts everything is
+// saved for no one.
+type User struct {
+	ID       int64     `db:"id" json:"id"`
+	Name     string    `db:"name" json:"name"`
+	Disabled bool      `db:"disabled" json:"disabled"`
+	Created  time.Time `db:"created_at" json:"created"`
+	// PasswordHash is the bcrypt hash of the password, empty until one is set
+	PasswordHash string `db:"password_hash" json:"-"`
+}
+
+// usersByID sorts users by id
+type usersByID []User
+
+func (u usersByID) Len() int           { return len(u) }
+func (u usersByID) Swap(i, j int)      { u[i], u[j] = u[j], u[i] }
+func (u usersByID) Less(i, j int) bool { return u[i].ID < u[j].ID }
+
+// Accounts manages the users of a store, unlike Executor it is not scoped to a user
+type Accounts interface {
+	// Users returns all users, by id
+	Users() ([]User, error)
+	// GetUser returns the user with id
+	GetUser(id int64) (User, error)
+	// UserByName returns the user with name
+	UserByName(name string) (User, error)
+	// PutUser inserts u when it has no id yet, and updates it otherwise, it returns
+	// sql.ErrNoRows when there is no user with its id
+	PutUser(u *User) error
+	// ClaimRows gives the rows that belong to no one to the user with id, it returns the
+	// number of rows changed and fails when the user has rows already
+	ClaimRows(id int64) (int64, error)
+	// PutSession saves a new session
+	PutSession(session *Session) error
+	// GetSession returns the session saved under tokenHash
+	GetSession(tokenHash string) (Session, error)
+	// DeleteSession ends the session saved under tokenHash
+	DeleteSession(tokenHash string) error
+	// DeleteSessions ends all sessions of the user with id, it returns the number ended
+	DeleteSessions(userID int64) (int64, error)
+	// DeleteExpiredSessions removes the sessions that expired before a time, it returns
+	// the number removed
+	DeleteExpiredSessions(before time.Time) (int64, error)
+}
+
+// ValidateUserName checks that name can be used to log in with
+func ValidateUserName(name string) error {
+	if name == "" || strings.TrimSpace(name) != name || strings.ContainsAny(name, " \t\n:") {
+		return fmt.Errorf("%q is not a valid user name, it has to be a single word without a colon", name)
+	}
+	return nil
+}
+
+// CreateUser adds an account for name
+func CreateUser(store Store, name string) (User, error) {
+	if err := ValidateUserName(name); err != nil {
+		return User{}, err
+	}
+	switch _, err := store.UserByName(name); {
+	case err == nil:
+		return User{}, fmt.Errorf("there is a user %s already", name)
+	case err != sql.ErrNoRows:
+		return User{}, err
+	}
+	user := User{Name: name, Created: time.Now().UTC().Truncate(time.Second)}
+	return user, store.PutUser(&user)
+}
+
+// GetUserByName returns the account of name, or an error saying there is none
+func GetUserByName(store Store, name string) (User, error) {
+	user, err := store.UserByName(name)
+	if err == sql.ErrNoRows {
+		return User{}, fmt.Errorf("there is no user %s", name)
+	}
+	return user, err
+}
+
+// DisableUser disables or enables the account of name, a disabled user can not use the app
+// but keeps what they saved. Disabling ends all sessions of the user.
+func DisableUser(store Store, name string, disabled bool) (User, error) {
+	user, err := GetUserByName(store, name)
+	if err != nil {
+		return User{}, err
+	}
+	user.Disabled = disabled
+	if err = store.PutUser(&user); err != nil || !disabled {
+		return user, err
+	}
+	_, err = store.DeleteSessions(user.ID)
+	return user, err
+}
+
+// ForEachOwner calls f with store scoped to every user, and first to no one for the rows
+// saved before there were accounts
+func ForEachOwner(store Store, f func(owner User, store Store) error) error {
+	users, err := store.Users()
+	if err != nil {
+		return err
+	}
+	for _, owner := range append([]User{{}}, users...) {
+		if err = f(owner, store.ForUser(owner.ID)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// claimRows gives the rows of all tables that belong to no one to the user with id in one
+// transaction on db, as long as the user has no rows yet. count and update are the statements
+// for a table.
+func claimRows(db *sql.DB, id int64, count, update string) (claimed int64, err error) {
+	tables := []string{"kilometers", "times", "trips", "vehicles", "audit"}
+	tx, err := db.Begin()
+	if err != nil {
+		return 0, err
+	}
+	for _, table := range tables {
+		var owned int64
+		if err = tx.QueryRow(fmt.Sprintf(count, table), id).Scan(&owned); err != nil {
+			tx.Rollback()
+			return 0, err
+		}
+		if owned > 0 {
+			tx.Rollback()
+			return 0, fmt.Errorf("user %d has rows saved already", id)
+		}
+	}
+	for _, table := range tables {
+		result, err := tx.Exec(fmt.Sprintf(update, table), id)
+		if err != nil {
+			tx.Rollback()
+			return 0, err
+		}
+		n, err := result.RowsAffected()
+		if err != nil {
+			tx.Rollback()
+			return 0, err
+		}
+		claimed += n
+	}
+	return claimed, tx.Commit()
+}
+
+// userKey is the key of the user making a request in its context
+type userKey struct{}
+
+// withUser returns r with the user making it in its context
+func withUser(r *http.Request, user User) *http.Request {
+	return r.WithContext(context.WithValue(r.Context(), userKey{}, user))
+}
+
+// userOf returns the user making r, no one when it was not looked up
+func userOf(r *http.Request) User {
+	user, _ := r.Context().Value(userKey{}).(User)
+	return user
+}
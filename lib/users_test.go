@@ -0,0 +1,196 @@
+package km
+
+import (
+	"bytes"
+	"database/sql"
+	"encoding/json"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestCreateUser(t *testing.T) {
+	store := NewMemoryStore()
+	for _, name := range []string{"", " alice", "alice smith", "alice:x"} {
+		if _, err := CreateUser(store, name); err == nil {
+			t.Errorf("user name %q is accepted", name)
+		}
+	}
+	alice, err := CreateUser(store, "alice")
+	if err != nil || alice.ID == 0 || alice.Created.IsZero() {
+		t.Fatalf("got %+v, %v", alice, err)
+	}
+	if _, err = CreateUser(store, "alice"); err == nil {
+		t.Error("a second user alice is added")
+	}
+	if alice, err = DisableUser(store, "alice", true); err != nil || !alice.Disabled {
+		t.Errorf("disabling: got %+v, %v", alice, err)
+	}
+	if _, err = DisableUser(store, "bob", true); err == nil {
+		t.Error("disabling a user that does not exist succeeds")
+	}
+	if users, _ := store.Users(); len(users) != 1 || !users[0].Disabled {
+		t.Errorf("got users %+v", users)
+	}
+}
+
+// twoUsers returns a store with the users alice and bob, and the stores scoped to them
+func twoUsers(t *testing.T) (store *MemoryStore, alice, bob Store) {
+	store = NewMemoryStore()
+	for _, name := range []string{"alice", "bob"} {
+		user, err := CreateUser(store, name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if name == "alice" {
+			alice = store.ForUser(user.ID)
+		} else {
+			bob = store.ForUser(user.ID)
+		}
+	}
+	return store, alice, bob
+}
+
+func TestUserIsolation(t *testing.T) {
+	store, alice, bob := twoUsers(t)
+	date := time.Date(2014, time.January, 2, 0, 0, 0, 0, time.UTC)
+	audited := Audited(alice, Origin{User: "alice"})
+	if err := SaveKilometers(audited, date, []Field{Field{Name: "Begin", Km: 1000}, Field{Name: "Terug", Km: 1070}}); err != nil {
+		t.Fatal(err)
+	}
+	trip := Trip{Date: date, StartKm: 1000, EndKm: 1070, Type: TripBusiness}
+	if err := SaveTrip(audited, &trip, 0, false); err != nil {
+		t.Fatal(err)
+	}
+	vehicle := Vehicle{LicensePlate: "12-AB-34", StartDate: date}
+	if err := SaveVehicle(alice, &vehicle); err != nil {
+		t.Fatal(err)
+	}
+
+	// bob saves the same date, with other readings
+	if err := SaveKilometers(Audited(bob, Origin{User: "bob"}), date, []Field{Field{Name: "Begin", Km: 50}}); err != nil {
+		t.Fatalf("bob can not save a date alice saved: %v", err)
+	}
+	if k, _ := alice.GetKilometers(date); k.Begin != 1000 || k.UserID == 0 {
+		t.Errorf("alice got %+v", k)
+	}
+	if k, _ := bob.GetKilometers(date); k.Begin != 50 {
+		t.Errorf("bob got %+v", k)
+	}
+	if _, err := bob.GetTrip(trip.ID); err != sql.ErrNoRows {
+		t.Errorf("bob sees the trip of alice: %v", err)
+	}
+	if err := bob.DeleteTrip(trip.ID); err != sql.ErrNoRows {
+		t.Errorf("bob deletes the trip of alice: %v", err)
+	}
+	if _, err := GetVehicle(bob, vehicle.ID); err == nil {
+		t.Error("bob sees the vehicle of alice")
+	}
+	if entries, _ := bob.AuditLog(); len(entries) != 1 || entries[0].User != "bob" {
+		t.Errorf("bob sees the audit log of alice: %+v", entries)
+	}
+	if k, err := store.GetKilometers(date); err != sql.ErrNoRows {
+		t.Errorf("the store scoped to no one sees %+v", k)
+	}
+
+	// every user has a chain of their own
+	for name, user := range map[string]Store{"alice": alice, "bob": bob} {
+		if problems, err := Verify(user); err != nil || len(problems) > 0 {
+			t.Errorf("%s: %v %v", name, problems, err)
+		}
+	}
+
+	deleteAllForDate(alice, date)
+	deleteAllForDate(bob, date)
+	if purged, err := PurgeTrash(store, -time.Hour); err != nil || purged != 3 {
+		t.Errorf("purged %d rows of all users, want 3 (%v)", purged, err)
+	}
+}
+
+func TestClaimRows(t *testing.T) {
+	store := backupStore(t)
+	alice, err := CreateUser(store, "alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if claimed, err := store.ClaimRows(alice.ID); err != nil || claimed == 0 {
+		t.Fatalf("claimed %d rows: %v", claimed, err)
+	}
+	scoped := store.ForUser(alice.ID)
+	if _, err = scoped.GetKilometers(time.Date(2014, time.January, 2, 0, 0, 0, 0, time.UTC)); err != nil {
+		t.Errorf("alice does not get the day saved before there were users: %v", err)
+	}
+	if problems, err := Verify(scoped); err != nil || len(problems) > 0 {
+		t.Errorf("the claimed rows do not match the chain: %v %v", problems, err)
+	}
+	if days, _ := store.KilometersBetween(allDates[0], allDates[1]); len(days) != 0 {
+		t.Errorf("days saved before there were users are left: %+v", days)
+	}
+}
+
+func TestBackupUsers(t *testing.T) {
+	store, alice, _ := twoUsers(t)
+	date := time.Date(2014, time.January, 2, 0, 0, 0, 0, time.UTC)
+	if err := SaveKilometers(Audited(alice, Origin{User: "alice"}), date, []Field{Field{Name: "Begin", Km: 1000}}); err != nil {
+		t.Fatal(err)
+	}
+	var b bytes.Buffer
+	if _, err := Backup(store, &b); err != nil {
+		t.Fatal(err)
+	}
+	restored := NewMemoryStore()
+	if _, err := Restore(restored, bytes.NewReader(b.Bytes()), int64(b.Len())); err != nil {
+		t.Fatal(err)
+	}
+	user, err := restored.UserByName("alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if k, err := restored.ForUser(user.ID).GetKilometers(date); err != nil || k.Begin != 1000 {
+		t.Errorf("the day of alice is not restored for her: %+v %v", k, err)
+	}
+	if problems, err := Verify(restored.ForUser(user.ID)); err != nil || len(problems) > 0 {
+		t.Errorf("%v %v", problems, err)
+	}
+	if _, err := CreateUser(restored, "carol"); err != nil {
+		t.Fatal(err)
+	}
+	if carol, _ := restored.UserByName("carol"); carol.ID <= user.ID {
+		t.Errorf("a new user gets id %d, restored ids go up to %d", carol.ID, user.ID)
+	}
+}
+
+func TestRequestsAreScoped(t *testing.T) {
+	initServer(t)
+	cookies := make(map[string]*http.Cookie)
+	for _, name := range []string{"alice", "bob"} {
+		cookies[name] = loginCookie(t, name)
+	}
+	request := func(user, method, url, body string, v interface{}) int {
+		req, _ := http.NewRequest(method, url, bytes.NewReader([]byte(body)))
+		req.AddCookie(cookies[user])
+		req.Header.Set("Accept", "application/json")
+		w := serve(req)
+		if v != nil && w.Code < 300 {
+			if err := json.Unmarshal(w.Body.Bytes(), v); err != nil {
+				t.Fatalf("%s %s: not a valid json response: %s", method, url, err)
+			}
+		}
+		return w.Code
+	}
+	url := "/api/v1/days/2014-01-02"
+	if code := request("alice", "PUT", url, `{"readings": {"begin": 1000, "terug": 1070}}`, nil); code != 200 {
+		t.Fatalf("PUT %s as alice: code = %d", url, code)
+	}
+	if code := request("bob", "GET", url, "", nil); code != NoDay.Code {
+		t.Errorf("bob gets the day of alice: code = %d", code)
+	}
+	var day Day
+	if code := request("alice", "GET", url, "", &day); code != 200 || day.Readings.Begin != 1000 {
+		t.Errorf("alice: code = %d, got %+v", code, day)
+	}
+	var history []AuditEntry
+	if request("alice", "GET", url+"/history", "", &history); len(history) == 0 || history[0].User != "alice" {
+		t.Errorf("history of alice: %+v", history)
+	}
+}
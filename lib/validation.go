@@ -0,0 +1,105 @@
+package km
+
+import (
+	"fmt"
+	"time"
+)
+
+// DefaultMaxDistance is the largest distance in km between two consecutive
+// readings that is accepted when none is configured
+const DefaultMaxDistance = 1000
+
+// FieldError tells why the value posted for a field is rejected
+type FieldError struct {
+	Field  string `json:"field"`
+	Reason string `json:"reason"`
+}
+
+// ValidateKilometers checks that the readings of a day never go back, compared to
+// each other and to the last reading of the previous day, and that they do not jump
+// more than maxDistance km. Readings that are not filled in (0) are skipped.
+func ValidateKilometers(k, previous Kilometers, maxDistance int) (errs []FieldError) {
+	if maxDistance <= 0 {
+		maxDistance = DefaultMaxDistance
+	}
+	last, lastName := previous.getMax(), "the last reading of the previous day"
+	readings := []struct {
+		name string
+		km   int
+	}{
+		{"Begin", k.Begin},
+		{"Eerste", k.Eerste},
+		{"Laatste", k.Laatste},
+		{"Terug", k.Terug},
+	}
+	for _, r := range readings {
+		if r.km == 0 {
+			continue
+		}
+		switch {
+		case last > 0 && r.km < last:
+			errs = append(errs, FieldError{r.name, fmt.Sprintf("%d is lower than %s (%d)", r.km, lastName, last)})
+		case last > 0 && r.km-last > maxDistance:
+			errs = append(errs, FieldError{r.name, fmt.Sprintf("%d is %d km more than %s (%d), the maximum is %d", r.km, r.km-last, lastName, last, maxDistance)})
+		default:
+			// only valid readings are used to check the next one
+			last, lastName = r.km, r.name
+		}
+	}
+	return errs
+}
+
+// ValidateBeforeNext checks that the readings of a day are not higher than the first reading
+// of the next day, so an older day can not be changed to go past the days after it. Readings
+// that are not filled in (0) are skipped, as is the check when there is no next day.
+func ValidateBeforeNext(k, next Kilometers) (errs []FieldError) {
+	first := next.getMin()
+	if first == 0 {
+		return nil
+	}
+	for _, r := range []struct {
+		name string
+		km   int
+	}{
+		{"Begin", k.Begin},
+		{"Eerste", k.Eerste},
+		{"Laatste", k.Laatste},
+		{"Terug", k.Terug},
+	} {
+		if r.km > first {
+			errs = append(errs, FieldError{r.name, fmt.Sprintf("%d is higher than the first reading of the next day (%d)", r.km, first)})
+		}
+	}
+	return errs
+}
+
+// ValidateSave checks the kilometers that would be saved for date when fields are
+// added to them, against the previous and the next day of the same vehicle. On a day with trips
+// they have to be the readings derived from them. It returns an InvalidReading
+// response listing the rejected fields
+func ValidateSave(ex Executor, date time.Time, fields []Field, maxDistance int) error {
+	k, err := dayKilometers(ex, date)
+	if err != nil {
+		return CustomResponse(DbError, err)
+	}
+	k.AddFields(fields)
+	previous, err := previousKilometers(ex, k)
+	if err != nil {
+		return CustomResponse(DbError, err)
+	}
+	next, err := nextKilometers(ex, k)
+	if err != nil {
+		return CustomResponse(DbError, err)
+	}
+	errs := append(ValidateKilometers(k, previous, maxDistance), ValidateBeforeNext(k, next)...)
+	tripErrs, err := validateAgainstTrips(ex, date, fields)
+	if err != nil {
+		return CustomResponse(DbError, err)
+	}
+	if errs = append(errs, tripErrs...); len(errs) > 0 {
+		response := InvalidReading
+		response.Fields = errs
+		return response
+	}
+	return nil
+}
@@ -0,0 +1,74 @@
+package km
+
+import (
+	"testing"
+	"time"
+)
+
+func TestValidateKilometers(t *testing.T) {
+	date := time.Date(2014, time.January, 2, 0, 0, 0, 0, time.UTC)
+	previous := Kilometers{Date: date.AddDate(0, 0, -1), Begin: 1000, Terug: 1100}
+	var tests = []struct {
+		k       Kilometers
+		invalid []string
+	}{
+		{Kilometers{Begin: 1100, Eerste: 1120, Laatste: 1150, Terug: 1170}, nil},
+		{Kilometers{Begin: 1100, Terug: 1170}, nil},
+		{Kilometers{}, nil},
+		{Kilometers{Begin: 1099}, []string{"Begin"}},
+		{Kilometers{Begin: 1100, Eerste: 1090, Laatste: 1150}, []string{"Eerste"}},
+		{Kilometers{Begin: 1100, Eerste: 1120, Laatste: 1110, Terug: 1130}, []string{"Laatste"}},
+		{Kilometers{Begin: 1100, Eerste: 2200}, []string{"Eerste"}},
+		// a rejected reading is not used to check the next one
+		{Kilometers{Begin: 11000, Eerste: 1120}, []string{"Begin"}},
+	}
+	for i, tt := range tests {
+		errs := ValidateKilometers(tt.k, previous, 1000)
+		if len(errs) != len(tt.invalid) {
+			t.Errorf("%d: expected %v to be rejected, got: %+v", i, tt.invalid, errs)
+			continue
+		}
+		for j, e := range errs {
+			if e.Field != tt.invalid[j] || e.Reason == "" {
+				t.Errorf("%d: expected %v to be rejected, got: %+v", i, tt.invalid, errs)
+			}
+		}
+	}
+
+	// the next day is checked too
+	next := Kilometers{Date: date.AddDate(0, 0, 1), Begin: 1170, Terug: 1200}
+	if errs := ValidateBeforeNext(Kilometers{Begin: 1100, Terug: 1170}, next); len(errs) != 0 {
+		t.Errorf("expected no errors up to the next day, got: %+v", errs)
+	}
+	if errs := ValidateBeforeNext(Kilometers{Begin: 1100, Terug: 1180}, next); len(errs) != 1 || errs[0].Field != "Terug" {
+		t.Errorf("expected Terug to be rejected, got: %+v", errs)
+	}
+	if errs := ValidateBeforeNext(Kilometers{Begin: 50000}, Kilometers{}); len(errs) != 0 {
+		t.Errorf("expected no errors without a next day, got: %+v", errs)
+	}
+
+	// the first day has nothing to compare to
+	if errs := ValidateKilometers(Kilometers{Begin: 50000}, Kilometers{}, 0); len(errs) != 0 {
+		t.Errorf("expected no errors without a previous day, got: %+v", errs)
+	}
+}
+
+func TestValidateSaveAgainstNextDay(t *testing.T) {
+	store := NewMemoryStore()
+	first := time.Date(2014, time.January, 1, 0, 0, 0, 0, time.UTC)
+	third := first.AddDate(0, 0, 2)
+	SaveKilometers(store, first, []Field{Field{Name: "Begin", Km: 1000}, Field{Name: "Terug", Km: 1100}})
+	SaveKilometers(store, third, []Field{Field{Name: "Begin", Km: 1200}, Field{Name: "Terug", Km: 1300}})
+
+	if err := ValidateSave(store, first.AddDate(0, 0, 1), []Field{Field{Name: "Begin", Km: 1100}, Field{Name: "Terug", Km: 1200}}, 0); err != nil {
+		t.Errorf("a day between its neighbours is rejected: %v", err)
+	}
+	if err := ValidateSave(store, first.AddDate(0, 0, 1), []Field{Field{Name: "Begin", Km: 1100}, Field{Name: "Terug", Km: 1250}}, 0); err == nil {
+		t.Error("a reading past the first reading of the next day is accepted")
+	}
+	// editing an older day can not make it go past the days after it
+	err := ValidateSave(store, first, []Field{Field{Name: "Terug", Km: 1250}}, 0)
+	if resp, ok := err.(Response); !ok || len(resp.Fields) != 1 || resp.Fields[0].Field != "Terug" {
+		t.Errorf("expected Terug of the older day to be rejected, got %v", err)
+	}
+}
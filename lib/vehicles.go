@@ -0,0 +1,212 @@
+package km
+
+import (
+	"database/sql"
+	"fmt"
+	"time"
+)
+
+// Vehicle is a car the kilometers are driven in, every day saved refers to the vehicle driven
+// that day. Days saved before any vehicle was added refer to none (0), they are taken for one
+// vehicle.
+type Vehicle struct {
+	ID           int64  `db:"id" json:"id"`
+	LicensePlate string `db:"license_plate" json:"licensePlate"`
+	Make         string `db:"make" json:"make"`
+	// StartDate is the first day the vehicle is driven, EndDate the last one, nil while it
+	// is still driven
+	StartDate time.Time  `db:"start_date" json:"startDate"`
+	EndDate   *time.Time `db:"end_date" json:"endDate"`
+	// StartKm is the odometer reading the vehicle is taken into use with, the first day
+	// saved for it is validated against it
+	StartKm int `db:"start_km" json:"startKm"`
+	// Active is set for the vehicle new days are saved for, it is ignored when a vehicle
+	// is saved
+	Active bool `db:"active" json:"active"`
+	// UserID is the user driving the vehicle
+	UserID int64 `db:"user_id" json:"-"`
+}
+
+// vehiclesInOrder sorts vehicles by start date
+type vehiclesInOrder []Vehicle
+
+func (v vehiclesInOrder) Len() int      { return len(v) }
+func (v vehiclesInOrder) Swap(i, j int) { v[i], v[j] = v[j], v[i] }
+func (v vehiclesInOrder) Less(i, j int) bool {
+	if !v[i].StartDate.Equal(v[j].StartDate) {
+		return v[i].StartDate.Before(v[j].StartDate)
+	}
+	return v[i].ID < v[j].ID
+}
+
+// inUse tells whether v is driven on date
+func (v Vehicle) inUse(date time.Time) bool {
+	date = truncateDate(date)
+	return !date.Before(truncateDate(v.StartDate)) && (v.EndDate == nil || !date.After(truncateDate(*v.EndDate)))
+}
+
+// ValidateVehicle checks that v has a license plate and a start date, and that it is not
+// taken out of use before it is taken into use
+func ValidateVehicle(v Vehicle) (errs []FieldError) {
+	if v.LicensePlate == "" {
+		errs = append(errs, FieldError{"licensePlate", "the license plate is required"})
+	}
+	if v.StartDate.IsZero() {
+		errs = append(errs, FieldError{"startDate", "the first day the vehicle is driven is required"})
+	} else if v.EndDate != nil && truncateDate(*v.EndDate).Before(truncateDate(v.StartDate)) {
+		errs = append(errs, FieldError{"endDate", fmt.Sprintf("%s is before the start date (%s)", FormatURLDate(*v.EndDate), FormatURLDate(v.StartDate))})
+	}
+	if v.StartKm < 0 {
+		errs = append(errs, FieldError{"startKm", fmt.Sprintf("%d is not an odometer reading", v.StartKm)})
+	}
+	return errs
+}
+
+// SaveVehicle validates v and saves it. The first vehicle added is made active, the other ones
+// keep whether they are active. It returns an InvalidVehicle response listing what is rejected.
+func SaveVehicle(ex Executor, v *Vehicle) error {
+	if errs := ValidateVehicle(*v); len(errs) > 0 {
+		response := InvalidVehicle
+		response.Fields = errs
+		return response
+	}
+	v.StartDate = truncateDate(v.StartDate)
+	if v.EndDate != nil {
+		end := truncateDate(*v.EndDate)
+		v.EndDate = &end
+	}
+	if v.ID == 0 {
+		vehicles, err := ex.Vehicles()
+		if err != nil {
+			return CustomResponse(DbError, err)
+		}
+		v.Active = len(vehicles) == 0
+	} else {
+		saved, err := GetVehicle(ex, v.ID)
+		if err != nil {
+			return err
+		}
+		v.Active = saved.Active
+	}
+	switch err := ex.PutVehicle(v); {
+	case err == sql.ErrNoRows:
+		return NoVehicle
+	case err != nil:
+		return CustomResponse(DbError, err)
+	}
+	return nil
+}
+
+// ActivateVehicle makes the vehicle with id the one new days are saved for
+func ActivateVehicle(ex Executor, id int64) (Vehicle, error) {
+	switch err := ex.ActivateVehicle(id); {
+	case err == sql.ErrNoRows:
+		return Vehicle{}, NoVehicle
+	case err != nil:
+		return Vehicle{}, CustomResponse(DbError, err)
+	}
+	return GetVehicle(ex, id)
+}
+
+// GetVehicle returns the vehicle with id, or a NoVehicle response when there is none
+func GetVehicle(ex Executor, id int64) (Vehicle, error) {
+	v, err := ex.GetVehicle(id)
+	switch {
+	case err == sql.ErrNoRows:
+		return Vehicle{}, NoVehicle
+	case err != nil:
+		return Vehicle{}, CustomResponse(DbError, err)
+	}
+	return v, nil
+}
+
+// GetVehicles returns all vehicles, in the order they were taken into use
+func GetVehicles(ex Executor) ([]Vehicle, error) {
+	vehicles, err := ex.Vehicles()
+	if err != nil {
+		return nil, CustomResponse(DbError, err)
+	}
+	if vehicles == nil {
+		vehicles = []Vehicle{}
+	}
+	return vehicles, nil
+}
+
+// vehicleFor returns the vehicle driven on date: the active one when it is in use on that date,
+// otherwise the one in use on it that was taken into use last, or the active one when none is.
+// It returns the zero Vehicle when no vehicle is added.
+func vehicleFor(ex Executor, date time.Time) (Vehicle, error) {
+	vehicles, err := ex.Vehicles()
+	if err != nil {
+		return Vehicle{}, err
+	}
+	var active, inUse Vehicle
+	for _, v := range vehicles {
+		if v.Active {
+			active = v
+			if v.inUse(date) {
+				return v, nil
+			}
+		}
+		if v.inUse(date) {
+			inUse = v
+		}
+	}
+	if inUse.ID != 0 {
+		return inUse, nil
+	}
+	return active, nil
+}
+
+// kilometersOfVehicle returns the kilometers in kms saved for the vehicle with id
+func kilometersOfVehicle(kms []Kilometers, id int64) []Kilometers {
+	of := make([]Kilometers, 0, len(kms))
+	for _, k := range kms {
+		if k.VehicleID == id {
+			of = append(of, k)
+		}
+	}
+	return of
+}
+
+// dayKilometers returns the kilometers saved for date, or new ones for the vehicle driven on
+// date when there are none
+func dayKilometers(ex Executor, date time.Time) (Kilometers, error) {
+	k, err := ex.GetKilometers(date)
+	if err != sql.ErrNoRows {
+		return k, err
+	}
+	vehicle, err := vehicleFor(ex, date)
+	return Kilometers{Date: date, VehicleID: vehicle.ID}, err
+}
+
+// previousKilometers returns the kilometers of the last day before k saved for its vehicle. The
+// first day of a vehicle comes after the reading it was taken into use with, which is returned
+// as Begin. It returns empty kilometers when there is nothing to compare k with.
+func previousKilometers(ex Executor, k Kilometers) (Kilometers, error) {
+	previous, err := ex.PreviousKilometers(k.VehicleID, k.Date)
+	if err != sql.ErrNoRows {
+		return previous, err
+	}
+	if k.VehicleID == 0 {
+		return Kilometers{}, nil
+	}
+	vehicle, err := ex.GetVehicle(k.VehicleID)
+	switch {
+	case err == sql.ErrNoRows:
+		return Kilometers{}, nil
+	case err != nil:
+		return Kilometers{}, err
+	}
+	return Kilometers{VehicleID: vehicle.ID, Begin: vehicle.StartKm}, nil
+}
+
+// nextKilometers returns the kilometers of the first day after k of the same vehicle, with no
+// readings when there is none
+func nextKilometers(ex Executor, k Kilometers) (Kilometers, error) {
+	next, err := ex.NextKilometers(k.VehicleID, k.Date)
+	if err == sql.ErrNoRows {
+		return Kilometers{}, nil
+	}
+	return next, err
+}
@@ -0,0 +1,213 @@
+package km
+
+import (
+	"net/http"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestValidateVehicle(t *testing.T) {
+	start := time.Date(2014, time.January, 1, 0, 0, 0, 0, time.UTC)
+	before := start.AddDate(0, 0, -1)
+	var tests = []struct {
+		vehicle Vehicle
+		invalid []string
+	}{
+		{Vehicle{LicensePlate: "12-AB-34", StartDate: start}, nil},
+		{Vehicle{LicensePlate: "12-AB-34", StartDate: start, EndDate: &start}, nil},
+		{Vehicle{StartDate: start}, []string{"licensePlate"}},
+		{Vehicle{LicensePlate: "12-AB-34"}, []string{"startDate"}},
+		{Vehicle{LicensePlate: "12-AB-34", StartDate: start, EndDate: &before}, []string{"endDate"}},
+		{Vehicle{LicensePlate: "12-AB-34", StartDate: start, StartKm: -1}, []string{"startKm"}},
+	}
+	for i, tt := range tests {
+		errs := ValidateVehicle(tt.vehicle)
+		if len(errs) != len(tt.invalid) {
+			t.Errorf("%d: expected %v to be rejected, got: %+v", i, tt.invalid, errs)
+			continue
+		}
+		for j, e := range errs {
+			if e.Field != tt.invalid[j] || e.Reason == "" {
+				t.Errorf("%d: expected %v to be rejected, got: %+v", i, tt.invalid, errs)
+			}
+		}
+	}
+}
+
+// replaceCar returns a store with days driven in a car before any vehicle was added, and a
+// lease car replacing it on 2014-07-01 with its odometer at 10
+func replaceCar(t *testing.T) (store *MemoryStore, old, lease Vehicle) {
+	store = NewMemoryStore()
+	july := time.Date(2014, time.July, 1, 0, 0, 0, 0, time.UTC)
+	if err := SaveKilometers(store, july.AddDate(0, 0, -1), []Field{Field{Name: "Begin", Km: 52000}, Field{Name: "Terug", Km: 52100}}); err != nil {
+		t.Fatal(err)
+	}
+	end := july.AddDate(0, 0, -1)
+	old = Vehicle{LicensePlate: "12-AB-34", StartDate: time.Date(2010, time.March, 1, 0, 0, 0, 0, time.UTC), EndDate: &end}
+	lease = Vehicle{LicensePlate: "56-CD-78", Make: "Volvo", StartDate: july, StartKm: 10}
+	for _, v := range []*Vehicle{&old, &lease} {
+		if err := SaveVehicle(store, v); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := ActivateVehicle(store, lease.ID); err != nil {
+		t.Fatal(err)
+	}
+	return store, old, lease
+}
+
+func TestVehicleFor(t *testing.T) {
+	store, old, lease := replaceCar(t)
+	var tests = []struct {
+		date time.Time
+		want int64
+	}{
+		{time.Date(2014, time.June, 30, 0, 0, 0, 0, time.UTC), old.ID},
+		{time.Date(2014, time.July, 1, 0, 0, 0, 0, time.UTC), lease.ID},
+		// before any vehicle the active one is driven
+		{time.Date(2009, time.January, 1, 0, 0, 0, 0, time.UTC), lease.ID},
+	}
+	for _, tt := range tests {
+		if v, err := vehicleFor(store, tt.date); err != nil || v.ID != tt.want {
+			t.Errorf("%s: got vehicle %d (%v), want %d", FormatURLDate(tt.date), v.ID, err, tt.want)
+		}
+	}
+	if v, _ := vehicleFor(NewMemoryStore(), time.Date(2014, time.January, 1, 0, 0, 0, 0, time.UTC)); v.ID != 0 {
+		t.Errorf("got vehicle %d without vehicles", v.ID)
+	}
+}
+
+func TestActivateVehicle(t *testing.T) {
+	store, old, lease := replaceCar(t)
+	if !old.Active {
+		t.Errorf("the first vehicle added is not active: %+v", old)
+	}
+	if lease, _ = GetVehicle(store, lease.ID); !lease.Active {
+		t.Errorf("the activated vehicle is not active: %+v", lease)
+	}
+	if old, _ = GetVehicle(store, old.ID); old.Active {
+		t.Errorf("two vehicles are active: %+v", old)
+	}
+	// saving a vehicle does not change which one is active
+	old.Active = true
+	if err := SaveVehicle(store, &old); err != nil || old.Active {
+		t.Errorf("saving made the vehicle active: %+v %v", old, err)
+	}
+	if _, err := ActivateVehicle(store, 1234); err == nil || err.(Response).Name != NoVehicle.Name {
+		t.Errorf("expected NoVehicle, got %v", err)
+	}
+}
+
+func TestValidateSavePerVehicle(t *testing.T) {
+	store, _, lease := replaceCar(t)
+	july := time.Date(2014, time.July, 1, 0, 0, 0, 0, time.UTC)
+	// the odometer of the new car starts over
+	if err := ValidateSave(store, july, []Field{Field{Name: "Begin", Km: 10}, Field{Name: "Terug", Km: 60}}, 0); err != nil {
+		t.Errorf("the first day of a new vehicle is rejected: %v", err)
+	}
+	if err := ValidateSave(store, july, []Field{Field{Name: "Begin", Km: 5}}, 0); err == nil {
+		t.Error("a reading below the odometer the vehicle is taken into use with is accepted")
+	}
+	if err := SaveKilometers(store, july, []Field{Field{Name: "Begin", Km: 10}, Field{Name: "Terug", Km: 60}}); err != nil {
+		t.Fatal(err)
+	}
+	if k, _ := store.GetKilometers(july); k.VehicleID != lease.ID {
+		t.Errorf("the day is saved for vehicle %d, want %d", k.VehicleID, lease.ID)
+	}
+	if err := ValidateSave(store, july.AddDate(0, 0, 1), []Field{Field{Name: "Begin", Km: 50}}, 0); err == nil {
+		t.Error("a reading going back compared to the previous day of the vehicle is accepted")
+	}
+
+	// the Begin of a new car is not copied to the last day of the old one
+	if err := BackfillPrevious(store, july, []Field{Field{Name: "Begin", Km: 10}}); err != nil {
+		t.Fatal(err)
+	}
+	if k, _ := store.GetKilometers(july.AddDate(0, 0, -1)); k.Terug != 52100 || k.Inferred {
+		t.Errorf("the reading of another vehicle is copied: %+v", k)
+	}
+}
+
+func TestGetStatePerVehicle(t *testing.T) {
+	store, _, _ := replaceCar(t)
+	july := time.Date(2014, time.July, 1, 0, 0, 0, 0, time.UTC)
+	err, state := GetState(store, july, time.UTC)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if state.LastDayKm != 10 || state.Vehicle != "56-CD-78" {
+		t.Errorf("the first day of a vehicle starts at %d in %q, want 10 in 56-CD-78", state.LastDayKm, state.Vehicle)
+	}
+	SaveTimes(store, july.AddDate(0, 0, -1), []Field{Field{Name: "Begin", Time: "08:00"}}, time.UTC)
+	err, state = GetState(store, july.AddDate(0, 0, -1), time.UTC)
+	if err != nil || state.Vehicle != "" {
+		t.Errorf("a day saved before vehicles were added got vehicle %q (%v)", state.Vehicle, err)
+	}
+}
+
+func TestYearReportPerVehicle(t *testing.T) {
+	store, _, _ := replaceCar(t)
+	SaveKilometers(store, time.Date(2014, time.July, 1, 0, 0, 0, 0, time.UTC), []Field{Field{Name: "Begin", Km: 20}, Field{Name: "Terug", Km: 80}})
+	report, err := GetYearReport(store, 2014)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// from the delivery of the new car to its first day, but not from the old car to the new one
+	if report.Private != 10 {
+		t.Errorf("got %d private km, want 10", report.Private)
+	}
+}
+
+func TestVehicleHandlers(t *testing.T) {
+	initServer(t)
+	var vehicles []Vehicle
+	if code := apiRequest(t, "GET", "/api/v1/vehicles", "", &vehicles); code != 200 || len(vehicles) != 0 {
+		t.Errorf("GET /api/v1/vehicles before adding: code = %d, got %+v", code, vehicles)
+	}
+	var first, second Vehicle
+	body := `{"licensePlate": "12-AB-34", "make": "Opel", "startDate": "2010-03-01T00:00:00Z"}`
+	if code := apiRequest(t, "POST", "/api/v1/vehicles", body, &first); code != http.StatusCreated || first.ID == 0 || !first.Active {
+		t.Fatalf("POST /api/v1/vehicles: code = %d, got %+v", code, first)
+	}
+	body = `{"licensePlate": "56-CD-78", "startDate": "2014-07-01T00:00:00Z", "startKm": 10}`
+	if code := apiRequest(t, "POST", "/api/v1/vehicles", body, &second); code != http.StatusCreated || second.Active {
+		t.Fatalf("POST /api/v1/vehicles: code = %d, got %+v", code, second)
+	}
+	firstURL := "/api/v1/vehicles/" + strconv.FormatInt(first.ID, 10)
+	secondURL := "/api/v1/vehicles/" + strconv.FormatInt(second.ID, 10)
+
+	if code := apiRequest(t, "PATCH", firstURL, `{"endDate": "2014-06-30T00:00:00Z"}`, &first); code != 200 || first.EndDate == nil || first.Make != "Opel" {
+		t.Errorf("PATCH %s: code = %d, got %+v", firstURL, code, first)
+	}
+	if code := apiRequest(t, "POST", secondURL+"/activate", "", &second); code != 200 || !second.Active {
+		t.Errorf("POST %s/activate: code = %d, got %+v", secondURL, code, second)
+	}
+	if apiRequest(t, "GET", firstURL, "", &first); first.Active {
+		t.Errorf("the vehicle switched from is still active: %+v", first)
+	}
+
+	apiRequest(t, "PUT", "/api/v1/days/2014-06-30/readings", `{"begin": 52000, "terug": 52100}`, nil)
+	if code := apiRequest(t, "PUT", "/api/v1/days/2014-07-01/readings", `{"begin": 10, "terug": 60}`, nil); code != 200 {
+		t.Errorf("the first day of the new vehicle is rejected: code = %d", code)
+	}
+	var day Day
+	if apiRequest(t, "GET", "/api/v1/days/2014-07-01", "", &day); day.Vehicle != second.ID {
+		t.Errorf("the day is saved for vehicle %d, want %d", day.Vehicle, second.ID)
+	}
+
+	for _, tc := range []struct {
+		method, url, body string
+		want              Response
+	}{
+		{"POST", "/api/v1/vehicles", `{"make": "Opel", "startDate": "2010-03-01T00:00:00Z"}`, InvalidVehicle},
+		{"PUT", firstURL, `{"licensePlate": "12-AB-34"}`, InvalidVehicle},
+		{"POST", "/api/v1/vehicles", `{"plate": "12-AB-34"}`, UnknownField},
+		{"GET", "/api/v1/vehicles/1234", ``, NoVehicle},
+		{"POST", "/api/v1/vehicles/1234/activate", ``, NoVehicle},
+		{"GET", "/api/v1/vehicles/first", ``, InvalidURL},
+	} {
+		if code := apiRequest(t, tc.method, tc.url, tc.body, nil); code != tc.want.Code {
+			t.Errorf("%s %s %s: code = %d, want %d", tc.method, tc.url, tc.body, code, tc.want.Code)
+		}
+	}
+}
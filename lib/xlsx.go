@@ -0,0 +1,280 @@
+package km
+
+import (
+	"archive/zip"
+	"bytes"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// An xlsx workbook is a zip of xml files, this writes the few of them a workbook of plain sheets
+// needs. Formulas are left to be calculated when the workbook is opened.
+
+// xlsxCell is a cell of a sheet, a number, a text or a formula. Cells without value are left out.
+type xlsxCell struct {
+	value   string
+	text    bool
+	formula bool
+	// style is one of the xlsx styles below
+	style int
+}
+
+// the styles of cells, in the order of cellXfs in xlsxStyles
+const (
+	xlsxPlain = iota
+	xlsxDate
+	xlsxDecimal
+	xlsxBold
+	xlsxBoldDecimal
+)
+
+func xlsxNumber(n float64, style int) xlsxCell {
+	return xlsxCell{value: strconv.FormatFloat(n, 'f', -1, 64), style: style}
+}
+
+// xlsxKm is a cell with a reading, empty when it is not saved
+func xlsxKm(km int) xlsxCell {
+	if km == 0 {
+		return xlsxCell{}
+	}
+	return xlsxNumber(float64(km), xlsxPlain)
+}
+
+func xlsxText(text string, style int) xlsxCell {
+	return xlsxCell{value: text, text: true, style: style}
+}
+
+func xlsxFormula(formula string, style int) xlsxCell {
+	return xlsxCell{value: formula, formula: true, style: style}
+}
+
+// xlsxDateCell is a cell with date, spreadsheets count days from the end of 1899
+func xlsxDateCell(date time.Time) xlsxCell {
+	epoch := time.Date(1899, time.December, 30, 0, 0, 0, 0, time.UTC)
+	return xlsxNumber(float64(truncateDate(date).Sub(epoch)/(24*time.Hour)), xlsxDate)
+}
+
+// xlsxColumn is the name of column i, counting from 0: A to Z, AA to AZ, and so on
+func xlsxColumn(i int) string {
+	name := ""
+	for i++; i > 0; i = (i - 1) / 26 {
+		name = string(rune('A'+(i-1)%26)) + name
+	}
+	return name
+}
+
+// xlsxSheet is a sheet of a workbook
+type xlsxSheet struct {
+	name string
+	rows [][]xlsxCell
+}
+
+// ref is the reference to cell in column and row, counting from A and 1, from another sheet
+func (s xlsxSheet) ref(column string, row int) string {
+	return fmt.Sprintf("'%s'!%s%d", strings.Replace(s.name, "'", "''", -1), column, row)
+}
+
+// the columns of a month sheet, in the order of exportColumns
+const (
+	xlsxDistanceColumn = "F"
+	xlsxHoursColumn    = "K"
+)
+
+// monthSheet returns the sheet of days, all of month, with a row with their totals. total is
+// the number of that row.
+func monthSheet(month time.Time, days []ExportDay) (sheet xlsxSheet, total int) {
+	sheet.name = month.Format("January 2006")
+	header := make([]xlsxCell, 0, len(exportColumns))
+	for _, column := range exportColumns {
+		header = append(header, xlsxText(column, xlsxBold))
+	}
+	sheet.rows = append(sheet.rows, header)
+	for _, d := range days {
+		sheet.rows = append(sheet.rows, []xlsxCell{
+			xlsxDateCell(d.Date),
+			xlsxKm(d.Readings.Begin), xlsxKm(d.Readings.Eerste), xlsxKm(d.Readings.Laatste), xlsxKm(d.Readings.Terug),
+			xlsxNumber(float64(d.Distance), xlsxPlain),
+			xlsxText(d.Times.Begin, xlsxPlain), xlsxText(d.Times.Eerste, xlsxPlain),
+			xlsxText(d.Times.Laatste, xlsxPlain), xlsxText(d.Times.Terug, xlsxPlain),
+			xlsxNumber(d.Hours, xlsxDecimal),
+			xlsxText(d.Comment, xlsxPlain),
+		})
+	}
+	total = len(sheet.rows) + 1
+	distance, hours := xlsxNumber(0, xlsxBold), xlsxNumber(0, xlsxBoldDecimal)
+	if len(days) > 0 {
+		distance = xlsxFormula(fmt.Sprintf("SUM(%s2:%[1]s%d)", xlsxDistanceColumn, total-1), xlsxBold)
+		hours = xlsxFormula(fmt.Sprintf("SUM(%s2:%[1]s%d)", xlsxHoursColumn, total-1), xlsxBoldDecimal)
+	}
+	row := make([]xlsxCell, len(exportColumns))
+	row[0], row[5], row[10] = xlsxText("total", xlsxBold), distance, hours
+	sheet.rows = append(sheet.rows, row)
+	return sheet, total
+}
+
+// WriteXLSX writes the days saved from one date up to and including another, oldest first, as
+// an xlsx workbook. Every month has its own sheet, the first sheet sums them up. All totals are
+// formulas.
+func WriteXLSX(w io.Writer, from, to time.Time, days []ExportDay) error {
+	months := make(map[time.Time][]ExportDay)
+	for _, month := range byMonth(days) {
+		months[time.Date(month.year, month.month, 1, 0, 0, 0, 0, time.UTC)] = month.days
+	}
+
+	summary := xlsxSheet{name: "Summary", rows: [][]xlsxCell{{
+		xlsxText("month", xlsxBold), xlsxText("days", xlsxBold), xlsxText("distance", xlsxBold), xlsxText("hours", xlsxBold),
+	}}}
+	var sheets []xlsxSheet
+	for month := time.Date(from.Year(), from.Month(), 1, 0, 0, 0, 0, time.UTC); !month.After(to); month = month.AddDate(0, 1, 0) {
+		sheet, total := monthSheet(month, months[month])
+		days := xlsxNumber(0, xlsxPlain)
+		if total > 2 {
+			days = xlsxFormula(fmt.Sprintf("COUNT(%s:A%d)", sheet.ref("A", 2), total-1), xlsxPlain)
+		}
+		summary.rows = append(summary.rows, []xlsxCell{
+			xlsxText(sheet.name, xlsxPlain),
+			days,
+			xlsxFormula(sheet.ref(xlsxDistanceColumn, total), xlsxPlain),
+			xlsxFormula(sheet.ref(xlsxHoursColumn, total), xlsxDecimal),
+		})
+		sheets = append(sheets, sheet)
+	}
+	last := len(summary.rows)
+	summary.rows = append(summary.rows, []xlsxCell{
+		xlsxText("total", xlsxBold),
+		xlsxFormula(fmt.Sprintf("SUM(B2:B%d)", last), xlsxBold),
+		xlsxFormula(fmt.Sprintf("SUM(C2:C%d)", last), xlsxBold),
+		xlsxFormula(fmt.Sprintf("SUM(D2:D%d)", last), xlsxBoldDecimal),
+	})
+	return writeWorkbook(w, append([]xlsxSheet{summary}, sheets...))
+}
+
+// xlsxFile is a file in the zip of a workbook
+type xlsxFile struct {
+	name    string
+	content []byte
+}
+
+// writeWorkbook writes sheets as an xlsx workbook
+func writeWorkbook(w io.Writer, sheets []xlsxSheet) error {
+	var types, workbook, rels bytes.Buffer
+	types.WriteString(xml.Header + `<Types xmlns="http://schemas.openxmlformats.org/package/2006/content-types">` +
+		`<Default Extension="rels" ContentType="application/vnd.openxmlformats-package.relationships+xml"/>` +
+		`<Default Extension="xml" ContentType="application/xml"/>` +
+		`<Override PartName="/xl/workbook.xml" ContentType="application/vnd.openxmlformats-officedocument.spreadsheetml.sheet.main+xml"/>` +
+		`<Override PartName="/xl/styles.xml" ContentType="application/vnd.openxmlformats-officedocument.spreadsheetml.styles+xml"/>`)
+	workbook.WriteString(xml.Header + `<workbook xmlns="http://schemas.openxmlformats.org/spreadsheetml/2006/main" ` +
+		`xmlns:r="http://schemas.openxmlformats.org/officeDocument/2006/relationships"><sheets>`)
+	rels.WriteString(xml.Header + `<Relationships xmlns="http://schemas.openxmlformats.org/package/2006/relationships">`)
+	for i, sheet := range sheets {
+		fmt.Fprintf(&types, `<Override PartName="/xl/worksheets/sheet%d.xml" ContentType="application/vnd.openxmlformats-officedocument.spreadsheetml.worksheet+xml"/>`, i+1)
+		fmt.Fprintf(&workbook, `<sheet name="%s" sheetId="%d" r:id="rId%[2]d"/>`, xmlEscape(sheet.name), i+1)
+		fmt.Fprintf(&rels, `<Relationship Id="rId%d" Type="http://schemas.openxmlformats.org/officeDocument/2006/relationships/worksheet" Target="worksheets/sheet%[1]d.xml"/>`, i+1)
+	}
+	types.WriteString(`</Types>`)
+	// the formulas have no values yet
+	workbook.WriteString(`</sheets><calcPr fullCalcOnLoad="1"/></workbook>`)
+	fmt.Fprintf(&rels, `<Relationship Id="rId%d" Type="http://schemas.openxmlformats.org/officeDocument/2006/relationships/styles" Target="styles.xml"/></Relationships>`, len(sheets)+1)
+
+	files := []xlsxFile{
+		{"[Content_Types].xml", types.Bytes()},
+		{"_rels/.rels", []byte(xml.Header + `<Relationships xmlns="http://schemas.openxmlformats.org/package/2006/relationships">` +
+			`<Relationship Id="rId1" Type="http://schemas.openxmlformats.org/officeDocument/2006/relationships/officeDocument" Target="xl/workbook.xml"/></Relationships>`)},
+		{"xl/workbook.xml", workbook.Bytes()},
+		{"xl/_rels/workbook.xml.rels", rels.Bytes()},
+		{"xl/styles.xml", []byte(xlsxStyles)},
+	}
+	for i, sheet := range sheets {
+		files = append(files, xlsxFile{fmt.Sprintf("xl/worksheets/sheet%d.xml", i+1), sheet.xml()})
+	}
+
+	archive := zip.NewWriter(w)
+	for _, file := range files {
+		f, err := archive.Create(file.name)
+		if err != nil {
+			return err
+		}
+		if _, err = f.Write(file.content); err != nil {
+			return err
+		}
+	}
+	return archive.Close()
+}
+
+// xml returns the worksheet xml of s
+func (s xlsxSheet) xml() []byte {
+	var b bytes.Buffer
+	b.WriteString(xml.Header + `<worksheet xmlns="http://schemas.openxmlformats.org/spreadsheetml/2006/main"><sheetData>`)
+	for i, row := range s.rows {
+		fmt.Fprintf(&b, `<row r="%d">`, i+1)
+		for j, cell := range row {
+			if cell.value == "" {
+				continue
+			}
+			ref := fmt.Sprintf("%s%d", xlsxColumn(j), i+1)
+			switch {
+			case cell.formula:
+				fmt.Fprintf(&b, `<c r="%s" s="%d"><f>%s</f></c>`, ref, cell.style, xmlEscape(cell.value))
+			case cell.text:
+				fmt.Fprintf(&b, `<c r="%s" s="%d" t="inlineStr"><is><t xml:space="preserve">%s</t></is></c>`, ref, cell.style, xmlEscape(cell.value))
+			default:
+				fmt.Fprintf(&b, `<c r="%s" s="%d"><v>%s</v></c>`, ref, cell.style, cell.value)
+			}
+		}
+		b.WriteString(`</row>`)
+	}
+	b.WriteString(`</sheetData></worksheet>`)
+	return b.Bytes()
+}
+
+func xmlEscape(s string) string {
+	var b bytes.Buffer
+	xml.EscapeText(&b, []byte(s))
+	return b.String()
+}
+
+// xlsxStyles are the styles of the cells: plain, date, decimal, bold and bold decimal
+const xlsxStyles = xml.Header + `<styleSheet xmlns="http://schemas.openxmlformats.org/spreadsheetml/2006/main">` +
+	`<numFmts count="1"><numFmt numFmtId="164" formatCode="yyyy-mm-dd"/></numFmts>` +
+	`<fonts count="2"><font><sz val="11"/><name val="Calibri"/></font><font><b/><sz val="11"/><name val="Calibri"/></font></fonts>` +
+	`<fills count="2"><fill><patternFill patternType="none"/></fill><fill><patternFill patternType="gray125"/></fill></fills>` +
+	`<borders count="1"><border><left/><right/><top/><bottom/><diagonal/></border></borders>` +
+	`<cellStyleXfs count="1"><xf numFmtId="0" fontId="0" fillId="0" borderId="0"/></cellStyleXfs>` +
+	`<cellXfs count="5">` +
+	`<xf numFmtId="0" fontId="0" fillId="0" borderId="0" xfId="0"/>` +
+	`<xf numFmtId="164" fontId="0" fillId="0" borderId="0" xfId="0" applyNumberFormat="1"/>` +
+	`<xf numFmtId="2" fontId="0" fillId="0" borderId="0" xfId="0" applyNumberFormat="1"/>` +
+	`<xf numFmtId="0" fontId="1" fillId="0" borderId="0" xfId="0" applyFont="1"/>` +
+	`<xf numFmtId="2" fontId="1" fillId="0" borderId="0" xfId="0" applyNumberFormat="1" applyFont="1"/>` +
+	`</cellXfs><cellStyles count="1"><cellStyle name="Normal" xfId="0" builtinId="0"/></cellStyles></styleSheet>`
+
+// exportXLSXHandler downloads the days of a year, a month or a date range as an xlsx workbook
+func (s *Server) exportXLSXHandler(w http.ResponseWriter, r *http.Request) {
+	err, from, to, name := exportRange(r)
+	if err != nil {
+		WriteError(w, r, err)
+		return
+	}
+	err, loc := s.requestLocation(r)
+	if err != nil {
+		WriteError(w, r, err)
+		return
+	}
+	days, err := GetExportDays(s.store(r), from, to, loc)
+	if err != nil {
+		WriteError(w, r, err)
+		return
+	}
+	var b bytes.Buffer
+	if err = WriteXLSX(&b, from, to, days); err != nil {
+		WriteError(w, r, CustomResponse(ReportError, err))
+		return
+	}
+	attachment(w, "application/vnd.openxmlformats-officedocument.spreadsheetml.sheet", name+".xlsx")
+	b.WriteTo(w)
+}
@@ -0,0 +1,131 @@
+package km
+
+import (
+	"archive/zip"
+	"bytes"
+	"encoding/xml"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestXLSXColumn(t *testing.T) {
+	for i, want := range map[int]string{0: "A", 5: "F", 25: "Z", 26: "AA", 51: "AZ", 52: "BA", 701: "ZZ", 702: "AAA"} {
+		if got := xlsxColumn(i); got != want {
+			t.Errorf("%d: got %s, want %s", i, got, want)
+		}
+	}
+}
+
+// readXLSX returns the files in the workbook in b, checking they are well formed xml
+func readXLSX(t *testing.T, b []byte) map[string]string {
+	archive, err := zip.NewReader(bytes.NewReader(b), int64(len(b)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	files := make(map[string]string)
+	for _, f := range archive.File {
+		r, err := f.Open()
+		if err != nil {
+			t.Fatal(err)
+		}
+		content, _ := ioutil.ReadAll(r)
+		r.Close()
+		decoder := xml.NewDecoder(bytes.NewReader(content))
+		for {
+			if _, err := decoder.Token(); err == io.EOF {
+				break
+			} else if err != nil {
+				t.Fatalf("%s: %s", f.Name, err)
+			}
+		}
+		files[f.Name] = string(content)
+	}
+	return files
+}
+
+func TestWriteXLSX(t *testing.T) {
+	date := func(month time.Month, day int) time.Time { return time.Date(2014, month, day, 0, 0, 0, 0, time.UTC) }
+	days := []ExportDay{
+		ExportDay{Day: Day{Date: date(time.January, 2), Readings: Readings{Begin: 1000, Terug: 1070}, Times: Stamps{Begin: "08:00"}, Hours: 8.5}, Distance: 70, Comment: "klant <A&B>"},
+		ExportDay{Day: Day{Date: date(time.January, 3), Readings: Readings{Begin: 1070, Terug: 1100}}, Distance: 30},
+		ExportDay{Day: Day{Date: date(time.March, 3), Readings: Readings{Begin: 1200, Terug: 1210}}, Distance: 10},
+	}
+	var b bytes.Buffer
+	if err := WriteXLSX(&b, date(time.January, 1), date(time.December, 31), days); err != nil {
+		t.Fatal(err)
+	}
+	files := readXLSX(t, b.Bytes())
+	for _, name := range []string{"[Content_Types].xml", "_rels/.rels", "xl/workbook.xml", "xl/_rels/workbook.xml.rels", "xl/styles.xml", "xl/worksheets/sheet1.xml", "xl/worksheets/sheet13.xml"} {
+		if _, ok := files[name]; !ok {
+			t.Errorf("%s is missing", name)
+		}
+	}
+	if _, ok := files["xl/worksheets/sheet14.xml"]; ok {
+		t.Error("more sheets than a summary and 12 months")
+	}
+	for _, want := range []string{`<sheet name="Summary" sheetId="1"`, `<sheet name="January 2014" sheetId="2"`, `<sheet name="December 2014" sheetId="13"`} {
+		if !strings.Contains(files["xl/workbook.xml"], want) {
+			t.Errorf("workbook does not contain %s", want)
+		}
+	}
+
+	january := files["xl/worksheets/sheet2.xml"]
+	for _, want := range []string{
+		`<c r="A2" s="1"><v>41641</v></c>`,
+		`<c r="B2" s="0"><v>1000</v></c>`,
+		`<c r="F4" s="3"><f>SUM(F2:F3)</f></c>`,
+		`<c r="K4" s="4"><f>SUM(K2:K3)</f></c>`,
+		`klant &lt;A&amp;B&gt;`,
+	} {
+		if !strings.Contains(january, want) {
+			t.Errorf("january does not contain %s", want)
+		}
+	}
+	if strings.Contains(january, `r="C2"`) {
+		t.Error("a reading that is not saved is not left empty")
+	}
+	if february := files["xl/worksheets/sheet3.xml"]; !strings.Contains(february, `<c r="F2" s="3"><v>0</v></c>`) {
+		t.Errorf("february without days does not total 0: %s", february)
+	}
+
+	summary := files["xl/worksheets/sheet1.xml"]
+	for _, want := range []string{
+		`<c r="B2" s="0"><f>COUNT(&#39;January 2014&#39;!A2:A3)</f></c>`,
+		`<c r="C2" s="0"><f>&#39;January 2014&#39;!F4</f></c>`,
+		`<c r="D4" s="2"><f>&#39;March 2014&#39;!K3</f></c>`,
+		`<c r="C14" s="3"><f>SUM(C2:C13)</f></c>`,
+	} {
+		if !strings.Contains(summary, want) {
+			t.Errorf("summary does not contain %s", want)
+		}
+	}
+}
+
+func TestExportXLSXHandler(t *testing.T) {
+	initServer(t)
+	apiRequest(t, "PUT", "/api/v1/days/2014-01-02/readings", `{"begin": 1000, "terug": 1070}`, nil)
+
+	for url, filename := range map[string]string{
+		"/api/v1/export.xlsx?year=2014":                     "km-2014.xlsx",
+		"/api/v1/export.xlsx?month=2014-01":                 "km-2014-01.xlsx",
+		"/api/v1/export.xlsx?from=2014-01-01&to=2014-01-31": "km-2014-01-01-2014-01-31.xlsx",
+	} {
+		req, _ := http.NewRequest("GET", url, nil)
+		w := serve(req)
+		if w.Code != 200 {
+			t.Errorf("GET %s: code = %d, want %d", url, w.Code, 200)
+			continue
+		}
+		if got, want := w.Header().Get("Content-Disposition"), `attachment; filename="`+filename+`"`; got != want {
+			t.Errorf("GET %s: Content-Disposition = %q, want %q", url, got, want)
+		}
+		readXLSX(t, w.Body.Bytes())
+	}
+	if code := apiRequest(t, "GET", "/api/v1/export.xlsx?year=dit-jaar", "", nil); code != InvalidDate.Code {
+		t.Errorf("GET with an invalid year: code = %d, want %d", code, InvalidDate.Code)
+	}
+}